@@ -0,0 +1,126 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import "context"
+
+// bufferAllocator is set by WithBufferAllocator.
+type bufferAllocator struct {
+	alloc func(size int) []byte
+	free  func([]byte)
+	arena *arenaClient // set by WithArena.
+}
+
+// WithBufferAllocator requests that the buffers used to hold the
+// decompressed output of each block be obtained by calling alloc, rather
+// than being allocated by the package, for example, to use an arena or
+// off-heap memory. alloc is called with the size required and must return
+// a slice of at least that length, it may be called more than once for a
+// block whose output turns out to be larger than expected. If free is not
+// nil each buffer is passed to it, possibly resliced, once its contents
+// have been returned by Read, or are no longer needed because of an
+// error, and is never referred to again. When a ReorderBuffer is also
+// specified via WithReorderBuffer buffers are freed as soon as they are
+// passed to its Put method, which must therefore copy their contents.
+// alloc and free may be called concurrently. The buffers used by the
+// serial implementation are also obtained from alloc rather than Read
+// decompressing directly into the buffer passed to it.
+func WithBufferAllocator(alloc func(size int) []byte, free func([]byte)) ReaderOption {
+	return func(o *readerOpts) {
+		o.allocator = nil
+		if alloc != nil {
+			if free == nil {
+				free = func([]byte) {}
+			}
+			o.allocator = &bufferAllocator{alloc: alloc, free: free}
+		}
+	}
+}
+
+// BufferPool is a pool of buffers, as implemented by *sync.Pool, see
+// BZBufferPool.
+type BufferPool interface {
+	Get() interface{}
+	Put(interface{})
+}
+
+// BZBufferPool requests that the buffers used to hold the decompressed
+// output of each block be obtained from, and returned to, pool so that
+// they may be reused across many Readers, for example, when decompressing
+// many small streams. The pool holds values of type *[]byte; a value of
+// any other type, including nil, or a buffer that is too small for the
+// block is discarded and a new buffer allocated in its place, hence
+// a *sync.Pool need not specify a New function. As for
+// WithBufferAllocator, in terms of which it is implemented, a buffer is
+// only returned to the pool once its contents have been returned by Read,
+// or are no longer needed because of an error. It has no effect if
+// WithBufferAllocator or WithArena is specified.
+func BZBufferPool(pool BufferPool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.bufferPool = pool
+	}
+}
+
+// poolAllocator returns a bufferAllocator that uses pool, or nil if pool
+// is nil.
+func poolAllocator(pool BufferPool) *bufferAllocator {
+	if pool == nil {
+		return nil
+	}
+	return &bufferAllocator{
+		alloc: func(size int) []byte {
+			if buf, ok := pool.Get().(*[]byte); ok && cap(*buf) >= size {
+				return (*buf)[:size]
+			}
+			return make([]byte, size)
+		},
+		free: func(buf []byte) {
+			if cap(buf) == 0 {
+				return
+			}
+			buf = buf[:cap(buf)]
+			pool.Put(&buf)
+		},
+	}
+}
+
+// release passes the buffer allocated for the output of block, if any,
+// to the free function supplied to WithBufferAllocator.
+func (ba *bufferAllocator) release(block *blockDesc) {
+	if ba != nil && block.allocated != nil {
+		ba.free(block.allocated)
+		block.allocated = nil
+	}
+}
+
+// allocFor returns the function used to allocate the buffers for block.
+func (ba *bufferAllocator) allocFor(block *blockDesc) func(size int) []byte {
+	if ba.arena != nil {
+		return ba.arena.allocFor(block)
+	}
+	return ba.alloc
+}
+
+// reserve reserves the memory for the output of block, see WithArena.
+func (ba *bufferAllocator) reserve(ctx context.Context, block *blockDesc) error {
+	if ba == nil || ba.arena == nil {
+		return nil
+	}
+	return ba.arena.reserve(ctx, block)
+}
+
+// settle returns any memory reserved for block that it did not use.
+func (ba *bufferAllocator) settle(block *blockDesc) {
+	if ba != nil && ba.arena != nil {
+		ba.arena.settle(block)
+	}
+}
+
+// close returns all of the memory held by a Reader to its Arena.
+func (ba *bufferAllocator) close() {
+	if ba != nil && ba.arena != nil {
+		ba.arena.close()
+	}
+}
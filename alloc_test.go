@@ -0,0 +1,184 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+// countingAllocator counts the buffers it allocates and frees, freed
+// buffers are overwritten to detect any use of them after being freed.
+type countingAllocator struct {
+	sync.Mutex
+	allocs, frees int
+}
+
+func (ca *countingAllocator) alloc(size int) []byte {
+	ca.Lock()
+	defer ca.Unlock()
+	ca.allocs++
+	return make([]byte, size)
+}
+
+func (ca *countingAllocator) free(buf []byte) {
+	ca.Lock()
+	defer ca.Unlock()
+	ca.frees++
+	buf = buf[:cap(buf)]
+	for i := range buf {
+		buf[i] = 0xff
+	}
+}
+
+// copyingBuffer is a ReorderBuffer that copies the data passed to Put.
+type copyingBuffer map[int][]byte
+
+func (cb copyingBuffer) Put(index int, data []byte) {
+	cb[index] = append([]byte(nil), data...)
+}
+
+func (cb copyingBuffer) Get(index int) ([]byte, bool) {
+	data, ok := cb[index]
+	delete(cb, index)
+	return data, ok
+}
+
+func TestBufferAllocator(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "300KB1", "900KB2_Random", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		blocks, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, opt := range []pbzip2.ReaderOption{
+			pbzip2.DecompressionOptions(),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)),
+			pbzip2.WithReorderBuffer(copyingBuffer{}),
+			pbzip2.SmallMemory(true),
+		} {
+			ca := &countingAllocator{}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opt,
+				pbzip2.WithBufferAllocator(ca.alloc, ca.free))
+			out := &bytes.Buffer{}
+			if _, err := io.CopyBuffer(out, rd, make([]byte, 4096)); err != nil {
+				t.Fatalf("%v: %v: %v", name, i, err)
+			}
+			if got, want := out.Bytes(), bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: wrong output", name, i)
+			}
+			if got, want := ca.allocs, blocks; got != want {
+				t.Errorf("%v: %v: allocs: got %v, want %v", name, i, got, want)
+			}
+			if got, want := ca.frees, ca.allocs; got != want {
+				t.Errorf("%v: %v: frees: got %v, want %v", name, i, got, want)
+			}
+		}
+	}
+}
+
+func TestBufferAllocatorErrors(t *testing.T) {
+	ctx := context.Background()
+	corruptedBlock, _ := concatFiles(t, "300KB1", "hello", "empty")
+	corruptedBlock[len(corruptedBlock)-26] = 0xff
+	for i, opt := range []pbzip2.ReaderOption{
+		pbzip2.DecompressionOptions(),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)),
+	} {
+		ca := &countingAllocator{}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(corruptedBlock), opt,
+			pbzip2.WithBufferAllocator(ca.alloc, ca.free))
+		if _, err := io.Copy(io.Discard, rd); !errors.Is(err, pbzip2.ErrBlockChecksum) {
+			t.Errorf("%v: got %v, want %v", i, err, pbzip2.ErrBlockChecksum)
+		}
+		if got, want := ca.frees, ca.allocs; got != want {
+			t.Errorf("%v: frees: got %v, want %v", i, got, want)
+		}
+	}
+}
+
+// recordingPool is a BufferPool that overwrites the buffers that are
+// returned to it to detect any use of them after being returned.
+type recordingPool struct {
+	sync.Mutex
+	free       []*[]byte
+	gets, puts int
+	reused     int
+}
+
+func (rp *recordingPool) Get() interface{} {
+	rp.Lock()
+	defer rp.Unlock()
+	rp.gets++
+	if len(rp.free) == 0 {
+		return nil
+	}
+	buf := rp.free[len(rp.free)-1]
+	rp.free = rp.free[:len(rp.free)-1]
+	rp.reused++
+	return buf
+}
+
+func (rp *recordingPool) Put(v interface{}) {
+	rp.Lock()
+	defer rp.Unlock()
+	rp.puts++
+	buf := v.(*[]byte)
+	for i := range *buf {
+		(*buf)[i] = 0xff
+	}
+	rp.free = append(rp.free, buf)
+}
+
+func TestBufferPool(t *testing.T) {
+	ctx := context.Background()
+	rp := &recordingPool{}
+	for _, name := range []string{"hello", "300KB1", "900KB2_Random", "1033KB4_Random", "hello"} {
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{0, 2} {
+			decOpts := []pbzip2.DecompressorOption{pbzip2.BZBufferPool(rp)}
+			if concurrency > 0 {
+				decOpts = append(decOpts, pbzip2.BZConcurrency(concurrency))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(decOpts...))
+			out := &bytes.Buffer{}
+			if _, err := io.CopyBuffer(out, rd, make([]byte, 4096)); err != nil {
+				t.Fatalf("%v: concurrency %v: %v", name, concurrency, err)
+			}
+			if got, want := out.Bytes(), bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: wrong output", name, concurrency)
+			}
+		}
+	}
+	if got, want := rp.puts, rp.gets; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if rp.reused == 0 {
+		t.Errorf("no buffers were reused")
+	}
+
+	// A sync.Pool may be used directly.
+	pool := &sync.Pool{}
+	for i := 0; i < 2; i++ {
+		compressed, _ := readFile(t, "300KB1")
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(pbzip2.BZBufferPool(pool)))
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := data, bzip2Data["300KB1"]; !bytes.Equal(got, want) {
+			t.Errorf("wrong output")
+		}
+	}
+}
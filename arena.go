@@ -0,0 +1,231 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"sync"
+)
+
+// Arena limits the total memory used by the buffers that hold the
+// decompressed output of the blocks that are in flight, that is, being
+// decompressed or waiting to be read, across all of the Readers that
+// share it via WithArena. It is intended to be used along with
+// a concurrency pool, see CreateConcurrencyPool, to provide a global
+// memory ceiling for a service that decompresses many streams at once.
+type Arena struct {
+	mu      sync.Mutex
+	size    int
+	inUse   int
+	peak    int
+	changed chan struct{} // closed, and replaced, whenever memory is released.
+}
+
+// NewArena returns an Arena that allows at most size bytes to be in use
+// at any one time.
+func NewArena(size int) *Arena {
+	return &Arena{size: size, changed: make(chan struct{})}
+}
+
+// InUse returns the number of bytes currently in use.
+func (a *Arena) InUse() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.inUse
+}
+
+// Peak returns the largest number of bytes that have been in use at any
+// one time.
+func (a *Arena) Peak() int {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.peak
+}
+
+// acquire waits for n bytes to be available. A request for more than the
+// size of the arena is granted once nothing else is in use.
+func (a *Arena) acquire(ctx context.Context, n int) error {
+	for {
+		a.mu.Lock()
+		if a.inUse+n <= a.size || a.inUse == 0 {
+			a.take(n)
+			a.mu.Unlock()
+			return nil
+		}
+		changed := a.changed
+		a.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// take takes n bytes without waiting, it must be called with mu held.
+func (a *Arena) take(n int) {
+	a.inUse += n
+	if a.inUse > a.peak {
+		a.peak = a.inUse
+	}
+}
+
+func (a *Arena) release(n int) {
+	if n == 0 {
+		return
+	}
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.inUse -= n
+	close(a.changed)
+	a.changed = make(chan struct{})
+}
+
+// WithArena requests that the buffers used to hold the decompressed output
+// of each block be allocated from arena, which may be shared by many
+// Readers. Before a block is passed to a worker to be decompressed, memory
+// for its output is reserved from the arena, waiting until enough is
+// available, a block's size as declared by its stream's header plus one
+// sixteenth. Since memory is reserved in the order in which blocks appear
+// in the stream the oldest block of each Reader can always make progress.
+// Memory not used by a block is returned to the arena once the block has
+// been decompressed and the remainder once its output has been returned
+// by Read, or when the Reader is closed. A block whose output exceeds its
+// reservation, which requires highly repetitive input, is allocated the
+// additional memory immediately, rather than waiting for it, since it may
+// be held by later blocks that are waiting for the block's output to be
+// read, and hence may briefly exceed the size of the arena. Note that
+// a Reader whose output is not read holds on to the memory reserved for
+// its blocks and may therefore block other Readers. WithArena replaces any
+// allocator specified via WithBufferAllocator.
+func WithArena(arena *Arena) ReaderOption {
+	return func(o *readerOpts) {
+		o.allocator = nil
+		if arena != nil {
+			ac := &arenaClient{arena: arena, buffers: map[*byte]int{}}
+			o.allocator = &bufferAllocator{alloc: ac.alloc, free: ac.free, arena: ac}
+		}
+	}
+}
+
+// arenaBlockSize returns the memory reserved from an Arena for a block.
+// It matches the initial size of the buffer allocated for a block's
+// output by bzip2.BlockReader.ReadAllUsing.
+func arenaBlockSize(block *blockDesc) int {
+	size := block.StreamBlockSize
+	return size + size/16
+}
+
+// arenaClient tracks the memory reserved, and the buffers allocated, by
+// a single Reader from an Arena.
+type arenaClient struct {
+	arena    *Arena
+	mu       sync.Mutex
+	reserved int           // memory reserved for blocks but not yet allocated.
+	buffers  map[*byte]int // the size of each outstanding buffer, see bufferKey.
+	closed   bool
+}
+
+// reserve reserves the memory for the output of block.
+func (ac *arenaClient) reserve(ctx context.Context, block *blockDesc) error {
+	if len(block.Data) == 0 {
+		return nil
+	}
+	n := arenaBlockSize(block)
+	if err := ac.arena.acquire(ctx, n); err != nil {
+		return err
+	}
+	ac.mu.Lock()
+	defer ac.mu.Unlock()
+	if ac.closed {
+		ac.arena.release(n)
+		return nil
+	}
+	ac.reserved += n
+	block.reserved = n
+	return nil
+}
+
+// allocFor returns the function used to allocate the buffers for block.
+func (ac *arenaClient) allocFor(block *blockDesc) func(size int) []byte {
+	return func(size int) []byte {
+		buf := make([]byte, size)
+		if size == 0 {
+			return buf
+		}
+		ac.mu.Lock()
+		defer ac.mu.Unlock()
+		if ac.closed {
+			return buf
+		}
+		if size <= block.reserved {
+			block.reserved -= size
+			ac.reserved -= size
+		} else {
+			extra := size - block.reserved
+			ac.reserved -= block.reserved
+			block.reserved = 0
+			ac.arena.mu.Lock()
+			ac.arena.take(extra)
+			ac.arena.mu.Unlock()
+		}
+		ac.buffers[bufferKey(buf)] = size
+		return buf
+	}
+}
+
+// alloc is used for blocks that have no reservation.
+func (ac *arenaClient) alloc(size int) []byte {
+	return ac.allocFor(&blockDesc{})(size)
+}
+
+func (ac *arenaClient) free(buf []byte) {
+	if cap(buf) == 0 {
+		return
+	}
+	ac.mu.Lock()
+	key := bufferKey(buf)
+	n, ok := ac.buffers[key]
+	delete(ac.buffers, key)
+	ac.mu.Unlock()
+	if ok {
+		ac.arena.release(n)
+	}
+}
+
+// bufferKey returns the address of the last byte of the capacity of buf,
+// which, unlike that of its first byte, is unchanged when buf is resliced
+// as its contents are consumed and hence identifies the original
+// allocation.
+func bufferKey(buf []byte) *byte {
+	return &buf[:cap(buf)][cap(buf)-1]
+}
+
+// settle returns any of the memory reserved for block that was not used.
+func (ac *arenaClient) settle(block *blockDesc) {
+	ac.mu.Lock()
+	n := block.reserved
+	block.reserved = 0
+	if ac.closed {
+		n = 0
+	}
+	ac.reserved -= n
+	ac.mu.Unlock()
+	ac.arena.release(n)
+}
+
+// close returns all of the memory held by the Reader to the arena.
+func (ac *arenaClient) close() {
+	ac.mu.Lock()
+	n := ac.reserved
+	for _, size := range ac.buffers {
+		n += size
+	}
+	ac.reserved = 0
+	ac.buffers = nil
+	ac.closed = true
+	ac.mu.Unlock()
+	ac.arena.release(n)
+}
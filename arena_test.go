@@ -0,0 +1,82 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"sync"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func TestArena(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	// Enough for the output of two of the 200KB blocks to be in flight.
+	size := 2 * (200000 + 200000/16)
+	for _, concurrency := range []int{0, 2} {
+		arena := pbzip2.NewArena(size)
+		pool := pbzip2.CreateConcurrencyPool(2)
+		decOpts := []pbzip2.DecompressorOption{pbzip2.BZConcurrencyPool(pool)}
+		if concurrency > 0 {
+			decOpts = append(decOpts, pbzip2.BZConcurrency(concurrency))
+		}
+		var wg sync.WaitGroup
+		errs := make(chan error, 3)
+		for i := 0; i < 3; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+					pbzip2.WithArena(arena),
+					pbzip2.DecompressionOptions(decOpts...))
+				defer rd.Close()
+				out := &bytes.Buffer{}
+				if _, err := io.CopyBuffer(out, rd, make([]byte, 4096)); err != nil {
+					errs <- err
+					return
+				}
+				if got, want := out.Bytes(), bzip2Data[name]; !bytes.Equal(got, want) {
+					t.Errorf("concurrency %v: wrong output", concurrency)
+				}
+				if got := arena.InUse(); got > size {
+					t.Errorf("concurrency %v: in use: got %v, want <= %v", concurrency, got, size)
+				}
+			}()
+		}
+		wg.Wait()
+		close(errs)
+		for err := range errs {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := arena.Peak(), size; got > want || got == 0 {
+			t.Errorf("concurrency %v: peak: got %v, want > 0 and <= %v", concurrency, got, want)
+		}
+		if got, want := arena.InUse(), 0; got != want {
+			t.Errorf("concurrency %v: in use: got %v, want %v", concurrency, got, want)
+		}
+	}
+
+	// Memory is returned to the arena when a Reader is closed before all
+	// of its output has been read.
+	arena := pbzip2.NewArena(size)
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.WithArena(arena),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	if _, err := rd.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if arena.InUse() == 0 {
+		t.Errorf("no memory in use")
+	}
+	rd.Close()
+	if got, want := arena.InUse(), 0; got != want {
+		t.Errorf("in use: got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build !pbzip2assert
+// +build !pbzip2assert
+
+package pbzip2
+
+// assertEmitOrder is a no-op unless the pbzip2assert build tag is set.
+func assertEmitOrder(prev, next uint64) {}
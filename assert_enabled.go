@@ -0,0 +1,18 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build pbzip2assert
+// +build pbzip2assert
+
+package pbzip2
+
+import "fmt"
+
+// assertEmitOrder panics if blocks are not emitted in strictly increasing
+// order. It is only enabled when the pbzip2assert build tag is set.
+func assertEmitOrder(prev, next uint64) {
+	if next <= prev {
+		panic(fmt.Sprintf("block %v emitted after block %v", next, prev))
+	}
+}
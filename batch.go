@@ -0,0 +1,219 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+)
+
+// MaxConcurrentSources sets the number of sources that DecompressAll will
+// decompress concurrently. The default is runtime.GOMAXPROCS(0). It has
+// no effect on NewReader.
+func MaxConcurrentSources(n int) ReaderOption {
+	return func(o *readerOpts) {
+		o.maxSources = n
+	}
+}
+
+// SourceErrors is returned by DecompressAll when any of its sources fail
+// to decompress. It contains an entry for every source, in input order,
+// that is nil for those sources that were successfully decompressed.
+type SourceErrors []error
+
+// Error implements error.
+func (se SourceErrors) Error() string {
+	var msgs []string
+	for i, err := range se {
+		if err != nil {
+			msgs = append(msgs, fmt.Sprintf("source %v: %v", i, err))
+		}
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// DecompressAll decompresses the supplied sources concurrently, subject
+// to MaxConcurrentSources, and returns their decompressed contents in
+// input order. The options are applied to the Reader used for each source
+// and hence each source may itself be decompressed concurrently. If any
+// sources fail to decompress the returned error will be of type
+// SourceErrors and the results for the failed sources will be nil.
+func DecompressAll(ctx context.Context, sources []io.Reader, opts ...ReaderOption) ([][]byte, error) {
+	var rdOpts readerOpts
+	for _, fn := range opts {
+		fn(&rdOpts)
+	}
+	concurrency := rdOpts.maxSources
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	results := make([][]byte, len(sources))
+	errs := make(SourceErrors, len(sources))
+	var wg sync.WaitGroup
+	ch := make(chan int)
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for idx := range ch {
+				rd := NewReader(ctx, sources[idx], opts...)
+				buf, err := io.ReadAll(rd)
+				rd.Close()
+				if err != nil {
+					errs[idx] = err
+					continue
+				}
+				results[idx] = buf
+			}
+		}()
+	}
+	for i := range sources {
+		ch <- i
+	}
+	close(ch)
+	wg.Wait()
+	for _, err := range errs {
+		if err != nil {
+			return results, errs
+		}
+	}
+	return results, nil
+}
+
+// DecompressFiles decompresses each of the named files, subject to
+// MaxConcurrentSources, writing the decompressed contents of each to the
+// writer returned by dst for that file, which is closed once the file has
+// been decompressed if it implements io.Closer. Rather than multiplying
+// the concurrency used for each file by the number of files being
+// decompressed, the blocks of all of the files are decompressed subject to
+// a single concurrency pool, see BZConcurrencyPool, which defaults to
+// one created by CreateConcurrencyPool(0) unless one is supplied via the
+// options. The first error encountered is returned, annotated with the
+// name of the file concerned, and causes the decompression of the
+// remaining files to be canceled.
+func DecompressFiles(ctx context.Context, paths []string, dst func(path string) (io.Writer, error), opts ...ReaderOption) error {
+	var rdOpts readerOpts
+	for _, fn := range opts {
+		fn(&rdOpts)
+	}
+	if newDecompressorOpts(rdOpts.decOpts).pool == nil {
+		pool := CreateConcurrencyPool(0)
+		opts = append(opts[:len(opts):len(opts)], DecompressionOptions(BZConcurrencyPool(pool)))
+	}
+	concurrency := rdOpts.maxSources
+	if concurrency <= 0 {
+		concurrency = runtime.GOMAXPROCS(0)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var (
+		wg       sync.WaitGroup
+		errOnce  sync.Once
+		firstErr error
+	)
+	ch := make(chan string)
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			for path := range ch {
+				if err := decompressTo(ctx, path, dst, opts); err != nil {
+					errOnce.Do(func() {
+						firstErr = fmt.Errorf("%v: %w", path, err)
+						cancel()
+					})
+				}
+			}
+		}()
+	}
+feed:
+	for _, path := range paths {
+		select {
+		case ch <- path:
+		case <-ctx.Done():
+			break feed
+		}
+	}
+	close(ch)
+	wg.Wait()
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
+
+// decompressTo decompresses the named file to the writer returned for it
+// by dst.
+func decompressTo(ctx context.Context, path string, dst func(path string) (io.Writer, error), opts []ReaderOption) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+	wr, err := dst(path)
+	if err != nil {
+		return err
+	}
+	rd := NewReader(ctx, src, opts...)
+	defer rd.Close()
+	_, err = io.Copy(wr, rd)
+	if c, ok := wr.(io.Closer); ok {
+		if cerr := c.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// DecompressStreams decompresses the concatenated bzip2 streams read from
+// rd and returns the decompressed contents of each stream separately, in
+// input order, rather than concatenated as they would be by NewReader.
+// Empty streams contain no blocks and, as for OnStreamBoundary, are not
+// included in the results. The options are applied to the Reader used to
+// decompress rd, and any function passed to OnStreamBoundary is still
+// called.
+func DecompressStreams(ctx context.Context, rd io.Reader, opts ...ReaderOption) ([][]byte, error) {
+	var rdOpts readerOpts
+	for _, fn := range opts {
+		fn(&rdOpts)
+	}
+	onStream := rdOpts.onStreamBoundary
+	var zrd *Reader
+	// The offsets, in the decompressed output, of the start of each stream
+	// after the first. OnStreamBoundary is called before any of a new
+	// stream's blocks are assembled and hence the number of bytes
+	// assembled so far is the size of all of the preceding streams.
+	var offsets []int64
+	opts = append(opts[:len(opts):len(opts)], OnStreamBoundary(func(streamIndex int, offset int64) {
+		offsets = append(offsets, zrd.Stats().UncompressedBytes)
+		if onStream != nil {
+			onStream(streamIndex, offset)
+		}
+	}))
+	zrd = NewReader(ctx, rd, opts...)
+	defer zrd.Close()
+	buf, err := io.ReadAll(zrd)
+	if err != nil {
+		return nil, err
+	}
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	results := make([][]byte, 0, len(offsets)+1)
+	prev := int64(0)
+	for _, offset := range offsets {
+		results = append(results, buf[prev:offset:offset])
+		prev = offset
+	}
+	return append(results, buf[prev:]), nil
+}
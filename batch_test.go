@@ -0,0 +1,213 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func TestDecompressAll(t *testing.T) {
+	ctx := context.Background()
+	var names []string
+	for name := range bzip2Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, concurrency := range []int{0, 1, 3} {
+		var sources []io.Reader
+		for _, name := range names {
+			compressed, _ := readFile(t, name)
+			sources = append(sources, bytes.NewReader(compressed))
+		}
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.MaxConcurrentSources(concurrency))
+		}
+		results, err := pbzip2.DecompressAll(ctx, sources, opts...)
+		if err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := len(results), len(names); got != want {
+			t.Fatalf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		for i, name := range names {
+			if got, want := results[i], bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("concurrency %v: %v: got %v..., want %v...", concurrency, name, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+
+	compressed, _ := readFile(t, "hello")
+	sources := []io.Reader{
+		bytes.NewReader(compressed),
+		bytes.NewReader([]byte("not a bzip2 file")),
+		bytes.NewReader(compressed),
+	}
+	results, err := pbzip2.DecompressAll(ctx, sources)
+	var errs pbzip2.SourceErrors
+	if !errors.As(err, &errs) {
+		t.Fatalf("got %v, want an error of type %T", err, errs)
+	}
+	if got, want := len(errs), len(sources); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if errs[0] != nil || errs[1] == nil || errs[2] != nil {
+		t.Errorf("unexpected errors: %#v", errs)
+	}
+	if got, want := results[0], bzip2Data["hello"]; !bytes.Equal(got, want) {
+		t.Errorf("got %s, want %s", got, want)
+	}
+	if got := results[1]; got != nil {
+		t.Errorf("got %v, want nil", got)
+	}
+}
+
+func TestDecompressStreams(t *testing.T) {
+	ctx := context.Background()
+	for i, names := range [][]string{
+		{"hello", "300KB3_Random"},
+		{"hello"},
+		{"300KB3_Random", "empty", "hello", "900KB2_Random"},
+		{"empty"},
+	} {
+		multi, _ := concatFiles(t, names...)
+		var want [][]byte
+		for _, name := range names {
+			if name != "empty" {
+				want = append(want, bzip2Data[name])
+			}
+		}
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			streams := 0
+			opts = append(opts, pbzip2.OnStreamBoundary(func(int, int64) {
+				streams++
+			}))
+			results, err := pbzip2.DecompressStreams(ctx, bytes.NewReader(multi), opts...)
+			if err != nil {
+				t.Fatalf("%v: concurrency %v: %v", i, concurrency, err)
+			}
+			if got, want := len(results), len(want); got != want {
+				t.Fatalf("%v: concurrency %v: got %v, want %v", i, concurrency, got, want)
+			}
+			for j := range results {
+				if got, want := results[j], want[j]; !bytes.Equal(got, want) {
+					t.Errorf("%v: concurrency %v: stream %v: got %v..., want %v...", i, concurrency, j, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+			}
+			if want := len(want) - 1; want > 0 && streams != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", i, concurrency, streams, want)
+			}
+		}
+	}
+}
+
+// closingBuffer records whether it has been closed.
+type closingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (cb *closingBuffer) Close() error {
+	cb.closed = true
+	return nil
+}
+
+func TestDecompressFiles(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	var names, paths []string
+	for name := range bzip2Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		compressed, _ := readFile(t, name)
+		path := filepath.Join(tmpdir, name+".bz2")
+		if err := os.WriteFile(path, compressed, 0600); err != nil {
+			t.Fatal(err)
+		}
+		paths = append(paths, path)
+	}
+
+	for _, sources := range []int{0, 1, 3} {
+		var mu sync.Mutex
+		outputs := map[string]*closingBuffer{}
+		dst := func(path string) (io.Writer, error) {
+			mu.Lock()
+			defer mu.Unlock()
+			outputs[path] = &closingBuffer{}
+			return outputs[path], nil
+		}
+		pool := pbzip2.CreateConcurrencyPool(2)
+		opts := []pbzip2.ReaderOption{
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrencyPool(pool)),
+		}
+		if sources > 0 {
+			opts = append(opts, pbzip2.MaxConcurrentSources(sources))
+		}
+		if err := pbzip2.DecompressFiles(ctx, paths, dst, opts...); err != nil {
+			t.Fatalf("sources %v: %v", sources, err)
+		}
+		for i, name := range names {
+			out := outputs[paths[i]]
+			if out == nil {
+				t.Errorf("sources %v: %v: not decompressed", sources, name)
+				continue
+			}
+			if got, want := out.Bytes(), bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("sources %v: %v: got %v..., want %v...", sources, name, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if !out.closed {
+				t.Errorf("sources %v: %v: output was not closed", sources, name)
+			}
+		}
+		if got, want := len(pool), 2; got != want {
+			t.Errorf("sources %v: got %v, want %v", sources, got, want)
+		}
+	}
+
+	// The first error is returned with the name of the file.
+	bad := filepath.Join(tmpdir, "bad.bz2")
+	if err := os.WriteFile(bad, []byte("not a bzip2 file"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	discard := func(string) (io.Writer, error) { return io.Discard, nil }
+	err := pbzip2.DecompressFiles(ctx, append([]string{bad}, paths...), discard, pbzip2.MaxConcurrentSources(1))
+	if !errors.Is(err, pbzip2.ErrBadMagic) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrBadMagic)
+	}
+	if err == nil || !strings.HasPrefix(err.Error(), bad+": ") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	missing := filepath.Join(tmpdir, "missing.bz2")
+	if err := pbzip2.DecompressFiles(ctx, []string{missing}, discard); !errors.Is(err, os.ErrNotExist) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	// Cancelation stops all of the files from being decompressed.
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := pbzip2.DecompressFiles(cctx, paths, discard); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,398 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"io"
+	"sync"
+)
+
+// UnorderedOutput requests that ReadBlocks pass each block to its callback
+// as soon as it has been decompressed rather than in stream order, for
+// consumers that process each block independently.
+func UnorderedOutput(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.unordered = v
+	}
+}
+
+// UnsafeZeroCopy declares that the callback passed to ReadBlocks neither
+// retains nor modifies the data passed to it once it returns, allowing
+// the buffer used for each block's output to be reused for the output of
+// subsequent blocks rather than a new buffer being allocated for every
+// block. This is unsafe in that retaining the data, or any slice of it,
+// will result in it being silently overwritten by the output of a later
+// block; data must be copied if it is needed after the callback returns.
+func UnsafeZeroCopy(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.zeroCopy = v
+	}
+}
+
+// ReadBlocks decompresses the stream, or concatenated streams, read from
+// rd, calling fn with the index, starting at zero, and the decompressed
+// output of each block. The index is that reported by OnCompressedBlock
+// except that a block that was split by a false positive match of the
+// block magic number, and then merged, counts as a single block, so that
+// the indices passed to fn are contiguous. fn is only ever called by the
+// goroutine that calls ReadBlocks and may retain data, unless
+// UnsafeZeroCopy is set. ReadBlocks returns the first error returned by
+// fn, or encountered by the decompression. Blocks are passed to fn in
+// stream order unless UnorderedOutput is set, in which case they are
+// passed to fn as soon as they are decompressed, thus avoiding reorder
+// buffering and the latency it entails. When a block fails to decompress
+// the error returned is a BlockError and, in stream order, the blocks
+// passed to fn are exactly those that precede it, regardless of the
+// concurrency used. The CRC of each block is verified before it is passed
+// to fn, whereas a stream's CRC can only be verified once all of its
+// blocks have been decompressed and hence a mismatched stream CRC is
+// reported after all of that stream's blocks have been passed to fn.
+// Note that when UnorderedOutput is set a block that is split by a false
+// positive match of the block magic number cannot be merged with its
+// successor, which may already have been passed to fn, and hence results
+// in an error. Options that do not apply to the decompression of
+// individual blocks, other than UnorderedOutput and UnsafeZeroCopy, are
+// rejected, see ErrUnsupportedOption.
+func ReadBlocks(ctx context.Context, rd io.Reader, fn func(index int, data []byte) error, opts ...ReaderOption) error {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	return readBlocks(ctx, rd, rdOpts, func(block Block) error {
+		return fn(block.Index, block.Data)
+	})
+}
+
+// readBlocks implements ReadBlocks, passing each block to fn as a Block.
+func readBlocks(ctx context.Context, rd io.Reader, rdOpts *readerOpts, fn func(Block) error) error {
+	if err := rdOpts.unsupportedOption(true); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var buffers chan []byte
+	if rdOpts.zeroCopy {
+		// Allow for a buffer for each worker and for each block
+		// that may be queued between the workers and fn.
+		buffers = make(chan []byte, 3*blockConcurrency(rdOpts))
+	}
+	done, scanErr := decompressBlocks(ctx, rd, rdOpts, 0, buffers)
+	index, offset := 0, int64(0)
+	emit := func(block *blockDesc) error {
+		if len(block.Data) == 0 {
+			return nil
+		}
+		// In stream order, blocks are numbered as they are emitted so
+		// that merged blocks count as one. Blocks are never merged
+		// when unordered, but their offsets are unknown.
+		out := Block{Index: index, DecompressedOffset: offset, Data: block.uncompressed}
+		if rdOpts.unordered {
+			out.Index, out.DecompressedOffset = block.index, -1
+		}
+		index++
+		offset += int64(len(block.uncompressed))
+		if err := fn(out); err != nil {
+			return err
+		}
+		if buffers != nil {
+			select {
+			case buffers <- block.uncompressed[:0]:
+			default:
+			}
+		}
+		return nil
+	}
+	receive := inOrder
+	if rdOpts.unordered {
+		receive = unordered
+	}
+	if err := receive(done, nil, emit); err != nil {
+		return err
+	}
+	return <-scanErr
+}
+
+// Block is a decompressed block as returned by a BlockReader.
+type Block struct {
+	Index int // Index of the block, as passed to the callback for ReadBlocks.
+	// DecompressedOffset is the offset of the block's output within the
+	// decompressed stream, or -1 if the blocks are unordered and hence
+	// the offset is unknown.
+	DecompressedOffset int64
+	Data               []byte // The decompressed output of the block.
+}
+
+// BlockReader returns the decompressed blocks of a stream, or concatenated
+// streams, as soon as each has been decompressed, rather than in stream
+// order, for consumers that are insensitive to the order of the blocks or
+// that reorder them themselves. It is ReadBlocks with UnorderedOutput set
+// presented as an iterator and the same options apply, except that
+// UnsafeZeroCopy is ignored since the data returned by Block may be
+// retained. UnorderedOutput(false) may be specified to have the blocks
+// returned in stream order, along with their offsets in the decompressed
+// stream. A BlockReader is also returned by ReverseBlocks.
+type BlockReader struct {
+	ch     <-chan Block
+	errCh  <-chan error
+	cancel context.CancelFunc
+	block  Block
+	err    error
+	done   bool
+}
+
+// NewBlockReader returns a BlockReader for the bzip2 data read from rd.
+// Close must be called if the blocks are not read to completion.
+func NewBlockReader(ctx context.Context, rd io.Reader, opts ...ReaderOption) *BlockReader {
+	rdOpts := &readerOpts{unordered: true}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	rdOpts.zeroCopy = false
+	return startBlockReader(ctx, func(ctx context.Context, fn func(Block) error) error {
+		return readBlocks(ctx, rd, rdOpts, fn)
+	})
+}
+
+// startBlockReader returns a BlockReader for the blocks passed to fn by
+// produce, which is run in its own goroutine and whose return value is
+// returned by Err.
+func startBlockReader(ctx context.Context, produce func(ctx context.Context, fn func(Block) error) error) *BlockReader {
+	ctx, cancel := context.WithCancel(ctx)
+	ch := make(chan Block)
+	errCh := make(chan error, 1)
+	go func() {
+		defer close(ch)
+		errCh <- produce(ctx, func(block Block) error {
+			select {
+			case ch <- block:
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		})
+	}()
+	return &BlockReader{ch: ch, errCh: errCh, cancel: cancel}
+}
+
+// Scan advances to the next block to have been decompressed, it returns
+// false when there are no more blocks or an error is encountered.
+func (br *BlockReader) Scan() bool {
+	if br.done {
+		return false
+	}
+	if block, ok := <-br.ch; ok {
+		br.block = block
+		return true
+	}
+	br.finish()
+	return false
+}
+
+func (br *BlockReader) finish() {
+	br.done = true
+	br.err = <-br.errCh
+	br.cancel()
+}
+
+// Block returns the current block.
+func (br *BlockReader) Block() Block {
+	return br.block
+}
+
+// Err returns the first error encountered, as per ReadBlocks.
+func (br *BlockReader) Err() error {
+	return br.err
+}
+
+// Close stops the decompression of any remaining blocks and waits for it
+// to finish. It always returns nil.
+func (br *BlockReader) Close() error {
+	if br.done {
+		return nil
+	}
+	br.cancel()
+	for range br.ch {
+	}
+	br.finish()
+	return nil
+}
+
+// decompressBlocks scans rd and decompresses the blocks it contains using
+// the concurrency requested by rdOpts, returning a channel on which the
+// blocks are sent as they are decompressed and a channel on which the
+// scanner's error, if any, is sent once scanning is complete. If scratch
+// is non-zero each goroutine discards the output of the blocks it
+// decompresses using a buffer of that size. Otherwise, buffers received
+// from buffers, if not nil, are used for the output of blocks.
+func decompressBlocks(ctx context.Context, rd io.Reader, rdOpts *readerOpts, scratch int, buffers <-chan []byte) (<-chan *blockDesc, <-chan error) {
+	concurrency := blockConcurrency(rdOpts)
+	sc := NewScanner(rd, rdOpts.scanOpts...)
+	work := make(chan *blockDesc, concurrency)
+	done := make(chan *blockDesc, concurrency)
+	scanErr := make(chan error, 1)
+	go func() {
+		defer close(work)
+		order := uint64(0)
+		for sc.Scan(ctx) {
+			order++
+			select {
+			case work <- rdOpts.newBlock(order, sc.Block()):
+			case <-ctx.Done():
+				scanErr <- ctx.Err()
+				return
+			}
+		}
+		scanErr <- sc.Err()
+	}()
+
+	var wg sync.WaitGroup
+	wg.Add(concurrency)
+	for i := 0; i < concurrency; i++ {
+		go func() {
+			defer wg.Done()
+			var buf []byte
+			if scratch > 0 {
+				buf = make([]byte, scratch)
+			}
+			for block := range work {
+				block.scratch = buf
+				select {
+				case block.dst = <-buffers:
+				default:
+				}
+				block.decompress()
+				select {
+				case done <- block:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}()
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	return done, scanErr
+}
+
+// blockConcurrency returns the number of goroutines to be used by
+// decompressBlocks.
+func blockConcurrency(rdOpts *readerOpts) int {
+	if n := newDecompressorOpts(rdOpts.decOpts).concurrency; n > 0 {
+		return n
+	}
+	return 1
+}
+
+// streamVerifier verifies the stream CRCs of blocks presented in order.
+type streamVerifier struct {
+	crc uint32
+}
+
+func (sv *streamVerifier) verify(block *blockDesc) error {
+	sv.crc = updateStreamCRC(sv.crc, block.CRC)
+	if !block.EOS {
+		return nil
+	}
+	got, want := sv.crc, block.StreamCRC
+	sv.crc = 0
+	if got != want {
+		return streamCRCError(block, got, want)
+	}
+	return nil
+}
+
+// inOrder passes the blocks received from ch to emit, if not nil, in
+// order, verifying the stream CRCs and merging blocks that were split by
+// a false positive match of the block magic number as per
+// Decompressor.tryMergeBlocks. scratch, if not nil, is used to discard
+// the output of merged blocks.
+func inOrder(ch <-chan *blockDesc, scratch []byte, emit func(*blockDesc) error) error {
+	var (
+		pending = map[uint64]*blockDesc{}
+		next    = uint64(1)
+		sv      streamVerifier
+		failed  *blockDesc // a block to be merged with its successor.
+	)
+	for block := range ch {
+		pending[block.order] = block
+		for {
+			block, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if failed != nil {
+				failed.scratch = scratch
+				if !mergeBlocks(failed, block) {
+					return blockError(failed)
+				}
+				block, failed = failed, nil
+			}
+			if block.err != nil {
+				if !mergeable(block.err) {
+					return blockError(block)
+				}
+				failed = block
+				continue
+			}
+			if emit != nil {
+				if err := emit(block); err != nil {
+					return err
+				}
+			}
+			if err := sv.verify(block); err != nil {
+				return err
+			}
+		}
+	}
+	if failed != nil {
+		return blockError(failed)
+	}
+	return nil
+}
+
+// blockError returns the error encountered decompressing block as
+// a BlockError.
+func blockError(block *blockDesc) error {
+	return &BlockError{Block: block.index, Offset: block.Offset, Err: block.err}
+}
+
+// unordered passes the blocks received from ch to emit as they are
+// received and verifies the stream CRCs in order once the blocks that
+// precede them have been received.
+func unordered(ch <-chan *blockDesc, _ []byte, emit func(*blockDesc) error) error {
+	var (
+		pending = map[uint64]*blockDesc{}
+		next    = uint64(1)
+		sv      streamVerifier
+	)
+	for block := range ch {
+		if block.err != nil {
+			return blockError(block)
+		}
+		if err := emit(block); err != nil {
+			return err
+		}
+		// Only the CRCs are needed from now on.
+		block.uncompressed, block.Data = nil, nil
+		pending[block.order] = block
+		for {
+			block, ok := pending[next]
+			if !ok {
+				break
+			}
+			delete(pending, next)
+			next++
+			if err := sv.verify(block); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
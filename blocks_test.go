@@ -0,0 +1,311 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func TestReadBlocks(t *testing.T) {
+	ctx := context.Background()
+	multi, multiData := concatFiles(t, "hello", "empty", "300KB2", "900KB2_Random")
+	for _, tc := range []struct {
+		name       string
+		compressed []byte
+		want       []byte
+	}{
+		{"empty", nil, nil},
+		{"hello", nil, nil},
+		{"1033KB4_Random", nil, nil},
+		{"multiple streams", multi, multiData},
+	} {
+		if tc.compressed == nil {
+			tc.compressed, _ = readFile(t, tc.name)
+			tc.want = bzip2Data[tc.name]
+		}
+		blocks, err := pbzip2.CountBlocks(ctx, bytes.NewReader(tc.compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, concurrency := range []int{0, 2, 4} {
+			for _, unordered := range []bool{false, true} {
+				msg := fmt.Sprintf("%v: concurrency %v, unordered %v", tc.name, concurrency, unordered)
+				opts := []pbzip2.ReaderOption{pbzip2.UnorderedOutput(unordered)}
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency)))
+				}
+				output := map[int][]byte{}
+				var indices []int
+				err := pbzip2.ReadBlocks(ctx, bytes.NewReader(tc.compressed), func(index int, data []byte) error {
+					if _, ok := output[index]; ok {
+						t.Errorf("%v: block %v delivered more than once", msg, index)
+					}
+					output[index] = data
+					indices = append(indices, index)
+					return nil
+				}, opts...)
+				if err != nil {
+					t.Errorf("%v: %v", msg, err)
+					continue
+				}
+				if got, want := len(output), blocks; got != want {
+					t.Errorf("%v: got %v, want %v", msg, got, want)
+				}
+				var all []byte
+				for i := 0; i < len(output); i++ {
+					all = append(all, output[i]...)
+				}
+				if got, want := all, tc.want; !bytes.Equal(got, want) {
+					t.Errorf("%v: got %v bytes, want %v bytes", msg, len(got), len(want))
+				}
+				if unordered {
+					continue
+				}
+				for i, index := range indices {
+					if got, want := index, i; got != want {
+						t.Errorf("%v: got %v, want %v", msg, got, want)
+						break
+					}
+				}
+			}
+		}
+	}
+
+	compressed, _ := readFile(t, "1033KB4_Random")
+	oops := errors.New("oops")
+	for _, unordered := range []bool{false, true} {
+		calls := 0
+		err := pbzip2.ReadBlocks(ctx, bytes.NewReader(compressed), func(index int, data []byte) error {
+			calls++
+			return oops
+		}, pbzip2.UnorderedOutput(unordered))
+		if got, want := err, oops; got != want {
+			t.Errorf("unordered %v: got %v, want %v", unordered, got, want)
+		}
+		if got, want := calls, 1; got != want {
+			t.Errorf("unordered %v: got %v, want %v", unordered, got, want)
+		}
+	}
+
+	for _, unordered := range []bool{false, true} {
+		corruptedBlock, _ := concatFiles(t, "hello", "hello", "empty")
+		corruptedBlock[len(corruptedBlock)-26] = 0xff
+		err := pbzip2.ReadBlocks(ctx, bytes.NewReader(corruptedBlock), func(index int, data []byte) error {
+			return nil
+		}, pbzip2.UnorderedOutput(unordered))
+		if !errors.Is(err, pbzip2.ErrBlockChecksum) {
+			t.Errorf("unordered %v: got %v, want %v", unordered, err, pbzip2.ErrBlockChecksum)
+		}
+
+		corruptedEmpty, _ := concatFiles(t, "hello", "empty", "empty")
+		corruptedEmpty[len(corruptedEmpty)-2] = 0xff
+		err = pbzip2.ReadBlocks(ctx, bytes.NewReader(corruptedEmpty), func(index int, data []byte) error {
+			return nil
+		}, pbzip2.UnorderedOutput(unordered))
+		if got, want := fmt.Sprint(err), "mismatched stream CRCs: calculated=0x4eece836 != stored=0x0000ff00"; got != want {
+			t.Errorf("unordered %v: got %v, want %v", unordered, got, want)
+		}
+	}
+}
+
+func TestUnsafeZeroCopy(t *testing.T) {
+	ctx := context.Background()
+	compressed, want := concatFiles(t, "1033KB4_Random", "hello", "900KB2_Random", "300KB2")
+	for _, concurrency := range []int{0, 2} {
+		for _, unordered := range []bool{false, true} {
+			opts := []pbzip2.ReaderOption{
+				pbzip2.UnsafeZeroCopy(true),
+				pbzip2.UnorderedOutput(unordered),
+			}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			output := map[int][]byte{}
+			err := pbzip2.ReadBlocks(ctx, bytes.NewReader(compressed), func(index int, data []byte) error {
+				// data may not be retained.
+				output[index] = append([]byte(nil), data...)
+				return nil
+			}, opts...)
+			if err != nil {
+				t.Errorf("concurrency %v, unordered %v: %v", concurrency, unordered, err)
+				continue
+			}
+			var all []byte
+			for i := 0; i < len(output); i++ {
+				all = append(all, output[i]...)
+			}
+			if got := all; !bytes.Equal(got, want) {
+				t.Errorf("concurrency %v, unordered %v: got %v bytes, want %v bytes", concurrency, unordered, len(got), len(want))
+			}
+		}
+	}
+}
+
+func TestReadBlocksFailure(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "300KB1", "300KB2")
+	var blocks []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+		if block := sc.Block(); len(block.Data) > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(blocks), 6; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// Corrupt the CRC stored for block 3, which immediately follows its
+	// magic number.
+	corrupted := append([]byte(nil), compressed...)
+	bit := blocks[3].Offset + 8
+	corrupted[bit/8] ^= 0x80 >> (bit % 8)
+	for _, concurrency := range []int{0, 2, 4, 8} {
+		opts := []pbzip2.ReaderOption{}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		var indices []int
+		err := pbzip2.ReadBlocks(ctx, bytes.NewReader(corrupted), func(index int, data []byte) error {
+			indices = append(indices, index)
+			return nil
+		}, opts...)
+		if !errors.Is(err, pbzip2.ErrBlockChecksum) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrBlockChecksum)
+		}
+		if got, want := fmt.Sprint(err), fmt.Sprintf("block 3 at bit offset %v: %v", blocks[3].Offset, pbzip2.ErrBlockChecksum); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := indices, []int{0, 1, 2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestReadBlocksUnsupportedOption(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "hello")
+	fn := func(int, []byte) error { return nil }
+	for i, opt := range []pbzip2.ReaderOption{
+		pbzip2.ExpectBlockCRCs([]uint32{1}),
+		pbzip2.WithBufferAllocator(func(size int) []byte { return make([]byte, size) }, func([]byte) {}),
+		pbzip2.StopAtBytes([]byte("x")),
+	} {
+		if err := pbzip2.ReadBlocks(ctx, bytes.NewReader(compressed), fn, opt); !errors.Is(err, pbzip2.ErrUnsupportedOption) {
+			t.Errorf("option %v: got %v, want %v", i, err, pbzip2.ErrUnsupportedOption)
+		}
+		br := pbzip2.NewBlockReader(ctx, bytes.NewReader(compressed), opt)
+		for br.Scan() {
+		}
+		if err := br.Err(); !errors.Is(err, pbzip2.ErrUnsupportedOption) {
+			t.Errorf("option %v: got %v, want %v", i, err, pbzip2.ErrUnsupportedOption)
+		}
+	}
+	err := pbzip2.ReadBlocks(ctx, bytes.NewReader(compressed), fn,
+		pbzip2.UnorderedOutput(true), pbzip2.UnsafeZeroCopy(true), pbzip2.MaxHuffmanTrees(7))
+	if err != nil {
+		t.Errorf("supported options: %v", err)
+	}
+}
+
+func TestBlockReader(t *testing.T) {
+	ctx := context.Background()
+	compressed, data := concatFiles(t, "hello", "empty", "300KB2", "900KB1")
+	blocks, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, concurrency := range []int{0, 2, 4} {
+		opts := []pbzip2.ReaderOption{pbzip2.UnsafeZeroCopy(true)}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		br := pbzip2.NewBlockReader(ctx, bytes.NewReader(compressed), opts...)
+		output := map[int][]byte{}
+		for br.Scan() {
+			block := br.Block()
+			if _, ok := output[block.Index]; ok {
+				t.Errorf("concurrency %v: block %v delivered more than once", concurrency, block.Index)
+			}
+			output[block.Index] = block.Data
+			if got, want := block.DecompressedOffset, int64(-1); got != want {
+				t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+			}
+		}
+		if err := br.Err(); err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		if err := br.Close(); err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := len(output), blocks; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		var all []byte
+		for i := 0; i < len(output); i++ {
+			all = append(all, output[i]...)
+		}
+		if got, want := all, data; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %v bytes, want %v bytes", concurrency, len(got), len(want))
+		}
+	}
+
+	// Blocks are returned in order, with their offsets, if requested.
+	br := pbzip2.NewBlockReader(ctx, bytes.NewReader(compressed), pbzip2.UnorderedOutput(false),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	var all []byte
+	for index := 0; br.Scan(); index++ {
+		block := br.Block()
+		if got, want := block.Index, index; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := block.DecompressedOffset, int64(len(all)); got != want {
+			t.Errorf("block %v: got %v, want %v", index, got, want)
+		}
+		all = append(all, block.Data...)
+	}
+	if err := br.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := all, data; !bytes.Equal(got, want) {
+		t.Errorf("got %v bytes, want %v bytes", len(got), len(want))
+	}
+
+	// Errors are reported as for ReadBlocks.
+	corrupted := append([]byte{}, compressed...)
+	corrupted[len(corrupted)-2] ^= 0xff
+	br = pbzip2.NewBlockReader(ctx, bytes.NewReader(corrupted))
+	for br.Scan() {
+	}
+	if err := br.Err(); !errors.Is(err, pbzip2.ErrMismatchedCRC) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrMismatchedCRC)
+	}
+
+	// Close stops the decompression part way through.
+	br = pbzip2.NewBlockReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	if !br.Scan() {
+		t.Fatalf("missing block: %v", br.Err())
+	}
+	if err := br.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if br.Scan() {
+		t.Errorf("unexpected block after Close")
+	}
+}
@@ -0,0 +1,101 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// NewReaderWithBoundaries returns a Reader that decompresses the blocks
+// located at the supplied bit offsets within rd rather than scanning rd to
+// discover them. Each offset is that of a block's magic number, as
+// reported by Stats.BlockBitOffsets, and offsets must be supplied, in
+// order, for every block in rd. The block size of the first stream is
+// assumed for all blocks. The CRC of each block is verified as it is
+// decompressed, but since the stream trailers are never read the stream
+// CRCs are not.
+func NewReaderWithBoundaries(ctx context.Context, rd io.ReaderAt, boundaries []int64, opts ...ReaderOption) *Reader {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	sc := NewScanner(nil, rdOpts.scannerOptions()...)
+	sc.boundaries = boundaries
+	sc.ra = rd
+	zrd := newReader(ctx, sc, rdOpts)
+	zrd.own(rdOpts, rd)
+	return zrd
+}
+
+// scanBoundary returns the block located at the next of the externally
+// supplied boundaries.
+func (sc *Scanner) scanBoundary() bool {
+	if sc.first {
+		var header [4]byte
+		n, err := sc.ra.ReadAt(header[:], 0)
+		switch {
+		case n == len(header):
+		case n == 0 && err == io.EOF:
+			sc.err = emptyStreamError()
+			return false
+		case err == io.EOF:
+			sc.err = notBzip2(header[:n], shortHeaderError(n))
+			return false
+		default:
+			sc.err = fmt.Errorf("failed to read stream header: %v", err)
+			return false
+		}
+		sc.currentStreamBlockSize, sc.err = parseHeader(header[:])
+		if sc.err != nil {
+			return false
+		}
+		sc.setStreamBlockSize(sc.currentStreamBlockSize)
+		sc.first = false
+	}
+	if len(sc.boundaries) == 0 {
+		sc.done = true
+		return false
+	}
+	start := sc.boundaries[0] + int64(len(blockMagic)*8)
+	sc.boundaries = sc.boundaries[1:]
+	last := len(sc.boundaries) == 0
+	var size int64
+	if last {
+		// The end of the last block is only known once its trailer has
+		// been found, so allow for the maximum possible block size.
+		size = int64(9*100*1000+sc.maxPreamble) * 8
+	} else {
+		size = sc.boundaries[0] - start
+	}
+	if size <= 0 || start <= sc.prevOffset {
+		sc.err = fmt.Errorf("%w: block boundary at bit offset %v, size %v bits, previous block at bit offset %v", ErrBlockDesync, start, size, sc.prevOffset)
+		return false
+	}
+	bitOffset := int(start % 8)
+	buf := make([]byte, (int64(bitOffset)+size+7)/8)
+	n, err := sc.ra.ReadAt(buf, start/8)
+	if err != nil && (err != io.EOF || !last || n == 0) {
+		sc.err = fmt.Errorf("failed to read block at bit offset %v: %v", start, err)
+		return false
+	}
+	buf = buf[:n]
+	sc.block = CompressedBlock{
+		Data:            buf,
+		BitOffset:       bitOffset,
+		SizeInBits:      len(buf)*8 - bitOffset,
+		CRC:             readCRC(buf, bitOffset),
+		StreamBlockSize: sc.currentStreamBlockSize,
+		Offset:          start,
+	}
+	if !last {
+		sc.block.SizeInBits = int(size)
+	}
+	sc.prevOffset = start
+	atomic.StoreInt64(&sc.consumed, start/8+int64(n))
+	return true
+}
@@ -0,0 +1,123 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func scanBoundaries(t testing.TB, compressed []byte) []int64 {
+	var boundaries []int64
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(context.Background()) {
+		if block := sc.Block(); len(block.Data) > 0 {
+			boundaries = append(boundaries, block.Offset-48)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	return boundaries
+}
+
+// timeToFirstByte returns the time taken to create a reader and read its
+// first byte.
+func timeToFirstByte(t testing.TB, newReader func() *pbzip2.Reader) time.Duration {
+	start := time.Now()
+	rd := newReader()
+	defer rd.Close()
+	var buf [1]byte
+	if _, err := io.ReadFull(rd, buf[:]); err != nil {
+		t.Fatal(err)
+	}
+	return time.Since(start)
+}
+
+func TestReaderWithBoundaries(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "300KB1", "900KB1", "900KB2_Random", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		boundaries := scanBoundaries(t, compressed)
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReaderWithBoundaries(ctx, bytes.NewReader(compressed), boundaries, opts...)
+			data, err := io.ReadAll(rd)
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", name, concurrency, err)
+				continue
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if got, want := rd.Stats().BlockBitOffsets, boundaries; !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+		}
+	}
+
+	name := "900KB1"
+	compressed, _ := readFile(t, name)
+	boundaries := scanBoundaries(t, compressed)
+	scanned := timeToFirstByte(t, func() *pbzip2.Reader {
+		return pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+	})
+	supplied := timeToFirstByte(t, func() *pbzip2.Reader {
+		return pbzip2.NewReaderWithBoundaries(ctx, bytes.NewReader(compressed), boundaries)
+	})
+	t.Logf("%v: time to first byte: scanned %v, supplied %v", name, scanned, supplied)
+
+	// A boundary that does not correspond to a block must be detected.
+	corrupt := append([]int64(nil), boundaries...)
+	corrupt[2]++
+	_, err := io.ReadAll(pbzip2.NewReaderWithBoundaries(ctx, bytes.NewReader(compressed), corrupt))
+	if err == nil {
+		t.Errorf("%v: expected an error for a corrupt boundary", name)
+	}
+
+	// Out of order boundaries must be detected.
+	corrupt = append([]int64(nil), boundaries...)
+	corrupt[1], corrupt[2] = corrupt[2], corrupt[1]
+	_, err = io.ReadAll(pbzip2.NewReaderWithBoundaries(ctx, bytes.NewReader(compressed), corrupt))
+	if !errors.Is(err, pbzip2.ErrBlockDesync) {
+		t.Errorf("%v: unexpected or missing error: %v", name, err)
+	}
+}
+
+func BenchmarkReaderSetup(b *testing.B) {
+	ctx := context.Background()
+	compressed, err := os.ReadFile(bzip2Files["900KB1"] + ".bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	boundaries := scanBoundaries(b, compressed)
+	b.Run("scanned", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			timeToFirstByte(b, func() *pbzip2.Reader {
+				return pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+			})
+		}
+	})
+	b.Run("supplied", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			timeToFirstByte(b, func() *pbzip2.Reader {
+				return pbzip2.NewReaderWithBoundaries(ctx, bytes.NewReader(compressed), boundaries)
+			})
+		}
+	})
+}
@@ -0,0 +1,58 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"bytes"
+	"context"
+	"io"
+)
+
+// maxLengthHint limits the amount by which DecompressToBuffer grows its
+// buffer up front, so that an unreasonably large hint, for example one
+// read from a corrupt header, does not result in a huge allocation.
+const maxLengthHint = 256 << 20
+
+// DecompressedLengthHint provides the expected length of the decompressed
+// output for use by DecompressToBuffer. Unlike ExpectDecompressedLength it
+// is only a hint and the length of the output is not checked. Hints of
+// zero or less are ignored and those larger than 256MB are treated as
+// 256MB.
+func DecompressedLengthHint(n int64) ReaderOption {
+	return func(o *readerOpts) {
+		o.lengthHint = n
+	}
+}
+
+// DecompressToBuffer decompresses the stream, or concatenated streams,
+// read from rd and appends the output to buf, returning the number of
+// bytes appended. If the length of the output is known, as specified via
+// DecompressedLengthHint or ExpectDecompressedLength, buf is grown once,
+// before decompression starts, to accommodate it rather than repeatedly as
+// the output is appended. Since bytes.Buffer doubles its capacity each time
+// it is grown, this avoids both the allocations and the copying of the
+// output produced so far that are otherwise incurred, as well as up to
+// half of the final buffer being unused.
+func DecompressToBuffer(ctx context.Context, buf *bytes.Buffer, rd io.Reader, opts ...ReaderOption) (int64, error) {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	hint := rdOpts.lengthHint
+	if hint <= 0 {
+		hint = rdOpts.expectedLength()
+	}
+	if hint > maxLengthHint {
+		hint = maxLengthHint
+	}
+	if hint > 0 {
+		// bytes.Buffer.ReadFrom requires bytes.MinRead bytes of free
+		// space to detect the end of its input without growing buf.
+		buf.Grow(int(hint) + bytes.MinRead)
+	}
+	drd := NewReader(ctx, rd, opts...)
+	defer drd.Close()
+	return buf.ReadFrom(drd)
+}
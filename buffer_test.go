@@ -0,0 +1,125 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func TestDecompressToBuffer(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		want := bzip2Data[name]
+		size := int64(len(want))
+		for _, concurrency := range []int{0, 2} {
+			for _, hint := range []pbzip2.ReaderOption{
+				nil,
+				pbzip2.DecompressedLengthHint(size),
+				pbzip2.ExpectDecompressedLength(size),
+			} {
+				opts := []pbzip2.ReaderOption{pbzip2.DecompressionOptions()}
+				if concurrency > 0 {
+					opts = []pbzip2.ReaderOption{pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency))}
+				}
+				if hint != nil {
+					opts = append(opts, hint)
+				}
+				var buf bytes.Buffer
+				buf.WriteString("prefix")
+				n, err := pbzip2.DecompressToBuffer(ctx, &buf, bytes.NewReader(compressed), opts...)
+				if err != nil {
+					t.Errorf("%v: concurrency %v: %v", name, concurrency, err)
+					continue
+				}
+				if got, want := n, size; got != want {
+					t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+				}
+				if got, want := buf.Bytes(), append([]byte("prefix"), want...); !bytes.Equal(got, want) {
+					t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+				if hint == nil || size == 0 {
+					continue
+				}
+				// The buffer is grown once, before any output is written,
+				// rather than being doubled as the output is appended.
+				if got, want := buf.Cap(), 2*(buf.Len()+bytes.MinRead); got >= want {
+					t.Errorf("%v: concurrency %v: buffer was grown more than once: got capacity %v, want less than %v", name, concurrency, got, want)
+				}
+			}
+		}
+	}
+
+	// The length is only checked when specified via
+	// ExpectDecompressedLength.
+	compressed, _ := readFile(t, "hello")
+	var buf bytes.Buffer
+	if _, err := pbzip2.DecompressToBuffer(ctx, &buf, bytes.NewReader(compressed),
+		pbzip2.DecompressedLengthHint(1024)); err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	if _, err := pbzip2.DecompressToBuffer(ctx, &buf, bytes.NewReader(compressed),
+		pbzip2.ExpectDecompressedLength(1024)); err == nil {
+		t.Errorf("expected an error")
+	}
+
+	// Unreasonable hints are ignored or limited.
+	for _, hint := range []int64{-1, math.MaxInt64} {
+		var buf bytes.Buffer
+		if _, err := pbzip2.DecompressToBuffer(ctx, &buf, bytes.NewReader(compressed),
+			pbzip2.DecompressedLengthHint(hint)); err != nil {
+			t.Errorf("%v: unexpected error: %v", hint, err)
+		}
+		if got, want := buf.Bytes(), bzip2Data["hello"]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %q, want %q", hint, got, want)
+		}
+		if got, want := buf.Cap(), 512<<20; got > want {
+			t.Errorf("%v: got capacity %v, want at most %v", hint, got, want)
+		}
+	}
+}
+
+func BenchmarkDecompressToBuffer(b *testing.B) {
+	ctx := context.Background()
+	compressed, err := os.ReadFile(bzip2Files["1033KB4_Random"] + ".bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	size := int64(len(bzip2Data["1033KB4_Random"]))
+	for _, concurrency := range []int{1, 4} {
+		opt := pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency))
+		b.Run(fmt.Sprintf("DecompressToBuffer-%v", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				if _, err := pbzip2.DecompressToBuffer(ctx, &buf, bytes.NewReader(compressed), opt, pbzip2.DecompressedLengthHint(size)); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("Copy-%v", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				var buf bytes.Buffer
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opt)
+				if _, err := io.Copy(&buf, rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,90 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"fmt"
+	"io"
+	"sync/atomic"
+)
+
+// ReadAtCache requests that the most recent n bytes of output returned by
+// Read be retained in memory so that they may be read again via ReadAt,
+// for example, to allow for small backward jumps when the input is only
+// available as an io.Reader.
+func ReadAtCache(n int) ReaderOption {
+	return func(o *readerOpts) {
+		o.cacheSize = n
+	}
+}
+
+// outputCache is a ring buffer that holds the most recent output returned
+// by Read, see ReadAtCache.
+type outputCache struct {
+	buf []byte
+	end int64 // the offset immediately following the cached output.
+}
+
+func newOutputCache(size int) *outputCache {
+	if size <= 0 {
+		return nil
+	}
+	return &outputCache{buf: make([]byte, size)}
+}
+
+// start returns the offset of the oldest byte in the cache.
+func (c *outputCache) start() int64 {
+	if start := c.end - int64(len(c.buf)); start > 0 {
+		return start
+	}
+	return 0
+}
+
+// add appends data, which immediately follows the output already cached.
+func (c *outputCache) add(data []byte) {
+	size := int64(len(c.buf))
+	c.end += int64(len(data))
+	if int64(len(data)) > size {
+		data = data[int64(len(data))-size:]
+	}
+	i := (c.end - int64(len(data))) % size
+	n := copy(c.buf[i:], data)
+	copy(c.buf, data[n:])
+}
+
+// readAt copies the cached output at off to p.
+func (c *outputCache) readAt(p []byte, off int64) (int, error) {
+	if off < c.start() || off > c.end {
+		return 0, fmt.Errorf("%w: offset %v is outside of the range %v..%v", ErrNotCached, off, c.start(), c.end)
+	}
+	if avail := c.end - off; int64(len(p)) > avail {
+		p = p[:avail]
+	}
+	i := off % int64(len(c.buf))
+	n := copy(p, c.buf[i:])
+	n += copy(p[n:], c.buf)
+	return n, nil
+}
+
+// ReadAt implements io.ReaderAt for the output that has already been
+// returned by Read and is still retained by the cache requested via
+// ReadAtCache. It returns an error that wraps ErrNotCached if off is
+// outside of the cached output, or if the cache was not requested, and
+// io.EOF if fewer than len(p) bytes are available. It never reads further
+// input and must not be called concurrently with Read.
+func (rd *Reader) ReadAt(p []byte, off int64) (int, error) {
+	if rd.cache == nil {
+		return 0, fmt.Errorf("%w: ReadAtCache was not specified", ErrNotCached)
+	}
+	n, err := rd.cache.readAt(p, off)
+	if err != nil {
+		return n, err
+	}
+	atomic.AddInt64(&rd.cacheHits, 1)
+	if n < len(p) {
+		err = io.EOF
+	}
+	return n, err
+}
@@ -0,0 +1,128 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func TestReadAtCache(t *testing.T) {
+	ctx := context.Background()
+	const cacheSize = 64 * 1024
+	compressed, _ := readFile(t, "900KB2_Random")
+	want := bzip2Data["900KB2_Random"]
+	for _, concurrency := range []int{0, 2} {
+		opts := []pbzip2.ReaderOption{pbzip2.ReadAtCache(cacheSize)}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		// Read in chunks that do not divide the cache size so that
+		// the ring buffer wraps at different offsets.
+		buf := make([]byte, 10000)
+		pos := int64(0)
+		for pos < 500*1000 {
+			n, err := io.ReadFull(rd, buf)
+			if err != nil {
+				t.Fatalf("concurrency %v: %v", concurrency, err)
+			}
+			pos += int64(n)
+			back := make([]byte, 3000)
+			off := pos - 4000
+			if _, err := rd.ReadAt(back, off); err != nil {
+				t.Fatalf("concurrency %v: %v: %v", concurrency, off, err)
+			}
+			if got, want := back, want[off:off+int64(len(back))]; !bytes.Equal(got, want) {
+				t.Errorf("concurrency %v: %v: ReadAt returned the wrong data", concurrency, off)
+			}
+		}
+
+		// The entire cache can be read.
+		back := make([]byte, cacheSize)
+		if n, err := rd.ReadAt(back, pos-cacheSize); err != nil || n != cacheSize || !bytes.Equal(back, want[pos-cacheSize:pos]) {
+			t.Errorf("concurrency %v: n %v, err %v", concurrency, n, err)
+		}
+
+		// Reading past the current position returns io.EOF.
+		n, err := rd.ReadAt(back, pos-10)
+		if got, want := n, 10; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := err, io.EOF; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+
+		// Reading beyond the cache is an error.
+		for _, off := range []int64{0, pos - cacheSize - 1, pos + 1} {
+			if _, err := rd.ReadAt(back[:1], off); !errors.Is(err, pbzip2.ErrNotCached) {
+				t.Errorf("concurrency %v: %v: got %v, want %v", concurrency, off, err, pbzip2.ErrNotCached)
+			}
+		}
+
+		// Read can continue after ReadAt.
+		rest, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := rest, want[pos:]; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: wrong output after ReadAt", concurrency)
+		}
+		rd.Close()
+	}
+
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+	defer rd.Close()
+	if _, err := rd.ReadAt(make([]byte, 1), 0); !errors.Is(err, pbzip2.ErrNotCached) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrNotCached)
+	}
+}
+
+func TestReadAtCacheStats(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "1033KB4_Random")
+	want := bzip2Data["1033KB4_Random"]
+	blocks, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), pbzip2.ReadAtCache(100*1000))
+	defer rd.Close()
+	head := make([]byte, 600*1000)
+	if _, err := io.ReadFull(rd, head); err != nil {
+		t.Fatal(err)
+	}
+	// Overlapping reads are all served from the cache.
+	buf := make([]byte, 20*1000)
+	for i, off := range []int64{550 * 1000, 560 * 1000, 565 * 1000, 570 * 1000} {
+		if _, err := rd.ReadAt(buf, off); err != nil {
+			t.Fatal(err)
+		}
+		if got, want := buf, want[off:off+int64(len(buf))]; !bytes.Equal(got, want) {
+			t.Errorf("%v: ReadAt returned the wrong data", off)
+		}
+		if got, want := rd.Stats().IndexHits, int64(i+1); got != want {
+			t.Errorf("%v: got %v, want %v", off, got, want)
+		}
+	}
+	if _, err := rd.ReadAt(buf, 0); !errors.Is(err, pbzip2.ErrNotCached) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrNotCached)
+	}
+	if got, want := rd.Stats().IndexHits, int64(4); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rd.Stats().BlocksDecoded, blocks; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,145 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"bytes"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
+	"io"
+)
+
+// ChecksumKind identifies the checksum used by ExpectAppendedChecksum.
+type ChecksumKind int
+
+const (
+	// ChecksumCRC32 is the IEEE CRC-32 as implemented by hash/crc32.
+	ChecksumCRC32 ChecksumKind = iota + 1
+	// ChecksumCRC32C is the Castagnoli CRC-32.
+	ChecksumCRC32C
+	// ChecksumCRC64 is the ECMA CRC-64 as implemented by hash/crc64.
+	ChecksumCRC64
+)
+
+func (k ChecksumKind) String() string {
+	switch k {
+	case ChecksumCRC32:
+		return "crc32"
+	case ChecksumCRC32C:
+		return "crc32c"
+	case ChecksumCRC64:
+		return "crc64"
+	}
+	return fmt.Sprintf("ChecksumKind(%d)", int(k))
+}
+
+func (k ChecksumKind) new() hash.Hash {
+	switch k {
+	case ChecksumCRC32:
+		return crc32.NewIEEE()
+	case ChecksumCRC32C:
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli))
+	case ChecksumCRC64:
+		return crc64.New(crc64.MakeTable(crc64.ECMA))
+	}
+	return nil
+}
+
+// ExpectAppendedChecksum requests that the final size bytes of the input
+// to NewReader be treated as a checksum, of the given kind, over all of
+// the preceding input rather than as part of the compressed data, for
+// the pipelines that append such a checksum after the stream trailer.
+// The checksum is stored big-endian and, if size is smaller than that of
+// the checksum, contains only its low order bytes. The final call to
+// Read, the one that would otherwise return io.EOF, returns an error that
+// wraps ErrAppendedChecksum if the checksum does not match or is missing.
+// Note that this is not part of the bzip2 format, that the checksum must
+// be the very last bytes of the input, and hence that this cannot be used
+// with AllowTrailingData, and that the checksum is not verified if
+// decompression is ended early by StopAtBytes or Abort.
+func ExpectAppendedChecksum(kind ChecksumKind, size int) ReaderOption {
+	return func(o *readerOpts) {
+		o.checksumKind = kind
+		o.checksumSize = size
+	}
+}
+
+// checksumReader implements ExpectAppendedChecksum by withholding the
+// final size bytes of its input from the scanner and computing the
+// checksum of all of the bytes that precede them.
+type checksumReader struct {
+	rd   io.Reader
+	kind ChecksumKind
+	hash hash.Hash
+	size int
+	held []byte // the most recently read size bytes, or fewer.
+	eof  bool
+	err  error // set for an unsupported kind or size.
+}
+
+func newChecksumReader(rd io.Reader, kind ChecksumKind, size int) *checksumReader {
+	cr := &checksumReader{rd: rd, kind: kind, hash: kind.new(), size: size}
+	switch {
+	case cr.hash == nil:
+		cr.err = fmt.Errorf("unsupported checksum kind: %v", kind)
+	case size <= 0 || size > cr.hash.Size():
+		cr.err = fmt.Errorf("unsupported checksum size for %v: %v", kind, size)
+	}
+	return cr
+}
+
+func (cr *checksumReader) Read(buf []byte) (int, error) {
+	if cr.err != nil {
+		return 0, cr.err
+	}
+	if cr.eof {
+		return 0, io.EOF
+	}
+	if len(buf) == 0 {
+		// Nothing could ever be released into buf.
+		return 0, nil
+	}
+	for {
+		n, err := cr.rd.Read(buf)
+		// Release all but the final size bytes of the data read so far,
+		// which may include some of those previously held back.
+		held := append(cr.held, buf[:n]...)
+		release := 0
+		if len(held) > cr.size {
+			release = len(held) - cr.size
+		}
+		copy(buf, held[:release])
+		cr.held = append(cr.held[:0], held[release:]...)
+		cr.hash.Write(buf[:release])
+		if err == io.EOF {
+			cr.eof = true
+		}
+		if release > 0 || err != nil {
+			return release, err
+		}
+	}
+}
+
+// verify returns an error that wraps ErrAppendedChecksum if the checksum
+// that was withheld from the scanner does not match that computed over
+// the preceding input.
+func (cr *checksumReader) verify() error {
+	if cr.err != nil {
+		return cr.err
+	}
+	if !cr.eof {
+		return fmt.Errorf("%w: the input following the compressed data was not read", ErrAppendedChecksum)
+	}
+	if len(cr.held) < cr.size {
+		return fmt.Errorf("%w: input is too short for a %v byte %v checksum", ErrAppendedChecksum, cr.size, cr.kind)
+	}
+	sum := cr.hash.Sum(nil)
+	if want := sum[len(sum)-cr.size:]; !bytes.Equal(cr.held, want) {
+		return fmt.Errorf("%w: %v: stored %x, computed %x", ErrAppendedChecksum, cr.kind, cr.held, want)
+	}
+	return nil
+}
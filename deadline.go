@@ -0,0 +1,59 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// SourceReadTimeout requests that, if the underlying io.Reader implements
+// SetReadDeadline(time.Time) error, as net.Conn does, a deadline of d from
+// now, or the deadline of the context passed to NewReader if that is
+// sooner, be set before each Read on it so that a stalled connection
+// results in an error rather than the scanner blocking indefinitely. The
+// error returned by the io.Reader when a deadline expires, typically one
+// that wraps os.ErrDeadlineExceeded, is returned by Read. Such errors are
+// temporary and hence are retried if WithSourceRetry is also specified.
+func SourceReadTimeout(d time.Duration) ReaderOption {
+	return func(o *readerOpts) {
+		o.readTimeout = d
+	}
+}
+
+// deadlineSetter is implemented by net.Conn and os.File amongst others.
+type deadlineSetter interface {
+	SetReadDeadline(t time.Time) error
+}
+
+// deadlineReader implements SourceReadTimeout.
+type deadlineReader struct {
+	ctx     context.Context
+	rd      io.Reader
+	ds      deadlineSetter
+	timeout time.Duration
+}
+
+// newDeadlineReader returns rd wrapped so as to implement SourceReadTimeout,
+// or rd itself if it does not support deadlines.
+func newDeadlineReader(ctx context.Context, rd io.Reader, timeout time.Duration) io.Reader {
+	ds, ok := rd.(deadlineSetter)
+	if !ok || timeout <= 0 {
+		return rd
+	}
+	return &deadlineReader{ctx: ctx, rd: rd, ds: ds, timeout: timeout}
+}
+
+func (dr *deadlineReader) Read(buf []byte) (int, error) {
+	deadline := time.Now().Add(dr.timeout)
+	if d, ok := dr.ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	// Any error, such as that returned by net.Pipe once the other end has
+	// been closed, is ignored in favour of the one returned by Read.
+	dr.ds.SetReadDeadline(deadline)
+	return dr.rd.Read(buf)
+}
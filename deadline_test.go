@@ -0,0 +1,66 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func TestSourceReadTimeout(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	for _, concurrency := range []int{0, 2} {
+		opts := []pbzip2.ReaderOption{pbzip2.SourceReadTimeout(100 * time.Millisecond)}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+
+		// A connection that delivers all of its data.
+		client, server := net.Pipe()
+		go func() {
+			server.Write(compressed)
+			server.Close()
+		}()
+		data, err := io.ReadAll(pbzip2.NewReader(ctx, client, opts...))
+		client.Close()
+		if err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %v..., want %v...", concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+
+		// A connection that stalls part way through.
+		client, server = net.Pipe()
+		go server.Write(compressed[:len(compressed)/2])
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := io.ReadAll(pbzip2.NewReader(ctx, client, opts...))
+			errCh <- err
+		}()
+		select {
+		case err := <-errCh:
+			if !errors.Is(err, os.ErrDeadlineExceeded) {
+				t.Errorf("concurrency %v: got %v, want %v", concurrency, err, os.ErrDeadlineExceeded)
+			}
+		case <-time.After(5 * time.Second):
+			t.Errorf("concurrency %v: Read failed to time out", concurrency)
+		}
+		client.Close()
+		server.Close()
+	}
+}
@@ -0,0 +1,333 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
+)
+
+var (
+	// ErrClosed is returned by Read once Close has been called on a Reader.
+	ErrClosed = errors.New("reader is closed")
+
+	// ErrBlockDesync is returned when the scanner detects that the
+	// offsets of consecutive blocks do not advance, which is typically
+	// caused by a corrupted or duplicated block magic number.
+	ErrBlockDesync = errors.New("block desync")
+
+	// ErrInconsistentBlockSize is returned when RequireUniformBlockSize
+	// is set and a stream declares a different block size than the first.
+	ErrInconsistentBlockSize = errors.New("inconsistent block size")
+
+	// ErrInternal is returned when decompressing a block fails because of
+	// a bug in the decompressor, such as a panic, rather than because
+	// the block is corrupt.
+	ErrInternal = errors.New("internal error")
+
+	// ErrCPUBudgetExceeded is returned once the time spent decompressing
+	// blocks exceeds that specified by MaxWorkerCPUTime.
+	ErrCPUBudgetExceeded = errors.New("cpu budget exceeded")
+
+	// ErrBlockChecksum is returned when the CRC of a decompressed block
+	// does not match the CRC stored for it in the compressed stream. It
+	// is wrapped by a CRCError that records the CRCs.
+	ErrBlockChecksum = errors.New("block checksum mismatch")
+
+	// ErrEmptyBlock is returned when a block decompresses to no data,
+	// which bzip2 never produces and hence indicates a malformed block
+	// rather than a legitimately empty stream, which contains no blocks.
+	ErrEmptyBlock = errors.New("empty block")
+
+	// ErrLengthMismatch is returned when the length of the decompressed
+	// output differs from that specified by ExpectDecompressedLength.
+	ErrLengthMismatch = errors.New("decompressed length mismatch")
+
+	// ErrNotCached is returned by ReadAt for output that is not retained
+	// by the cache requested via ReadAtCache.
+	ErrNotCached = errors.New("output is not cached")
+
+	// ErrDeadlineExceeded is returned by Read once the time allowed for
+	// decompressing the entire stream by TotalTimeout has elapsed.
+	ErrDeadlineExceeded = errors.New("total timeout exceeded")
+
+	// ErrEmptyStream is returned when the input is completely empty and
+	// hence does not contain even a stream header.
+	ErrEmptyStream = errors.New("empty stream")
+
+	// ErrShortHeader is returned when the input ends part way through the
+	// 4 byte stream header.
+	ErrShortHeader = errors.New("stream header is too small")
+
+	// ErrBadBlockSize is returned when a stream header declares an invalid
+	// block size, or when a block contains more data than allowed by the
+	// block size declared in its stream's header, unless
+	// AllowOversizeBlocks is specified.
+	ErrBadBlockSize = errors.New("block exceeds the declared block size")
+
+	// ErrBadMagic is returned when a stream does not start with the bzip2
+	// file magic number, ie. "BZ", typically because the input is not
+	// bzip2 data.
+	ErrBadMagic = errors.New("wrong file magic")
+
+	// ErrNotBzip2 is returned when the input does not start with a bzip2
+	// stream header but does start with the signature of another common
+	// format, such as gzip, in which case the error also wraps the error
+	// that would otherwise have been returned, ie. ErrBadMagic or
+	// ErrShortHeader, and its message names the format detected.
+	ErrNotBzip2 = errors.New("not bzip2")
+
+	// ErrWrongVersion is returned when a stream header specifies a version
+	// other than 'h', the only version supported.
+	ErrWrongVersion = errors.New("wrong version")
+
+	// ErrMismatchedCRC is returned when the CRC computed for a stream does
+	// not match that stored in its trailer. A mismatched block CRC is
+	// reported via ErrBlockChecksum. Both are wrapped by a CRCError.
+	ErrMismatchedCRC = errors.New("mismatched stream CRCs")
+
+	// ErrNoTrailer is returned when the trailer of a stream cannot be
+	// found, typically because the input has been truncated.
+	ErrNoTrailer = errors.New("failed to find trailer")
+
+	// ErrConcurrentRead is returned by Read, and the other methods that
+	// read decompressed data, when called concurrently with another such
+	// call, which is not supported.
+	ErrConcurrentRead = errors.New("concurrent calls to Read are not supported")
+
+	// ErrAppendedChecksum is returned when the checksum requested by
+	// ExpectAppendedChecksum does not match the compressed input.
+	ErrAppendedChecksum = errors.New("appended checksum mismatch")
+
+	// ErrSuspiciousCRC is returned when a non-empty block has a stored CRC
+	// of zero and FlagZeroCRC was specified in strict mode.
+	ErrSuspiciousCRC = errors.New("suspicious zero block CRC")
+
+	// ErrBlockCRCMismatch is returned when the CRCs of the blocks in the
+	// stream differ from those specified via ExpectBlockCRCs.
+	ErrBlockCRCMismatch = errors.New("block CRCs do not match those expected")
+
+	// ErrTruncated is returned, once all of the complete blocks have been
+	// read, for a stream that ends without a trailer when BZAllowTruncated
+	// is specified. It wraps io.ErrUnexpectedEOF.
+	ErrTruncated = fmt.Errorf("truncated stream: %w", io.ErrUnexpectedEOF)
+
+	// ErrUnsupportedOption is returned by the functions that decompress
+	// individual blocks rather than a Reader's output, such as Verify and
+	// ReadBlocks, when passed an option that they do not support. They
+	// support ScannerOptions, SmallMemory, MaxHuffmanTrees,
+	// MTFShiftThreshold, AllowOversizeBlocks, WithBlockRetry, WithCRC and
+	// DecompressionOptions with only BZConcurrency, as well as
+	// UnorderedOutput and UnsafeZeroCopy for ReadBlocks and NewBlockReader.
+	ErrUnsupportedOption = errors.New("unsupported option")
+
+	// ErrInvalidOption is returned when an option is specified with an
+	// invalid value, such as MaxHuffmanTrees(8).
+	ErrInvalidOption = errors.New("invalid option")
+)
+
+// BlockError is returned when a block cannot be decompressed, wrapping the
+// error encountered, and identifies the block so that it can be located,
+// and inspected, in the compressed input.
+type BlockError struct {
+	Block  int   // Index of the block, starting at zero, as per BlockEvent.Block.
+	Offset int64 // Offset, in bits, of the block's compressed data, as per CompressedBlock.Offset.
+	Err    error
+}
+
+func (e *BlockError) Error() string {
+	return fmt.Sprintf("block %v at bit offset %v: %v", e.Block, e.Offset, e.Err)
+}
+
+func (e *BlockError) Unwrap() error {
+	return e.Err
+}
+
+// StreamError is returned by Read, wrapping the error encountered, when
+// a block of a stream cannot be decompressed, in which case it wraps
+// a BlockError, or when a stream's CRC does not match that stored for it.
+// It identifies the stream, which is useful when reading concatenated
+// streams, see ContinueAfterStreamError. Its Error method returns the
+// message of the error it wraps, unchanged.
+type StreamError struct {
+	Stream int   // Index of the stream, as passed to OnStreamBoundary.
+	Offset int64 // Offset, in bytes, of the header of the stream.
+	Err    error
+}
+
+func (e *StreamError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *StreamError) Unwrap() error {
+	return e.Err
+}
+
+// headerError is used to return ErrEmptyStream, ErrShortHeader or
+// ErrBadBlockSize without changing the messages historically used for
+// these errors.
+type headerError struct {
+	msg string
+	err error
+}
+
+func (e *headerError) Error() string {
+	return e.msg
+}
+
+func (e *headerError) Unwrap() error {
+	return e.err
+}
+
+// formats are the signatures of the common formats that are mistaken for
+// bzip2 input.
+var formats = []struct {
+	name      string
+	signature []byte
+}{
+	{"gzip", []byte{0x1f, 0x8b}},
+	{"zstd", []byte{0x28, 0xb5, 0x2f, 0xfd}},
+	{"xz", []byte{0xfd, '7', 'z', 'X', 'Z', 0x00}},
+}
+
+// detectFormat returns the name of the format, other than bzip2, that the
+// input starting with header appears to be, or "" if none is recognized.
+// header may be shorter than a complete signature when the input is short.
+func detectFormat(header []byte) string {
+	if len(header) == 0 || bytes.HasPrefix(header, bzip2.FileMagic) {
+		return ""
+	}
+	for _, f := range formats {
+		n := len(f.signature)
+		if len(header) < n {
+			n = len(header)
+		}
+		if n >= 2 && bytes.Equal(header[:n], f.signature[:n]) {
+			return f.name
+		}
+	}
+	if len(header) >= 4 && header[2] == 'h' && header[3] >= '1' && header[3] <= '9' {
+		// A bzip2 header with a corrupt magic number.
+		return ""
+	}
+	for _, c := range header {
+		if (c < 0x20 || c > 0x7e) && c != '\t' && c != '\n' && c != '\r' {
+			return ""
+		}
+	}
+	return "text"
+}
+
+// formatError is returned for input that is recognized as being in
+// a format other than bzip2.
+type formatError struct {
+	format string
+	err    error
+}
+
+func (e *formatError) Error() string {
+	return fmt.Sprintf("input appears to be %v, not bzip2: %v", e.format, e.err)
+}
+
+func (e *formatError) Unwrap() error {
+	return e.err
+}
+
+func (e *formatError) Is(target error) bool {
+	return target == ErrNotBzip2
+}
+
+// notBzip2 returns a formatError wrapping err if the input starting with
+// header is recognized as being in a format other than bzip2, and err
+// otherwise.
+func notBzip2(header []byte, err error) error {
+	if format := detectFormat(header); format != "" {
+		return &formatError{format: format, err: err}
+	}
+	return err
+}
+
+// shortHeaderError returns an error that wraps ErrShortHeader for a stream
+// header of which only n bytes could be read.
+func shortHeaderError(n int) error {
+	return fmt.Errorf("%w: %v", ErrShortHeader, n)
+}
+
+// emptyStreamError returns the error, which wraps ErrEmptyStream, for an
+// input that ends before the stream header.
+func emptyStreamError() error {
+	return &headerError{"failed to read stream header: EOF", ErrEmptyStream}
+}
+
+// CRCKind distinguishes the two CRCs checked when decompressing.
+type CRCKind int
+
+const (
+	// BlockCRCMismatch is used for a block whose output does not match
+	// the CRC stored in the block.
+	BlockCRCMismatch CRCKind = iota
+	// StreamCRCMismatch is used for a stream whose combined block CRCs
+	// do not match the CRC stored in its trailer.
+	StreamCRCMismatch
+)
+
+// CRCError is returned when a CRC check fails. It wraps ErrBlockChecksum
+// for a block CRC, in which case it is in turn wrapped by a BlockError,
+// and ErrMismatchedCRC for a stream CRC, in which case it is wrapped by
+// a StreamError. For a stream CRC, Block and Offset identify the last
+// block of the stream and are -1 for a stream that contains no blocks.
+// Its Error method returns the message historically used for these errors.
+type CRCError struct {
+	Kind     CRCKind
+	Block    int    // Index of the block, starting at zero, as per BlockEvent.Block.
+	Offset   int64  // Offset, in bits, of the block's compressed data, as per CompressedBlock.Offset.
+	Expected uint32 // CRC stored in the compressed stream.
+	Computed uint32 // CRC computed from the decompressed data.
+}
+
+func (e *CRCError) Error() string {
+	if e.Kind == StreamCRCMismatch {
+		return fmt.Sprintf("%v: calculated=0x%08x != stored=0x%08x", ErrMismatchedCRC, e.Computed, e.Expected)
+	}
+	return ErrBlockChecksum.Error()
+}
+
+func (e *CRCError) Unwrap() error {
+	if e.Kind == StreamCRCMismatch {
+		return ErrMismatchedCRC
+	}
+	return ErrBlockChecksum
+}
+
+// blockCRCError returns a CRCError for a block whose output does not match
+// its stored CRC.
+func blockCRCError(block *blockDesc, computed uint32) error {
+	return &CRCError{
+		Kind:     BlockCRCMismatch,
+		Block:    block.index,
+		Offset:   block.Offset,
+		Expected: block.CRC,
+		Computed: computed,
+	}
+}
+
+// streamCRCError returns a CRCError for the stream that ends with block.
+func streamCRCError(block *blockDesc, calculated, stored uint32) error {
+	e := &CRCError{
+		Kind:     StreamCRCMismatch,
+		Block:    -1,
+		Offset:   -1,
+		Expected: stored,
+		Computed: calculated,
+	}
+	if len(block.Data) > 0 {
+		e.Block, e.Offset = block.index, block.Offset
+	}
+	return e
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"errors"
+)
+
+// BlockEventType identifies the type of a BlockEvent.
+type BlockEventType int
+
+const (
+	// CRCMismatch is sent when a block's CRC does not match that stored
+	// for it. The error returned by Read will wrap ErrBlockChecksum.
+	CRCMismatch BlockEventType = iota + 1
+	// BlockSkipped is sent for each block that is not decompressed
+	// because it was rejected by the function passed to BlockFilter.
+	BlockSkipped
+	// StreamBoundary is sent when a new stream is encountered when
+	// reading concatenated streams, as for OnStreamBoundary.
+	StreamBoundary
+	// EmptyBlock is sent when a block decompresses to no data. The error
+	// returned by Read will wrap ErrEmptyBlock.
+	EmptyBlock
+	// ZeroCRC is sent, when FlagZeroCRC is specified, for each non-empty
+	// block whose stored CRC is zero.
+	ZeroCRC
+)
+
+func (t BlockEventType) String() string {
+	switch t {
+	case CRCMismatch:
+		return "CRCMismatch"
+	case BlockSkipped:
+		return "BlockSkipped"
+	case StreamBoundary:
+		return "StreamBoundary"
+	case EmptyBlock:
+		return "EmptyBlock"
+	case ZeroCRC:
+		return "ZeroCRC"
+	}
+	return "unknown"
+}
+
+// BlockEvent represents an event encountered whilst decompressing that is
+// reported via WithEventChannel.
+type BlockEvent struct {
+	Type         BlockEventType
+	Block        int   // Index of the block, starting at zero, as passed to a BlockFilter.
+	Offset       int64 // Offset, in bits, of the block's compressed data, as per CompressedBlock.Offset.
+	Stream       int   // For StreamBoundary, the index of the new stream as passed to OnStreamBoundary.
+	StreamOffset int64 // Offset, in bytes, of the header of the stream containing the block.
+}
+
+// WithEventChannel requests that BlockEvents be sent to ch as they are
+// encountered. BlockSkipped events are sent as the input is scanned,
+// which may be ahead of decompression, and hence events are not
+// necessarily sent in the order of the blocks they refer to. Events are
+// sent synchronously and hence ch must be either drained by the caller
+// concurrently with calling Read, or be sufficiently buffered, since
+// decompression will stall until each event has been sent. Pending sends
+// are abandoned once the Reader is closed or its context canceled. ch is
+// not closed by the Reader.
+func WithEventChannel(ch chan<- BlockEvent) ReaderOption {
+	return func(o *readerOpts) {
+		o.events = ch
+	}
+}
+
+// sendEvent sends ev on ch unless ctx is canceled first.
+func sendEvent(ctx context.Context, ch chan<- BlockEvent, ev BlockEvent) {
+	if ch == nil {
+		return
+	}
+	select {
+	case ch <- ev:
+	case <-ctx.Done():
+	}
+}
+
+// failed must be called for a block that could not be decompressed, before
+// its error is returned.
+func (a *assembler) failed(ctx context.Context, block *blockDesc) {
+	var typ BlockEventType
+	switch {
+	case errors.Is(block.err, ErrBlockChecksum):
+		typ = CRCMismatch
+	case errors.Is(block.err, ErrEmptyBlock):
+		typ = EmptyBlock
+	}
+	if typ != 0 {
+		sendEvent(ctx, a.events, BlockEvent{
+			Type:         typ,
+			Block:        block.index,
+			Offset:       block.Offset,
+			StreamOffset: block.StreamOffset,
+		})
+	}
+}
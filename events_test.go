@@ -0,0 +1,314 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func TestEventChannel(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "hello", "300KB2", "hello")
+	var blocks []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+		if block := sc.Block(); len(block.Data) > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(blocks), 4; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	// Corrupt the CRC of the last block.
+	offset := blocks[3].Offset
+	compressed[offset/8] ^= 0x80 >> (offset % 8)
+
+	for _, concurrency := range []int{0, 2} {
+		events := make(chan pbzip2.BlockEvent, 10)
+		opts := []pbzip2.ReaderOption{
+			pbzip2.WithEventChannel(events),
+			pbzip2.BlockFilter(func(index int, storedCRC uint32) bool {
+				return index != 2
+			}),
+		}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		_, err := io.Copy(io.Discard, rd)
+		if !errors.Is(err, pbzip2.ErrBlockChecksum) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrBlockChecksum)
+		}
+		rd.Close()
+		close(events)
+		var got []pbzip2.BlockEvent
+		for ev := range events {
+			got = append(got, ev)
+		}
+		sort.Slice(got, func(i, j int) bool { return got[i].Block < got[j].Block })
+		want := []pbzip2.BlockEvent{
+			{Type: pbzip2.StreamBoundary, Block: 1, Offset: blocks[1].Offset, Stream: 1, StreamOffset: blocks[1].StreamOffset},
+			{Type: pbzip2.BlockSkipped, Block: 2, Offset: blocks[2].Offset, StreamOffset: blocks[2].StreamOffset},
+			{Type: pbzip2.CRCMismatch, Block: 3, Offset: blocks[3].Offset, StreamOffset: blocks[3].StreamOffset},
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %v: got %+v, want %+v", concurrency, got, want)
+		}
+	}
+}
+
+// bitWriter is used to craft compressed streams bit by bit.
+type bitWriter struct {
+	buf  []byte
+	bits int
+}
+
+func (bw *bitWriter) write(n int, v uint64) {
+	for i := n - 1; i >= 0; i-- {
+		if bw.bits%8 == 0 {
+			bw.buf = append(bw.buf, 0)
+		}
+		if v&(1<<uint(i)) != 0 {
+			bw.buf[bw.bits/8] |= 0x80 >> (uint(bw.bits) % 8)
+		}
+		bw.bits++
+	}
+}
+
+// craftedStream returns a stream containing a single block that uses the
+// specified number of Huffman trees to encode either "a", or, if empty
+// is set, only the end of block symbol and hence no data.
+func craftedStream(trees int, empty bool) []byte {
+	crc := uint64(0x19939b6b) // the CRC of "a", as per the tiny fixture.
+	if empty {
+		crc = 0
+	}
+	bw := &bitWriter{}
+	bw.write(32, 0x425a6839)     // BZh9
+	bw.write(48, 0x314159265359) // block magic
+	bw.write(32, crc)            // block CRC
+	bw.write(1, 0)               // not randomized
+	bw.write(24, 0)              // origPtr
+	bw.write(16, 1<<9)           // 'a' is in the 7th range of 16 symbols
+	bw.write(16, 1<<14)          // and is the 2nd symbol in that range
+	bw.write(3, uint64(trees))   // Huffman trees
+	bw.write(15, 1)              // selectors
+	bw.write(1, 0)               // the first tree
+	for i := 0; i < trees; i++ {
+		// Code lengths of 1, 2 and 2 for RUNA, RUNB and EOB.
+		bw.write(5, 1)
+		bw.write(1, 0)
+		bw.write(3, 0x4)
+		bw.write(1, 0)
+	}
+	if !empty {
+		bw.write(1, 0) // RUNA, ie. a single copy of the first symbol
+	}
+	bw.write(2, 0x3)             // EOB
+	bw.write(48, 0x177245385090) // end of stream magic
+	bw.write(32, crc)            // stream CRC
+	return bw.buf
+}
+
+func TestEmptyBlock(t *testing.T) {
+	ctx := context.Background()
+	compressed := craftedStream(2, true)
+	for _, concurrency := range []int{0, 2} {
+		events := make(chan pbzip2.BlockEvent, 10)
+		opts := []pbzip2.ReaderOption{pbzip2.WithEventChannel(events)}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		n, err := io.Copy(io.Discard, rd)
+		if !errors.Is(err, pbzip2.ErrEmptyBlock) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrEmptyBlock)
+		}
+		if got, want := n, int64(0); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		rd.Close()
+		close(events)
+		var got []pbzip2.BlockEvent
+		for ev := range events {
+			got = append(got, ev)
+		}
+		want := []pbzip2.BlockEvent{{Type: pbzip2.EmptyBlock, Offset: 80}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %v: got %+v, want %+v", concurrency, got, want)
+		}
+	}
+
+	// A legitimately empty stream contains no blocks and is not an error.
+	empty, _ := readFile(t, "empty")
+	events := make(chan pbzip2.BlockEvent, 10)
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(empty), pbzip2.WithEventChannel(events))
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		t.Errorf("empty: %v", err)
+	}
+	if got, want := len(events), 0; got != want {
+		t.Errorf("empty: got %v, want %v", got, want)
+	}
+}
+
+func TestFlagZeroCRC(t *testing.T) {
+	ctx := context.Background()
+	// The data for the zerocrc fixture was chosen so that its CRC is zero.
+	compressed, _ := concatFiles(t, "hello", "zerocrc")
+	want := append(append([]byte{}, bzip2Data["hello"]...), bzip2Data["zerocrc"]...)
+	for _, strict := range []bool{false, true} {
+		for _, concurrency := range []int{0, 2} {
+			events := make(chan pbzip2.BlockEvent, 10)
+			opts := []pbzip2.ReaderOption{
+				pbzip2.WithEventChannel(events),
+				pbzip2.FlagZeroCRC(strict),
+			}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			out, err := io.ReadAll(rd)
+			rd.Close()
+			close(events)
+			if strict {
+				if !errors.Is(err, pbzip2.ErrSuspiciousCRC) {
+					t.Errorf("strict %v, concurrency %v: got %v, want %v", strict, concurrency, err, pbzip2.ErrSuspiciousCRC)
+				}
+				if got, want := out, bzip2Data["hello"]; !bytes.Equal(got, want) {
+					t.Errorf("strict %v, concurrency %v: got %q, want %q", strict, concurrency, got, want)
+				}
+			} else {
+				if err != nil {
+					t.Errorf("strict %v, concurrency %v: %v", strict, concurrency, err)
+				}
+				if got := out; !bytes.Equal(got, want) {
+					t.Errorf("strict %v, concurrency %v: got %q, want %q", strict, concurrency, got, want)
+				}
+			}
+			var got []pbzip2.BlockEventType
+			for ev := range events {
+				got = append(got, ev.Type)
+			}
+			if want := []pbzip2.BlockEventType{pbzip2.StreamBoundary, pbzip2.ZeroCRC}; !reflect.DeepEqual(got, want) {
+				t.Errorf("strict %v, concurrency %v: got %v, want %v", strict, concurrency, got, want)
+			}
+		}
+	}
+}
+
+func TestMaxHuffmanTrees(t *testing.T) {
+	ctx := context.Background()
+	read := func(compressed []byte, opts ...pbzip2.ReaderOption) ([]byte, []string, error) {
+		var warnings []string
+		logf := func(format string, args ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+		opts = append(opts, pbzip2.WithLogger(logf))
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		defer rd.Close()
+		data, err := io.ReadAll(rd)
+		return data, warnings, err
+	}
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		for _, tc := range []struct {
+			trees, max int
+			ok         bool
+		}{
+			{2, 0, true},
+			{6, 0, true},
+			{1, 0, false},
+			{7, 0, false},
+			{0, 0, false},
+			{1, 7, true},
+			{7, 7, true},
+			{6, 7, true},
+			{7, 6, false},
+			{0, 7, false},
+			// The range is only ever widened.
+			{6, 3, true},
+			{4, 3, true},
+			{1, 3, true},
+			{7, 3, false},
+		} {
+			tcOpts := opts
+			if tc.max > 0 {
+				tcOpts = append(tcOpts, pbzip2.MaxHuffmanTrees(tc.max))
+			}
+			data, warnings, err := read(craftedStream(tc.trees, false), tcOpts...)
+			if !tc.ok {
+				if err == nil || !strings.Contains(err.Error(), "invalid number of Huffman trees") {
+					t.Errorf("concurrency %v: trees %v, max %v: missing or unexpected error: %v", concurrency, tc.trees, tc.max, err)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("concurrency %v: trees %v, max %v: %v", concurrency, tc.trees, tc.max, err)
+				continue
+			}
+			if got, want := string(data), "a"; got != want {
+				t.Errorf("concurrency %v: trees %v, max %v: got %q, want %q", concurrency, tc.trees, tc.max, got, want)
+			}
+			var want []string
+			if tc.trees < 2 || tc.trees > 6 {
+				want = []string{fmt.Sprintf("pbzip2: block 1 uses %v Huffman trees, outside of the standard range of 2..6", tc.trees)}
+			}
+			if got := warnings; !reflect.DeepEqual(got, want) {
+				t.Errorf("concurrency %v: trees %v, max %v: got %v, want %v", concurrency, tc.trees, tc.max, got, want)
+			}
+		}
+	}
+
+	// Blocks produced by bzip2 are still accepted with a lower bound.
+	compressed, _ := readFile(t, "900KB2_Random")
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), pbzip2.MaxHuffmanTrees(3), pbzip2.CollectBlockStats(true))
+	data, err := io.ReadAll(rd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := data, bzip2Data["900KB2_Random"]; !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+	trees := 0
+	for _, bs := range rd.Stats().BlockStats {
+		if bs.HuffmanTrees > trees {
+			trees = bs.HuffmanTrees
+		}
+	}
+	if got, want := trees, 6; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, n := range []int{0, 8} {
+		opt := pbzip2.MaxHuffmanTrees(n)
+		if _, _, err := read(compressed, opt); !errors.Is(err, pbzip2.ErrInvalidOption) {
+			t.Errorf("%v: got %v, want %v", n, err, pbzip2.ErrInvalidOption)
+		}
+		if err := pbzip2.Verify(ctx, bytes.NewReader(compressed), opt); !errors.Is(err, pbzip2.ErrInvalidOption) {
+			t.Errorf("%v: got %v, want %v", n, err, pbzip2.ErrInvalidOption)
+		}
+	}
+}
@@ -66,6 +66,48 @@ func TestHandlingFalsePositives(t *testing.T) {
 				t.Error(err)
 			}
 
+			// The same false positives found by the concurrent search.
+			ard := pbzip2.NewReaderAt(ctx, bytes.NewReader(data), int64(len(data)),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+			if all, err := io.ReadAll(ard); err != nil || !bytes.Equal(all, godata) {
+				t.Errorf("%v: NewReaderAt: got %v bytes, %v, want %v bytes", i, len(all), err, len(godata))
+			}
+
+			// The merged blocks are numbered contiguously.
+			br := pbzip2.NewBlockReader(ctx, bytes.NewReader(data), pbzip2.UnorderedOutput(false))
+			var all []byte
+			for index := 0; br.Scan(); index++ {
+				block := br.Block()
+				if got, want := block.Index, index; got != want {
+					t.Errorf("%v: NewBlockReader: got index %v, want %v", i, got, want)
+				}
+				if got, want := block.DecompressedOffset, int64(len(all)); got != want {
+					t.Errorf("%v: NewBlockReader: got offset %v, want %v", i, got, want)
+				}
+				all = append(all, block.Data...)
+			}
+			if err := br.Err(); err != nil || !bytes.Equal(all, godata) {
+				t.Errorf("%v: NewBlockReader: got %v bytes, %v, want %v bytes", i, len(all), err, len(godata))
+			}
+
+			// All of the memory used by the merged blocks, and by their
+			// failed first attempts, is returned to the arena.
+			for _, concurrency := range []int{0, 2} {
+				arena := pbzip2.NewArena(4 * 1000 * 1000)
+				opts := []pbzip2.ReaderOption{pbzip2.WithArena(arena)}
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+				}
+				mrd := pbzip2.NewReader(ctx, bytes.NewReader(data), opts...)
+				if all, err := io.ReadAll(mrd); err != nil || !bytes.Equal(all, godata) {
+					t.Errorf("%v: concurrency %v: WithArena: got %v bytes, %v, want %v bytes", i, concurrency, len(all), err, len(godata))
+				}
+				if got, want := arena.InUse(), 0; got != want {
+					t.Errorf("%v: concurrency %v: in use: got %v, want %v", i, concurrency, got, want)
+				}
+				mrd.Close()
+			}
+
 			if got, want := buf.Bytes(), godata; !bytes.Equal(got, want) {
 				if testing.Verbose() {
 					fmt.Printf("got\n")
@@ -0,0 +1,91 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// decompressedName returns the name of the decompressed file using the
+// same rules as the bzip2 command line tool.
+func decompressedName(name string) string {
+	for _, suffix := range []struct{ from, to string }{
+		{".bz2", ""},
+		{".bz", ""},
+		{".tbz2", ".tar"},
+		{".tbz", ".tar"},
+	} {
+		if strings.HasSuffix(name, suffix.from) && len(name) > len(suffix.from) {
+			return strings.TrimSuffix(name, suffix.from) + suffix.to
+		}
+	}
+	return name + ".out"
+}
+
+// removeFile is used to remove the source file, it is replaced by tests.
+var removeFile = os.Remove
+
+// DecompressFile decompresses srcPath to a file named by removing its
+// .bz2 or .bz suffix (.tbz2 and .tbz are replaced by .tar, and any other
+// file has .out appended), in the same manner as the bzip2 command line
+// tool. The modification time and permissions of srcPath are applied to
+// the decompressed file, and srcPath is removed unless keepSource is true.
+// An existing file will not be overwritten, and the decompressed file is
+// removed if it cannot be completely written. It returns the name of the
+// decompressed file, which is also returned, along with the error, if the
+// decompressed file is complete but srcPath cannot be removed.
+func DecompressFile(ctx context.Context, srcPath string, keepSource bool, opts ...ReaderOption) (string, error) {
+	dstPath := decompressedName(srcPath)
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	info, err := src.Stat()
+	if err != nil {
+		return "", err
+	}
+	if !info.Mode().IsRegular() {
+		return "", fmt.Errorf("%v: not a regular file", srcPath)
+	}
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return "", err
+	}
+	if err := decompressFile(ctx, dst, src, opts); err != nil {
+		os.Remove(dstPath)
+		return "", fmt.Errorf("%v: %w", srcPath, err)
+	}
+	// The permissions passed to OpenFile are subject to the umask.
+	if err := os.Chmod(dstPath, info.Mode().Perm()); err != nil {
+		os.Remove(dstPath)
+		return "", fmt.Errorf("%v: %w", srcPath, err)
+	}
+	if err := os.Chtimes(dstPath, info.ModTime(), info.ModTime()); err != nil {
+		os.Remove(dstPath)
+		return "", fmt.Errorf("%v: %w", srcPath, err)
+	}
+	if !keepSource {
+		src.Close()
+		if err := removeFile(srcPath); err != nil {
+			return dstPath, fmt.Errorf("%v: %w", srcPath, err)
+		}
+	}
+	return dstPath, nil
+}
+
+func decompressFile(ctx context.Context, dst *os.File, src io.Reader, opts []ReaderOption) error {
+	rd := NewReader(ctx, src, opts...)
+	defer rd.Close()
+	if _, err := io.Copy(dst, rd); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
@@ -0,0 +1,103 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func TestDecompressFile(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	compressed, _ := readFile(t, "300KB2")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for i, keep := range []bool{true, false} {
+		src := filepath.Join(tmpdir, "300KB2.bz2")
+		if err := os.WriteFile(src, compressed, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chmod(src, 0640); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(src, mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+		dst, err := pbzip2.DecompressFile(ctx, src, keep)
+		if err != nil {
+			t.Fatalf("%v: %v", i, err)
+		}
+		if got, want := dst, filepath.Join(tmpdir, "300KB2"); got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		data, err := os.ReadFile(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := data, bzip2Data["300KB2"]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v, want %v", i, got[:10], want[:10])
+		}
+		info, err := os.Stat(dst)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := info.ModTime(), mtime; !got.Equal(want) {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if got, want := info.Mode().Perm(), os.FileMode(0640); got != want {
+			t.Errorf("%v: got %v, want %v", i, got, want)
+		}
+		if _, err := os.Stat(src); keep != (err == nil) {
+			t.Errorf("%v: source file: keep %v: %v", i, keep, err)
+		}
+		// An existing file must not be overwritten.
+		if keep {
+			if _, err := pbzip2.DecompressFile(ctx, src, keep); !os.IsExist(err) {
+				t.Errorf("%v: expected an existing file error, got %v", i, err)
+			}
+		}
+		os.Remove(dst)
+	}
+}
+
+func TestDecompressFileRemoveSource(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	compressed, _ := readFile(t, "hello")
+	src := filepath.Join(tmpdir, "hello.bz2")
+	if err := os.WriteFile(src, compressed, 0640); err != nil {
+		t.Fatal(err)
+	}
+	errRemove := errors.New("remove failed")
+	prev := pbzip2.SetRemoveFile(func(string) error { return errRemove })
+	defer pbzip2.SetRemoveFile(prev)
+	dst, err := pbzip2.DecompressFile(ctx, src, false)
+	if !errors.Is(err, errRemove) {
+		t.Fatalf("got %v, want %v", err, errRemove)
+	}
+	if got, want := err.Error(), src; !strings.Contains(got, want) {
+		t.Errorf("%q does not contain %q", got, want)
+	}
+	// The decompressed file is complete and is returned with the error.
+	if got, want := dst, filepath.Join(tmpdir, "hello"); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	data, err := os.ReadFile(dst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := data, bzip2Data["hello"]; !bytes.Equal(got, want) {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
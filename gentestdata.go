@@ -28,6 +28,8 @@ func main() {
 	}{
 		{"empty", nil, nil},
 		{"hello", []byte("hello world\n"), nil},
+		{"tiny", []byte("a"), nil},
+		{"tinyrun", []byte("aaaa"), nil},
 		{"100KB1", internal.GenPredictableRandomData(100 * 1024), []string{"-1"}},
 		{"300KB1", internal.GenPredictableRandomData(300 * 1024), []string{"-1"}},
 		{"400KB1", internal.GenPredictableRandomData(400 * 1024), []string{"-1"}},
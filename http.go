@@ -0,0 +1,41 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+)
+
+// isBzip2Response returns true if resp's Content-Encoding or Content-Type
+// indicate that its body is bzip2 compressed.
+func isBzip2Response(resp *http.Response) bool {
+	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
+	case "bzip2", "x-bzip2":
+		return true
+	}
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	switch mediaType {
+	case "application/x-bzip2", "application/x-bzip", "application/bzip2":
+		return true
+	}
+	return false
+}
+
+// WrapHTTPBody returns an io.ReadCloser that decompresses resp.Body if
+// resp's Content-Encoding is bzip2 (or x-bzip2) or its Content-Type is
+// that of a bzip2 file, such as application/x-bzip2, and resp.Body
+// itself otherwise. Closing the returned io.ReadCloser closes both the
+// Reader and resp.Body. resp is not modified.
+func WrapHTTPBody(ctx context.Context, resp *http.Response, opts ...ReaderOption) io.ReadCloser {
+	if !isBzip2Response(resp) {
+		return resp.Body
+	}
+	opts = append(opts[:len(opts):len(opts)], OwnsSource(true))
+	return NewReader(ctx, resp.Body, opts...)
+}
@@ -0,0 +1,59 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func TestWrapHTTPBody(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	for _, tc := range []struct {
+		header, value string
+		decompressed  bool
+	}{
+		{"Content-Encoding", "bzip2", true},
+		{"Content-Encoding", "x-bzip2", true},
+		{"Content-Type", "application/x-bzip2", true},
+		{"Content-Type", "application/x-bzip2; charset=binary", true},
+		{"Content-Type", "application/octet-stream", false},
+		{"Content-Encoding", "identity", false},
+	} {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set(tc.header, tc.value)
+			w.Write(compressed)
+		}))
+		resp, err := http.Get(srv.URL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body := pbzip2.WrapHTTPBody(ctx, resp)
+		data, err := io.ReadAll(body)
+		if err != nil {
+			t.Errorf("%v: %v: %v", tc.header, tc.value, err)
+		}
+		if err := body.Close(); err != nil {
+			t.Errorf("%v: %v: %v", tc.header, tc.value, err)
+		}
+		want := compressed
+		if tc.decompressed {
+			want = bzip2Data[name]
+		}
+		if got := data; !bytes.Equal(got, want) {
+			t.Errorf("%v: %v: got %v..., want %v...", tc.header, tc.value, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		srv.Close()
+	}
+}
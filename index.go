@@ -0,0 +1,406 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// IndexedBlock describes a single block in an Index.
+type IndexedBlock struct {
+	Offset             int64  // Offset, in bits, of the block's compressed data, as per CompressedBlock.Offset.
+	SizeInBits         int    // Size, in bits, of the block's compressed data.
+	StreamBlockSize    int    // Block size declared by the header of the stream containing the block.
+	CRC                uint32 // CRC for the block.
+	UncompressedOffset int64  // Offset of the block's output within the decompressed output.
+	Size               int    // Size of the block's decompressed output.
+}
+
+// Index records the location of each block in a bzip2 stream, or
+// concatenated streams, along with the location of its output within the
+// decompressed output, so that the blocks needed to provide any part of
+// the output may be decompressed without decompressing those that precede
+// them, see NewIndexedReader.
+type Index struct {
+	Blocks []IndexedBlock
+}
+
+// Size returns the size of the decompressed output.
+func (idx *Index) Size() int64 {
+	if len(idx.Blocks) == 0 {
+		return 0
+	}
+	last := idx.Blocks[len(idx.Blocks)-1]
+	return last.UncompressedOffset + int64(last.Size)
+}
+
+// BuildIndex builds an Index for the size bytes of bzip2 data read from r.
+// Since the size of a block's output is only known once it has been
+// decompressed every block must be decompressed, albeit concurrently as
+// for ReadBlocks, and the block and stream CRCs are verified as they are.
+// The options supported are the same as for Verify.
+func BuildIndex(ctx context.Context, r io.ReaderAt, size int64, opts ...ReaderOption) (*Index, error) {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	if err := rdOpts.unsupportedOption(false); err != nil {
+		return nil, err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	idx := &Index{}
+	var offset int64
+	done, scanErr := decompressBlocks(ctx, io.NewSectionReader(r, 0, size), rdOpts, 0, nil)
+	err := inOrder(done, nil, func(block *blockDesc) error {
+		if len(block.Data) == 0 {
+			return nil
+		}
+		idx.Blocks = append(idx.Blocks, IndexedBlock{
+			Offset:             block.Offset,
+			SizeInBits:         block.SizeInBits,
+			StreamBlockSize:    block.StreamBlockSize,
+			CRC:                block.CRC,
+			UncompressedOffset: offset,
+			Size:               len(block.uncompressed),
+		})
+		offset += int64(len(block.uncompressed))
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := <-scanErr; err != nil {
+		return nil, err
+	}
+	return idx, nil
+}
+
+// indexMagic identifies, and versions, the serialized form of an Index.
+var indexMagic = [8]byte{'p', 'b', 'z', 'i', 'd', 'x', 0, 1}
+
+// indexRecord is the serialized form of an IndexedBlock.
+type indexRecord struct {
+	Offset             int64
+	SizeInBits         uint32
+	StreamBlockSize    uint32
+	CRC                uint32
+	UncompressedOffset int64
+	Size               uint32
+}
+
+// WriteTo implements io.WriterTo and writes idx in a form that can be
+// read by ReadIndex.
+func (idx *Index) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: w}
+	bw := bufio.NewWriter(cw)
+	binary.Write(bw, binary.BigEndian, indexMagic)
+	binary.Write(bw, binary.BigEndian, uint64(len(idx.Blocks)))
+	for _, b := range idx.Blocks {
+		binary.Write(bw, binary.BigEndian, indexRecord{
+			Offset:             b.Offset,
+			SizeInBits:         uint32(b.SizeInBits),
+			StreamBlockSize:    uint32(b.StreamBlockSize),
+			CRC:                b.CRC,
+			UncompressedOffset: b.UncompressedOffset,
+			Size:               uint32(b.Size),
+		})
+	}
+	err := bw.Flush()
+	return cw.n, err
+}
+
+// ReadIndex reads an Index written by Index.WriteTo.
+func ReadIndex(r io.Reader) (*Index, error) {
+	br := bufio.NewReader(r)
+	var magic [8]byte
+	if err := binary.Read(br, binary.BigEndian, &magic); err != nil {
+		return nil, fmt.Errorf("failed to read index header: %v", err)
+	}
+	if magic != indexMagic {
+		return nil, fmt.Errorf("wrong index magic: %x", magic)
+	}
+	var n uint64
+	if err := binary.Read(br, binary.BigEndian, &n); err != nil {
+		return nil, fmt.Errorf("failed to read index header: %v", err)
+	}
+	idx := &Index{}
+	var offset int64
+	for i := uint64(0); i < n; i++ {
+		var rec indexRecord
+		if err := binary.Read(br, binary.BigEndian, &rec); err != nil {
+			return nil, fmt.Errorf("failed to read index entry %v: %v", i, err)
+		}
+		if rec.UncompressedOffset != offset {
+			return nil, fmt.Errorf("index entry %v: inconsistent offset: %v, expected %v", i, rec.UncompressedOffset, offset)
+		}
+		idx.Blocks = append(idx.Blocks, IndexedBlock{
+			Offset:             rec.Offset,
+			SizeInBits:         int(rec.SizeInBits),
+			StreamBlockSize:    int(rec.StreamBlockSize),
+			CRC:                rec.CRC,
+			UncompressedOffset: rec.UncompressedOffset,
+			Size:               int(rec.Size),
+		})
+		offset += int64(rec.Size)
+	}
+	return idx, nil
+}
+
+type countingWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countingWriter) Write(buf []byte) (int, error) {
+	n, err := cw.w.Write(buf)
+	cw.n += int64(n)
+	return n, err
+}
+
+// IndexedReader provides random access to the decompressed output of
+// a bzip2 stream, or concatenated streams, using an Index.
+type IndexedReader struct {
+	ctx   context.Context
+	ra    io.ReaderAt
+	idx   *Index
+	opts  *readerOpts
+	pos   int64
+	block int    // the index of the block whose output is in data, or -1.
+	data  []byte // the output of block.
+	err   error  // set if an unsupported option is specified.
+}
+
+// NewIndexedReader returns an IndexedReader for the bzip2 data read from r
+// as described by idx. Seeking to an offset in the decompressed output
+// does not entail any decompression; Read decompresses only the block that
+// contains the current offset, the output of which is retained for
+// subsequent calls to Read, and each block is decompressed in turn by the
+// goroutine calling Read. The CRC of each block is verified as it is
+// decompressed, but since entire streams are not decompressed the stream
+// CRCs are not. Options that do not apply to the decompression of
+// individual blocks are rejected by Read, see ErrUnsupportedOption.
+func NewIndexedReader(ctx context.Context, r io.ReaderAt, idx *Index, opts ...ReaderOption) *IndexedReader {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	return &IndexedReader{ctx: ctx, ra: r, idx: idx, opts: rdOpts, block: -1, err: rdOpts.unsupportedOption(false)}
+}
+
+// Read implements io.Reader.
+func (ir *IndexedReader) Read(buf []byte) (int, error) {
+	if ir.err != nil {
+		return 0, ir.err
+	}
+	if ir.pos >= ir.idx.Size() {
+		return 0, io.EOF
+	}
+	blocks := ir.idx.Blocks
+	i := sort.Search(len(blocks), func(i int) bool {
+		return blocks[i].UncompressedOffset+int64(blocks[i].Size) > ir.pos
+	})
+	if i != ir.block {
+		data, err := decompressIndexed(ir.ctx, ir.ra, ir.idx, i, ir.opts)
+		if err != nil {
+			return 0, err
+		}
+		ir.block, ir.data = i, data
+	}
+	n := copy(buf, ir.data[ir.pos-blocks[i].UncompressedOffset:])
+	ir.pos += int64(n)
+	return n, nil
+}
+
+// RangeReader returns a reader for the bytes in the range [start, end) of
+// the decompressed output of the bzip2 data read from r, as described by
+// idx, for example to serve an HTTP range request. Only the blocks that
+// overlap the range are decompressed, each in turn, as for an
+// IndexedReader, and the output is trimmed to the range. A range that
+// extends beyond the end of the decompressed output is truncated to it.
+// An error is returned by Read if start is negative or end is less than
+// start.
+func RangeReader(ctx context.Context, r io.ReaderAt, idx *Index, start, end int64, opts ...ReaderOption) io.Reader {
+	ir := NewIndexedReader(ctx, r, idx, opts...)
+	if start < 0 || end < start {
+		if ir.err == nil {
+			ir.err = fmt.Errorf("pbzip2: invalid range [%v, %v)", start, end)
+		}
+		return ir
+	}
+	ir.pos = start
+	return io.LimitReader(ir, end-start)
+}
+
+// SectionReader provides the same methods as io.SectionReader for a
+// section of the decompressed output of a bzip2 stream, or concatenated
+// streams, described by an Index. It is created by NewSectionReader.
+type SectionReader struct {
+	ctx  context.Context
+	ra   io.ReaderAt
+	idx  *Index
+	opts []ReaderOption
+	base int64     // the offset of the section in the decompressed output.
+	size int64     // the size of the section.
+	pos  int64     // the current position relative to base.
+	rd   io.Reader // a RangeReader from pos to the end of the section.
+}
+
+// NewSectionReader returns a SectionReader that reads from the
+// decompressed output of the bzip2 data read from r, as described by idx,
+// starting at offset off and stopping after n bytes. Read decompresses
+// each block in the section once, as for a RangeReader, whereas each call
+// to ReadAt decompresses all of the blocks that overlap the bytes it
+// returns, using a RangeReader of its own, so that ReadAt may be called
+// concurrently.
+func NewSectionReader(ctx context.Context, r io.ReaderAt, idx *Index, off, n int64, opts ...ReaderOption) *SectionReader {
+	return &SectionReader{ctx: ctx, ra: r, idx: idx, opts: opts, base: off, size: n}
+}
+
+// Size returns the size of the section in bytes.
+func (s *SectionReader) Size() int64 {
+	return s.size
+}
+
+// Read implements io.Reader.
+func (s *SectionReader) Read(buf []byte) (int, error) {
+	if s.pos >= s.size {
+		return 0, io.EOF
+	}
+	if s.rd == nil {
+		s.rd = RangeReader(s.ctx, s.ra, s.idx, s.base+s.pos, s.base+s.size, s.opts...)
+	}
+	n, err := s.rd.Read(buf)
+	s.pos += int64(n)
+	return n, err
+}
+
+// Seek implements io.Seeker.
+func (s *SectionReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += s.pos
+	case io.SeekEnd:
+		offset += s.size
+	default:
+		return 0, errors.New("pbzip2: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("pbzip2: negative position")
+	}
+	if offset != s.pos {
+		s.pos, s.rd = offset, nil
+	}
+	return offset, nil
+}
+
+// ReadAt implements io.ReaderAt, off is relative to the start of the
+// section.
+func (s *SectionReader) ReadAt(buf []byte, off int64) (int, error) {
+	if off < 0 || off >= s.size {
+		return 0, io.EOF
+	}
+	want := len(buf)
+	if max := s.size - off; int64(len(buf)) > max {
+		buf = buf[:max]
+	}
+	rd := RangeReader(s.ctx, s.ra, s.idx, s.base+off, s.base+off+int64(len(buf)), s.opts...)
+	n, err := io.ReadFull(rd, buf)
+	switch {
+	case err == io.ErrUnexpectedEOF:
+		// The section extends beyond the end of the output.
+		err = io.EOF
+	case err == nil && n < want:
+		err = io.EOF
+	}
+	return n, err
+}
+
+// decompressIndexed decompresses the i'th block of idx, read from r.
+func decompressIndexed(ctx context.Context, r io.ReaderAt, idx *Index, i int, opts *readerOpts) ([]byte, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	ib := idx.Blocks[i]
+	bitOffset := int(ib.Offset % 8)
+	buf := make([]byte, (bitOffset+ib.SizeInBits+7)/8)
+	if _, err := r.ReadAt(buf, ib.Offset/8); err != nil && err != io.EOF {
+		return nil, fmt.Errorf("failed to read block at bit offset %v: %v", ib.Offset, err)
+	}
+	block := opts.newBlock(uint64(i+1), CompressedBlock{
+		Data:            buf,
+		BitOffset:       bitOffset,
+		SizeInBits:      ib.SizeInBits,
+		CRC:             ib.CRC,
+		StreamBlockSize: ib.StreamBlockSize,
+		Offset:          ib.Offset,
+		index:           i,
+	})
+	block.decompress()
+	if block.err != nil {
+		return nil, blockError(block)
+	}
+	if got, want := len(block.uncompressed), ib.Size; got != want {
+		return nil, fmt.Errorf("%w: block %v: expected %v bytes, got %v", ErrLengthMismatch, i, want, got)
+	}
+	return block.uncompressed, nil
+}
+
+// Seek implements io.Seeker. Seeking beyond the end of the decompressed
+// output is allowed, with subsequent calls to Read returning io.EOF.
+func (ir *IndexedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += ir.pos
+	case io.SeekEnd:
+		offset += ir.idx.Size()
+	default:
+		return 0, errors.New("pbzip2: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("pbzip2: negative position")
+	}
+	ir.pos = offset
+	return offset, nil
+}
+
+// ReverseBlocks returns a BlockReader that returns the blocks of the bzip2
+// data read from r, as described by idx, from the last to the first, for
+// example to read the most recent entries of a compressed log first. Each
+// block is decompressed independently, in turn, and its Index and
+// DecompressedOffset are those of its entry in idx. As for an
+// IndexedReader, the CRC of each block is verified but the stream CRCs
+// are not, and options that do not apply to the decompression of
+// individual blocks are rejected, see ErrUnsupportedOption.
+func ReverseBlocks(ctx context.Context, r io.ReaderAt, idx *Index, opts ...ReaderOption) *BlockReader {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	return startBlockReader(ctx, func(ctx context.Context, fn func(Block) error) error {
+		if err := rdOpts.unsupportedOption(false); err != nil {
+			return err
+		}
+		for i := len(idx.Blocks) - 1; i >= 0; i-- {
+			data, err := decompressIndexed(ctx, r, idx, i, rdOpts)
+			if err != nil {
+				return err
+			}
+			block := Block{Index: i, DecompressedOffset: idx.Blocks[i].UncompressedOffset, Data: data}
+			if err := fn(block); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
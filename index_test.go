@@ -0,0 +1,297 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func TestIndex(t *testing.T) {
+	ctx := context.Background()
+	compressed, data := concatFiles(t, "300KB1", "hello", "empty", "900KB2_Random")
+	for _, concurrency := range []int{0, 2} {
+		opts := []pbzip2.ReaderOption{}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		idx, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed), int64(len(compressed)), opts...)
+		if err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		blocks, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := len(idx.Blocks), blocks; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := idx.Size(), int64(len(data)); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+
+		buf := &bytes.Buffer{}
+		if _, err := idx.WriteTo(buf); err != nil {
+			t.Fatal(err)
+		}
+		read, err := pbzip2.ReadIndex(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := read, idx; !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+	}
+
+	idx, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	all, err := io.ReadAll(pbzip2.NewIndexedReader(ctx, bytes.NewReader(compressed), idx))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := all, data; !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+
+	size := int64(len(data))
+	last := idx.Blocks[len(idx.Blocks)-1].UncompressedOffset
+	for _, tc := range []struct {
+		offset int64
+		whence int
+		pos    int64
+		n      int
+		blocks int
+	}{
+		{0, io.SeekStart, 0, 10, 1},
+		{-100, io.SeekEnd, size - 100, 100, 1},
+		{last - 10, io.SeekStart, last - 10, 20, 2},
+		{300 * 1024, io.SeekStart, 300 * 1024, 12, 1},
+		{size, io.SeekStart, size, 0, 0},
+	} {
+		cc := &countingCRC{}
+		ir := pbzip2.NewIndexedReader(ctx, bytes.NewReader(compressed), idx, pbzip2.WithCRC(cc.new))
+		pos, err := ir.Seek(tc.offset, tc.whence)
+		if err != nil {
+			t.Errorf("%v: %v", tc.offset, err)
+			continue
+		}
+		if got, want := pos, tc.pos; got != want {
+			t.Errorf("%v: got %v, want %v", tc.offset, got, want)
+		}
+		window := make([]byte, tc.n)
+		if _, err := io.ReadFull(ir, window); err != nil {
+			t.Errorf("%v: %v", tc.offset, err)
+			continue
+		}
+		if got, want := window, data[pos:pos+int64(tc.n)]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v..., want %v...", tc.offset, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		if got, want := cc.n, tc.blocks; got != want {
+			t.Errorf("%v: got %v, want %v", tc.offset, got, want)
+		}
+		if pos, err := ir.Seek(-int64(tc.n), io.SeekCurrent); err != nil || pos != tc.pos {
+			t.Errorf("%v: got %v, %v, want %v", tc.offset, pos, err, tc.pos)
+		}
+	}
+
+	ir := pbzip2.NewIndexedReader(ctx, bytes.NewReader(compressed), idx)
+	if _, err := ir.Seek(-1, io.SeekStart); err == nil {
+		t.Errorf("expected an error for a negative position")
+	}
+	if _, err := ir.Seek(size+1, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ir.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("got %v, want %v", err, io.EOF)
+	}
+
+	if _, err := pbzip2.ReadIndex(bytes.NewReader([]byte("not an index"))); err == nil {
+		t.Errorf("expected an error for an invalid index")
+	}
+
+	// A corrupt block is detected when it is read.
+	corrupted := append([]byte{}, compressed...)
+	bit := idx.Blocks[1].Offset
+	corrupted[bit/8] ^= 0x80 >> (bit % 8)
+	ir = pbzip2.NewIndexedReader(ctx, bytes.NewReader(corrupted), idx)
+	if _, err := ir.Seek(idx.Blocks[1].UncompressedOffset, io.SeekStart); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ir.Read(make([]byte, 1)); !errors.Is(err, pbzip2.ErrBlockChecksum) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrBlockChecksum)
+	}
+
+	// Options that do not apply to individual blocks are rejected.
+	opt := pbzip2.ExpectDecompressedLength(size)
+	if _, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed), int64(len(compressed)), opt); !errors.Is(err, pbzip2.ErrUnsupportedOption) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrUnsupportedOption)
+	}
+	ir = pbzip2.NewIndexedReader(ctx, bytes.NewReader(compressed), idx, opt)
+	if _, err := ir.Read(make([]byte, 1)); !errors.Is(err, pbzip2.ErrUnsupportedOption) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrUnsupportedOption)
+	}
+}
+
+func TestReverseBlocks(t *testing.T) {
+	ctx := context.Background()
+	compressed, data := concatFiles(t, "300KB1", "hello", "empty", "900KB2_Random")
+	idx, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	br := pbzip2.ReverseBlocks(ctx, bytes.NewReader(compressed), idx)
+	defer br.Close()
+	next, end := len(idx.Blocks)-1, int64(len(data))
+	for br.Scan() {
+		block := br.Block()
+		if got, want := block.Index, next; got != want {
+			t.Fatalf("got %v, want %v", got, want)
+		}
+		start := end - int64(len(block.Data))
+		if got, want := block.DecompressedOffset, start; got != want {
+			t.Errorf("%v: got %v, want %v", block.Index, got, want)
+		}
+		if got, want := block.Data, data[start:end]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v..., want %v...", block.Index, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		next, end = next-1, start
+	}
+	if err := br.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if next != -1 || end != 0 {
+		t.Errorf("not all blocks were returned: %v, %v", next, end)
+	}
+
+	br = pbzip2.ReverseBlocks(ctx, bytes.NewReader(compressed), idx, pbzip2.ExpectDecompressedLength(end))
+	if br.Scan() {
+		t.Errorf("unexpected block")
+	}
+	if err := br.Err(); !errors.Is(err, pbzip2.ErrUnsupportedOption) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrUnsupportedOption)
+	}
+}
+
+func TestRangeReader(t *testing.T) {
+	ctx := context.Background()
+	compressed, data := concatFiles(t, "300KB1", "hello", "empty", "900KB2_Random")
+	idx, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	size := int64(len(data))
+	second, third := idx.Blocks[1].UncompressedOffset, idx.Blocks[2].UncompressedOffset
+	for _, tc := range []struct {
+		start, end int64
+		blocks     int
+	}{
+		// Spans two block boundaries.
+		{second - 100, third + 100, 3},
+		{0, 10, 1},
+		{second, third, 1},
+		{size - 10, size, 1},
+		{size - 10, size + 10, 1},
+		{10, 10, 0},
+	} {
+		cc := &countingCRC{}
+		rd := pbzip2.RangeReader(ctx, bytes.NewReader(compressed), idx, tc.start, tc.end, pbzip2.WithCRC(cc.new))
+		got, err := io.ReadAll(rd)
+		if err != nil {
+			t.Errorf("[%v, %v): %v", tc.start, tc.end, err)
+			continue
+		}
+		end := tc.end
+		if end > size {
+			end = size
+		}
+		if want := data[tc.start:end]; !bytes.Equal(got, want) {
+			t.Errorf("[%v, %v): got %v..., want %v...", tc.start, tc.end, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		if got, want := cc.n, tc.blocks; got != want {
+			t.Errorf("[%v, %v): got %v, want %v", tc.start, tc.end, got, want)
+		}
+	}
+
+	for _, tc := range []struct{ start, end int64 }{{-1, 10}, {10, 9}} {
+		rd := pbzip2.RangeReader(ctx, bytes.NewReader(compressed), idx, tc.start, tc.end)
+		if _, err := io.ReadAll(rd); err == nil {
+			t.Errorf("[%v, %v): expected an error", tc.start, tc.end)
+		}
+	}
+}
+
+func TestSectionReader(t *testing.T) {
+	ctx := context.Background()
+	compressed, data := concatFiles(t, "300KB1", "hello", "empty", "900KB2_Random")
+	idx, err := pbzip2.BuildIndex(ctx, bytes.NewReader(compressed), int64(len(compressed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// A section over the middle of the output, spanning several blocks.
+	off, n := int64(len(data)/4), int64(len(data)/2)
+	want := data[off : off+n]
+	sr := pbzip2.NewSectionReader(ctx, bytes.NewReader(compressed), idx, off, n)
+	if got, want := sr.Size(), n; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	got, err := io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+
+	// The section may also be read via io.SectionReader's own methods.
+	section := io.NewSectionReader(sr, 0, sr.Size())
+	got, err = io.ReadAll(section)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+
+	buf := make([]byte, 100)
+	for _, tc := range []struct {
+		off int64
+		n   int
+		err error
+	}{
+		{0, 100, nil},
+		{n / 2, 100, nil},
+		{n - 50, 50, io.EOF},
+		{n, 0, io.EOF},
+	} {
+		got, err := sr.ReadAt(buf, tc.off)
+		if got != tc.n || err != tc.err {
+			t.Errorf("%v: got %v, %v, want %v, %v", tc.off, got, err, tc.n, tc.err)
+		}
+		if want := want[tc.off : tc.off+int64(got)]; !bytes.Equal(buf[:got], want) {
+			t.Errorf("%v: got %v..., want %v...", tc.off, internal.FirstN(10, buf[:got]), internal.FirstN(10, want))
+		}
+	}
+
+	if pos, err := sr.Seek(-10, io.SeekEnd); err != nil || pos != n-10 {
+		t.Fatalf("got %v, %v, want %v", pos, err, n-10)
+	}
+	got, err = io.ReadAll(sr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := want[n-10:]; !bytes.Equal(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
@@ -172,7 +172,7 @@ func FindTrailingMagicAndCRC(buf []byte, trailer []byte) (crc []byte, length int
 	}
 	crc = make([]byte, 4)
 	aligned := buf[l-10:]
-	if idx := bytes.Index(aligned, trailer); idx == 0 {
+	if bytes.HasPrefix(aligned, trailer) {
 		copy(crc, aligned[6:10])
 		// 10 is 6 bits of magic and 4 of crc.
 		return crc, 10, 0
@@ -185,7 +185,7 @@ func FindTrailingMagicAndCRC(buf []byte, trailer []byte) (crc []byte, length int
 	for p := 0; p < 7; p++ {
 		// shift until all of the padding has been consumed
 		unaligned = ShiftRight(unaligned)
-		if idx := bytes.Index(unaligned[1:], trailer); idx == 0 {
+		if bytes.HasPrefix(unaligned[1:], trailer) {
 			copy(crc, unaligned[7:11])
 			return crc, 10, (7 - p)
 		}
@@ -130,8 +130,26 @@ func shifted(shift int) []byte {
 	}
 	return buf
 }
+
+var (
+	tableFinder       = bitstream.NewTableFinder(bzip2.BlockMagic)
+	accumulatorFinder = bitstream.NewAccumulatorFinder(bzip2.BlockMagic)
+)
+
+func finders() map[string]bitstream.MagicFinder {
+	return map[string]bitstream.MagicFinder{
+		"table":       tableFinder,
+		"accumulator": accumulatorFinder,
+	}
+}
+
 func TestFindPatterns(t *testing.T) {
-	pre, first, second := bitstream.Init(bzip2.BlockMagic)
+	for name, finder := range finders() {
+		testFindPatterns(t, name, finder)
+	}
+}
+
+func testFindPatterns(t *testing.T, name string, finder bitstream.MagicFinder) {
 	for i, tc := range []struct {
 		buf                   []byte
 		byteOffset, bitOffset int
@@ -148,12 +166,12 @@ func TestFindPatterns(t *testing.T) {
 		{append([]byte{0x0}, shifted(6)...), 1, 6},
 		{[]byte{0xa3, 0x14, 0x15, 0x92, 0x15, 0x94, 0x2b, 0xff, 0x31, 0x41, 0x59, 0x26, 0x53, 0x59}, 8, 0},
 	} {
-		byteOffset, bitOffset := bitstream.Scan(pre, first, second, tc.buf)
+		byteOffset, bitOffset := finder.Find(tc.buf)
 		if got, want := byteOffset, tc.byteOffset; got != want {
-			t.Errorf("%d: got %v, want %v", i, got, want)
+			t.Errorf("%v: %d: got %v, want %v", name, i, got, want)
 		}
 		if got, want := bitOffset, tc.bitOffset; got != want {
-			t.Errorf("%d: got %v, want %v", i, got, want)
+			t.Errorf("%v: %d: got %v, want %v", name, i, got, want)
 		}
 	}
 
@@ -162,11 +180,11 @@ func TestFindPatterns(t *testing.T) {
 		filler := make([]byte, i)
 		n, err := rnd.Read(filler)
 		if err != nil {
-			t.Errorf("%v: failed to %v rand bytes", i, err)
+			t.Errorf("%v: %v: failed to %v rand bytes", name, i, err)
 			continue
 		}
 		if got, want := n, i; got != want {
-			t.Errorf("%v: got %v, want %v", i, got, want)
+			t.Errorf("%v: %v: got %v, want %v", name, i, got, want)
 			continue
 		}
 		for p := 0; p < (i-6)*8; p++ {
@@ -175,20 +193,24 @@ func TestFindPatterns(t *testing.T) {
 			buf := make([]byte, i)
 			copy(buf, filler)
 			m := insertMagic(buf, bzip2.BlockMagic[:], p)
-			byteOffset, bitOffset := bitstream.Scan(pre, first, second, m)
+			byteOffset, bitOffset := finder.Find(m)
 			if got, want := byteOffset, p/8; got != want {
-				t.Fatalf("%v: %v: got %v, want %v", i, p, got, want)
+				t.Fatalf("%v: %v: %v: got %v, want %v", name, i, p, got, want)
 			}
 			if got, want := bitOffset, p%8; got != want {
-				t.Errorf("%v: %v: got %v, want %v", i, p, got, want)
+				t.Errorf("%v: %v: %v: got %v, want %v", name, i, p, got, want)
 			}
 		}
 	}
-
 }
 
 func TestPartialFalsePositives(t *testing.T) {
-	pre, first, second := bitstream.Init(bzip2.BlockMagic)
+	for name, finder := range finders() {
+		testPartialFalsePositives(t, name, finder)
+	}
+}
+
+func testPartialFalsePositives(t *testing.T, name string, finder bitstream.MagicFinder) {
 	// partial patterns
 	partial := [6][]byte{}
 	for i := range partial {
@@ -200,29 +222,68 @@ func TestPartialFalsePositives(t *testing.T) {
 	partial[5][5] &= 0xf7
 
 	for i, p := range partial {
-		byteOffset, bitOffset := bitstream.Scan(pre, first, second, p)
+		byteOffset, bitOffset := finder.Find(p)
 		if got, want := byteOffset, -1; got != want {
-			t.Errorf("%v: %v: got %v, want %v", i, p, got, want)
+			t.Errorf("%v: %v: %v: got %v, want %v", name, i, p, got, want)
 		}
 		if got, want := bitOffset, -1; got != want {
-			t.Errorf("%v: %v: got %v, want %v", i, p, got, want)
+			t.Errorf("%v: %v: %v: got %v, want %v", name, i, p, got, want)
 		}
 		tmp := make([]byte, len(p)+6)
 		copy(tmp, p)
 		for shift := 0; shift < 7; shift++ {
 			tmp = bitstream.ShiftRight(tmp)
 			copy(tmp[len(tmp)-6:], bzip2.BlockMagic[:])
-			byteOffset, bitOffset := bitstream.Scan(pre, first, second, tmp)
+			byteOffset, bitOffset := finder.Find(tmp)
 			if got, want := byteOffset, len(p); got != want {
-				t.Errorf("%v: %v: got %v, want %v", i, p, got, want)
+				t.Errorf("%v: %v: %v: got %v, want %v", name, i, p, got, want)
 			}
 			if got, want := bitOffset, 0; got != want {
-				t.Errorf("%v: %v: got %v, want %v", i, p, got, want)
+				t.Errorf("%v: %v: %v: got %v, want %v", name, i, p, got, want)
 			}
 		}
 	}
 }
 
+// compareFinders checks that all of the finders agree on every prefix of
+// buf, so as to exercise the cases where the magic number straddles the
+// end of the input, eg. at the end of a buffer read from a stream.
+func compareFinders(t *testing.T, buf []byte) {
+	for l := 0; l <= len(buf); l++ {
+		wb, ws := tableFinder.Find(buf[:l])
+		gb, gs := accumulatorFinder.Find(buf[:l])
+		if gb != wb || gs != ws {
+			t.Fatalf("%v: %02x: got %v, %v, want %v, %v", l, buf[:l], gb, gs, wb, ws)
+		}
+	}
+}
+
+func TestCompareFinders(t *testing.T) {
+	rnd := rand.New(rand.NewSource(time.Now().Unix()))
+	for i := 0; i < 1000; i++ {
+		buf := make([]byte, 6+rnd.Intn(32))
+		rnd.Read(buf)
+		if i%2 == 0 {
+			buf = insertMagic(buf, bzip2.BlockMagic[:], rnd.Intn((len(buf)-6)*8+1))
+		}
+		compareFinders(t, buf)
+	}
+}
+
+func BenchmarkFindMagic(b *testing.B) {
+	rnd := rand.New(rand.NewSource(0))
+	input := make([]byte, 1024*1024)
+	rnd.Read(input)
+	for name, finder := range finders() {
+		b.Run(name, func(b *testing.B) {
+			b.SetBytes(int64(len(input)))
+			for i := 0; i < b.N; i++ {
+				finder.Find(input)
+			}
+		})
+	}
+}
+
 func TestFindTrailer(t *testing.T) {
 	crc := []byte{0x01, 0x02, 0x03, 0x04}
 	end := 10
@@ -245,6 +306,32 @@ func TestFindTrailer(t *testing.T) {
 		}
 		end = 11
 	}
+
+	// The trailer should be found regardless of the value of the bits
+	// that precede it.
+	for i := 0; i < 8; i++ {
+		buf := make([]byte, 1+6+4+1)
+		buf[0] = 0xff
+		copy(buf[1:], bzip2.EOSMagic[:])
+		copy(buf[7:], crc)
+		for s := 0; s < i; s++ {
+			buf = bitstream.ShiftRight(buf)
+			buf[0] |= 0x80
+		}
+		if i == 0 {
+			buf = buf[:11]
+		}
+		found, length, offset := bitstream.FindTrailingMagicAndCRC(buf, bzip2.EOSMagic[:])
+		if got, want := found, crc; !bytes.Equal(got, want) {
+			t.Errorf("%v: got: %02x, want %02x\n", i, got, want)
+		}
+		if got, want := length, 10; got != want {
+			t.Errorf("%v: got: %02x, want %02x\n", i, got, want)
+		}
+		if got, want := offset, i; got != want {
+			t.Errorf("%v: got: %02x, want %02x\n", i, got, want)
+		}
+	}
 }
 
 var (
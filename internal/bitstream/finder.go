@@ -0,0 +1,123 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package bitstream
+
+import "encoding/binary"
+
+// MagicFinder locates a 48 bit magic number, such as the bzip2 block
+// magic, at any bit alignment in its input treating that input as a
+// bitstream.
+type MagicFinder interface {
+	// Find returns the offset of the byte containing the first bit of
+	// the first occurrence of the magic number in input and the bit
+	// offset within that byte, or -1, -1 if it does not occur in its
+	// entirety in input. See Scan.
+	Find(input []byte) (byteOffset, bitOffset int)
+}
+
+// NewTableFinder returns a MagicFinder that uses the lookup tables
+// created by Init and the Scan function.
+func NewTableFinder(magic [6]byte) MagicFinder {
+	f := &tableFinder{}
+	f.pretest, f.first, f.second = Init(magic)
+	return f
+}
+
+type tableFinder struct {
+	pretest       [256]bool
+	first, second map[uint32]uint8
+}
+
+// Find implements MagicFinder.
+func (f *tableFinder) Find(input []byte) (int, int) {
+	return Scan(f.pretest, f.first, f.second, input)
+}
+
+// NewAccumulatorFinder returns a MagicFinder that loads 64 bits of its
+// input at a time into an accumulator and compares each of the 8
+// possible alignments of the magic number against it using shifts and
+// a mask, rather than the map lookups used by Scan. Candidate positions
+// are located by examining only every fourth pair of bytes in the input.
+func NewAccumulatorFinder(magic [6]byte) MagicFinder {
+	f := &accumulatorFinder{}
+	var tmp [8]byte
+	copy(tmp[:], magic[:])
+	f.magic = binary.BigEndian.Uint64(tmp[:]) >> 16
+	for s := 0; s < 8; s++ {
+		// The magic number starting at bit offset s of the first byte.
+		v := f.magic << (16 - s)
+		// The second byte is always entirely occupied by the magic
+		// number, whatever its alignment, and is used to reject most
+		// of the candidate positions cheaply.
+		f.first[uint8(v>>48)] = true
+		// As are the four pairs of bytes that follow the first byte.
+		for j := 1; j <= 4; j++ {
+			pair := uint16(v >> (48 - 8*j))
+			f.pairs[pair/64] |= 1 << (pair % 64)
+		}
+	}
+	return f
+}
+
+type accumulatorFinder struct {
+	first [256]bool
+	pairs [65536 / 64]uint64 // bitset of the pairs of bytes in the magic number.
+	magic uint64             // the magic number in the low 48 bits.
+}
+
+const mask48 = 1<<48 - 1
+
+// Find implements MagicFinder.
+func (f *accumulatorFinder) Find(input []byte) (int, int) {
+	il := len(input)
+	// All positions before pos have been ruled out. Any occurrence of
+	// the magic number that starts in one of the bytes k-4..k-1 must
+	// contain input[k:k+2] as one of its interior pairs of bytes.
+	pos := 0
+	for k := 4; k+1 < il; k += 4 {
+		pair := uint16(input[k])<<8 | uint16(input[k+1])
+		if f.pairs[pair/64]&(1<<(pair%64)) == 0 {
+			pos = k
+			continue
+		}
+		for ; pos < k; pos++ {
+			if s := f.match(input, pos); s >= 0 {
+				return pos, s
+			}
+		}
+	}
+	for ; pos+6 <= il; pos++ {
+		if s := f.match(input, pos); s >= 0 {
+			return pos, s
+		}
+	}
+	return -1, -1
+}
+
+// match returns the bit offset of the magic number if it starts in the byte
+// at pos, or -1.
+func (f *accumulatorFinder) match(input []byte, pos int) int {
+	il := len(input)
+	if pos+6 > il || !f.first[input[pos+1]] {
+		return -1
+	}
+	var acc uint64
+	if pos+8 <= il {
+		acc = binary.BigEndian.Uint64(input[pos:])
+	} else {
+		var tmp [8]byte
+		copy(tmp[:], input[pos:])
+		acc = binary.BigEndian.Uint64(tmp[:])
+	}
+	// The magic number is in the 48 bits starting at bit offset s from
+	// the most significant bit of acc, only 8*(il-pos) of which are valid
+	// when near the end of the input.
+	for s := 0; s < 8 && s+48 <= 8*(il-pos); s++ {
+		if (acc>>(16-s))&mask48 == f.magic {
+			return s
+		}
+	}
+	return -1
+}
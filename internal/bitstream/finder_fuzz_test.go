@@ -0,0 +1,27 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build go1.18
+// +build go1.18
+
+package bitstream_test
+
+import (
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
+)
+
+func FuzzFinders(f *testing.F) {
+	f.Add([]byte{}, uint(0))
+	f.Add(bzip2.BlockMagic[:], uint(0))
+	f.Add(append([]byte{0x0}, shifted(7)...), uint(0))
+	f.Add([]byte{0xa3, 0x14, 0x15, 0x92, 0x15, 0x94, 0x2b, 0xff, 0x31, 0x41, 0x59, 0x26, 0x53}, uint(17))
+	f.Fuzz(func(t *testing.T, buf []byte, offset uint) {
+		if len(buf) >= 6 && offset%2 == 0 {
+			buf = insertMagic(buf, bzip2.BlockMagic[:], int(offset/2)%((len(buf)-6)*8+1))
+		}
+		compareFinders(t, buf)
+	})
+}
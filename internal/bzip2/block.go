@@ -6,8 +6,9 @@ package bzip2
 
 import (
 	"bytes"
-	"fmt"
+	"hash"
 	"io"
+	"sync"
 )
 
 var (
@@ -19,13 +20,75 @@ var (
 
 	// EOSMagic is the magic number for each bzip end of stream block.
 	EOSMagic = [6]byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}
+
+	// ErrBlockChecksum is returned when the CRC of a decoded block does
+	// not match that stored in the block header.
+	ErrBlockChecksum = StructuralError("block checksum mismatch")
+
+	// ErrEmptyBlock is returned when a block contains no data, which
+	// bzip2 never produces.
+	ErrEmptyBlock = StructuralError("block contains no data")
+
+	// ErrBlockSize and ErrRepeatsPastEnd are returned when a block
+	// contains more data than allowed by its declared block size.
+	ErrBlockSize      = StructuralError("data exceeds block size")
+	ErrRepeatsPastEnd = StructuralError("repeats past end of block")
 )
 
+// ttPool is used to reuse the tt arrays, which at 4 bytes per byte of
+// block size are the largest allocation needed to decode a block, across
+// BlockReaders. This reduces the garbage generated by decoding each block,
+// but not the memory in use whilst a block is being decoded, which is only
+// reduced by NewSmallBlockReader.
+var ttPool sync.Pool
+
+func getTT(blockSize int) []uint32 {
+	if tt, ok := ttPool.Get().(*[]uint32); ok && cap(*tt) >= blockSize {
+		return (*tt)[:blockSize]
+	}
+	return make([]uint32, blockSize)
+}
+
+func putTT(tt []uint32) {
+	if tt != nil {
+		ttPool.Put(&tt)
+	}
+}
+
+// growTT returns tt grown to n entries, preserving its contents.
+func growTT(tt []uint32, n int) []uint32 {
+	if cap(tt) >= n {
+		return tt[:n]
+	}
+	grown := make([]uint32, n)
+	copy(grown, tt)
+	return grown
+}
+
+// minGrowableTT is the smallest initial size of a tt array that is grown
+// as needed, see SetGrowableTables.
+const minGrowableTT = 4096
+
+// growableTTSize returns the initial size of a tt array that is grown as
+// needed for a block of srcLen compressed bytes, see SetGrowableTables.
+func growableTTSize(blockSize, srcLen int) int {
+	n := 8 * srcLen
+	if n < minGrowableTT {
+		n = minGrowableTT
+	}
+	if n > blockSize {
+		n = blockSize
+	}
+	return n
+}
+
 // BlockReader represents an io.Reader that can read a single bzip2 block.
 type BlockReader struct {
 	underlying *reader
 	first      bool
 	start      uint
+	srcLen     int
+	growable   bool // set by SetGrowableTables.
 	err        error
 }
 
@@ -39,9 +102,189 @@ func NewBlockReader(blockSize int, src []byte, start int) io.Reader {
 	bz2.fileCRC = 0
 	bz2.setupDone = true
 	bz2.blockSize = blockSize
-	bz2.tt = make([]uint32, bz2.blockSize)
 	bz2.br = newBitReader(bytes.NewBuffer(src))
-	return &BlockReader{underlying: bz2, first: true, start: uint(start)}
+	// tt is allocated by the first Read, see SetGrowableTables.
+	return &BlockReader{underlying: bz2, first: true, start: uint(start), srcLen: len(src)}
+}
+
+// ReadAll reads the entire block. The buffer used for the output is
+// allocated according to the size of the block once its entropy coding has
+// been decoded, rather than the maximum block size declared by the stream,
+// and grown as needed. This avoids allocating large buffers for small
+// blocks or for corrupt or malicious inputs.
+func (br *BlockReader) ReadAll() ([]byte, error) {
+	return br.ReadAllInto(nil)
+}
+
+// ReadAllInto is like ReadAll except that the block is decoded directly
+// into dst, from its start and without allocating, if the capacity of
+// dst is at least the size that ReadAll would allocate. Otherwise dst is
+// not used, since the output would typically have to be copied to an
+// allocated buffer part way through.
+func (br *BlockReader) ReadAllInto(dst []byte) ([]byte, error) {
+	// The first Read with an empty buffer decodes the block.
+	if _, err := br.Read(nil); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	// The final run length decoding typically expands the block
+	// slightly, so allow some headroom to avoid having to grow
+	// the buffer.
+	size := br.underlying.preRLELen
+	size += size / 16
+	buf := dst[:0]
+	if cap(buf) < size {
+		buf = make([]byte, 0, size)
+	}
+	for {
+		if len(buf) == cap(buf) {
+			buf = append(buf, 0)[:len(buf)]
+		}
+		n, err := br.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			return buf, err
+		}
+	}
+}
+
+// ReadAllUsing is like ReadAll except that the buffer used for the output
+// is obtained by calling alloc, with the size that ReadAll would allocate.
+// If the output exceeds the capacity of that buffer a larger one is
+// obtained from alloc, the output copied to it and the smaller one passed
+// to free. The buffer is passed to free, and nil returned, if the block
+// cannot be read, otherwise ownership of it passes to the caller.
+func (br *BlockReader) ReadAllUsing(alloc func(size int) []byte, free func([]byte)) ([]byte, error) {
+	if _, err := br.Read(nil); err != nil {
+		if err == io.EOF {
+			return nil, nil
+		}
+		return nil, err
+	}
+	size := br.underlying.preRLELen
+	buf := alloc(size + size/16)[:0]
+	for {
+		if len(buf) == cap(buf) {
+			// Only grow the buffer if there is more output.
+			var next [1]byte
+			if _, err := br.Read(next[:]); err != nil {
+				if err == io.EOF {
+					return buf, nil
+				}
+				free(buf)
+				return nil, err
+			}
+			grown := alloc(2*cap(buf) + 1)[:len(buf)]
+			copy(grown, buf)
+			free(buf)
+			buf = append(grown, next[0])
+		}
+		n, err := br.Read(buf[len(buf):cap(buf)])
+		buf = buf[:len(buf)+n]
+		if err == io.EOF {
+			return buf, nil
+		}
+		if err != nil {
+			free(buf)
+			return nil, err
+		}
+	}
+}
+
+// BlockReaderStats returns the statistics gathered for the block read by r,
+// which must have been created by NewBlockReader.
+func BlockReaderStats(r io.Reader) BlockStats {
+	if br, ok := r.(*BlockReader); ok && br.underlying != nil {
+		return br.underlying.blockStats
+	}
+	return BlockStats{}
+}
+
+// ComputedBlockCRC returns the CRC computed for the output of the block
+// read by r, which must have been created by NewBlockReader or
+// NewSmallBlockReader. It is only meaningful once r has been read to
+// completion or has returned ErrBlockChecksum.
+func ComputedBlockCRC(r io.Reader) uint32 {
+	if br, ok := r.(*BlockReader); ok && br.underlying != nil {
+		return br.underlying.blockCRC
+	}
+	return 0
+}
+
+// SetMaxHuffmanTrees allows the block read by r, which must have been
+// created by NewBlockReader or NewSmallBlockReader, to use between 1 and
+// the larger of 6 and max Huffman trees rather than the 2 to 6 allowed by
+// bzip2. A max of zero restores the standard bounds. It must be called
+// before r is read.
+func SetMaxHuffmanTrees(r io.Reader, max int) {
+	if br, ok := r.(*BlockReader); ok && br.underlying != nil {
+		br.underlying.maxTrees = max
+	}
+}
+
+// SetMTFShiftThreshold sets the distance below which symbols are moved to
+// the front of the move-to-front list used to decode the block read by r,
+// which must have been created by NewBlockReader or NewSmallBlockReader,
+// by shifting the symbols ahead of them one at a time rather than by
+// copy. The default of zero always uses copy. It must be called before r
+// is read.
+func SetMTFShiftThreshold(r io.Reader, n int) {
+	if br, ok := r.(*BlockReader); ok && br.underlying != nil {
+		br.underlying.mtfThreshold = n
+	}
+}
+
+// SetBlockCRC requests that the CRC of the block read by r, which must
+// have been created by NewBlockReader or NewSmallBlockReader, be computed
+// using crc rather than the CRC used by bzip2. crc must be newly created
+// or reset and must not be used concurrently. It must be called before r
+// is read.
+func SetBlockCRC(r io.Reader, crc hash.Hash32) {
+	if br, ok := r.(*BlockReader); ok && br.underlying != nil {
+		br.underlying.crc = crc
+	}
+}
+
+// SetAllowOversizeBlocks allows the block read by r, which must have been
+// created by NewBlockReader or NewSmallBlockReader, to exceed the declared
+// block size by up to an eighth of that size, as produced by some broken
+// encoders. It must be called before r is read.
+func SetAllowOversizeBlocks(r io.Reader, v bool) {
+	if br, ok := r.(*BlockReader); ok && br.underlying != nil {
+		br.underlying.oversize = v
+	}
+}
+
+// SetGrowableTables requests that the table used for the inverse BWT of
+// the block read by r, which must have been created by NewBlockReader, be
+// sized according to the amount of data in the block, starting with a size
+// proportional to that of the compressed block and doubling as the block
+// is decoded, rather than being sized for the block size declared by the
+// stream. This reduces the memory required to decode blocks that are much
+// smaller than their declared size, at the cost of copying the table as it
+// grows. It must be called before r is read.
+func SetGrowableTables(r io.Reader, v bool) {
+	if br, ok := r.(*BlockReader); ok && br.underlying != nil {
+		br.growable = v
+	}
+}
+
+// release returns the tt array to the pool once the block has been
+// read, or has failed to be read, since it is no longer needed.
+func (br *BlockReader) release(err error) {
+	br.err = err
+	if br.underlying.small != nil {
+		smallPool.Put(br.underlying.small)
+		br.underlying.small = nil
+		return
+	}
+	putTT(br.underlying.tt)
+	br.underlying.tt, br.underlying.preRLE = nil, nil
 }
 
 // Read implements io.Reader.
@@ -50,21 +293,38 @@ func (br *BlockReader) Read(buf []byte) (n int, err error) {
 		return 0, br.err
 	}
 	if br.first {
+		if u := br.underlying; u.small == nil && u.tt == nil {
+			size := u.blockSize
+			if br.growable {
+				size = growableTTSize(size, br.srcLen)
+			}
+			u.tt = getTT(size)
+		}
 		// skip to the start of the block.
 		br.underlying.br.ReadBits(br.start)
 		// We know we're at the start of a block.
 		if err := br.underlying.readBlock(); err != nil {
+			br.release(err)
 			return 0, err
 		}
 		br.first = false
 	}
 	n = br.underlying.readFromBlock(buf)
 	if n > 0 || len(buf) == 0 {
-		br.underlying.blockCRC = updateCRC(br.underlying.blockCRC, buf[:n])
+		if crc := br.underlying.crc; crc != nil {
+			crc.Write(buf[:n])
+		} else {
+			br.underlying.blockCRC = updateCRC(br.underlying.blockCRC, buf[:n])
+		}
 		return n, nil
 	}
+	if crc := br.underlying.crc; crc != nil {
+		br.underlying.blockCRC = crc.Sum32()
+	}
 	if br.underlying.blockCRC != br.underlying.wantBlockCRC {
-		return 0, fmt.Errorf("block checksum mismatch")
+		br.release(ErrBlockChecksum)
+		return 0, ErrBlockChecksum
 	}
+	br.release(io.EOF)
 	return n, io.EOF
 }
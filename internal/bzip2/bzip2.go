@@ -6,6 +6,7 @@
 package bzip2
 
 import (
+	"hash"
 	"io"
 )
 
@@ -31,18 +32,30 @@ type reader struct {
 	setupDone    bool // true if we have parsed the bzip2 header.
 	blockSize    int  // blockSize in bytes, i.e. 900 * 1000.
 	eof          bool
-	c            [256]uint // the `C' array for the inverse BWT.
-	tt           []uint32  // mirrors the `tt' array in the bzip2 source and contains the P array in the upper 24 bits.
-	tPos         uint32    // Index of the next output byte in tt.
+	c            [256]uint    // the `C' array for the inverse BWT.
+	tt           []uint32     // mirrors the `tt' array in the bzip2 source and contains the P array in the upper 24 bits.
+	tPos         uint32       // Index of the next output byte in tt.
+	small        *smallTables // used instead of tt and preRLE if set.
 
 	preRLE      []uint32 // contains the RLE data still to be processed.
+	preRLELen   int      // number of entries in preRLE, or small.
 	preRLEUsed  int      // number of entries of preRLE used.
 	lastByte    int      // the last byte value seen.
 	byteRepeats uint     // the number of repeats of lastByte seen.
 	repeats     uint     // the number of copies of lastByte to output.
 
+	randomized *randomizer // set if the current block is randomised.
+
 	recordStats bool
 	stats       Stats
+	blockStats  BlockStats
+
+	maxTrees int  // if non-zero, the lenient upper bound on the number of Huffman trees.
+	oversize bool // set if blocks may exceed the declared block size.
+
+	mtfThreshold int // see SetMTFShiftThreshold.
+
+	crc hash.Hash32 // if set, used instead of updateCRC for the block CRC.
 }
 
 // Stats contains the offset and crc information for the decoded stream.
@@ -54,6 +67,16 @@ type Stats struct {
 	StreamCRC         uint32
 }
 
+// BlockStats contains information on the structure of a single block
+// gathered as it is decoded.
+type BlockStats struct {
+	HuffmanTrees int   // Number of Huffman trees used by the block, 2..6.
+	Selectors    int   // Number of tree selectors, one per 50 symbols.
+	Symbols      int   // Number of distinct byte values in the block.
+	SymbolCounts []int // Number of times each Huffman coded symbol, ie. RUNA, RUNB, the MTF indices and EOB, was decoded.
+	Size         int   // Number of bytes in the block prior to the inverse BWT.
+}
+
 // NewReader returns an io.Reader which decompresses bzip2 data from r.
 // If r does not also implement io.ByteReader,
 // the decompressor may read more data than necessary from r.
@@ -145,7 +168,7 @@ func (bz2 *reader) readFromBlock(buf []byte) int {
 	// maximum expansion. Thus we process blocks all at once, except for
 	// the RLE which we decompress as required.
 	n := 0
-	for (bz2.repeats > 0 || bz2.preRLEUsed < len(bz2.preRLE)) && n < len(buf) {
+	for (bz2.repeats > 0 || bz2.preRLEUsed < bz2.preRLELen) && n < len(buf) {
 		// We have RLE data pending.
 
 		// The run-length encoding works like this:
@@ -165,10 +188,19 @@ func (bz2 *reader) readFromBlock(buf []byte) int {
 			continue
 		}
 
-		bz2.tPos = bz2.preRLE[bz2.tPos]
-		b := byte(bz2.tPos)
-		bz2.tPos >>= 8
+		var b byte
+		if bz2.small != nil {
+			b = bz2.small.indexIntoF(bz2.tPos)
+			bz2.tPos = bz2.small.get(bz2.tPos)
+		} else {
+			bz2.tPos = bz2.preRLE[bz2.tPos]
+			b = byte(bz2.tPos)
+			bz2.tPos >>= 8
+		}
 		bz2.preRLEUsed++
+		if bz2.randomized != nil {
+			b ^= bz2.randomized.mask()
+		}
 
 		if bz2.byteRepeats == 3 {
 			bz2.repeats = uint(b)
@@ -201,7 +233,7 @@ func (bz2 *reader) read(buf []byte) (int, error) {
 
 		// End of block. Check CRC.
 		if bz2.blockCRC != bz2.wantBlockCRC {
-			bz2.br.err = StructuralError("block checksum mismatch")
+			bz2.br.err = ErrBlockChecksum
 			return 0, bz2.br.err
 		}
 		if bz2.recordStats {
@@ -280,16 +312,18 @@ func (bz2 *reader) read(buf []byte) (int, error) {
 }
 
 // readBlock reads a bzip2 block. The magic number should already have been consumed.
+//
 //nolint:gocyclo
 func (bz2 *reader) readBlock() (err error) {
 	br := &bz2.br
 	bz2.wantBlockCRC = uint32(br.ReadBits64(32)) // skip checksum. TODO: check it if we can figure out what it is.
 	bz2.blockCRC = 0
 	bz2.fileCRC = (bz2.fileCRC<<1 | bz2.fileCRC>>31) ^ bz2.wantBlockCRC
-	randomized := br.ReadBits(1)
-	if randomized != 0 {
-		return StructuralError("deprecated randomized files")
-	}
+	// Randomisation is long deprecated and no longer produced by bzip2,
+	// but is still supported when decompressing. It is a property of
+	// each block and hence streams may contain a mix of randomised and
+	// non-randomised blocks.
+	randomized := br.ReadBits(1) != 0
 	origPtr := uint(br.ReadBits(24))
 
 	// If not every byte value is used in the block (i.e., it's text) then
@@ -315,9 +349,17 @@ func (bz2 *reader) readBlock() (err error) {
 		return StructuralError("no symbols in input")
 	}
 
-	// A block uses between two and six different Huffman trees.
+	// A block uses between two and six different Huffman trees, the
+	// lenient bounds only ever widen that range.
 	numHuffmanTrees := br.ReadBits(3)
-	if numHuffmanTrees < 2 || numHuffmanTrees > 6 {
+	minTrees, maxTrees := 2, 6
+	if bz2.maxTrees > 0 {
+		minTrees = 1
+		if bz2.maxTrees > maxTrees {
+			maxTrees = bz2.maxTrees
+		}
+	}
+	if numHuffmanTrees < minTrees || numHuffmanTrees > maxTrees {
 		return StructuralError("invalid number of Huffman trees")
 	}
 
@@ -356,8 +398,16 @@ func (bz2 *reader) readBlock() (err error) {
 	}
 	mtf := newMTFDecoder(symbols)
 
+	bz2.blockStats = BlockStats{
+		HuffmanTrees: int(numHuffmanTrees),
+		Selectors:    int(numSelectors),
+		Symbols:      numSymbols,
+	}
+
 	numSymbols += 2 // to account for RUNA and RUNB symbols
 	huffmanTrees := make([]huffmanTree, numHuffmanTrees)
+	symbolCounts := make([]int, numSymbols)
+	bz2.blockStats.SymbolCounts = symbolCounts
 
 	// Now we decode the arrays of code-lengths for each tree.
 	lengths := make([]uint8, numSymbols)
@@ -395,6 +445,14 @@ func (bz2 *reader) readBlock() (err error) {
 	}
 	currentHuffmanTree := huffmanTrees[treeIndexes[0]]
 	bufIndex := 0 // indexes bz2.buf, the output buffer.
+	// size is the number of bytes the block may contain, it can only exceed
+	// the declared block size if oversize blocks are allowed. It is
+	// smaller than the declared block size whilst tt is being grown as
+	// needed, see SetGrowableTables.
+	size := bz2.blockSize
+	if bz2.small == nil && len(bz2.tt) < size {
+		size = len(bz2.tt)
+	}
 	// The output of the move-to-front transform is run-length encoded and
 	// we merge the decoding into the Huffman parsing loop. These two
 	// variables accumulate the repeat count. See the Wikipedia page for
@@ -423,6 +481,7 @@ func (bz2 *reader) readBlock() (err error) {
 
 		v := currentHuffmanTree.Decode(br)
 		decoded++
+		symbolCounts[v]++
 
 		if v < 2 {
 			// This is either the RUNA or RUNB symbol.
@@ -443,12 +502,20 @@ func (bz2 *reader) readBlock() (err error) {
 		if repeat > 0 {
 			// We have decoded a complete run-length so we need to
 			// replicate the last output symbol.
-			if repeat > bz2.blockSize-bufIndex {
-				return StructuralError("repeats past end of block")
+			for repeat > size-bufIndex {
+				grown := bz2.grow()
+				if grown == size {
+					return ErrRepeatsPastEnd
+				}
+				size = grown
 			}
 			for i := 0; i < repeat; i++ {
 				b := mtf.First()
-				bz2.tt[bufIndex] = uint32(b)
+				if bz2.small != nil {
+					bz2.small.ll16[bufIndex] = uint16(b)
+				} else {
+					bz2.tt[bufIndex] = uint32(b)
+				}
 				bz2.c[b]++
 				bufIndex++
 			}
@@ -468,31 +535,85 @@ func (bz2 *reader) readBlock() (err error) {
 		// it's always referenced with a run-length of 1. Thus 0
 		// doesn't need to be encoded and we have |v-1| in the next
 		// line.
-		b := mtf.Decode(int(v - 1))
-		if bufIndex >= bz2.blockSize {
-			return StructuralError("data exceeds block size")
+		b := mtf.DecodeWithThreshold(int(v-1), bz2.mtfThreshold)
+		if bufIndex >= size {
+			if size = bz2.grow(); bufIndex >= size {
+				return ErrBlockSize
+			}
+		}
+		if bz2.small != nil {
+			bz2.small.ll16[bufIndex] = uint16(b)
+		} else {
+			bz2.tt[bufIndex] = uint32(b)
 		}
-		bz2.tt[bufIndex] = uint32(b)
 		bz2.c[b]++
 		bufIndex++
 	}
 
+	if bufIndex == 0 {
+		return ErrEmptyBlock
+	}
 	if origPtr >= uint(bufIndex) {
 		return StructuralError("origPtr out of bounds")
 	}
 
 	// We have completed the entropy decoding. Now we can perform the
 	// inverse BWT and setup the RLE buffer.
-	bz2.preRLE = bz2.tt[:bufIndex]
+	bz2.blockStats.Size = bufIndex
+	bz2.preRLELen = bufIndex
 	bz2.preRLEUsed = 0
-	bz2.tPos = inverseBWT(bz2.preRLE, origPtr, bz2.c[:])
+	if bz2.small != nil {
+		bz2.tPos = bz2.small.inverseBWT(bufIndex, origPtr, bz2.c[:])
+	} else {
+		bz2.preRLE = bz2.tt[:bufIndex]
+		bz2.tPos = inverseBWT(bz2.preRLE, origPtr, bz2.c[:])
+	}
 	bz2.lastByte = -1
 	bz2.byteRepeats = 0
 	bz2.repeats = 0
+	bz2.randomized = nil
+	if randomized {
+		bz2.randomized = &randomizer{}
+	}
 
 	return nil
 }
 
+// oversizeFraction determines the hard limit on the size of blocks that
+// are allowed to exceed their declared size, see SetAllowOversizeBlocks,
+// as a fraction of the declared size. The limit must ensure that the
+// indices used by the inverse BWT fit in 24 bits, or 20 bits for the
+// small memory tables, for the largest block size of 900KB.
+const oversizeFraction = 8
+
+// grow grows the tables used for the inverse BWT, doubling tt up to the
+// declared block size if it is being grown as needed, see
+// SetGrowableTables, or to accommodate a block that exceeds its declared
+// size, if allowed, and returns the number of bytes that the block may
+// contain.
+func (bz2 *reader) grow() int {
+	if bz2.small == nil && len(bz2.tt) < bz2.blockSize {
+		n := 2 * len(bz2.tt)
+		if n > bz2.blockSize {
+			n = bz2.blockSize
+		}
+		bz2.tt = growTT(bz2.tt, n)
+		return n
+	}
+	if !bz2.oversize {
+		return bz2.blockSize
+	}
+	limit := bz2.blockSize + bz2.blockSize/oversizeFraction
+	if bz2.small != nil {
+		bz2.small.grow(limit)
+		return limit
+	}
+	if len(bz2.tt) < limit {
+		bz2.tt = growTT(bz2.tt, limit)
+	}
+	return limit
+}
+
 // inverseBWT implements the inverse Burrows-Wheeler transform as described in
 // http://www.hpl.hp.com/techreports/Compaq-DEC/SRC-RR-124.pdf, section 4.2.
 // In that document, origPtr is called `I' and c is the `C' array after the
@@ -9,6 +9,7 @@ import (
 	"encoding/hex"
 	"fmt"
 	"io"
+	"math/rand"
 	"os"
 	"testing"
 )
@@ -94,6 +95,10 @@ func TestReader(t *testing.T) {
 			"9e6c2a2bd4f5f88db07ecd0da3a33b263483db9b2c158786ad6363be35d17335" +
 			"ba",
 		),
+	}, {
+		desc:   "mixed randomised and non-randomised blocks",
+		input:  mustLoadFile("testdata/mixed-randomized.bz2"),
+		output: mustLoadFile("testdata/mixed-randomized.txt"),
 	}, {
 		desc:  "1MiB sawtooth",
 		input: mustLoadFile("testdata/pass-sawtooth.bz2"),
@@ -204,6 +209,101 @@ func TestMTF(t *testing.T) {
 	}
 }
 
+// mtfIndices returns n pseudo-random move-to-front indices less than
+// size. If skewed is set the indices are exponentially distributed, as is
+// typical for the output of the BWT, otherwise they are uniform.
+func mtfIndices(n, size int, skewed bool) []int {
+	rnd := rand.New(rand.NewSource(1))
+	indices := make([]int, n)
+	for i := range indices {
+		if !skewed {
+			indices[i] = rnd.Intn(size)
+			continue
+		}
+		v := int(rnd.ExpFloat64() * 4)
+		if v >= size {
+			v = size - 1
+		}
+		indices[i] = v
+	}
+	return indices
+}
+
+// referenceMTF is a straightforward implementation of a move-to-front
+// list used to validate moveToFrontDecoder.
+type referenceMTF []byte
+
+func (m *referenceMTF) Decode(n int) byte {
+	b := (*m)[n]
+	rest := append(append([]byte{}, (*m)[:n]...), (*m)[n+1:]...)
+	*m = append([]byte{b}, rest...)
+	return b
+}
+
+func TestMTFReference(t *testing.T) {
+	for _, size := range []int{2, 6, 17, 256} {
+		for _, skewed := range []bool{false, true} {
+			for _, threshold := range mtfThresholds {
+				mtf := newMTFDecoderWithRange(size)
+				ref := referenceMTF(append([]byte{}, mtf...))
+				for i, n := range mtfIndices(10000, size, skewed) {
+					if got, want := mtf.DecodeWithThreshold(n, threshold), ref.Decode(n); got != want {
+						t.Fatalf("size %v: skewed %v: threshold %v: index %v: Decode(%v): got %v, want %v", size, skewed, threshold, i, n, got, want)
+					}
+				}
+				if got, want := []byte(mtf), []byte(ref); !bytes.Equal(got, want) {
+					t.Errorf("size %v: skewed %v: threshold %v: got %v, want %v", size, skewed, threshold, got, want)
+				}
+			}
+		}
+	}
+}
+
+// mtfThresholds are the thresholds benchmarked for SetMTFShiftThreshold.
+var mtfThresholds = []int{0, 4, 8, 16, 32}
+
+func BenchmarkMTFDecode(b *testing.B) {
+	for _, skewed := range []bool{false, true} {
+		indices := mtfIndices(1<<16, 256, skewed)
+		for _, threshold := range mtfThresholds {
+			b.Run(fmt.Sprintf("skewed=%v/threshold=%v", skewed, threshold), func(b *testing.B) {
+				mtf := newMTFDecoderWithRange(256)
+				b.SetBytes(int64(len(indices)))
+				for i := 0; i < b.N; i++ {
+					for _, n := range indices {
+						mtf.DecodeWithThreshold(n, threshold)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkMTFShiftThreshold(b *testing.B) {
+	for _, tc := range []struct {
+		name       string
+		compressed []byte
+	}{
+		{"newton", newton},
+		{"digits", digits},
+	} {
+		size, err := io.Copy(io.Discard, NewReader(bytes.NewReader(tc.compressed)))
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, threshold := range mtfThresholds {
+			b.Run(fmt.Sprintf("%v/threshold=%v", tc.name, threshold), func(b *testing.B) {
+				b.SetBytes(size)
+				for i := 0; i < b.N; i++ {
+					rd := NewReader(bytes.NewReader(tc.compressed))
+					rd.(*reader).mtfThreshold = threshold
+					io.Copy(io.Discard, rd)
+				}
+			})
+		}
+	}
+}
+
 func TestZeroRead(t *testing.T) {
 	b := mustDecodeHex("425a6839314159265359b5aa5098000000600040000004200021008283177245385090b5aa5098")
 	r := NewReader(bytes.NewReader(b))
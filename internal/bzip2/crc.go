@@ -0,0 +1,32 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package bzip2
+
+import "hash"
+
+// crcHash implements hash.Hash32 for the CRC used by bzip2, see updateCRC.
+type crcHash struct {
+	crc uint32
+}
+
+// NewCRC returns a hash.Hash32 that computes the CRC used by bzip2.
+func NewCRC() hash.Hash32 {
+	return &crcHash{}
+}
+
+func (h *crcHash) Write(p []byte) (int, error) {
+	h.crc = updateCRC(h.crc, p)
+	return len(p), nil
+}
+
+func (h *crcHash) Sum(b []byte) []byte {
+	s := h.crc
+	return append(b, byte(s>>24), byte(s>>16), byte(s>>8), byte(s))
+}
+
+func (h *crcHash) Sum32() uint32  { return h.crc }
+func (h *crcHash) Reset()         { h.crc = 0 }
+func (h *crcHash) Size() int      { return 4 }
+func (h *crcHash) BlockSize() int { return 1 }
@@ -47,6 +47,22 @@ func (m moveToFrontDecoder) Decode(n int) (b byte) {
 	return
 }
 
+// DecodeWithThreshold is like Decode except that if n is less than
+// threshold the symbols ahead of the n'th are shifted one at a time rather
+// than by copy, which may be faster for the small values of n that are
+// typical of the output of the BWT, see SetMTFShiftThreshold.
+func (m moveToFrontDecoder) DecodeWithThreshold(n, threshold int) (b byte) {
+	if n >= threshold {
+		return m.Decode(n)
+	}
+	b = m[n]
+	for ; n > 0; n-- {
+		m[n] = m[n-1]
+	}
+	m[0] = b
+	return
+}
+
 // First returns the symbol at the front of the list.
 func (m moveToFrontDecoder) First() byte {
 	return m[0]
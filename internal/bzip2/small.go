@@ -0,0 +1,116 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package bzip2
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// smallTables implements the small memory inverse BWT used by the bzip2
+// -s option. Rather than storing each byte and the index of its successor
+// in a uint32, only the 20 bit index is stored, split across ll16 and
+// the nibbles of ll4, for a total of 2.5 bytes per byte of block size.
+// Each byte is instead recovered from its index via a binary search of
+// cftab, the cumulative counts of each byte value.
+type smallTables struct {
+	ll16  []uint16
+	ll4   []byte
+	cftab [257]uint32
+}
+
+var smallPool sync.Pool
+
+func getSmallTables(blockSize int) *smallTables {
+	if st, ok := smallPool.Get().(*smallTables); ok && cap(st.ll16) >= blockSize {
+		st.ll16, st.ll4 = st.ll16[:blockSize], st.ll4[:(blockSize+1)/2]
+		return st
+	}
+	return &smallTables{
+		ll16: make([]uint16, blockSize),
+		ll4:  make([]byte, (blockSize+1)/2),
+	}
+}
+
+// grow ensures that the tables can hold at least n bytes.
+func (st *smallTables) grow(n int) {
+	if len(st.ll16) >= n {
+		return
+	}
+	ll16, ll4 := make([]uint16, n), make([]byte, (n+1)/2)
+	copy(ll16, st.ll16)
+	copy(ll4, st.ll4)
+	st.ll16, st.ll4 = ll16, ll4
+}
+
+func (st *smallTables) get(i uint32) uint32 {
+	return uint32(st.ll16[i]) | uint32((st.ll4[i>>1]>>((i&1)<<2))&0xf)<<16
+}
+
+func (st *smallTables) set(i, v uint32) {
+	st.ll16[i] = uint16(v)
+	shift := (i & 1) << 2
+	st.ll4[i>>1] = st.ll4[i>>1]&^(0xf<<shift) | byte((v>>16)&0xf)<<shift
+}
+
+// indexIntoF returns the byte at position i of the sorted block.
+func (st *smallTables) indexIntoF(i uint32) byte {
+	lo, hi := 0, 256
+	for hi-lo > 1 {
+		mid := (lo + hi) >> 1
+		if i >= st.cftab[mid] {
+			lo = mid
+		} else {
+			hi = mid
+		}
+	}
+	return byte(lo)
+}
+
+// inverseBWT is the equivalent of the package level inverseBWT for the
+// n bytes stored in ll16. It first replaces each byte with the position
+// of that byte in the sorted block, that is, the inverse of the T vector,
+// and then reverses that permutation in place to obtain T. The position
+// of the first byte is returned.
+func (st *smallTables) inverseBWT(n int, origPtr uint, c []uint) uint32 {
+	st.cftab[0] = 0
+	for i := 0; i < 256; i++ {
+		st.cftab[i+1] = st.cftab[i] + uint32(c[i])
+	}
+	var next [256]uint32
+	copy(next[:], st.cftab[:256])
+	for i := 0; i < n; i++ {
+		b := st.ll16[i]
+		st.set(uint32(i), next[b])
+		next[b]++
+	}
+	i := uint32(origPtr)
+	j := st.get(i)
+	for {
+		tmp := st.get(j)
+		st.set(j, i)
+		i, j = j, tmp
+		if i == uint32(origPtr) {
+			break
+		}
+	}
+	return uint32(origPtr)
+}
+
+// NewSmallBlockReader is like NewBlockReader except that it uses the
+// slower, small memory, inverse BWT that requires 2.5 rather than 4 bytes
+// per byte of block size.
+func NewSmallBlockReader(blockSize int, src []byte, start int) io.Reader {
+	if len(src) == 0 {
+		return &BlockReader{err: io.EOF}
+	}
+	bz2 := new(reader)
+	bz2.setupDone = true
+	bz2.blockSize = blockSize
+	bz2.small = getSmallTables(bz2.blockSize)
+	bz2.br = newBitReader(bytes.NewBuffer(src))
+	return &BlockReader{underlying: bz2, first: true, start: uint(start)}
+}
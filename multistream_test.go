@@ -3,7 +3,10 @@ package pbzip2_test
 import (
 	"bytes"
 	"context"
+	"errors"
 	"io"
+	"reflect"
+	"strings"
 	"testing"
 
 	"github.com/cosnicolaou/pbzip2"
@@ -115,6 +118,13 @@ func TestMultipleStreamErrors(t *testing.T) {
 
 	corruptedBlock, _ := concatFiles(t, "hello", "hello", "empty")
 	corruptedBlock[len(corruptedBlock)-26] = 0xff
+
+	hello, _ := readFile(t, "hello")
+	truncatedHeader, _ := concatFiles(t, "hello", "hello")
+	truncatedHeader = truncatedHeader[:len(hello)+3]
+
+	truncatedStream, _ := concatFiles(t, "hello", "300KB2")
+	truncatedStream = truncatedStream[:len(truncatedStream)/2]
 	for _, tc := range []struct {
 		compressed []byte
 		err        string
@@ -122,7 +132,9 @@ func TestMultipleStreamErrors(t *testing.T) {
 		{corruptedEmpty, "mismatched stream CRCs: calculated=0x4eece836 != stored=0x0000ff00"},
 		{truncatedEmpty, "failed to find trailer"},
 		{trailingTruncatedEmpty, "failed to find trailer"},
-		{corruptedBlock, "block checksum mismatch"},
+		{corruptedBlock, "block 1 at bit offset 496: block checksum mismatch"},
+		{truncatedHeader, "stream header is too small: 3"},
+		{truncatedStream, "failed to find trailer"},
 	} {
 		rd := pbzip2.NewReader(ctx, bytes.NewBuffer(tc.compressed))
 		out := &bytes.Buffer{}
@@ -132,3 +144,130 @@ func TestMultipleStreamErrors(t *testing.T) {
 		}
 	}
 }
+
+func TestContinueAfterStreamError(t *testing.T) {
+	ctx := context.Background()
+	hello, _ := readFile(t, "hello")
+	corruptedBlock, _ := concatFiles(t, "hello", "300KB1", "300KB2")
+	var blocks []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(corruptedBlock))
+	for sc.Scan(ctx) {
+		if block := sc.Block(); len(block.Data) > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the CRC of the first block of the second stream.
+	bit := blocks[1].Offset
+	corruptedBlock[bit/8] ^= 0x80 >> (bit % 8)
+
+	corruptedStream, _ := concatFiles(t, "hello", "hello", "hello")
+	corruptedStream[2*len(hello)-2] ^= 0xff
+
+	helloData := bzip2Data["hello"]
+	for _, tc := range []struct {
+		compressed []byte
+		continued  bool
+		output     []byte
+		offset     int64
+		err        string
+	}{
+		{corruptedBlock, false, helloData, blocks[1].StreamOffset, pbzip2.ErrBlockChecksum.Error()},
+		{corruptedBlock, true, append(append([]byte{}, helloData...), bzip2Data["300KB2"]...), blocks[1].StreamOffset, pbzip2.ErrBlockChecksum.Error()},
+		{corruptedStream, false, bytes.Repeat(helloData, 2), int64(len(hello)), "mismatched stream CRCs"},
+		{corruptedStream, true, bytes.Repeat(helloData, 3), int64(len(hello)), "mismatched stream CRCs"},
+	} {
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{pbzip2.ContinueAfterStreamError(tc.continued)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(tc.compressed), opts...))
+			var streamErr *pbzip2.StreamError
+			if !errors.As(err, &streamErr) {
+				t.Errorf("continue %v: concurrency %v: missing or unexpected error: %v", tc.continued, concurrency, err)
+				continue
+			}
+			if got, want := streamErr.Stream, 1; got != want {
+				t.Errorf("continue %v: concurrency %v: got %v, want %v", tc.continued, concurrency, got, want)
+			}
+			if got, want := streamErr.Offset, tc.offset; got != want {
+				t.Errorf("continue %v: concurrency %v: got %v, want %v", tc.continued, concurrency, got, want)
+			}
+			if !strings.Contains(err.Error(), tc.err) {
+				t.Errorf("continue %v: concurrency %v: got %v, want %v", tc.continued, concurrency, err, tc.err)
+			}
+			if got, want := len(out), len(tc.output); got != want || !bytes.Equal(out, tc.output) {
+				t.Errorf("continue %v: concurrency %v: got %v bytes, want %v", tc.continued, concurrency, got, want)
+			}
+		}
+	}
+}
+
+func TestStreamBoundaries(t *testing.T) {
+	ctx := context.Background()
+	names := []string{"hello", "300KB2", "hello"}
+	compressed, uncompressed := concatFiles(t, names...)
+	var wantOffsets []int64
+	offset := int64(0)
+	for _, name := range names[:len(names)-1] {
+		buf, _ := readFile(t, name)
+		offset += int64(len(buf))
+		wantOffsets = append(wantOffsets, offset)
+	}
+	for _, concurrency := range []int{1, 2} {
+		var indices []int
+		var offsets []int64
+		rd := pbzip2.NewReader(ctx, bytes.NewBuffer(compressed),
+			pbzip2.OnStreamBoundary(func(streamIndex int, offset int64) {
+				indices = append(indices, streamIndex)
+				offsets = append(offsets, offset)
+			}),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := data, uncompressed; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got[:10], want[:10])
+		}
+		if got, want := indices, []int{1, 2}; !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := offsets, wantOffsets; !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestUniformBlockSize(t *testing.T) {
+	ctx := context.Background()
+	compressed, uncompressed := concatFiles(t, "100KB1", "900KB9")
+	for _, uniform := range []bool{false, true} {
+		rd := pbzip2.NewReader(ctx, bytes.NewBuffer(compressed),
+			pbzip2.ScannerOptions(pbzip2.RequireUniformBlockSize(uniform)))
+		data, err := io.ReadAll(rd)
+		if uniform {
+			if !errors.Is(err, pbzip2.ErrInconsistentBlockSize) {
+				t.Errorf("got %v, want %v", err, pbzip2.ErrInconsistentBlockSize)
+			}
+			continue
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := data, uncompressed; !bytes.Equal(got, want) {
+			t.Errorf("got %v, want %v", got[:10], want[:10])
+		}
+	}
+	// Streams with the same block size are always accepted.
+	compressed, _ = concatFiles(t, "hello", "900KB9")
+	rd := pbzip2.NewReader(ctx, bytes.NewBuffer(compressed),
+		pbzip2.ScannerOptions(pbzip2.RequireUniformBlockSize(true)))
+	if _, err := io.ReadAll(rd); err != nil {
+		t.Fatal(err)
+	}
+}
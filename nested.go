@@ -0,0 +1,81 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+)
+
+// Format identifies a compression format for use with DecompressNested.
+type Format int
+
+const (
+	// Bzip2 is decompressed using a Reader.
+	Bzip2 Format = iota + 1
+	// Gzip is decompressed using compress/gzip.
+	Gzip
+)
+
+func (f Format) String() string {
+	switch f {
+	case Bzip2:
+		return "bzip2"
+	case Gzip:
+		return "gzip"
+	}
+	return "unknown"
+}
+
+// DecompressNested returns a reader for the output of data that has been
+// compressed more than once, for example, compressed using bzip2 and then
+// gzip, with the layers of compression to be removed specified in order,
+// outermost first, ie. []Format{Gzip, Bzip2} for the example. Each bzip2
+// layer is decompressed by a Reader created with opts. Closing the
+// returned reader closes the readers for all of the layers, but not rd.
+func DecompressNested(ctx context.Context, rd io.Reader, layers []Format, opts ...ReaderOption) (io.ReadCloser, error) {
+	nr := &nestedReader{rd: rd}
+	for _, layer := range layers {
+		switch layer {
+		case Bzip2:
+			zrd := NewReader(ctx, nr.rd, opts...)
+			nr.rd, nr.layers = zrd, append(nr.layers, zrd)
+		case Gzip:
+			grd, err := gzip.NewReader(nr.rd)
+			if err != nil {
+				nr.Close()
+				return nil, fmt.Errorf("%v layer %v: %w", layer, len(nr.layers), err)
+			}
+			nr.rd, nr.layers = grd, append(nr.layers, grd)
+		default:
+			nr.Close()
+			return nil, fmt.Errorf("unsupported format: %v", layer)
+		}
+	}
+	return nr, nil
+}
+
+type nestedReader struct {
+	rd     io.Reader
+	layers []io.Closer
+}
+
+func (nr *nestedReader) Read(buf []byte) (int, error) {
+	return nr.rd.Read(buf)
+}
+
+// Close closes the readers for each layer, innermost first, returning the
+// first error encountered.
+func (nr *nestedReader) Close() error {
+	var err error
+	for i := len(nr.layers) - 1; i >= 0; i-- {
+		if cerr := nr.layers[i].Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
@@ -0,0 +1,67 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"io"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func gzipData(t *testing.T, data []byte) []byte {
+	buf := &bytes.Buffer{}
+	wr := gzip.NewWriter(buf)
+	if _, err := wr.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := wr.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestDecompressNested(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		for _, tc := range []struct {
+			input  []byte
+			layers []pbzip2.Format
+		}{
+			{compressed, []pbzip2.Format{pbzip2.Bzip2}},
+			{gzipData(t, compressed), []pbzip2.Format{pbzip2.Gzip, pbzip2.Bzip2}},
+			{gzipData(t, gzipData(t, compressed)), []pbzip2.Format{pbzip2.Gzip, pbzip2.Gzip, pbzip2.Bzip2}},
+		} {
+			rd, err := pbzip2.DecompressNested(ctx, bytes.NewReader(tc.input), tc.layers)
+			if err != nil {
+				t.Errorf("%v: %v: %v", name, tc.layers, err)
+				continue
+			}
+			data, err := io.ReadAll(rd)
+			if err != nil {
+				t.Errorf("%v: %v: %v", name, tc.layers, err)
+			}
+			if err := rd.Close(); err != nil {
+				t.Errorf("%v: %v: %v", name, tc.layers, err)
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v..., want %v...", name, tc.layers, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+
+	compressed, _ := readFile(t, "hello")
+	if _, err := pbzip2.DecompressNested(ctx, bytes.NewReader(compressed), []pbzip2.Format{pbzip2.Gzip, pbzip2.Bzip2}); err == nil {
+		t.Errorf("expected an error for a missing gzip layer")
+	}
+	if _, err := pbzip2.DecompressNested(ctx, bytes.NewReader(compressed), []pbzip2.Format{0}); err == nil {
+		t.Errorf("expected an error for an unsupported format")
+	}
+}
@@ -0,0 +1,11 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+//go:build !race
+// +build !race
+
+package pbzip2_test
+
+// raceEnabled is true when the race detector is enabled.
+const raceEnabled = false
@@ -7,10 +7,13 @@ package pbzip2
 import (
 	"container/heap"
 	"context"
+	"errors"
 	"fmt"
+	"hash"
 	"io"
 	"log"
 	"runtime"
+	"runtime/debug"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -20,17 +23,69 @@ import (
 	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
-var numDecompressionGoRoutines int64
+var numDecompressionGoRoutines, maxDecompressionGoRoutines int64
+
+// goroutineStarted and goroutineDone maintain the count, and high water
+// mark, of the goroutines used for decompression. goroutineStarted is
+// called before each goroutine is created so that goroutines that have
+// been created, but not yet scheduled, are included.
+func goroutineStarted() {
+	n := atomic.AddInt64(&numDecompressionGoRoutines, 1)
+	for {
+		max := atomic.LoadInt64(&maxDecompressionGoRoutines)
+		if n <= max || atomic.CompareAndSwapInt64(&maxDecompressionGoRoutines, max, n) {
+			return
+		}
+	}
+}
+
+func goroutineDone() {
+	atomic.AddInt64(&numDecompressionGoRoutines, -1)
+}
 
 func updateStreamCRC(streamCRC, blockCRC uint32) uint32 {
 	return (streamCRC<<1 | streamCRC>>31) ^ blockCRC
 }
 
 type decompressorOpts struct {
-	verbose     bool
-	concurrency int
-	progressCh  chan<- Progress
-	pool        chan struct{}
+	verbose             bool
+	concurrency         int
+	explicitConcurrency bool
+	progressCh          chan<- Progress
+	progressFn          func(inBytes, outBytes, blocks int64)
+	pool                chan struct{}
+	deterministic       bool
+	startLimiter        RateLimiter
+	dispatch            DispatchStrategy
+	prioritizeFirst     bool
+	batch               int
+	maxBuffered         int
+	allowTruncated      bool
+	bufferPool          BufferPool
+	scanConcurrency     int
+	forceParallel       bool
+}
+
+func newDecompressorOpts(opts []DecompressorOption) decompressorOpts {
+	o := decompressorOpts{
+		concurrency: runtime.GOMAXPROCS(-1),
+	}
+	for _, fn := range opts {
+		fn(&o)
+	}
+	return o
+}
+
+// serial returns true if the blocks are to be decompressed in turn, by
+// the goroutine calling Read, rather than by a Decompressor.
+func (o decompressorOpts) serial() bool {
+	if o.forceParallel {
+		return false
+	}
+	if o.explicitConcurrency {
+		return o.concurrency == 1 && o.scanConcurrency == 1
+	}
+	return runtime.GOMAXPROCS(-1) == 1
 }
 
 type DecompressorOption func(*decompressorOpts)
@@ -47,6 +102,31 @@ func BZVerbose(v bool) DecompressorOption {
 func BZConcurrency(n int) DecompressorOption {
 	return func(o *decompressorOpts) {
 		o.concurrency = n
+		o.explicitConcurrency = true
+	}
+}
+
+// BZScanConcurrency sets the number of goroutines used to locate the
+// blocks in the compressed input, independently of the number used to
+// decompress them as set by BZConcurrency, which it defaults to. It
+// applies to NewReaderAt since the input to NewReader can only be read,
+// and hence scanned, sequentially by a single goroutine. Setting both
+// BZConcurrency and BZScanConcurrency to 1 decompresses the input
+// serially, as is the case by default when GOMAXPROCS is 1.
+func BZScanConcurrency(n int) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.scanConcurrency = n
+	}
+}
+
+// BZForceParallel requests that the blocks always be decompressed by
+// a Decompressor, even when they would otherwise be decompressed in turn
+// by the goroutine calling Read, that is, when GOMAXPROCS is 1, when both
+// BZConcurrency and BZScanConcurrency are 1, or when the input is found to
+// contain a single block. It is intended for benchmarks and tests.
+func BZForceParallel(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.forceParallel = v
 	}
 }
 
@@ -60,6 +140,22 @@ func BZConcurrencyPool(pool chan struct{}) DecompressorOption {
 	}
 }
 
+// BZStartLimiter sets a limiter, typically a *rate.Limiter from
+// golang.org/x/time/rate, that is waited on before each worker goroutine
+// is started, with all of the goroutines for a decompressor being started
+// together once the limiter allows. A single limiter can be shared across
+// several decompressors to limit the rate at which goroutines are created
+// when many are started at the same time. Note that starting a
+// decompressor, and hence the first Read on a Reader, will block until the
+// limiter allows its goroutines to be started. This complements
+// BZConcurrencyPool which limits the number of workers that may be
+// decompressing at any one time.
+func BZStartLimiter(l RateLimiter) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.startLimiter = l
+	}
+}
+
 // CreateConcurrencyPool will create a pool that can be shared among several decompressor
 // that will limit the total number of concurrently running decompressors.
 // Each decompressor will still only use the number of concurrent decompressors set in BZConcurrency.
@@ -76,6 +172,106 @@ func CreateConcurrencyPool(maxConcurrent int) chan struct{} {
 	return ch
 }
 
+// DeterministicDispatch is intended for debugging only. It requests that
+// each block be dispatched to a specific worker, in turn, in the order that
+// blocks are appended so that the assignment of blocks to workers is the
+// same every time the same input is decompressed. Blocks are still
+// decompressed concurrently, but a block is not dispatched until the worker
+// it is assigned to is free. Each dispatch is logged via the function
+// supplied to WithLogger, if any.
+func DeterministicDispatch(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.deterministic = v
+	}
+}
+
+// DispatchStrategy determines how blocks are dispatched to the goroutines
+// that decompress them.
+type DispatchStrategy int
+
+const (
+	// FixedPool uses a fixed pool of BZConcurrency worker goroutines that
+	// are started with the decompressor and each decompress one block at
+	// a time. Blocks are not assigned to workers ahead of time, rather
+	// each worker takes the next block to be decompressed, in order,
+	// as soon as it is idle, so that a worker that is decompressing an
+	// expensive block does not delay the blocks that follow it. It is
+	// the default.
+	FixedPool DispatchStrategy = iota
+	// GoroutinePerBlock starts a new goroutine for every block, with at
+	// most BZConcurrency of them running at any one time.
+	GoroutinePerBlock
+)
+
+// BZDispatchStrategy sets the strategy used to dispatch blocks to the
+// goroutines that decompress them, the default is FixedPool. It is
+// ignored if DeterministicDispatch is set since that requires a fixed
+// pool of workers.
+func BZDispatchStrategy(s DispatchStrategy) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.dispatch = s
+	}
+}
+
+// DispatchBatch requests that blocks be dispatched to the workers of
+// a FixedPool in batches of n rather than one at a time, to reduce the
+// number of channel operations, and hence contention, when there are many
+// small blocks. Each worker decompresses the blocks in a batch in turn
+// and the output is unaffected. Note that a partial batch is only
+// dispatched once it is complete or Finish is called, and hence that
+// large batches delay the decompression of the first blocks. It is
+// ignored for GoroutinePerBlock and DeterministicDispatch.
+func DispatchBatch(n int) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.batch = n
+	}
+}
+
+// BZPrioritizeFirstBlock requests that the first block be given priority
+// over all others so that the time taken to return the first bytes of
+// output is minimized. Whilst the first block is being decompressed,
+// at most GOMAXPROCS-1 other blocks are decompressed concurrently with it;
+// once it has been decompressed all blocks are decompressed with the full
+// concurrency requested. Overall throughput is therefore unaffected
+// unless the concurrency exceeds GOMAXPROCS.
+func BZPrioritizeFirstBlock(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.prioritizeFirst = v
+	}
+}
+
+// BZMaxBuffered limits the output of the blocks that have been
+// decompressed but not yet read to approximately n bytes. Once the limit
+// is reached workers wait for output to be read before decompressing
+// any further blocks, other than the next block in order, which is always
+// decompressed so that Read can make progress. Since the size of a block's
+// output is not known until it has been decompressed, the block size
+// declared by the stream's header is counted against the limit whilst the
+// block is being decompressed, and hence the limit may be exceeded by
+// blocks whose output is larger than that, or by the next block in order
+// when n is smaller than the block size. The default, or n <= 0, is no
+// limit other than that imposed by the concurrency. It has no effect when
+// blocks are decompressed serially.
+func BZMaxBuffered(n int) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.maxBuffered = n
+	}
+}
+
+// BZAllowTruncated requests that a stream that ends without a trailer,
+// typically because the input was cut short, yield the output of all of
+// its complete blocks followed by ErrTruncated rather than failing with
+// ErrNoTrailer. The input that follows the last complete block is
+// treated as a final block which is returned only if it decompresses in
+// its entirety with a matching CRC and is otherwise dropped. Since the
+// stream CRC cannot be verified the output is only as trustworthy as the
+// block CRCs. It has no effect if AllowMissingTrailer is specified.
+func BZAllowTruncated(v bool) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.allowTruncated = v
+	}
+}
+
 // BZSendUpdates sets the channel for sending progress updates over.
 func BZSendUpdates(ch chan<- Progress) DecompressorOption {
 	return func(o *decompressorOpts) {
@@ -83,24 +279,51 @@ func BZSendUpdates(ch chan<- Progress) DecompressorOption {
 	}
 }
 
+// BZProgress requests that fn be called as each non-empty block is
+// reassembled, with the cumulative number of bytes of compressed data
+// consumed, of decompressed output produced and of blocks decompressed.
+// fn is called by a single goroutine, in the order in which the blocks
+// appear in the stream, regardless of the concurrency used, and hence the
+// values passed to it never decrease. It is not called for the block
+// that results in an error, nor at all once Read has returned an error.
+func BZProgress(fn func(inBytes, outBytes, blocks int64)) DecompressorOption {
+	return func(o *decompressorOpts) {
+		o.progressFn = fn
+	}
+}
+
 // Decompressor represents a concurrent decompressor for pbzip streams. The
 // decompressor is designed to work in conjunction with Scanner and its
 // Decompress method must be called with the values returned by the scanner's
 // Block method. Each block is then decompressed in parallel and reassembled
 // in the original order.
 type Decompressor struct {
-	order      uint64 // Must be the first field in a struct to ensure word alignment.
-	ctx        context.Context
-	workWg     sync.WaitGroup
-	doneWg     sync.WaitGroup
-	workCh     chan *blockDesc
-	doneCh     chan *blockDesc
-	progressCh chan<- Progress
-	prd        *io.PipeReader
-	pwr        *io.PipeWriter
-	heap       *blockHeap
-	streamCRC  uint32
-	verbose    bool
+	order        uint64 // Must be the first field in a struct to ensure word alignment.
+	ctx          context.Context
+	workWg       sync.WaitGroup
+	doneWg       sync.WaitGroup
+	workCh       chan *blockDesc
+	workerChs    []chan *blockDesc // per-worker channels used by DeterministicDispatch.
+	doneCh       chan *blockDesc
+	prd          *io.PipeReader
+	pwr          *io.PipeWriter
+	heap         *blockHeap
+	verbose      bool
+	concurrency  int
+	pool         chan struct{}
+	startLimiter RateLimiter
+	dispatch     DispatchStrategy
+	firstDone    chan struct{} // closed once the first block is decompressed.
+	others       chan struct{} // limits the blocks decompressed with the first.
+	limit        *bufferLimit  // set by BZMaxBuffered.
+	// batchCh is used instead of workCh by DispatchBatch, with blocks
+	// being accumulated in batch until there are batchSize of them.
+	batchCh   chan []*blockDesc
+	batchMu   sync.Mutex
+	batch     []*blockDesc
+	batchSize int
+	aborted   int32 // set by abort, accessed atomically.
+	assembler
 }
 
 // Progress is used to report the progress of decompression. Each report pertains
@@ -114,38 +337,99 @@ type Progress struct {
 
 // NewDecompressor creates a new parallel decompressor.
 func NewDecompressor(ctx context.Context, opts ...DecompressorOption) *Decompressor {
-	o := decompressorOpts{
-		concurrency: runtime.GOMAXPROCS(-1),
+	dc := newDecompressor(ctx, newDecompressorOpts(opts))
+	dc.start()
+	return dc
+}
+
+// newDecompressor creates a new Decompressor without starting any of its
+// goroutines, start must be called to do so.
+func newDecompressor(ctx context.Context, o decompressorOpts) *Decompressor {
+	dc := &Decompressor{
+		ctx:          ctx,
+		doneCh:       make(chan *blockDesc, o.concurrency),
+		workCh:       make(chan *blockDesc, o.concurrency),
+		heap:         &blockHeap{},
+		verbose:      o.verbose,
+		concurrency:  o.concurrency,
+		pool:         o.pool,
+		startLimiter: o.startLimiter,
+		dispatch:     o.dispatch,
+		assembler: assembler{
+			progressCh: o.progressCh,
+			progressFn: o.progressFn,
+			reorder:    memoryReorderBuffer{},
+		},
 	}
-	for _, fn := range opts {
-		fn(&o)
+	if o.prioritizeFirst {
+		dc.firstDone = make(chan struct{})
+		dc.others = make(chan struct{}, runtime.GOMAXPROCS(-1)-1)
 	}
-	dc := &Decompressor{
-		ctx:        ctx,
-		doneCh:     make(chan *blockDesc, o.concurrency),
-		workCh:     make(chan *blockDesc, o.concurrency),
-		progressCh: o.progressCh,
-		heap:       &blockHeap{},
+	if o.maxBuffered > 0 {
+		dc.limit = newBufferLimit(o.maxBuffered)
+	}
+	if o.batch > 1 && dc.dispatch == FixedPool && !o.deterministic {
+		dc.batchSize = o.batch
+		dc.batchCh = make(chan []*blockDesc, o.concurrency)
+	}
+	if o.deterministic {
+		dc.dispatch = FixedPool
+		dc.workerChs = make([]chan *blockDesc, o.concurrency)
+		for i := range dc.workerChs {
+			dc.workerChs[i] = make(chan *blockDesc, 1)
+		}
 	}
 	dc.prd, dc.pwr = io.Pipe()
 	heap.Init(dc.heap)
-	dc.workWg.Add(o.concurrency)
+	return dc
+}
+
+func (dc *Decompressor) start() {
+	ctx := dc.ctx
+	if dc.startLimiter != nil {
+		// Wait for all of the goroutines to be allowed to start before
+		// starting any of them so that decompressors that are waiting on
+		// a shared limiter do not hold on to partially started workers.
+		if err := waitN(ctx, dc.startLimiter, dc.concurrency+1); err != nil {
+			dc.pwr.CloseWithError(err)
+			return
+		}
+	}
 	dc.doneWg.Add(1)
-	for i := 0; i < o.concurrency; i++ {
+	switch dc.dispatch {
+	case GoroutinePerBlock:
+		dc.workWg.Add(1)
+		goroutineStarted()
 		go func() {
-			atomic.AddInt64(&numDecompressionGoRoutines, 1)
-			dc.worker(ctx, dc.workCh, dc.doneCh, o.pool)
-			atomic.AddInt64(&numDecompressionGoRoutines, -1)
+			dc.dispatcher(ctx, dc.workCh, dc.doneCh, dc.pool)
+			goroutineDone()
 			dc.workWg.Done()
 		}()
+	default:
+		dc.workWg.Add(dc.concurrency)
+		for i := 0; i < dc.concurrency; i++ {
+			in := dc.workCh
+			if dc.workerChs != nil {
+				in = dc.workerChs[i]
+			}
+			goroutineStarted()
+			go func() {
+				if dc.batchCh != nil {
+					dc.batchWorker(ctx, dc.batchCh, dc.doneCh, dc.pool)
+				} else {
+					dc.worker(ctx, in, dc.doneCh, dc.pool)
+				}
+				goroutineDone()
+				dc.workWg.Done()
+			}()
+		}
 	}
+	goroutineStarted()
 	go func() {
-		atomic.AddInt64(&numDecompressionGoRoutines, 1)
 		dc.assemble(ctx, dc.doneCh)
-		atomic.AddInt64(&numDecompressionGoRoutines, -1)
+		goroutineDone()
 		dc.doneWg.Done()
 	}()
-	return dc
 }
 
 type blockDesc struct {
@@ -154,6 +438,71 @@ type blockDesc struct {
 	err          error
 	uncompressed []byte
 	duration     time.Duration
+	stats        BlockStats
+	prioritySlot bool // set if one of Decompressor.others is held.
+	buffered     int  // counted against BZMaxBuffered, see bufferLimit.
+	smallMemory  bool // set if the block is to be decompressed using SmallMemory.
+	stashed      bool // set whilst the output is held by the reorder buffer.
+
+	// dst is set by serialReader.Read so that the block may be
+	// decompressed directly into the caller's buffer if it fits.
+	dst []byte
+	// maxTrees is set if the block may use a non-standard number of
+	// Huffman trees, see MaxHuffmanTrees.
+	maxTrees int
+	// mtfThreshold is set by MTFShiftThreshold.
+	mtfThreshold int
+	// oversize is set if the block may exceed its declared size, see
+	// AllowOversizeBlocks.
+	oversize bool
+	// retry is set by WithBlockRetry.
+	retry blockRetry
+	// newCRC is set by WithCRC.
+	newCRC func() hash.Hash32
+	// growTables is set for a block found to be the only one in the
+	// input by Reader.probe, see bzip2.SetGrowableTables.
+	growTables bool
+	// scratch is set by Verify, in which case the output is read into
+	// scratch and discarded rather than being retained.
+	scratch []byte
+	// allocator is set by WithBufferAllocator, in which case allocated
+	// is the buffer obtained from it that holds the output.
+	allocator *bufferAllocator
+	allocated []byte
+	// reserved is the memory reserved for the output, see WithArena.
+	reserved int
+}
+
+// blockOptions are the options that apply to the decompression of each
+// individual block.
+type blockOptions struct {
+	// smallMemory is set by SmallMemory.
+	smallMemory bool
+	// maxTrees is set by MaxHuffmanTrees.
+	maxTrees int
+	// mtfThreshold is set by MTFShiftThreshold.
+	mtfThreshold int
+	// oversize is set by AllowOversizeBlocks.
+	oversize bool
+	// blockRetry is set by WithBlockRetry.
+	blockRetry blockRetry
+	// newCRC is set by WithCRC.
+	newCRC func() hash.Hash32
+}
+
+// newBlock returns the blockDesc for the order'th block, cb, to be
+// decompressed using o.
+func (o *blockOptions) newBlock(order uint64, cb CompressedBlock) *blockDesc {
+	return &blockDesc{
+		order:           order,
+		CompressedBlock: cb,
+		smallMemory:     o.smallMemory,
+		maxTrees:        o.maxTrees,
+		mtfThreshold:    o.mtfThreshold,
+		oversize:        o.oversize,
+		retry:           o.blockRetry,
+		newCRC:          o.newCRC,
+	}
 }
 
 func (b *blockDesc) String() string {
@@ -171,13 +520,101 @@ func (dc *Decompressor) trace(format string, args ...interface{}) {
 	}
 }
 
+// newBlockReader is a variable to allow tests to substitute a different
+// block decoder.
+var newBlockReader = bzip2.NewBlockReader
+
+// maxPanicStackLines is the number of lines of the stack trace included in
+// the error returned for a panic encountered whilst decompressing a block.
+const maxPanicStackLines = 20
+
 func (b *blockDesc) decompress() {
 	start := time.Now()
-	rd := bzip2.NewBlockReader(b.StreamBlockSize, b.Data, b.BitOffset)
-	b.uncompressed, b.err = io.ReadAll(rd)
+	defer func() {
+		if r := recover(); r != nil {
+			stack := strings.SplitN(string(debug.Stack()), "\n", maxPanicStackLines+1)
+			if len(stack) > maxPanicStackLines {
+				stack = stack[:maxPanicStackLines]
+			}
+			b.err = fmt.Errorf("%w: block %v: panic: %v\n%s", ErrInternal, b.order, r, strings.Join(stack, "\n"))
+			b.uncompressed = nil
+			b.allocator.release(b)
+			b.allocator.settle(b)
+			b.duration = time.Since(start)
+		}
+	}()
+	for attempt := 0; ; attempt++ {
+		b.decode()
+		if !b.retry.retry(attempt, b.err) {
+			break
+		}
+		// Release any buffer used by the failed attempt, the
+		// reservation, if any, is only settled once all attempts
+		// have been made.
+		b.allocator.release(b)
+		b.err, b.uncompressed = nil, nil
+	}
+	b.allocator.settle(b)
 	b.duration = time.Since(start)
 }
 
+// decode makes a single attempt at decompressing the block.
+func (b *blockDesc) decode() {
+	newReader := newBlockReader
+	if b.smallMemory {
+		newReader = bzip2.NewSmallBlockReader
+	}
+	rd := newReader(b.StreamBlockSize, b.Data, b.BitOffset)
+	if b.maxTrees > 0 {
+		bzip2.SetMaxHuffmanTrees(rd, b.maxTrees)
+	}
+	if b.mtfThreshold > 0 {
+		bzip2.SetMTFShiftThreshold(rd, b.mtfThreshold)
+	}
+	if b.oversize {
+		bzip2.SetAllowOversizeBlocks(rd, true)
+	}
+	if b.newCRC != nil {
+		bzip2.SetBlockCRC(rd, b.newCRC())
+	}
+	if b.growTables {
+		bzip2.SetGrowableTables(rd, true)
+	}
+	br, ok := rd.(*bzip2.BlockReader)
+	switch {
+	case b.scratch != nil:
+		b.err = discard(rd, b.scratch)
+	case ok && b.allocator != nil:
+		b.uncompressed, b.err = br.ReadAllUsing(b.allocator.allocFor(b), b.allocator.free)
+		b.allocated = b.uncompressed
+	case ok:
+		b.uncompressed, b.err = br.ReadAllInto(b.dst)
+	default:
+		b.uncompressed, b.err = io.ReadAll(rd)
+	}
+	switch {
+	case errors.Is(b.err, bzip2.ErrBlockChecksum):
+		b.err = blockCRCError(b, bzip2.ComputedBlockCRC(rd))
+	case errors.Is(b.err, bzip2.ErrEmptyBlock):
+		b.err = ErrEmptyBlock
+	case errors.Is(b.err, bzip2.ErrBlockSize), errors.Is(b.err, bzip2.ErrRepeatsPastEnd):
+		b.err = fmt.Errorf("%w: %v", ErrBadBlockSize, b.err)
+	}
+	b.stats = BlockStats(bzip2.BlockReaderStats(rd))
+}
+
+// discard reads rd to completion using buf, discarding its output.
+func discard(rd io.Reader, buf []byte) error {
+	for {
+		if _, err := rd.Read(buf); err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+	}
+}
+
 func (dc *Decompressor) worker(ctx context.Context, in <-chan *blockDesc, out chan<- *blockDesc, pool chan struct{}) {
 	for {
 		select {
@@ -185,41 +622,182 @@ func (dc *Decompressor) worker(ctx context.Context, in <-chan *blockDesc, out ch
 			if block == nil {
 				return
 			}
-			if pool != nil {
-				// Wait for a token from the pool.
-				select {
-				case <-pool:
-				case <-ctx.Done():
+			if !dc.decompressBlock(ctx, block, out, pool) {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// batchWorker is used instead of worker by DispatchBatch.
+func (dc *Decompressor) batchWorker(ctx context.Context, in <-chan []*blockDesc, out chan<- *blockDesc, pool chan struct{}) {
+	for {
+		select {
+		case batch, ok := <-in:
+			if !ok {
+				return
+			}
+			for _, block := range batch {
+				if !dc.decompressBlock(ctx, block, out, pool) {
 					return
 				}
 			}
-			dc.trace("decompressing: %s", block)
-			block.decompress()
-			dc.trace("decompressed: %s, ch %v/%v", block, len(out), cap(out))
-			if pool != nil {
-				pool <- struct{}{}
-			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
 
+// dispatcher implements GoroutinePerBlock by starting a goroutine for each
+// block read from in, with at most concurrency of them running at once.
+func (dc *Decompressor) dispatcher(ctx context.Context, in <-chan *blockDesc, out chan<- *blockDesc, pool chan struct{}) {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	running := make(chan struct{}, dc.concurrency)
+	for {
+		select {
+		case block := <-in:
+			if block == nil {
+				return
+			}
 			select {
-			case out <- block:
+			case running <- struct{}{}:
 			case <-ctx.Done():
+				return
 			}
+			wg.Add(1)
+			goroutineStarted()
+			go func() {
+				dc.decompressBlock(ctx, block, out, pool)
+				<-running
+				goroutineDone()
+				wg.Done()
+			}()
 		case <-ctx.Done():
 			return
 		}
 	}
 }
 
+// decompressBlock decompresses block and sends it to out, it returns false
+// if ctx is canceled before it can do so.
+func (dc *Decompressor) decompressBlock(ctx context.Context, block *blockDesc, out chan<- *blockDesc, pool chan struct{}) bool {
+	if !dc.limit.acquire(ctx, block) {
+		return false
+	}
+	// Wait for priority before a token from the pool so that blocks
+	// waiting on the first block do not prevent it from obtaining one.
+	if !dc.waitForPriority(ctx, block) {
+		return false
+	}
+	if pool != nil {
+		// Wait for a token from the pool.
+		select {
+		case <-pool:
+		case <-ctx.Done():
+			return false
+		}
+	}
+	dc.trace("decompressing: %s", block)
+	dc.decompress(block)
+	dc.trace("decompressed: %s, ch %v/%v", block, len(out), cap(out))
+	dc.releasePriority(block)
+	dc.limit.decompressed(block)
+	if pool != nil {
+		pool <- struct{}{}
+	}
+	select {
+	case out <- block:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+// waitForPriority implements BZPrioritizeFirstBlock by waiting for either
+// the first block to have been decompressed or for one of the slots
+// available for blocks to be decompressed concurrently with it. It returns
+// false if ctx is canceled whilst waiting.
+func (dc *Decompressor) waitForPriority(ctx context.Context, block *blockDesc) bool {
+	if dc.firstDone == nil || block.order == 1 {
+		return true
+	}
+	select {
+	case <-dc.firstDone:
+		return true
+	default:
+	}
+	select {
+	case <-dc.firstDone:
+	case dc.others <- struct{}{}:
+		block.prioritySlot = true
+	case <-ctx.Done():
+		return false
+	}
+	return true
+}
+
+// releasePriority must be called once a block has been decompressed
+// to release any resources acquired by waitForPriority.
+func (dc *Decompressor) releasePriority(block *blockDesc) {
+	switch {
+	case dc.firstDone == nil:
+	case block.order == 1:
+		close(dc.firstDone)
+	case block.prioritySlot:
+		<-dc.others
+	}
+}
+
 // Append adds the supplied bzip2 block to the set to be decompressed in parallel
 // with the results of that decompression being appended to the previously
 // appended blocks.
 func (dc *Decompressor) Append(cb CompressedBlock) error {
 	order := atomic.AddUint64(&dc.order, 1)
+	workCh := dc.workCh
+	if dc.workerChs != nil {
+		worker := int((order - 1) % uint64(len(dc.workerChs)))
+		workCh = dc.workerChs[worker]
+		if dc.logf != nil {
+			dc.logf("pbzip2: dispatching block %v to worker %v", order, worker)
+		}
+	}
+	block := dc.newBlock(order, cb)
+	if err := dc.allocator.reserve(dc.ctx, block); err != nil {
+		return err
+	}
+	if dc.batchCh != nil {
+		return dc.appendToBatch(block)
+	}
 	select {
-	case dc.workCh <- &blockDesc{
-		order:           order,
-		CompressedBlock: cb,
-	}:
+	case workCh <- block:
+	case <-dc.ctx.Done():
+		return dc.ctx.Err()
+	}
+	return nil
+}
+
+// appendToBatch adds block to the current batch and dispatches the batch
+// once it is complete, see DispatchBatch.
+func (dc *Decompressor) appendToBatch(block *blockDesc) error {
+	dc.batchMu.Lock()
+	dc.batch = append(dc.batch, block)
+	var batch []*blockDesc
+	if len(dc.batch) >= dc.batchSize {
+		batch, dc.batch = dc.batch, make([]*blockDesc, 0, dc.batchSize)
+	}
+	dc.batchMu.Unlock()
+	if batch == nil {
+		return nil
+	}
+	return dc.sendBatch(batch)
+}
+
+func (dc *Decompressor) sendBatch(batch []*blockDesc) error {
+	select {
+	case dc.batchCh <- batch:
 	case <-dc.ctx.Done():
 		return dc.ctx.Err()
 	}
@@ -232,6 +810,24 @@ func (dc *Decompressor) Cancel(err error) {
 	dc.pwr.CloseWithError(err)
 }
 
+// abort prevents the output of any further blocks from being written,
+// but allows that of the block currently being written to be read in its
+// entirety, after which Read returns io.EOF, see Reader.Abort.
+func (dc *Decompressor) abort() {
+	atomic.StoreInt32(&dc.aborted, 1)
+}
+
+func (dc *Decompressor) isAborted() bool {
+	return atomic.LoadInt32(&dc.aborted) != 0
+}
+
+// waitForWorkers waits for the worker and assembly goroutines to exit, which they
+// will do promptly once the decompressor's context is canceled.
+func (dc *Decompressor) waitForWorkers() {
+	dc.workWg.Wait()
+	dc.doneWg.Wait()
+}
+
 // Finish must be called to wait for all of the currently outstanding
 // decompression processes to finish and their output to be reassembled.
 // It should be called exactly once.
@@ -242,7 +838,22 @@ func (dc *Decompressor) Finish() error {
 		err = dc.ctx.Err()
 	default:
 	}
+	if dc.batchCh != nil {
+		dc.batchMu.Lock()
+		batch := dc.batch
+		dc.batch = nil
+		dc.batchMu.Unlock()
+		if len(batch) > 0 {
+			if serr := dc.sendBatch(batch); err == nil {
+				err = serr
+			}
+		}
+		close(dc.batchCh)
+	}
 	close(dc.workCh)
+	for _, ch := range dc.workerChs {
+		close(ch)
+	}
 	dc.workWg.Wait()
 	close(dc.doneCh)
 	dc.doneWg.Wait()
@@ -276,8 +887,12 @@ func (h *blockHeap) Pop() interface{} {
 // that of a specific 6 byte sequence occurring randomly.
 // Merging two blocks like this means that it would take two false positives
 // within the /same/ block to defeat the code here, which given that blocks
-// are relatively small is even less likely to happen.
-func (dc *Decompressor) tryMergeBlocks(ctx context.Context, ch <-chan *blockDesc, min *blockDesc) bool {
+// are relatively small is even less likely to happen. It returns an error
+// if assembly is to be abandoned, in which case the merge did not occur.
+func (dc *Decompressor) tryMergeBlocks(ctx context.Context, ch <-chan *blockDesc, min *blockDesc) (bool, error) {
+	if !mergeable(min.err) {
+		return false, nil
+	}
 	// wait for the second consecutive block.
 	for {
 		for len(*dc.heap) < 1 {
@@ -285,21 +900,50 @@ func (dc *Decompressor) tryMergeBlocks(ctx context.Context, ch <-chan *blockDesc
 			case block, ok := <-ch:
 				if !ok {
 					// channel has been closed.
-					return false
+					return false, nil
+				}
+				if block.order != min.order+1 {
+					dc.store(block)
 				}
 				heap.Push(dc.heap, block)
 			case <-ctx.Done():
 				err := ctx.Err()
 				dc.trace("tryMergeBlocks: %v", err)
-				dc.pwr.CloseWithError(err)
-				return false
+				return false, err
 			}
 		}
 		if (*dc.heap)[0].order == min.order+1 {
 			break
 		}
 	}
-	next := (*dc.heap)[0]
+	if !mergeBlocks(min, (*dc.heap)[0]) {
+		return false, nil
+	}
+	// The merge succeeded, remove the block that was merged from the heap
+	// and its output from the reorder buffer.
+	next := heap.Remove(dc.heap, 0).(*blockDesc)
+	err := dc.retrieve(next)
+	dc.allocator.release(next)
+	dc.limit.release(next)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// mergeable returns true if a block that failed to decompress with err
+// may have been split by a false positive block magic number. A block
+// whose checksum could be computed was decoded in its entirety and hence
+// cannot have been split, so the checksum error is returned immediately
+// rather than waiting for the next block to attempt a merge.
+func mergeable(err error) bool {
+	return !errors.Is(err, ErrInternal) && !errors.Is(err, ErrBlockChecksum)
+}
+
+// mergeBlocks appends next to min, reinstating the block magic number
+// that was assumed to separate them, and attempts to decompress the
+// merged block.
+func mergeBlocks(min, next *blockDesc) bool {
 	bwr := &bitstream.BitWriter{}
 	// Note that the first block has an offset in the first byte and a size in
 	// bits and hence need the sum of those to accurently reflect the size of
@@ -308,19 +952,360 @@ func (dc *Decompressor) tryMergeBlocks(ctx context.Context, ch <-chan *blockDesc
 	bwr.Append(blockMagic[:], 0, len(blockMagic)*8)
 	bwr.Append(next.Data, next.BitOffset, next.SizeInBits)
 	min.Data, min.SizeInBits = bwr.Data()
+	// The merged block ends where next ends.
+	min.EOS, min.StreamCRC = next.EOS, next.StreamCRC
 
+	// Release any buffer still held from the failed attempt at
+	// decompressing min on its own.
+	min.allocator.release(min)
+	min.uncompressed = nil
 	min.decompress()
-	if min.err != nil {
-		return false
+	return min.err == nil
+}
+
+// assembler validates, and accumulates statistics for, each decompressed
+// block in the order in which they appear in the original stream.
+type assembler struct {
+	progressCh chan<- Progress
+	progressFn func(inBytes, outBytes, blocks int64)
+	streamCRC  uint32
+	emitted    uint64
+	streams    int  // number of streams started after the first one.
+	ended      bool // set when the previous block ended a stream.
+	onStream   func(streamIndex int, offset int64)
+	blockStats bool
+	limiter    RateLimiter
+	maxCPUTime time.Duration
+	logf       func(format string, args ...interface{})
+	warnIdle   bool
+	blocks     int // number of non-empty blocks assembled.
+	// active is the number of blocks being decompressed and maxActive
+	// the largest value it has had, both are accessed atomically.
+	active, maxActive int32
+	// callbacks is the number of callbacks supplied by the caller that are
+	// currently being run, accessed atomically, see Reader.Close.
+	callbacks int32
+	reorder   ReorderBuffer // used by Decompressor, see WithReorderBuffer.
+	// skipStreamCRC is set when the stream CRC cannot be verified.
+	skipStreamCRC bool
+	// blockOptions are used for each block, see newBlock.
+	blockOptions
+	// yieldEvery is set by YieldEvery.
+	yieldEvery int
+	// zeroCRC is set by FlagZeroCRC.
+	zeroCRC zeroCRC
+	// expectCRCs is set by ExpectBlockCRCs, crcsSeen is the number of
+	// blocks compared against it.
+	expectCRCs []uint32
+	crcsSeen   int
+	// truncated is set once the final block of a stream read with
+	// BZAllowTruncated has been seen.
+	truncated bool
+	// continueStreams is set by ContinueAfterStreamError, streamErr is the
+	// error for the first stream that failed and skipOffset the offset of
+	// the stream whose blocks are being skipped, if skipping is set.
+	continueStreams bool
+	streamErr       error
+	skipping        bool
+	skipOffset      int64
+	// allocator is set by WithBufferAllocator.
+	allocator *bufferAllocator
+	// blockTimings is set by CollectBlockTimings.
+	blockTimings bool
+	// highWater and onHighWater are set by OnBufferHighWater, buffered is
+	// the number of bytes of output currently held by the Decompressor.
+	highWater   int
+	onHighWater func(current int)
+	buffered    int
+	// verifiedProgress, if set, is called with the cumulative number of
+	// verified bytes, verified, as each block is assembled.
+	verifiedProgress func(verified int64)
+	verified         int64
+	events           chan<- BlockEvent
+	statsMu          sync.Mutex
+	stats            Stats
+	streamCRCs       []uint32 // the verified CRC of each stream, guarded by statsMu.
+}
+
+// check must be called for each block before its output is used.
+func (a *assembler) check(ctx context.Context, block *blockDesc) error {
+	if len(block.Data) > 0 && len(block.uncompressed) == 0 {
+		// A valid bzip2 block always contains some data.
+		return fmt.Errorf("%w: block %v produced no output", ErrBlockDesync, block.order)
 	}
-	// The merge succeeded, remove the block that was merged from the heap.
-	heap.Remove(dc.heap, 0)
-	return true
+	if block.truncated {
+		a.truncated = true
+	}
+	if a.maxCPUTime > 0 {
+		if total := a.Stats().WorkerCPUTime + block.duration; total > a.maxCPUTime {
+			return fmt.Errorf("%w: %v > %v", ErrCPUBudgetExceeded, total, a.maxCPUTime)
+		}
+	}
+	if a.ended && len(block.Data) > 0 {
+		a.ended = false
+		a.streams++
+		if a.onStream != nil {
+			a.callback(func() { a.onStream(a.streams, block.StreamOffset) })
+		}
+		sendEvent(ctx, a.events, BlockEvent{
+			Type:         StreamBoundary,
+			Block:        block.index,
+			Offset:       block.Offset,
+			Stream:       a.streams,
+			StreamOffset: block.StreamOffset,
+		})
+	}
+	if a.zeroCRC.enabled && len(block.Data) > 0 && block.CRC == 0 {
+		sendEvent(ctx, a.events, BlockEvent{
+			Type:         ZeroCRC,
+			Block:        block.index,
+			Offset:       block.Offset,
+			StreamOffset: block.StreamOffset,
+		})
+		if a.zeroCRC.strict {
+			return fmt.Errorf("%w: block %v", ErrSuspiciousCRC, block.index)
+		}
+	}
+	if a.expectCRCs != nil && len(block.Data) > 0 {
+		n := a.crcsSeen
+		if n >= len(a.expectCRCs) {
+			return fmt.Errorf("%w: expected %v blocks, got more", ErrBlockCRCMismatch, len(a.expectCRCs))
+		}
+		if got, want := block.CRC, a.expectCRCs[n]; got != want {
+			return fmt.Errorf("%w: block %v: got 0x%08x, want 0x%08x", ErrBlockCRCMismatch, block.index, got, want)
+		}
+		a.crcsSeen++
+	}
+	return nil
+}
+
+// streamFailed must be called when block cannot be decompressed, or
+// ends a stream whose CRC does not match, and returns err as a StreamError.
+// If ContinueAfterStreamError was specified the error is instead recorded
+// and nil is returned, with any remaining blocks in the stream being
+// skipped, see skip.
+func (a *assembler) streamFailed(block *blockDesc, err error) error {
+	stream := a.streams
+	if a.ended {
+		stream++
+	}
+	serr := &StreamError{Stream: stream, Offset: block.StreamOffset, Err: err}
+	if !a.continueStreams {
+		return serr
+	}
+	if a.streamErr == nil {
+		a.streamErr = serr
+	}
+	a.streams = stream
+	a.streamCRC = 0
+	a.ended = true
+	a.skipping, a.skipOffset = true, block.StreamOffset
+	return nil
+}
+
+// skip returns true for blocks that belong to a stream that is being
+// skipped following a call to streamFailed.
+func (a *assembler) skip(block *blockDesc) bool {
+	if a.skipping && block.StreamOffset == a.skipOffset {
+		return true
+	}
+	a.skipping = false
+	return false
+}
+
+// eof returns the error to be returned once all of the blocks have been
+// assembled.
+func (a *assembler) eof() error {
+	if a.streamErr != nil {
+		return a.streamErr
+	}
+	if a.truncated {
+		return ErrTruncated
+	}
+	return io.EOF
+}
 
+// dropTruncated returns true if block, which could not be decompressed,
+// is the incomplete final block of a truncated stream, see
+// BZAllowTruncated, and should be dropped.
+func (a *assembler) dropTruncated(block *blockDesc) bool {
+	if block.truncated {
+		a.truncated = true
+	}
+	return block.truncated
+}
+
+// wait must be called for each block before its output is used and will
+// block until the rate limiter, if any, allows it to be used.
+func (a *assembler) wait(ctx context.Context, block *blockDesc) error {
+	if a.limiter == nil {
+		return nil
+	}
+	return waitN(ctx, a.limiter, len(block.uncompressed))
+}
+
+// waitN waits on the limiter for n events, splitting the wait into
+// chunks of at most the limiter's burst size since WaitN fails for
+// larger requests.
+func waitN(ctx context.Context, l RateLimiter, n int) error {
+	burst := l.Burst()
+	if burst <= 0 {
+		return l.WaitN(ctx, n)
+	}
+	for ; n > 0; n -= burst {
+		m := n
+		if m > burst {
+			m = burst
+		}
+		if err := l.WaitN(ctx, m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// assembled must be called for each block once its output has been used.
+func (a *assembler) assembled(block *blockDesc) error {
+	assertEmitOrder(a.emitted, block.order)
+	a.emitted = block.order
+	if len(block.Data) > 0 {
+		a.blocks++
+		if a.yieldEvery > 0 && a.blocks%a.yieldEvery == 0 {
+			runtime.Gosched()
+		}
+	}
+	if n := block.stats.HuffmanTrees; a.logf != nil && len(block.Data) > 0 && (n < 2 || n > 6) {
+		a.callback(func() {
+			a.logf("pbzip2: block %v uses %v Huffman trees, outside of the standard range of 2..6", block.order, n)
+		})
+	}
+	if n := block.stats.Size; a.logf != nil && n > block.StreamBlockSize {
+		a.callback(func() {
+			a.logf("pbzip2: block %v contains %v bytes, exceeding the declared block size of %v", block.order, n, block.StreamBlockSize)
+		})
+	}
+	a.streamCRC = updateStreamCRC(a.streamCRC, block.CRC)
+	a.updateStats(block)
+	if block.EOS {
+		if got, want := a.streamCRC, block.StreamCRC; got != want && !a.skipStreamCRC {
+			if err := a.streamFailed(block, streamCRCError(block, got, want)); err != nil {
+				return err
+			}
+		} else if !a.skipStreamCRC && len(block.Data) > 0 {
+			// Empty streams, which contain no blocks, are not recorded.
+			a.statsMu.Lock()
+			a.streamCRCs = append(a.streamCRCs, want)
+			a.statsMu.Unlock()
+		}
+		a.streamCRC = 0
+		a.ended = true
+	}
+	if a.verifiedProgress != nil && len(block.uncompressed) > 0 {
+		a.verified += int64(len(block.uncompressed))
+		a.callback(func() { a.verifiedProgress(a.verified) })
+	}
+	if a.progressFn != nil && len(block.Data) > 0 {
+		a.statsMu.Lock()
+		in, out := a.stats.CompressedBytes, a.stats.UncompressedBytes
+		a.statsMu.Unlock()
+		a.callback(func() { a.progressFn(in, out, int64(a.blocks)) })
+	}
+	if a.progressCh != nil {
+		a.progressCh <- Progress{
+			Duration:   block.duration,
+			Block:      block.order,
+			CRC:        block.CRC,
+			Compressed: len(block.Data),
+			Size:       len(block.uncompressed),
+		}
+	}
+	return nil
+}
+
+// callback runs fn, which calls a function supplied by the caller, such that
+// a call to Reader.Close from within that function does not wait for the
+// goroutine running it to exit.
+func (a *assembler) callback(fn func()) {
+	atomic.AddInt32(&a.callbacks, 1)
+	defer atomic.AddInt32(&a.callbacks, -1)
+	fn()
+}
+
+// newBlock is like blockOptions.newBlock except that the block's output
+// is allocated using a.allocator.
+func (a *assembler) newBlock(order uint64, cb CompressedBlock) *blockDesc {
+	block := a.blockOptions.newBlock(order, cb)
+	block.allocator = a.allocator
+	return block
+}
+
+// decompress decompresses block, recording the number of blocks being
+// decompressed concurrently, see Stats.MaxConcurrency.
+func (a *assembler) decompress(block *blockDesc) {
+	n := atomic.AddInt32(&a.active, 1)
+	for {
+		max := atomic.LoadInt32(&a.maxActive)
+		if n <= max || atomic.CompareAndSwapInt32(&a.maxActive, max, n) {
+			break
+		}
+	}
+	block.decompress()
+	atomic.AddInt32(&a.active, -1)
+}
+
+func (a *assembler) updateStats(block *blockDesc) {
+	a.statsMu.Lock()
+	defer a.statsMu.Unlock()
+	a.stats.CompressedBytes += int64(len(block.Data))
+	a.stats.UncompressedBytes += int64(len(block.uncompressed))
+	a.stats.WorkerCPUTime += block.duration
+	if a.blockTimings {
+		a.stats.DecodeTime += block.duration
+	}
+	if len(block.Data) == 0 {
+		return
+	}
+	a.stats.RunningCRC = a.streamCRC
+	a.stats.BlocksDecoded++
+	a.stats.BlockBitOffsets = append(a.stats.BlockBitOffsets, block.Offset-int64(len(blockMagic)*8))
+	if a.blockStats {
+		a.stats.BlockStats = append(a.stats.BlockStats, block.stats)
+	}
+}
+
+// verifiedStreamCRCs returns the CRCs of the streams verified so far, or
+// nil if the last block assembled did not end a stream. It must only be
+// called once all of the blocks have been assembled.
+func (a *assembler) verifiedStreamCRCs() []uint32 {
+	if !a.ended {
+		return nil
+	}
+	a.statsMu.Lock()
+	defer a.statsMu.Unlock()
+	return append([]uint32(nil), a.streamCRCs...)
+}
+
+// Stats returns the statistics for the blocks that have been decompressed
+// and reassembled so far.
+func (a *assembler) Stats() Stats {
+	a.statsMu.Lock()
+	defer a.statsMu.Unlock()
+	stats := a.stats
+	stats.MaxConcurrency = int(atomic.LoadInt32(&a.maxActive))
+	stats.BlockStats = append([]BlockStats(nil), a.stats.BlockStats...)
+	stats.BlockBitOffsets = append([]int64(nil), a.stats.BlockBitOffsets...)
+	return stats
 }
 
 func (dc *Decompressor) assemble(ctx context.Context, ch <-chan *blockDesc) {
 	defer dc.pwr.Close()
+	// Make sure that any workers blocked on sending their output are
+	// released if assembly is abandoned because of an error.
+	defer drain(ctx, ch, dc.allocator)
+	defer dc.releasePending()
+	// Make sure that any workers waiting on the buffer limit are released
+	// before draining their output.
+	defer dc.limit.close()
 	expected := uint64(1)
 	for {
 		dc.trace("assemble select")
@@ -328,6 +1313,12 @@ func (dc *Decompressor) assemble(ctx context.Context, ch <-chan *blockDesc) {
 		case block := <-ch:
 			dc.trace("assemble: %v", block)
 			if block != nil {
+				dc.buffer(len(block.uncompressed))
+				// The next block in order is written immediately
+				// and need not pass through the reorder buffer.
+				if block.order != expected {
+					dc.store(block)
+				}
 				heap.Push(dc.heap, block)
 			}
 			for len(*dc.heap) > 0 {
@@ -337,39 +1328,59 @@ func (dc *Decompressor) assemble(ctx context.Context, ch <-chan *blockDesc) {
 				}
 				heap.Remove(dc.heap, 0)
 				expected++
+				dc.limit.advance(expected)
+				if err := dc.retrieve(min); err != nil {
+					dc.pwr.CloseWithError(err)
+					return
+				}
+				size := len(min.uncompressed)
+				if dc.skip(min) {
+					dc.allocator.release(min)
+					dc.limit.release(min)
+					dc.buffer(-size)
+					continue
+				}
 				if err := min.err; err != nil {
-					if !dc.tryMergeBlocks(ctx, ch, min) {
-						dc.pwr.CloseWithError(err)
+					merged, merr := dc.tryMergeBlocks(ctx, ch, min)
+					if merr != nil {
+						dc.pwr.CloseWithError(merr)
 						return
 					}
+					if !merged {
+						dc.failed(ctx, min)
+						min.err = err
+						if dc.dropTruncated(min) {
+							dc.allocator.release(min)
+							dc.limit.release(min)
+							dc.buffer(-size)
+							continue
+						}
+						if err := dc.streamFailed(min, blockError(min)); err != nil {
+							dc.pwr.CloseWithError(err)
+							return
+						}
+						dc.allocator.release(min)
+						dc.limit.release(min)
+						dc.buffer(-size)
+						continue
+					}
 					// merge was successful, so bump up the next
 					// expected block number.
 					expected++
+					dc.limit.advance(expected)
 				}
-				if _, err := dc.pwr.Write(min.uncompressed); err != nil {
+				if err := dc.emit(ctx, min); err != nil {
 					dc.pwr.CloseWithError(err)
 					return
 				}
-				dc.streamCRC = updateStreamCRC(dc.streamCRC, min.CRC)
-				if min.EOS {
-					if got, want := dc.streamCRC, min.StreamCRC; got != want {
-						dc.pwr.CloseWithError(fmt.Errorf("mismatched stream CRCs: calculated=0x%08x != stored=0x%08x", got, want))
-						return
-					}
-					dc.streamCRC = 0
-				}
-
-				if dc.progressCh != nil {
-					dc.progressCh <- Progress{
-						Duration:   min.duration,
-						Block:      min.order,
-						CRC:        min.CRC,
-						Compressed: len(min.Data),
-						Size:       len(min.uncompressed),
-					}
-				}
+				dc.limit.release(min)
+				dc.buffer(-size)
 			}
 			if block == nil && len(*dc.heap) == 0 {
+				dc.warnIdleWorkers()
+				if err := dc.eof(); err != io.EOF {
+					dc.pwr.CloseWithError(err)
+				}
 				return
 			}
 		case <-ctx.Done():
@@ -381,6 +1392,70 @@ func (dc *Decompressor) assemble(ctx context.Context, ch <-chan *blockDesc) {
 	}
 }
 
+// emit writes the output of block, which must be the next block in order,
+// and releases its buffer once it has been written.
+func (dc *Decompressor) emit(ctx context.Context, block *blockDesc) error {
+	defer dc.allocator.release(block)
+	if err := dc.check(ctx, block); err != nil {
+		return err
+	}
+	if err := dc.wait(ctx, block); err != nil {
+		return err
+	}
+	if dc.isAborted() {
+		return io.EOF
+	}
+	if _, err := dc.pwr.Write(block.uncompressed); err != nil {
+		return err
+	}
+	return dc.assembled(block)
+}
+
+// releasePending releases the buffers of any blocks that were not written
+// because assembly was abandoned.
+func (dc *Decompressor) releasePending() {
+	if dc.allocator == nil {
+		return
+	}
+	for len(*dc.heap) > 0 {
+		block := heap.Pop(dc.heap).(*blockDesc)
+		if err := dc.retrieve(block); err != nil {
+			// Assembly has already been abandoned, so the error
+			// will not replace the one that caused it.
+			dc.pwr.CloseWithError(err)
+			continue
+		}
+		dc.allocator.release(block)
+	}
+}
+
+// warnIdleWorkers logs a warning if more workers were configured than there
+// were blocks to decompress, if requested via WarnIdleWorkers.
+func (dc *Decompressor) warnIdleWorkers() {
+	if dc.warnIdle && dc.logf != nil && dc.concurrency > dc.blocks {
+		dc.logf("pbzip2: concurrency of %v exceeds the number of blocks, %v, %v workers were idle", dc.concurrency, dc.blocks, dc.concurrency-dc.blocks)
+	}
+}
+
+// drain discards all outstanding blocks, releasing their buffers, until ch
+// is closed by Finish or ctx is canceled, in which case the workers will
+// not send any more blocks.
+func drain(ctx context.Context, ch <-chan *blockDesc, ba *bufferAllocator) {
+	for {
+		select {
+		case block, ok := <-ch:
+			if !ok {
+				return
+			}
+			if block != nil {
+				ba.release(block)
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
 // Read implements io.Reader on the decompressed stream.
 func (dc *Decompressor) Read(buf []byte) (int, error) {
 	return dc.prd.Read(buf)
@@ -0,0 +1,66 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"sync"
+)
+
+// pauseGate is used to implement Reader.Pause and Reader.Resume.
+type pauseGate struct {
+	mu      sync.Mutex
+	resumed chan struct{} // non-nil whilst paused, closed by resume.
+}
+
+func (g *pauseGate) pause() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed == nil {
+		g.resumed = make(chan struct{})
+	}
+}
+
+func (g *pauseGate) resume() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if g.resumed != nil {
+		close(g.resumed)
+		g.resumed = nil
+	}
+}
+
+// wait blocks whilst paused, or until ctx is canceled.
+func (g *pauseGate) wait(ctx context.Context) error {
+	for {
+		g.mu.Lock()
+		resumed := g.resumed
+		g.mu.Unlock()
+		if resumed == nil {
+			return nil
+		}
+		select {
+		case <-resumed:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Pause stops any further blocks from being scanned and dispatched for
+// decompression until Resume is called, without canceling any of the
+// blocks that are already being decompressed. Read continues to return
+// the output of those blocks and then blocks until Resume is called, the
+// Reader is closed or its context is canceled. Pause and Resume may be
+// called concurrently with Read and calling either more than once has
+// no further effect.
+func (rd *Reader) Pause() {
+	rd.gate.pause()
+}
+
+// Resume resumes decompression after a call to Pause.
+func (rd *Reader) Resume() {
+	rd.gate.resume()
+}
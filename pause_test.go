@@ -0,0 +1,75 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func TestPauseResume(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB1"
+	compressed, _ := readFile(t, name)
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		buf := make([]byte, 1024)
+		n, err := rd.Read(buf)
+		if err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		data := append([]byte{}, buf[:n]...)
+
+		rd.Pause()
+		doneCh := make(chan error, 1)
+		go func() {
+			rest, err := io.ReadAll(rd)
+			data = append(data, rest...)
+			doneCh <- err
+		}()
+		// Allow any block that was being scanned when Pause was called to
+		// be dispatched.
+		time.Sleep(100 * time.Millisecond)
+		scanned := rd.Stats().BlocksScanned
+		time.Sleep(200 * time.Millisecond)
+		if got, want := rd.Stats().BlocksScanned, scanned; got != want {
+			t.Errorf("concurrency %v: blocks were dispatched whilst paused: got %v, want %v", concurrency, got, want)
+		}
+		select {
+		case err := <-doneCh:
+			t.Fatalf("concurrency %v: reading completed whilst paused: %v", concurrency, err)
+		default:
+		}
+
+		rd.Resume()
+		if err := <-doneCh; err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %v..., want %v...", concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+	}
+
+	// Canceling the context releases a paused Read.
+	cctx, cancel := context.WithCancel(ctx)
+	rd := pbzip2.NewReader(cctx, bytes.NewReader(compressed))
+	rd.Pause()
+	time.AfterFunc(100*time.Millisecond, cancel)
+	if _, err := io.ReadAll(rd); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+}
@@ -0,0 +1,248 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
+)
+
+// PreviewBytes returns at most the first n bytes of the decompressed stream
+// read from rd. Blocks are decompressed serially and only as much of
+// the last block as is needed to provide n bytes is decompressed, hence
+// the CRC for that block cannot be, and is not, verified. The CRCs of
+// all preceding blocks are verified. Fewer than n bytes will be returned
+// if the stream is smaller than n bytes. An error is returned if n is
+// negative.
+func PreviewBytes(ctx context.Context, rd io.Reader, n int) ([]byte, error) {
+	if n < 0 {
+		return nil, fmt.Errorf("invalid preview size: %v", n)
+	}
+	sc := NewScanner(rd)
+	out := []byte{}
+	for len(out) < n && sc.Scan(ctx) {
+		block := sc.Block()
+		if cap(out) == 0 {
+			// Avoid allocating n bytes up front since n may be much larger
+			// than the stream, let append grow the buffer thereafter.
+			size := n
+			if size > block.StreamBlockSize {
+				size = block.StreamBlockSize
+			}
+			out = make([]byte, 0, size)
+		}
+		brd := bzip2.NewBlockReader(block.StreamBlockSize, block.Data, block.BitOffset)
+		for len(out) < n {
+			if len(out) == cap(out) {
+				out = append(out, 0)[:len(out)]
+			}
+			end := cap(out)
+			if end > n {
+				end = n
+			}
+			read, err := brd.Read(out[len(out):end])
+			out = out[:len(out)+read]
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return out, err
+			}
+		}
+	}
+	return out, sc.Err()
+}
+
+// FirstBlock returns the decompressed contents of the first block of the
+// stream read from rd, for example, to sniff the type of its content. The
+// block is decompressed synchronously, without using any additional
+// goroutines, and its CRC is verified, but the rest of the stream is
+// neither read nor verified, including the stream CRC. Options that do
+// not apply to the decompression of individual blocks are rejected, see
+// ErrUnsupportedOption. It returns an empty slice for an empty stream.
+func FirstBlock(ctx context.Context, rd io.Reader, opts ...ReaderOption) ([]byte, error) {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	if err := rdOpts.unsupportedOption(false); err != nil {
+		return nil, err
+	}
+	sc := NewScanner(rd, rdOpts.scanOpts...)
+	for sc.Scan(ctx) {
+		block := rdOpts.newBlock(1, sc.Block())
+		if len(block.Data) == 0 {
+			continue
+		}
+		block.decompress()
+		if block.err != nil {
+			return nil, blockError(block)
+		}
+		return block.uncompressed, nil
+	}
+	return []byte{}, sc.Err()
+}
+
+// CountBlocks returns the number of compressed blocks in the stream, or
+// concatenated streams, read from rd. Only the scanner is run, that is,
+// the blocks are located by their magic numbers but are not decompressed
+// and hence it is much faster than decompressing the entire stream. Note
+// that since the blocks are not decompressed, none of the CRCs are
+// verified and a false positive match of the block magic number within
+// a block, which is extremely unlikely, will be counted as an additional
+// block.
+func CountBlocks(ctx context.Context, rd io.Reader) (int, error) {
+	sc := NewScanner(rd)
+	n := 0
+	for sc.Scan(ctx) {
+		if len(sc.Block().Data) > 0 {
+			n++
+		}
+	}
+	return n, sc.Err()
+}
+
+// DumpStructure writes a textual description of the structure of the
+// stream, or concatenated streams, read from rd to w, for debugging
+// corrupt files. Each stream is described by the offset, in bytes, and
+// contents of its header, followed by the offset and size, in bits, and
+// the CRC of each of its blocks, and finally by its trailer, for example:
+//
+//	stream 1: offset 0: BZh9: block size 900000
+//	  block 1: offset 80, size 253, crc 0x4eece836
+//	  trailer: stream crc 0x4eece836
+//
+// Like CountBlocks, only the scanner is run and hence none of the CRCs are
+// verified. Empty streams that follow another stream are not reported.
+// Any error encountered by the scanner is returned once the structure of
+// the input that precedes it has been written.
+func DumpStructure(ctx context.Context, rd io.Reader, w io.Writer) error {
+	sc := NewScanner(rd)
+	stream, block := 0, 0
+	var err error
+	printf := func(format string, args ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, args...)
+		}
+	}
+	ended := true
+	for sc.Scan(ctx) {
+		b := sc.Block()
+		if ended {
+			stream++
+			level := b.StreamBlockSize / (100 * 1000)
+			printf("stream %v: offset %v: BZh%v: block size %v\n", stream, b.StreamOffset, level, b.StreamBlockSize)
+		}
+		if len(b.Data) > 0 {
+			block++
+			printf("  block %v: offset %v, size %v, crc 0x%08x\n", block, b.Offset, b.SizeInBits, b.CRC)
+		}
+		if ended = b.EOS; ended {
+			printf("  trailer: stream crc 0x%08x\n", b.StreamCRC)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return sc.Err()
+}
+
+// PlanConcurrency returns the number of goroutines that a Reader created
+// by NewReader, for rd and with the same options, would use to decompress
+// blocks, without decompressing any of them. This is 1 if the blocks would
+// be decompressed serially, either because of the options specified or
+// because rd is an in-memory reader that contains a single block (see
+// NewReader), and otherwise the concurrency requested via BZConcurrency,
+// or GOMAXPROCS by default, regardless of the number of blocks, see
+// WarnIdleWorkers. Unless the blocks would be decompressed serially
+// regardless of the input, the scanner is run, with the same options as
+// for the Reader, up to the first non-empty block, so that, as for
+// CountBlocks, no CRCs are verified.
+func PlanConcurrency(ctx context.Context, rd io.Reader, opts ...ReaderOption) (int, error) {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	if rdOpts.invalid != nil {
+		return 0, rdOpts.invalid
+	}
+	rdOpts.probeSource(rd)
+	if serial, workers := rdOpts.decompression(false); serial {
+		return workers, nil
+	}
+	sc := NewScanner(rd, rdOpts.scannerOptions()...)
+	_, single := probeBlocks(ctx, sc)
+	if err := sc.Err(); err != nil {
+		return 0, err
+	}
+	_, workers := rdOpts.decompression(single)
+	return workers, nil
+}
+
+// HasMultipleBlocksWithin returns true if a second compressed block starts
+// within the first compressedLimit bytes of the stream, or concatenated
+// streams, read from rd. It can be used to determine if parallel
+// decompression of that prefix is worthwhile. Only the scanner is run and
+// it stops as soon as the second block is found, so at most compressedLimit
+// bytes are read from rd. As for CountBlocks, no CRCs are verified.
+func HasMultipleBlocksWithin(ctx context.Context, rd io.Reader, compressedLimit int64) (bool, error) {
+	// The input will typically be truncated part way through a block.
+	sc := NewScanner(io.LimitReader(rd, compressedLimit), AllowMissingTrailer(true))
+	for sc.Scan(ctx) {
+		if len(sc.Block().Data) == 0 {
+			continue
+		}
+		// The scanner has found the start of the next block unless
+		// it has reached the end of the limited input.
+		return !sc.done, nil
+	}
+	return false, sc.Err()
+}
+
+// Peeker is implemented by readers, such as bufio.Reader, that can return
+// upcoming bytes without consuming them.
+type Peeker interface {
+	Peek(n int) ([]byte, error)
+}
+
+// ProbeHeader validates the stream header at the start of rd and returns
+// the stream's block size in bytes. It also returns an io.Reader that
+// will return all of the input, including the header, and that should be
+// used in place of rd thereafter. If rd implements Peeker then the header
+// is not consumed and rd itself is returned, so that, for example,
+// a bufio.Reader may continue to be used directly. Otherwise the header
+// is read from rd and buffered by the returned reader.
+func ProbeHeader(rd io.Reader) (int, io.Reader, error) {
+	if p, ok := rd.(Peeker); ok {
+		header, err := p.Peek(4)
+		if err != nil {
+			return -1, rd, probeError(header, err)
+		}
+		size, err := parseHeader(header)
+		return size, rd, err
+	}
+	var header [4]byte
+	n, err := io.ReadFull(rd, header[:])
+	prd := io.MultiReader(bytes.NewReader(header[:n]), rd)
+	if err != nil {
+		return -1, prd, probeError(header[:n], err)
+	}
+	size, err := parseHeader(header[:])
+	return size, prd, err
+}
+
+func probeError(header []byte, err error) error {
+	if len(header) == 0 && err == io.EOF {
+		return emptyStreamError()
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return notBzip2(header, shortHeaderError(len(header)))
+	}
+	return fmt.Errorf("failed to read stream header: %v", err)
+}
@@ -0,0 +1,89 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"io"
+
+	"github.com/cosnicolaou/pbzip2/internal/bitstream"
+)
+
+// BlockScanner returns the compressed blocks of a bzip2 stream, or
+// concatenated streams, without decompressing them, for example,
+// to create a new stream from a subset of the blocks. Such a stream
+// consists of a header, as returned by StreamHeader, followed by the
+// bitwise concatenation of the blocks, as returned by Block, the end of
+// stream magic number, the stream CRC and padding to a byte boundary.
+// The stream CRC is computed from the block CRCs, in order, by rotating
+// the current value left by one bit and then xor'ing in the block's CRC.
+// Note that the block magic number may occur by chance within the
+// compressed data, in which case a block will be returned as two separate
+// blocks; these must be retained or dropped together.
+type BlockScanner struct {
+	sc     *Scanner
+	header []byte
+	data   []byte
+	bits   int
+}
+
+// NewBlockScanner returns a BlockScanner for the bzip2 data read from r.
+func NewBlockScanner(r io.Reader, opts ...ScannerOption) *BlockScanner {
+	return &BlockScanner{sc: NewScanner(r, opts...)}
+}
+
+// Scan advances to the next block, it returns false when there are no
+// more blocks or an error is encountered.
+func (bs *BlockScanner) Scan() bool {
+	for bs.sc.Scan(context.Background()) {
+		block := bs.sc.Block()
+		if len(block.Data) == 0 {
+			continue
+		}
+		bw := &bitstream.BitWriter{}
+		bw.Init(blockMagic[:], len(blockMagic)*8, len(block.Data)+len(blockMagic)+1)
+		bw.Append(block.Data, block.BitOffset, block.SizeInBits)
+		bs.data, bs.bits = bw.Data()
+		bs.data = bs.data[:(bs.bits+7)/8]
+		if trailing := bs.bits % 8; trailing != 0 {
+			bs.data[len(bs.data)-1] &= 0xff << (8 - trailing)
+		}
+		level := block.StreamBlockSize / (100 * 1000)
+		bs.header = []byte{'B', 'Z', 'h', byte('0' + level)}
+		return true
+	}
+	return false
+}
+
+// Block returns the current block, including its leading block magic
+// number, as a bitstream that starts at the first bit of the returned
+// slice and is BlockSizeInBits long. Any bits in the last byte beyond
+// the end of the block are zero. The returned slice is only valid until
+// the next call to Scan.
+func (bs *BlockScanner) Block() []byte {
+	return bs.data
+}
+
+// BlockSizeInBits returns the size, in bits, of the current block.
+func (bs *BlockScanner) BlockSizeInBits() int {
+	return bs.bits
+}
+
+// BlockCRC returns the CRC of the current block's decompressed output as
+// stored in the block.
+func (bs *BlockScanner) BlockCRC() uint32 {
+	return bs.sc.Block().CRC
+}
+
+// StreamHeader returns the four byte header, that is, the magic number,
+// version and block size, of the stream that contains the current block.
+func (bs *BlockScanner) StreamHeader() []byte {
+	return bs.header
+}
+
+// Err returns any error encountered by the scanner.
+func (bs *BlockScanner) Err() error {
+	return bs.sc.Err()
+}
@@ -0,0 +1,137 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+// bitBuffer appends bitstreams that start at the first bit of a slice.
+type bitBuffer struct {
+	data []byte
+	bits int
+}
+
+func (bb *bitBuffer) append(data []byte, bits int) {
+	for i := 0; i < bits; i++ {
+		if bb.bits%8 == 0 {
+			bb.data = append(bb.data, 0)
+		}
+		if data[i/8]&(0x80>>(i%8)) != 0 {
+			bb.data[len(bb.data)-1] |= 0x80 >> (bb.bits % 8)
+		}
+		bb.bits++
+	}
+}
+
+type rawBlock struct {
+	data []byte
+	bits int
+	crc  uint32
+}
+
+// newStream creates a bzip2 stream from the supplied blocks.
+func newStream(header []byte, blocks []rawBlock) []byte {
+	bb := &bitBuffer{}
+	bb.append(header, len(header)*8)
+	var streamCRC uint32
+	for _, b := range blocks {
+		bb.append(b.data, b.bits)
+		streamCRC = (streamCRC<<1 | streamCRC>>31) ^ b.crc
+	}
+	bb.append([]byte{0x17, 0x72, 0x45, 0x38, 0x50, 0x90}, 48)
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], streamCRC)
+	bb.append(crc[:], 32)
+	return bb.data
+}
+
+func TestBlockScanner(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB1"
+	compressed, _ := readFile(t, name)
+	bs := pbzip2.NewBlockScanner(bytes.NewReader(compressed))
+	var blocks []rawBlock
+	var header []byte
+	for bs.Scan() {
+		header = bs.StreamHeader()
+		blocks = append(blocks, rawBlock{
+			data: append([]byte{}, bs.Block()...),
+			bits: bs.BlockSizeInBits(),
+			crc:  bs.BlockCRC(),
+		})
+	}
+	if err := bs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := string(header), "BZh1"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	n, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(blocks), n; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	decompress := func(stream []byte) []byte {
+		data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(stream)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return data
+	}
+
+	// Each block may be decompressed on its own.
+	var outputs [][]byte
+	for _, b := range blocks {
+		outputs = append(outputs, decompress(newStream(header, []rawBlock{b})))
+	}
+	if got, want := bytes.Join(outputs, nil), bzip2Data[name]; !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+
+	// A subset of the blocks.
+	var even []rawBlock
+	var want []byte
+	for i := 0; i < len(blocks); i += 2 {
+		even = append(even, blocks[i])
+		want = append(want, outputs[i]...)
+	}
+	if got := decompress(newStream(header, even)); !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+
+	// Concatenated streams, including an empty one.
+	compressed, _ = concatFiles(t, "hello", "empty", "300KB1")
+	bs = pbzip2.NewBlockScanner(bytes.NewReader(compressed))
+	var headers []string
+	for bs.Scan() {
+		headers = append(headers, string(bs.StreamHeader()))
+	}
+	if err := bs.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(headers), 1+4; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	bs = pbzip2.NewBlockScanner(bytes.NewReader([]byte("not a bzip2 stream")))
+	if bs.Scan() {
+		t.Errorf("expected Scan to fail")
+	}
+	if !errors.Is(bs.Err(), pbzip2.ErrBadMagic) {
+		t.Errorf("got %v, want %v", bs.Err(), pbzip2.ErrBadMagic)
+	}
+}
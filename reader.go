@@ -5,19 +5,297 @@
 package pbzip2
 
 import (
+	"bufio"
+	"bytes"
 	"context"
+	"fmt"
+	"hash"
 	"io"
+	"os"
+	"reflect"
 	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
 type readerOpts struct {
-	decOpts  []DecompressorOption
-	scanOpts []ScannerOption
+	blockOptions
+	decOpts          []DecompressorOption
+	scanOpts         []ScannerOption
+	probe            bool  // set if the input is to be probed, see probeInput.
+	invalid          error // set for the first option with an invalid value.
+	onStreamBoundary func(streamIndex int, offset int64)
+	blockStats       bool
+	blockTimings     bool
+	limiter          RateLimiter
+	maxCPUTime       time.Duration
+	logf             func(format string, args ...interface{})
+	warnIdle         bool
+	stopAt           []byte
+	filter           func(index int, storedCRC uint32) bool
+	maxSources       int
+	verifiedProgress func(verified int64)
+	events           chan<- BlockEvent
+	retryAttempts    int
+	retryBackoff     time.Duration
+	retryable        func(error) bool
+	frameSize        int
+	reorder          ReorderBuffer
+	prewarm          bool
+	expectLen        int64
+	checkLen         bool
+	allocator        *bufferAllocator
+	cacheSize        int
+	totalTimeout     time.Duration
+	unordered        bool
+	zeroCopy         bool
+	lengthHint       int64
+	highWater        int
+	onHighWater      func(current int)
+	yieldEvery       int
+	ownsSource       bool
+	statsCh          chan<- Stats
+	statsEvery       time.Duration
+	checksumKind     ChecksumKind
+	checksumSize     int
+	readTimeout      time.Duration
+	zeroCRC          zeroCRC
+	expectCRCs       []uint32
+	continueStreams  bool
+}
+
+// configure applies the options that are implemented by the assembler.
+func (o *readerOpts) configure(a *assembler) {
+	a.onStream = o.onStreamBoundary
+	a.blockStats = o.blockStats
+	a.blockTimings = o.blockTimings
+	a.limiter = o.limiter
+	a.maxCPUTime = o.maxCPUTime
+	a.logf = o.logf
+	a.warnIdle = o.warnIdle
+	a.verifiedProgress = o.verifiedProgress
+	a.events = o.events
+	a.blockOptions = o.blockOptions
+	a.yieldEvery = o.yieldEvery
+	a.zeroCRC = o.zeroCRC
+	a.expectCRCs = o.expectCRCs
+	a.continueStreams = o.continueStreams
+	a.allocator = o.allocator
+	if a.allocator == nil {
+		a.allocator = poolAllocator(newDecompressorOpts(o.decOpts).bufferPool)
+	}
+	a.highWater, a.onHighWater = o.highWater, o.onHighWater
+	if o.reorder != nil {
+		a.reorder = o.reorder
+	}
+	// The stream CRC cannot be verified if blocks are skipped.
+	a.skipStreamCRC = o.filter != nil
 }
 
 // ReaderOption represents an option to NewReader.
 type ReaderOption func(o *readerOpts)
 
+// FrameSize requests that WriteTo write the decompressed output in frames
+// of exactly n bytes, using one call to Write per frame, with only the
+// final frame being smaller. It has no effect on Read.
+func FrameSize(n int) ReaderOption {
+	return func(o *readerOpts) {
+		o.frameSize = n
+	}
+}
+
+// SmallMemory requests the equivalent of the bzip2 -s option, that is,
+// that blocks be decompressed using a slower inverse BWT that requires
+// 2.5 rather than 4 bytes per byte of block size. The output is identical.
+func SmallMemory(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.smallMemory = v
+	}
+}
+
+// MaxHuffmanTrees widens the range of the number of Huffman trees that a
+// block may use from the 2 to 6 required by bzip2 to 1 to the larger of 6
+// and n, to allow for the output of non-conformant encoders. Blocks that
+// are accepted without it are therefore always accepted with it. n must be
+// between 1 and 7, the largest number that can be encoded, otherwise an
+// error that wraps ErrInvalidOption is returned by the first Read, by
+// PlanConcurrency and by the functions that reject unsupported options,
+// see ErrUnsupportedOption. Blocks that use a number of trees outside of the
+// standard range are logged via the function supplied to WithLogger, if
+// any. Blocks that use no trees are always rejected.
+func MaxHuffmanTrees(n int) ReaderOption {
+	return func(o *readerOpts) {
+		if n < 1 || n > 7 {
+			o.invalidOption(fmt.Errorf("%w: MaxHuffmanTrees(%v) is outside of the range 1..7", ErrInvalidOption, n))
+			return
+		}
+		o.maxTrees = n
+	}
+}
+
+// MTFShiftThreshold sets the distance below which the move-to-front decoder
+// moves each symbol to the front of its list by shifting the symbols ahead
+// of it one at a time rather than by a single copy. The default of zero
+// always uses copy since, when benchmarked via BenchmarkMTFDecode and
+// BenchmarkMTFShiftThreshold in the internal bzip2 package, no threshold
+// was consistently faster; those benchmarks may be used to choose a
+// threshold for a given platform. The output is identical regardless of
+// the threshold. A negative n results in an error that wraps
+// ErrInvalidOption, as for MaxHuffmanTrees.
+func MTFShiftThreshold(n int) ReaderOption {
+	return func(o *readerOpts) {
+		if n < 0 {
+			o.invalidOption(fmt.Errorf("%w: MTFShiftThreshold(%v) is negative", ErrInvalidOption, n))
+			return
+		}
+		o.mtfThreshold = n
+	}
+}
+
+// AllowOversizeBlocks requests that blocks that exceed the block size
+// declared by their stream's header, as produced by some broken encoders,
+// be accepted rather than rejected with ErrBadBlockSize, provided that they
+// exceed it by no more than an eighth. The tables used to decompress such
+// blocks are grown as needed. Oversize blocks are logged via the function
+// supplied to WithLogger, if any.
+func AllowOversizeBlocks(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.oversize = v
+	}
+}
+
+// FlagZeroCRC requests that non-empty blocks whose stored CRC is zero,
+// which is almost always a sign of corruption in practice, be flagged.
+// Such blocks are reported as ZeroCRC events to the channel supplied
+// to WithEventChannel, if any, and if strict is true, Read returns an
+// error that wraps ErrSuspiciousCRC rather than the block's output.
+func FlagZeroCRC(strict bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.zeroCRC = zeroCRC{enabled: true, strict: strict}
+	}
+}
+
+// zeroCRC is set by FlagZeroCRC.
+type zeroCRC struct {
+	enabled, strict bool
+}
+
+// WithCRC requests that the CRC of each block be computed using a hash
+// returned by newCRC, rather than the CRC used by bzip2, for forks of the
+// bzip2 format that use a different CRC. newCRC is called once for each
+// attempt at decompressing a block. The stream CRC is still computed by
+// combining the block CRCs as for bzip2. NewCRC returns the CRC used by
+// bzip2.
+func WithCRC(newCRC func() hash.Hash32) ReaderOption {
+	return func(o *readerOpts) {
+		o.newCRC = newCRC
+	}
+}
+
+// NewCRC returns a hash.Hash32 that computes the CRC used by bzip2, that
+// is, CRC-32 with the bits of each byte processed in the reverse of the
+// order used by hash/crc32.
+func NewCRC() hash.Hash32 {
+	return bzip2.NewCRC()
+}
+
+// YieldEvery requests that runtime.Gosched be called each time that the
+// output of another n blocks has been assembled, to give other goroutines
+// an opportunity to run, for example in a program that is sensitive to
+// scheduling latency or that limits GOMAXPROCS. Yielding improves
+// fairness for other goroutines at the cost of increased latency, and
+// hence reduced throughput, for Read whenever another goroutine is
+// scheduled in its place. By default Read never yields.
+func YieldEvery(n int) ReaderOption {
+	return func(o *readerOpts) {
+		o.yieldEvery = n
+	}
+}
+
+// OwnsSource requests that Close also close the source of the compressed
+// data, that is, the io.Reader passed to NewReader, each of the readers
+// passed to NewReaderMulti or the io.ReaderAt passed to
+// NewReaderWithBoundaries, if it implements io.Closer. By default the
+// Reader does not own its source and never closes it.
+func OwnsSource(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.ownsSource = v
+	}
+}
+
+// WithStatsChannel requests that a snapshot of the Reader's Stats be sent
+// on ch every interval whilst decompressing, for example to update a live
+// dashboard. A snapshot is dropped rather than delaying decompression if
+// ch is not ready to receive it. A final snapshot is sent, blocking until
+// it is received or the Reader is closed, once Read returns an error,
+// including io.EOF, after which ch is closed; ch is also closed if the
+// context passed to NewReader is canceled or the Reader is closed, and
+// hence must not be shared by multiple Readers.
+func WithStatsChannel(ch chan<- Stats, every time.Duration) ReaderOption {
+	return func(o *readerOpts) {
+		o.statsCh = ch
+		o.statsEvery = every
+	}
+}
+
+// ExpectDecompressedLength requests that the final call to Read, the
+// one that would otherwise return io.EOF, return an error that wraps
+// ErrLengthMismatch if the total number of bytes returned by Read differs
+// from n, for example, when n is recorded in a manifest. The length is
+// not checked if decompression is ended early by StopAtBytes or Abort.
+func ExpectDecompressedLength(n int64) ReaderOption {
+	return func(o *readerOpts) {
+		o.expectLen = n
+		o.checkLen = true
+	}
+}
+
+// ContinueAfterStreamError requests that when reading concatenated streams
+// a stream that cannot be decompressed, because one of its blocks cannot
+// be decompressed, or whose CRC does not match that stored for it, be
+// skipped rather than ending decompression. Any remaining blocks in the
+// stream are discarded and decompression continues with the next stream.
+// The StreamError for the first such stream is returned by Read once
+// all of the remaining streams have been read, in place of io.EOF. Note
+// that the output of the blocks that precede the one that could not be
+// decompressed, and of all the blocks of a stream whose CRC does not
+// match, will already have been returned by Read. Errors encountered
+// when scanning the input are not recoverable and are returned
+// immediately.
+func ContinueAfterStreamError(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.continueStreams = v
+	}
+}
+
+// ExpectBlockCRCs requests that the stored CRC of each non-empty block be
+// compared, in order, against crcs, for example, as recorded in a manifest,
+// and that Read return an error that wraps ErrBlockCRCMismatch as soon as
+// one differs, or, in place of io.EOF, if the stream contains fewer blocks
+// than crcs. Since the CRC computed for each block is always compared
+// against its stored CRC this detects blocks that have been reordered or
+// substituted as well as corrupted. The number of blocks is not checked
+// if decompression is ended early by StopAtBytes or Abort.
+func ExpectBlockCRCs(crcs []uint32) ReaderOption {
+	return func(o *readerOpts) {
+		o.expectCRCs = append([]uint32{}, crcs...)
+	}
+}
+
+// TotalTimeout limits the time allowed for decompressing the entire
+// stream, measured from the creation of the Reader, to d. Once d has
+// elapsed all of the goroutines used for decompression are stopped and
+// Read returns ErrDeadlineExceeded, unless it has already returned
+// io.EOF or another error. It is an alternative to using a context with
+// a deadline.
+func TotalTimeout(d time.Duration) ReaderOption {
+	return func(o *readerOpts) {
+		o.totalTimeout = d
+	}
+}
+
 // ScannerOptions passes a ScannerOption to the underlying scanner created by
 // NewReader.
 func ScannerOptions(opts ...ScannerOption) ReaderOption {
@@ -34,45 +312,445 @@ func DecompressionOptions(opts ...DecompressorOption) ReaderOption {
 	}
 }
 
-type reader struct {
-	ctx   context.Context
-	errCh chan error
-	wg    *sync.WaitGroup
-	dc    *Decompressor
+// OnStreamBoundary requests that fn be called each time that a new bzip2
+// stream is encountered after the trailer of a previous one when reading
+// concatenated streams. The index of the new stream, starting at 1 for the
+// second stream, and the offset, in bytes, of its header in the compressed
+// input are passed to fn. fn is called in output order, before any of the
+// new stream's data is returned by Read, and must not block. Empty streams
+// are not reported since they contain no blocks.
+func OnStreamBoundary(fn func(streamIndex int, offset int64)) ReaderOption {
+	return func(o *readerOpts) {
+		o.onStreamBoundary = fn
+	}
+}
+
+// VerifiedProgress requests that fn be called once each block has been
+// decompressed and its CRC verified, and, for the last block in a stream,
+// the stream's CRC has also been verified. fn is passed the cumulative
+// number of decompressed bytes verified so far and is called in output
+// order, typically before that block's data is returned by Read. It must
+// not block. Unlike the updates sent via BZSendUpdates it is intended for
+// callers that need to checkpoint data that is known to be intact.
+func VerifiedProgress(fn func(verified int64)) ReaderOption {
+	return func(o *readerOpts) {
+		o.verifiedProgress = fn
+	}
+}
+
+// CollectBlockStats requests that statistics on the structure of each block,
+// such as the number of Huffman tables used, be made available via
+// the BlockStats field returned by Reader.Stats.
+func CollectBlockStats(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.blockStats = v
+	}
+}
+
+// CollectBlockTimings requests that the time spent scanning for, and
+// decoding, blocks be made available via the ScannerTime and DecodeTime
+// fields returned by Reader.Stats.
+func CollectBlockTimings(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.blockTimings = v
+	}
+}
+
+// RateLimiter represents the methods of golang.org/x/time/rate.Limiter
+// used to limit the rate at which decompressed data is returned.
+type RateLimiter interface {
+	// Burst returns the maximum number of bytes that may be waited for
+	// in a single call to WaitN.
+	Burst() int
+	// WaitN blocks until n bytes may be returned or ctx is done.
+	WaitN(ctx context.Context, n int) error
+}
+
+// WithRateLimiter requests that the rate at which decompressed data is
+// returned be limited by the supplied limiter, typically a *rate.Limiter
+// from golang.org/x/time/rate which may be shared across multiple Readers
+// to limit their aggregate throughput. The limiter is waited on for each
+// block, in output order, before it is returned.
+func WithRateLimiter(l RateLimiter) ReaderOption {
+	return func(o *readerOpts) {
+		o.limiter = l
+	}
+}
+
+// MaxWorkerCPUTime requests that decompression be aborted with
+// ErrCPUBudgetExceeded once the aggregate time spent decompressing blocks,
+// as reported by Stats().WorkerCPUTime, would exceed d.
+func MaxWorkerCPUTime(d time.Duration) ReaderOption {
+	return func(o *readerOpts) {
+		o.maxCPUTime = d
+	}
+}
+
+// WithLogger specifies a function to be used for logging diagnostic
+// messages, such as those requested by WarnIdleWorkers. Note that the
+// function may be called from goroutines other than the one calling Read.
+func WithLogger(logf func(format string, args ...interface{})) ReaderOption {
+	return func(o *readerOpts) {
+		o.logf = logf
+	}
+}
+
+// WarnIdleWorkers requests that a warning be logged, via the function
+// supplied to WithLogger, once decompression is complete if the number of
+// concurrent workers exceeded the number of blocks, in which case some
+// workers were idle and a lower concurrency could have been used.
+func WarnIdleWorkers(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.warnIdle = v
+	}
+}
+
+// PrewarmWorkers requests that the goroutines used for decompression be
+// started by NewReader rather than by the first call to Read, so that they
+// are ready and waiting by the time that Read is called. Note that this
+// also starts reading from the underlying source. It has no effect when
+// blocks are decompressed serially (see NewReader).
+func PrewarmWorkers(v bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.prewarm = v
+	}
+}
+
+// StopAtBytes requests that Read return io.EOF once the first occurrence of
+// marker, which may span blocks, has been returned, with no further
+// blocks being decompressed. This is useful when only the data up to and
+// including the marker is required.
+func StopAtBytes(marker []byte) ReaderOption {
+	return func(o *readerOpts) {
+		o.stopAt = append([]byte(nil), marker...)
+	}
+}
+
+// BlockFilter requests that only those blocks for which fn returns true
+// be decompressed, with all other blocks being skipped entirely. fn is
+// called with the index of each block, starting at zero, and the CRC
+// stored for it in the compressed stream. The blocks that are kept are
+// returned in order. Since the stream CRC cannot be computed if any
+// blocks are skipped, it is not verified when a filter is specified.
+func BlockFilter(fn func(index int, storedCRC uint32) bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.filter = fn
+	}
+}
+
+// Reader represents a concurrent bzip2 decompressor that implements
+// io.ReadCloser. It is created by NewReader.
+type Reader struct {
+	ctx       context.Context
+	cancel    context.CancelFunc
+	errCh     chan error
+	wg        *sync.WaitGroup
+	dc        *Decompressor
+	sr        *serialReader
+	asm       *assembler
+	sc        *Scanner
+	opts      *readerOpts
+	workers   int64 // accessed atomically, see EstimatedMemory.
+	startOnce sync.Once
+	closeOnce sync.Once
+	closed    int32
+	aborted   int32
+	lastByte  int  // last byte returned by Read, or -1 if there is none.
+	unread    bool // set if lastByte is to be returned by the next Read.
+	stopAt    []byte
+	stopTail  []byte // trailing bytes of the output that may start stopAt.
+	stopped   bool
+	frameSize int   // set by FrameSize.
+	err       error // sticky error, including io.EOF, returned by Read.
+	byteBuf   [1]byte
+	pumpOnce  sync.Once
+	pumpCh    chan pumpChunk // set once TryRead has been called.
+	pumped    []byte         // data received from pumpCh not yet returned.
+	closeCh   chan struct{}  // closed by Close.
+	expectLen int64          // set by ExpectDecompressedLength, or -1.
+	emitted   int64          // number of bytes returned by Read.
+	cache     *outputCache   // set by ReadAtCache.
+	cacheHits int64          // accessed atomically, see Stats.IndexHits.
+	timer     *time.Timer    // set by TotalTimeout.
+	timedOut  int32
+	eof       int32 // set once Read has returned io.EOF, accessed atomically.
+	reading   int32 // set whilst a call to Read is in progress, accessed atomically.
+	gate      *pauseGate
+	sources   []io.Closer   // closed by Close, see OwnsSource.
+	closeErr  error         // returned by Close.
+	done      chan struct{} // closed once Read returns an error, see WithStatsChannel.
+	doneOnce  sync.Once
+	checksum  *checksumReader   // set by ExpectAppendedChecksum.
+	single    *serialReader     // used in place of dc if probe finds a single block.
+	probed    []CompressedBlock // blocks scanned by probe.
+	// progress is the largest estimate returned by Stats.Progress,
+	// guarded by progressMu.
+	progressMu sync.Mutex
+	progress   float64
 }
 
-// NewReader returns an io.Reader that uses a scanner and decompressor to decompress
-// bzip2 data concurrently.
-func NewReader(ctx context.Context, rd io.Reader, opts ...ReaderOption) io.Reader {
+// pumpChunk is used to pass decompressed data from the goroutine started
+// by TryRead.
+type pumpChunk struct {
+	data []byte
+	err  error
+}
+
+// pumpChunkSize is the size of the buffer used to read decompressed data
+// in the goroutine started by TryRead.
+const pumpChunkSize = 64 * 1024
+
+// NewReader returns a Reader that uses a scanner and decompressor to decompress
+// bzip2 data concurrently. If GOMAXPROCS is 1 and no concurrency is explicitly
+// requested via BZConcurrency then each block is decompressed in turn by
+// the goroutine calling Read since there is nothing to be gained from
+// using additional goroutines, as is also the case when both BZConcurrency
+// and BZScanConcurrency are set to 1. Similarly, if rd is an in-memory
+// reader, such as a *bytes.Reader or *strings.Reader, with no more than
+// 1MB remaining, and no concurrency, nor any option that only applies to
+// decompressing blocks concurrently, is requested, then the first Read
+// scans the first block and, if it is the only one, decompresses it
+// without starting any additional goroutines and with the memory used for
+// the inverse BWT sized for the block's contents rather than the stream's
+// declared block size. BZForceParallel disables this. rd is read
+// sequentially and need not implement io.ReaderAt or io.Seeker, so that,
+// for example, the reader returned by archive/zip's File.Open may be used
+// directly.
+func NewReader(ctx context.Context, rd io.Reader, opts ...ReaderOption) *Reader {
 	rdOpts := &readerOpts{}
 	for _, fn := range opts {
 		fn(rdOpts)
 	}
-	sc := NewScanner(rd, rdOpts.scanOpts...)
-	dc := NewDecompressor(ctx, rdOpts.decOpts...)
+	return newSourceReader(ctx, rd, rdOpts)
+}
+
+// newSourceReader implements NewReader once its options have been applied.
+func newSourceReader(ctx context.Context, rd io.Reader, rdOpts *readerOpts) *Reader {
+	src := rd
+	rdOpts.probeSource(rd)
+	if rdOpts.readTimeout > 0 {
+		rd = newDeadlineReader(ctx, rd, rdOpts.readTimeout)
+	}
+	if rdOpts.retryAttempts > 0 {
+		rd = &retryReader{
+			ctx:       ctx,
+			rd:        rd,
+			attempts:  rdOpts.retryAttempts,
+			backoff:   rdOpts.retryBackoff,
+			retryable: rdOpts.retryable,
+		}
+	}
+	var checksum *checksumReader
+	if rdOpts.checksumKind != 0 {
+		checksum = newChecksumReader(rd, rdOpts.checksumKind, rdOpts.checksumSize)
+		rd = checksum
+	}
+	zrd := newReader(ctx, NewScanner(rd, rdOpts.scannerOptions()...), rdOpts)
+	zrd.checksum = checksum
+	zrd.own(rdOpts, src)
+	return zrd
+}
+
+// own records the sources that are to be closed by Close, see OwnsSource.
+func (rd *Reader) own(rdOpts *readerOpts, sources ...interface{}) {
+	if !rdOpts.ownsSource {
+		return
+	}
+	for _, src := range sources {
+		if c, ok := src.(io.Closer); ok {
+			rd.sources = append(rd.sources, c)
+		}
+	}
+}
+
+// scannerOptions returns the options for the scanner used by a Reader,
+// including those that implement ReaderOptions.
+func (o *readerOpts) scannerOptions() []ScannerOption {
+	scanOpts := o.scanOpts
+	if o.blockTimings {
+		scanOpts = append(scanOpts, scanTimings(true))
+	}
+	if newDecompressorOpts(o.decOpts).allowTruncated {
+		scanOpts = append(scanOpts, scanTruncated(true))
+	}
+	if o.filter != nil {
+		scanOpts = append(scanOpts, scanBlockFilter(o.filter))
+	}
+	if events := o.events; events != nil {
+		scanOpts = append(scanOpts, scanOnSkip(func(ctx context.Context, block CompressedBlock) {
+			sendEvent(ctx, events, BlockEvent{
+				Type:         BlockSkipped,
+				Block:        block.index,
+				Offset:       block.Offset,
+				StreamOffset: block.StreamOffset,
+			})
+		}))
+	}
+	return scanOpts
+}
+
+// invalidOption records err for an option with an invalid value, unless
+// one has already been recorded.
+func (o *readerOpts) invalidOption(err error) {
+	if o.invalid == nil {
+		o.invalid = err
+	}
+}
 
-	errCh := make(chan error, 1)
-	wg := new(sync.WaitGroup)
-	wg.Add(1)
-	go func() {
-		errCh <- decompress(ctx, sc, dc)
-		close(errCh)
-		wg.Done()
-	}()
-	return &reader{
-		ctx:   ctx,
-		errCh: errCh,
-		dc:    dc,
-		wg:    wg,
+// unsupportedOption returns an error that wraps ErrUnsupportedOption if
+// any option other than those listed for ErrUnsupportedOption is set. The
+// options that are specific to ReadBlocks are allowed if blocks is true.
+// The error for an option with an invalid value, if any, is returned in
+// preference.
+func (o *readerOpts) unsupportedOption(blocks bool) error {
+	if o.invalid != nil {
+		return o.invalid
+	}
+	rest := *o
+	rest.blockOptions, rest.scanOpts, rest.decOpts = blockOptions{}, nil, nil
+	if blocks {
+		rest.unordered, rest.zeroCopy = false, false
+	}
+	do := newDecompressorOpts(o.decOpts)
+	do.concurrency, do.explicitConcurrency = 0, false
+	for _, v := range []reflect.Value{reflect.ValueOf(rest), reflect.ValueOf(do)} {
+		for i := 0; i < v.NumField(); i++ {
+			if !v.Field(i).IsZero() {
+				return fmt.Errorf("%w: %v", ErrUnsupportedOption, v.Type().Field(i).Name)
+			}
+		}
 	}
+	return nil
+}
+
+// expectedLength returns the length set by ExpectDecompressedLength, or -1.
+func (o *readerOpts) expectedLength() int64 {
+	if !o.checkLen {
+		return -1
+	}
+	return o.expectLen
+}
+
+func newReader(ctx context.Context, sc *Scanner, rdOpts *readerOpts) *Reader {
+	ctx, cancel := context.WithCancel(ctx)
+	o := newDecompressorOpts(rdOpts.decOpts)
+	gate := &pauseGate{}
+	serial, workers := rdOpts.decompression(false)
+	if serial {
+		sr := newSerialReader(ctx, sc, o, nil)
+		sr.gate = gate
+		rdOpts.configure(sr.assembler)
+		rd := &Reader{
+			ctx:       ctx,
+			cancel:    cancel,
+			sr:        sr,
+			asm:       sr.assembler,
+			sc:        sc,
+			opts:      rdOpts,
+			workers:   int64(workers),
+			err:       rdOpts.invalid,
+			lastByte:  -1,
+			stopAt:    rdOpts.stopAt,
+			frameSize: rdOpts.frameSize,
+			closeCh:   make(chan struct{}),
+			expectLen: rdOpts.expectedLength(),
+			cache:     newOutputCache(rdOpts.cacheSize),
+			gate:      gate,
+		}
+		rd.startTimer(rdOpts.totalTimeout)
+		rd.streamStats(rdOpts.statsCh, rdOpts.statsEvery)
+		return rd
+	}
+
+	dc := newDecompressor(ctx, o)
+	rdOpts.configure(&dc.assembler)
+	rd := &Reader{
+		ctx:       ctx,
+		cancel:    cancel,
+		errCh:     make(chan error, 1),
+		dc:        dc,
+		asm:       &dc.assembler,
+		sc:        sc,
+		opts:      rdOpts,
+		workers:   int64(workers),
+		err:       rdOpts.invalid,
+		wg:        new(sync.WaitGroup),
+		lastByte:  -1,
+		stopAt:    rdOpts.stopAt,
+		frameSize: rdOpts.frameSize,
+		closeCh:   make(chan struct{}),
+		expectLen: rdOpts.expectedLength(),
+		cache:     newOutputCache(rdOpts.cacheSize),
+		gate:      gate,
+	}
+	if rdOpts.probe {
+		rd.single = newSerialReader(ctx, sc, o, &dc.assembler)
+		rd.single.gate = gate
+	}
+	rd.startTimer(rdOpts.totalTimeout)
+	rd.streamStats(rdOpts.statsCh, rdOpts.statsEvery)
+	if rdOpts.prewarm {
+		rd.start()
+	}
+	return rd
+}
+
+// NewReaderMulti returns a Reader that decompresses the logical concatenation
+// of the supplied readers as a single compressed stream, for example when
+// a bzip2 file has been uploaded in multiple parts. The boundaries between
+// the readers need not coincide with block or byte boundaries in the
+// compressed data.
+func NewReaderMulti(ctx context.Context, rds []io.Reader, opts ...ReaderOption) *Reader {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	rd := newSourceReader(ctx, io.MultiReader(rds...), rdOpts)
+	for _, src := range rds {
+		rd.own(rdOpts, src)
+	}
+	return rd
+}
+
+// NewStdinReader returns a Reader for os.Stdin. Since the input is only
+// ever read sequentially it may be a pipe or terminal.
+func NewStdinReader(ctx context.Context, opts ...ReaderOption) *Reader {
+	return NewReader(ctx, os.Stdin, opts...)
+}
+
+// start starts the goroutines used for parallel decompression, it is
+// called on the first non-empty Read, or by newReader if PrewarmWorkers
+// was requested.
+func (rd *Reader) start() {
+	rd.startOnce.Do(func() {
+		rd.dc.start()
+		rd.wg.Add(1)
+		go func() {
+			rd.errCh <- decompress(rd.ctx, rd.sc, rd.dc, rd.gate, rd.probed)
+			close(rd.errCh)
+			rd.wg.Done()
+		}()
+	})
+}
+
+// NewReaderCompat returns an io.Reader that decompresses bzip2 data read
+// from rd using context.Background and the default options. Its signature
+// matches that of compress/bzip2.NewReader so that it may be used as
+// a drop-in replacement.
+func NewReaderCompat(rd io.Reader) io.Reader {
+	return NewReader(context.Background(), rd)
 }
 
 // decompress guarantees that it Finish will have been called on the
 // decompressor. Any non-nil error it returns should be returned by the
 // final call to Read.
-func decompress(ctx context.Context, sc *Scanner, dc *Decompressor) error {
-	if err := scan(ctx, sc, dc); err != nil {
-		dc.Cancel(err)
+func decompress(ctx context.Context, sc *Scanner, dc *Decompressor, gate *pauseGate, probed []CompressedBlock) error {
+	if err := scan(ctx, sc, dc, gate, probed); err != nil {
+		if !dc.isAborted() {
+			// The remainder of the block being read is still
+			// returned after an Abort.
+			dc.Cancel(err)
+		}
 		dc.Finish()
 		return err
 	}
@@ -80,20 +758,32 @@ func decompress(ctx context.Context, sc *Scanner, dc *Decompressor) error {
 }
 
 // scan runs the scanner against the input stream invoking the decompressor
-// to add each block to the set to decompressed.
-func scan(ctx context.Context, sc *Scanner, dc *Decompressor) error {
-	for sc.Scan(ctx) {
-		block := sc.Block()
+// to add each block to the set to decompressed, waiting before scanning
+// each block whilst paused. Any blocks already scanned by Reader.probe are
+// added first.
+func scan(ctx context.Context, sc *Scanner, dc *Decompressor, gate *pauseGate, probed []CompressedBlock) error {
+	for {
+		if err := gate.wait(ctx); err != nil {
+			return err
+		}
+		var block CompressedBlock
+		if len(probed) > 0 {
+			block, probed = probed[0], probed[1:]
+		} else {
+			if !sc.Scan(ctx) {
+				return sc.Err()
+			}
+			block = sc.Block()
+		}
 		if err := dc.Append(block); err != nil {
 			return err
 		}
 	}
-	return sc.Err()
 }
 
 // handleErrorOrCancel returns an error returned by the decompression goroutine
 // above or if the context is canceled.
-func (rd *reader) handleErrorOrCancel() error {
+func (rd *Reader) handleErrorOrCancel() error {
 	select {
 	case err := <-rd.errCh:
 		return err
@@ -104,12 +794,373 @@ func (rd *reader) handleErrorOrCancel() error {
 	}
 }
 
-// Read implements io.Reader.
-func (rd *reader) Read(buf []byte) (int, error) {
+func (rd *Reader) isClosed() bool {
+	return atomic.LoadInt32(&rd.closed) != 0
+}
+
+func (rd *Reader) isAborted() bool {
+	return atomic.LoadInt32(&rd.aborted) != 0
+}
+
+// startTimer starts the timer requested by TotalTimeout, if any.
+func (rd *Reader) startTimer(d time.Duration) {
+	if d > 0 {
+		rd.timer = time.AfterFunc(d, rd.timeout)
+	}
+}
+
+// timeout is called once the time allowed by TotalTimeout has elapsed.
+func (rd *Reader) timeout() {
+	atomic.StoreInt32(&rd.timedOut, 1)
+	if rd.dc != nil {
+		rd.dc.Cancel(ErrDeadlineExceeded)
+	}
+	rd.cancel()
+}
+
+func (rd *Reader) isTimedOut() bool {
+	return atomic.LoadInt32(&rd.timedOut) != 0
+}
+
+// Read implements io.Reader. Decompression is started by the first call
+// to Read with a non-empty buf; Read with an empty buf always returns
+// 0, nil and has no other effect. Once Read has returned an error,
+// including io.EOF, all subsequent calls return that same error. Read
+// must not be called concurrently with itself or with any of the other
+// methods that read decompressed data; such a call returns
+// ErrConcurrentRead rather than risk corrupting the output.
+func (rd *Reader) Read(buf []byte) (int, error) {
+	return rd.readUsing(buf, rd.read)
+}
+
+// TryRead is like Read except that it never blocks waiting for data to be
+// decompressed: it returns 0, nil if no decompressed data is currently
+// available. The first call to TryRead starts a goroutine that reads
+// decompressed data ahead of the caller, so that any data already
+// decompressed, including part of a block, is immediately available to
+// subsequent calls to TryRead and Read. Like Read, TryRead must not be
+// called concurrently with Read or with itself.
+func (rd *Reader) TryRead(buf []byte) (int, error) {
+	return rd.readUsing(buf, rd.tryRead)
+}
+
+func (rd *Reader) readUsing(buf []byte, read func([]byte) (int, error)) (int, error) {
+	if rd.isClosed() {
+		return 0, ErrClosed
+	}
+	if !atomic.CompareAndSwapInt32(&rd.reading, 0, 1) {
+		return 0, ErrConcurrentRead
+	}
+	defer atomic.StoreInt32(&rd.reading, 0)
+	if len(buf) == 0 {
+		return 0, nil
+	}
+	if rd.unread {
+		buf[0] = byte(rd.lastByte)
+		rd.unread = false
+		return 1, nil
+	}
+	if rd.stopped {
+		atomic.StoreInt32(&rd.eof, 1)
+		rd.finish()
+		return 0, io.EOF
+	}
+	if rd.err != nil {
+		return 0, rd.err
+	}
+	if rd.isTimedOut() {
+		rd.err = ErrDeadlineExceeded
+		rd.finish()
+		return 0, rd.err
+	}
+	n, err := read(buf)
+	switch {
+	case err == nil:
+	case rd.isAborted():
+		// Any error is a consequence of the decompressor
+		// having been stopped by Abort.
+		err = io.EOF
+	case rd.isTimedOut():
+		err = ErrDeadlineExceeded
+	}
+	rd.err = err
+	if err != nil && rd.timer != nil {
+		rd.timer.Stop()
+	}
+	if n > 0 && len(rd.stopAt) > 0 {
+		if end, ok := rd.findStop(buf[:n]); ok {
+			// Stop decompressing any further blocks.
+			rd.stopped = true
+			if rd.dc != nil {
+				rd.dc.Cancel(io.EOF)
+			}
+			rd.cancel()
+			n, err = end, nil
+		}
+	}
+	if n > 0 {
+		rd.lastByte = int(buf[n-1])
+	}
+	rd.emitted += int64(n)
+	if rd.cache != nil {
+		rd.cache.add(buf[:n])
+	}
+	if err == io.EOF && rd.expectLen >= 0 && rd.emitted != rd.expectLen && !rd.stopped && !rd.isAborted() {
+		err = fmt.Errorf("%w: expected %v bytes, got %v", ErrLengthMismatch, rd.expectLen, rd.emitted)
+		rd.err = err
+	}
+	if err == io.EOF && rd.asm.expectCRCs != nil && rd.asm.crcsSeen != len(rd.asm.expectCRCs) && !rd.stopped && !rd.isAborted() {
+		err = fmt.Errorf("%w: expected %v blocks, got %v", ErrBlockCRCMismatch, len(rd.asm.expectCRCs), rd.asm.crcsSeen)
+		rd.err = err
+	}
+	if err == io.EOF && rd.checksum != nil && !rd.stopped && !rd.isAborted() {
+		if cerr := rd.checksum.verify(); cerr != nil {
+			err = cerr
+			rd.err = err
+		}
+	}
+	if err == io.EOF {
+		atomic.StoreInt32(&rd.eof, 1)
+	}
+	if err != nil {
+		rd.finish()
+	}
+	return n, err
+}
+
+// findStop returns the offset in data immediately after the first
+// occurrence of the marker specified via StopAtBytes, taking into account
+// the output returned by previous calls to Read.
+func (rd *Reader) findStop(data []byte) (int, bool) {
+	marker := rd.stopAt
+	m := len(marker)
+	if len(rd.stopTail) > 0 {
+		head := data
+		if len(head) > m-1 {
+			head = head[:m-1]
+		}
+		span := append(append([]byte(nil), rd.stopTail...), head...)
+		if i := bytes.Index(span, marker); i >= 0 {
+			return i + m - len(rd.stopTail), true
+		}
+	}
+	if i := bytes.Index(data, marker); i >= 0 {
+		return i + m, true
+	}
+	if len(data) >= m-1 {
+		rd.stopTail = append(rd.stopTail[:0], data[len(data)-(m-1):]...)
+		return 0, false
+	}
+	rd.stopTail = append(rd.stopTail, data...)
+	if l := len(rd.stopTail); l > m-1 {
+		rd.stopTail = rd.stopTail[l-(m-1):]
+	}
+	return 0, false
+}
+
+// writeToBufferSize is the size of the buffer used by WriteTo, it is
+// large enough to hold the output of most blocks so that each block is
+// typically written using a single call to Write.
+const writeToBufferSize = 1 << 20
+
+// WriteTo implements io.WriterTo and hence is used by io.Copy. The output
+// of each block is written to w as soon as it is available, without any
+// need to wait for other blocks to be decompressed, avoiding the small
+// writes that io.Copy would otherwise make. If FrameSize is specified
+// the output is instead written in frames of that size.
+func (rd *Reader) WriteTo(w io.Writer) (int64, error) {
+	read, size := rd.Read, writeToBufferSize
+	if rd.frameSize > 0 {
+		read, size = rd.readFrame, rd.frameSize
+	}
+	buf := make([]byte, size)
+	var written int64
+	for {
+		n, err := read(buf)
+		if n > 0 {
+			nw, werr := w.Write(buf[:n])
+			written += int64(nw)
+			if werr != nil {
+				return written, werr
+			}
+			if nw != n {
+				return written, io.ErrShortWrite
+			}
+		}
+		if err == io.EOF {
+			return written, nil
+		}
+		if err != nil {
+			return written, err
+		}
+	}
+}
+
+// readFrame reads a complete frame into buf, the final frame may be short.
+func (rd *Reader) readFrame(buf []byte) (int, error) {
+	n, err := io.ReadFull(rd, buf)
+	if err == io.ErrUnexpectedEOF {
+		err = io.EOF
+	}
+	return n, err
+}
+
+// ReadByte implements io.ByteReader. Note that each call incurs the
+// overhead of a call to Read and hence a bufio.Reader should be used
+// when reading many individual bytes.
+func (rd *Reader) ReadByte() (byte, error) {
+	for {
+		n, err := rd.Read(rd.byteBuf[:])
+		if n == 1 {
+			return rd.byteBuf[0], nil
+		}
+		if err != nil {
+			return 0, err
+		}
+	}
+}
+
+// UnreadByte implements io.ByteScanner. It arranges for the last byte
+// returned by Read or ReadByte, which may have come from a previous block
+// or stream, to be returned again by the next call to Read or ReadByte.
+// It returns bufio.ErrInvalidUnreadByte if no byte has been read, or if
+// UnreadByte has already been called since the last read.
+func (rd *Reader) UnreadByte() error {
+	if rd.lastByte < 0 || rd.unread {
+		return bufio.ErrInvalidUnreadByte
+	}
+	rd.unread = true
+	return nil
+}
+
+// probe scans the blocks up to, and including, the first non-empty one,
+// see NewReader. If the scanner has then reached the end of the input
+// then the input contains a single block, which is decompressed by the
+// goroutine calling Read without ever starting the decompressor's
+// goroutines. Otherwise the blocks scanned are the first to be appended
+// to the decompressor.
+func (rd *Reader) probe() {
+	sr := rd.single
+	rd.single = nil
+	blocks, single := probeBlocks(rd.ctx, rd.sc)
+	serial, workers := rd.opts.decompression(single)
+	if !serial {
+		rd.probed = blocks
+		return
+	}
+	// The block is decoded using a table sized for its contents rather
+	// than the stream's declared block size.
+	sr.probed = blocks
+	sr.growTables = true
+	rd.sr = sr
+	atomic.StoreInt64(&rd.workers, int64(workers))
+}
+
+func (rd *Reader) read(buf []byte) (int, error) {
+	if rd.pumpCh != nil {
+		return rd.readPumped(buf, true)
+	}
+	return rd.readDirect(buf)
+}
+
+func (rd *Reader) tryRead(buf []byte) (int, error) {
+	rd.pumpOnce.Do(func() {
+		rd.pumpCh = make(chan pumpChunk)
+		go rd.pump()
+	})
+	return rd.readPumped(buf, false)
+}
+
+// pump reads decompressed data ahead of the caller for use by TryRead.
+func (rd *Reader) pump() {
+	for {
+		buf := make([]byte, pumpChunkSize)
+		n, err := rd.readDirect(buf)
+		select {
+		case rd.pumpCh <- pumpChunk{data: buf[:n], err: err}:
+		case <-rd.closeCh:
+			return
+		case <-rd.ctx.Done():
+			if !rd.isAborted() {
+				return
+			}
+			// Abort cancels the context but the remainder of
+			// the current block must still be returned.
+			select {
+			case rd.pumpCh <- pumpChunk{data: buf[:n], err: err}:
+			case <-rd.closeCh:
+				return
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+}
+
+// readPumped returns data read by pump, blocking until some is available
+// if block is true.
+func (rd *Reader) readPumped(buf []byte, block bool) (int, error) {
+	if len(rd.pumped) == 0 {
+		var chunk pumpChunk
+		if block {
+			select {
+			case chunk = <-rd.pumpCh:
+			case <-rd.closeCh:
+				return 0, ErrClosed
+			case <-rd.ctx.Done():
+				if rd.isAborted() {
+					// pump continues to send the remainder of
+					// the current block, see Abort.
+					select {
+					case chunk = <-rd.pumpCh:
+					case <-rd.closeCh:
+						return 0, ErrClosed
+					}
+					break
+				}
+				// pump may have exited without sending the error.
+				if rd.isClosed() {
+					return 0, ErrClosed
+				}
+				return 0, rd.ctx.Err()
+			}
+		} else {
+			select {
+			case chunk = <-rd.pumpCh:
+			default:
+				return 0, nil
+			}
+		}
+		if len(chunk.data) == 0 {
+			return 0, chunk.err
+		}
+		// Any error will be returned with the next chunk, which,
+		// since pump has exited, will be empty.
+		rd.pumped = chunk.data
+		if chunk.err != nil {
+			rd.pumpCh = make(chan pumpChunk, 1)
+			rd.pumpCh <- pumpChunk{err: chunk.err}
+		}
+	}
+	n := copy(buf, rd.pumped)
+	rd.pumped = rd.pumped[n:]
+	return n, nil
+}
+
+func (rd *Reader) readDirect(buf []byte) (int, error) {
+	if rd.single != nil {
+		rd.probe()
+	}
+	if rd.sr != nil {
+		return rd.sr.Read(buf)
+	}
+	rd.start()
 	// test for any errors prior to calling Read which may block
 	// if we don't handle context cancelation here and in particular
-	// call Cancel on the decompressor.
-	if err := rd.handleErrorOrCancel(); err != nil {
+	// call Cancel on the decompressor. Abort cancels the context but
+	// the remainder of the current block must still be read.
+	if err := rd.handleErrorOrCancel(); err != nil && !rd.isAborted() {
 		rd.dc.Cancel(err)
 		rd.wg.Wait() // wait for internal goroutine to finish.
 		return 0, err
@@ -118,6 +1169,22 @@ func (rd *reader) Read(buf []byte) (int, error) {
 	if err == nil {
 		return n, nil
 	}
+	if rd.isClosed() {
+		// Close may have been called whilst the Read was blocked, in which
+		// case the internal goroutine may itself be blocked reading from
+		// the underlying source and hence it is not waited for.
+		return n, ErrClosed
+	}
+	if rd.isAborted() {
+		// As for Close, the internal goroutine is not waited for since
+		// it may be blocked reading from the underlying source.
+		return n, io.EOF
+	}
+	if err != io.EOF {
+		// Tear down the scanner and decompressor promptly rather than
+		// waiting for them to consume the rest of the input.
+		rd.cancel()
+	}
 	rd.wg.Wait() // wait for internal goroutine to finish.
 	// make sure to catch errors sent after the decompressor is done
 	// such as a CRC error.
@@ -133,3 +1200,163 @@ func (rd *reader) Read(buf []byte) (int, error) {
 	}
 	return n, err
 }
+
+// CompressedOffset returns the number of bytes of compressed input that have
+// been consumed from the underlying reader so far. Note that this may be
+// ahead of the decompressed output returned by Read and that the underlying
+// reader may have been read further ahead still to fill internal buffers.
+// It may be called concurrently with Read.
+func (rd *Reader) CompressedOffset() int64 {
+	return rd.sc.CompressedOffset()
+}
+
+// Remainder returns an io.Reader for the input that follows the data
+// consumed by the Reader, including any that has been read from the
+// underlying reader and buffered but not consumed. It is intended to be
+// used once Read has returned io.EOF to read any data that follows the
+// end of the last stream, see AllowTrailingData, and must not be called
+// concurrently with Read. It returns nil for a Reader created by
+// NewReaderWithBoundaries.
+func (rd *Reader) Remainder() io.Reader {
+	return rd.sc.remainder()
+}
+
+// StreamCRC returns the CRC of the stream, as stored in its trailer and
+// verified against the CRCs of its blocks, once Read has returned io.EOF.
+// For concatenated streams it returns the CRC of the last stream, see
+// StreamCRCs. It returns false if Read has not returned io.EOF, if the
+// stream CRC could not be verified, for example because BlockFilter or
+// AllowMissingTrailer was specified, or if decompression was stopped
+// early by StopAtBytes, and for input that consists solely of empty
+// streams. It must not be called concurrently with Read.
+func (rd *Reader) StreamCRC() (uint32, bool) {
+	crcs := rd.StreamCRCs()
+	if len(crcs) == 0 {
+		return 0, false
+	}
+	return crcs[len(crcs)-1], true
+}
+
+// StreamCRCs is like StreamCRC but returns the CRC of each of the streams
+// that contain at least one block, in order, or nil under the same
+// conditions that StreamCRC returns false.
+func (rd *Reader) StreamCRCs() []uint32 {
+	if atomic.LoadInt32(&rd.eof) == 0 || rd.stopped {
+		return nil
+	}
+	return rd.asm.verifiedStreamCRCs()
+}
+
+// Stats returns the decompression statistics gathered so far.
+func (rd *Reader) Stats() Stats {
+	stats := rd.asm.Stats()
+	stats.ScannerTime = rd.sc.scanTime()
+	stats.IndexHits = atomic.LoadInt64(&rd.cacheHits)
+	stats.BlocksScanned, stats.scanned = rd.sc.blocksScanned()
+	stats.BlockSize = rd.sc.MaxStreamBlockSize()
+	stats.eof = atomic.LoadInt32(&rd.eof) != 0
+	rd.progressMu.Lock()
+	if p := stats.estimate(); p > rd.progress {
+		rd.progress = p
+	}
+	stats.progress = rd.progress
+	rd.progressMu.Unlock()
+	return stats
+}
+
+// memoryOverheadFactor is the multiple of the block size used by
+// EstimatedMemory to account for the memory required to decompress a single
+// block: 4 bytes per byte of block size for the inverse BWT, plus the
+// compressed input and the decompressed output for that block. The
+// inverse BWT requires 1.5 fewer bytes per byte of block size with
+// SmallMemory.
+const (
+	memoryOverheadFactor      = 6
+	smallMemoryOverheadFactor = 4.5
+)
+
+// EstimatedMemory returns an estimate of the peak memory, in bytes, required
+// for decompression, calculated as:
+//
+//	concurrency * block size * 6
+//
+// where concurrency is the number of blocks that may be decompressed
+// concurrently, block size is the largest block size specified by
+// the stream headers read so far and 6 accounts for the inverse BWT
+// table (4 bytes per byte of block size) and the compressed and
+// decompressed data for each block, or 4.5 with SmallMemory. It returns
+// zero until the first stream header has been read.
+func (rd *Reader) EstimatedMemory() int64 {
+	workers := atomic.LoadInt64(&rd.workers)
+	if rd.asm.smallMemory {
+		return int64(float64(workers) * float64(rd.sc.MaxStreamBlockSize()) * smallMemoryOverheadFactor)
+	}
+	return workers * int64(rd.sc.MaxStreamBlockSize()) * memoryOverheadFactor
+}
+
+// Abort stops decompression early, but cleanly: unlike Close, subsequent
+// calls to Read return any decompressed data that is already buffered,
+// for example the remainder of a partially read block, followed by io.EOF
+// rather than an error. Abort may be called concurrently with Read, in
+// which case a Read that is blocked waiting for a block to be decompressed
+// will return io.EOF. Close must still be called to wait for the
+// goroutines used for decompression to exit.
+func (rd *Reader) Abort() {
+	atomic.StoreInt32(&rd.aborted, 1)
+	if rd.dc != nil {
+		// No further blocks are started or written, but the remainder
+		// of the block being written is still returned by Read.
+		rd.dc.abort()
+	}
+	rd.cancel()
+}
+
+// Close implements io.Closer. It unblocks any in-progress Read, which
+// will return ErrClosed, and stops all of the goroutines used for
+// decompression independently of the context passed to NewReader.
+// It does not return until the goroutines used to decompress blocks
+// have exited, though the goroutine that reads the underlying source may
+// remain blocked in a Read on that source until it returns.
+// Subsequent calls to Read will return ErrClosed. It is safe to call
+// Close concurrently with Read and more than once. Note that when blocks
+// are being decompressed serially (see NewReader) a Read that is blocked
+// reading from the underlying source will only return once that source
+// returns. If OwnsSource was specified the source is closed once the
+// goroutines have exited and any error from doing so is returned.
+// Close may be called from a callback, such as those supplied to
+// BZProgress or VerifiedProgress, in which case it does not wait for
+// the goroutines to exit since one of them is running the callback.
+func (rd *Reader) Close() error {
+	rd.closeOnce.Do(func() {
+		atomic.StoreInt32(&rd.closed, 1)
+		if rd.timer != nil {
+			rd.timer.Stop()
+		}
+		close(rd.closeCh)
+		if rd.dc != nil {
+			rd.dc.Cancel(ErrClosed)
+		}
+		rd.cancel()
+		if rd.dc != nil {
+			// Prevent the decompressor from being started by a
+			// subsequent Read, or wait for a concurrent one to
+			// have started it, and then wait for its goroutines
+			// to exit, unless Close is being called from a callback
+			// run by one of them.
+			rd.startOnce.Do(func() {})
+			if atomic.LoadInt32(&rd.asm.callbacks) == 0 {
+				rd.dc.waitForWorkers()
+			}
+		}
+		if rd.sc != nil && rd.sc.regions != nil {
+			rd.sc.regions.stop()
+		}
+		rd.asm.allocator.close()
+		for _, src := range rd.sources {
+			if err := src.Close(); err != nil && rd.closeErr == nil {
+				rd.closeErr = err
+			}
+		}
+	})
+	return rd.closeErr
+}
@@ -5,16 +5,30 @@
 package pbzip2_test
 
 import (
+	"archive/zip"
+	"bufio"
 	"bytes"
 	"compress/bzip2"
+	"compress/gzip"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/crc32"
+	"hash/crc64"
 	"io"
+	"math/rand"
 	"os"
 	"path/filepath"
+	"reflect"
 	"runtime"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
+	"testing/iotest"
+	"time"
 
 	"github.com/cosnicolaou/pbzip2"
 	"github.com/cosnicolaou/pbzip2/internal"
@@ -90,7 +104,7 @@ func testIOReader(t *testing.T, readAll func(io.Reader) ([]byte, error)) {
 	// Use a fixed size pool.
 	pool := pbzip2.CreateConcurrencyPool(2)
 
-	for _, name := range []string{"empty", "hello", "300KB3_Random", "900KB2_Random", "1033KB4_Random"} {
+	for _, name := range []string{"empty", "hello", "tiny", "tinyrun", "300KB3_Random", "900KB2_Random", "1033KB4_Random"} {
 		filename := bzip2Files[name]
 		stdlibData := readBzipFile(t, filename)
 
@@ -223,6 +237,73 @@ func TestCancelation(t *testing.T) {
 
 }
 
+// TestCancelationStress repeatedly cancels, closes or aborts readers at
+// random points and is intended to be run with the race detector enabled.
+func TestCancelationStress(t *testing.T) {
+	ctx := context.Background()
+	name := "1033KB4_Random"
+	compressed, _ := readFile(t, name)
+	want := bzip2Data[name]
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	seed := time.Now().UnixNano()
+	t.Logf("seed: %v", seed)
+	rnd := rand.New(rand.NewSource(seed))
+	iterations := 50
+	if testing.Short() {
+		iterations = 10
+	}
+	for i := 0; i < iterations; i++ {
+		concurrency := rnd.Intn(4)
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		// Stop the reader from another goroutine after a random delay
+		// whilst the output is being read.
+		delay := time.Duration(rnd.Intn(20)) * time.Millisecond
+		stop := rnd.Intn(3)
+		timer := time.AfterFunc(delay, func() {
+			switch stop {
+			case 0:
+				cancel()
+			case 1:
+				rd.Close()
+			case 2:
+				rd.Abort()
+			}
+		})
+		buf := make([]byte, 1+rnd.Intn(64*1024))
+		var data []byte
+		var err error
+		for {
+			var n int
+			n, err = rd.Read(buf)
+			data = append(data, buf[:n]...)
+			if err != nil {
+				break
+			}
+		}
+		timer.Stop()
+		switch {
+		case err == io.EOF:
+		case errors.Is(err, context.Canceled), errors.Is(err, pbzip2.ErrClosed):
+		default:
+			t.Errorf("%v: concurrency %v: stop %v: unexpected error: %v", i, concurrency, stop, err)
+		}
+		if !bytes.Equal(data, want[:len(data)]) {
+			t.Errorf("%v: concurrency %v: stop %v: got %v bytes which are not a prefix of the output", i, concurrency, stop, len(data))
+		}
+		rd.Close()
+		cancel()
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+			t.Errorf("%v: concurrency %v: stop %v: goroutine leak: got %v, want %v", i, concurrency, stop, got, want)
+		}
+	}
+}
+
 func TestReaderErrors(t *testing.T) {
 	ctx := context.Background()
 	rd := bytes.NewBuffer(nil)
@@ -250,6 +331,31 @@ func TestReaderErrors(t *testing.T) {
 
 	testError([]byte{0x1, 0x1, 0x1}, "stream header is too small")
 
+	// Empty and truncated headers are distinguishable.
+	for _, tc := range []struct {
+		input []byte
+		want  error
+	}{
+		{nil, pbzip2.ErrEmptyStream},
+		{[]byte("BZh"), pbzip2.ErrShortHeader},
+	} {
+		_, err = io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(tc.input)))
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%q: got %v, want %v", tc.input, err, tc.want)
+		}
+		_, _, err = pbzip2.ProbeHeader(bytes.NewReader(tc.input))
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%q: ProbeHeader: got %v, want %v", tc.input, err, tc.want)
+		}
+		_, err = io.ReadAll(pbzip2.NewReaderWithBoundaries(ctx, bytes.NewReader(tc.input), nil))
+		if !errors.Is(err, tc.want) {
+			t.Errorf("%q: NewReaderWithBoundaries: got %v, want %v", tc.input, err, tc.want)
+		}
+	}
+	if errors.Is(err, pbzip2.ErrEmptyStream) {
+		t.Errorf("a truncated header should not be reported as an empty stream")
+	}
+
 	buf, l := readFile(t, "hello")
 	buf[l] = 0x1
 	buf[l-1] = 0x1
@@ -272,14 +378,3036 @@ func TestReaderErrors(t *testing.T) {
 	testError(buf, "bad block size")
 
 	buf, _ = readFile(t, "300KB1")
-	corrupted := buf[:9000]
+	corrupted := append([]byte{}, buf[:9000]...)
 	corrupted = append(corrupted, ibzip2.BlockMagic[:]...)
 	corrupted = append(corrupted, buf[9000:]...)
 	testError(corrupted, "bzip2 data invalid: data exceeds block size")
 }
 
+func TestSentinelErrors(t *testing.T) {
+	ctx := context.Background()
+	hello, _ := readFile(t, "hello")
+	corruptedStream := append([]byte{}, hello...)
+	corruptedStream[len(corruptedStream)-2] ^= 0xff
+	for _, tc := range []struct {
+		input    []byte
+		sentinel error
+		msg      string
+	}{
+		{[]byte("XXh9"), pbzip2.ErrBadMagic, "wrong file magic: 5858"},
+		{[]byte("BZx9"), pbzip2.ErrWrongVersion, "wrong version: x"},
+		{[]byte("BZhx"), pbzip2.ErrBadBlockSize, "bad block size: x"},
+		{[]byte("BZ"), pbzip2.ErrShortHeader, "stream header is too small: 2"},
+		{hello[:len(hello)-4], pbzip2.ErrNoTrailer, "failed to find trailer"},
+		{corruptedStream, pbzip2.ErrMismatchedCRC, "mismatched stream CRCs: calculated=0x4eece836"},
+	} {
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(tc.input), opts...))
+			if !errors.Is(err, tc.sentinel) {
+				t.Errorf("%q: concurrency %v: got %v, want %v", internal.FirstN(10, tc.input), concurrency, err, tc.sentinel)
+			}
+			if err == nil || !strings.Contains(err.Error(), tc.msg) {
+				t.Errorf("%q: concurrency %v: got %v, want %v", internal.FirstN(10, tc.input), concurrency, err, tc.msg)
+			}
+		}
+	}
+}
+
+func TestNotBzip2(t *testing.T) {
+	ctx := context.Background()
+	gz := &bytes.Buffer{}
+	gzw := gzip.NewWriter(gz)
+	gzw.Write([]byte("hello world\n"))
+	gzw.Close()
+	for _, tc := range []struct {
+		input    []byte
+		sentinel error
+		msg      string
+	}{
+		{gz.Bytes(), pbzip2.ErrBadMagic, "input appears to be gzip, not bzip2: wrong file magic: 1f8b"},
+		{gz.Bytes()[:2], pbzip2.ErrShortHeader, "input appears to be gzip, not bzip2: stream header is too small: 2"},
+		{[]byte{0x28, 0xb5, 0x2f, 0xfd, 0x00, 0x58}, pbzip2.ErrBadMagic, "input appears to be zstd, not bzip2: wrong file magic: 28b5"},
+		{[]byte{0xfd, '7', 'z', 'X', 'Z', 0x00, 0x00}, pbzip2.ErrBadMagic, "input appears to be xz, not bzip2: wrong file magic: fd37"},
+		{[]byte("hello world\n"), pbzip2.ErrBadMagic, "input appears to be text, not bzip2: wrong file magic: 6865"},
+		{[]byte("hi\n"), pbzip2.ErrShortHeader, "input appears to be text, not bzip2: stream header is too small: 3"},
+	} {
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(tc.input), opts...))
+			for _, sentinel := range []error{pbzip2.ErrNotBzip2, tc.sentinel} {
+				if !errors.Is(err, sentinel) {
+					t.Errorf("%q: concurrency %v: got %v, want %v", internal.FirstN(10, tc.input), concurrency, err, sentinel)
+				}
+			}
+			if got, want := fmt.Sprint(err), tc.msg; got != want {
+				t.Errorf("%q: concurrency %v: got %v, want %v", internal.FirstN(10, tc.input), concurrency, got, want)
+			}
+		}
+		_, _, err := pbzip2.ProbeHeader(bytes.NewReader(tc.input))
+		if got, want := fmt.Sprint(err), tc.msg; got != want {
+			t.Errorf("%q: got %v, want %v", internal.FirstN(10, tc.input), got, want)
+		}
+	}
+
+	// Corrupt bzip2 headers are reported as before.
+	for _, input := range []string{"XXh9", "BZx9", "BZhx", "BZ", "\x00\x01\x02\x03"} {
+		_, err := io.ReadAll(pbzip2.NewReader(ctx, strings.NewReader(input)))
+		if err == nil || errors.Is(err, pbzip2.ErrNotBzip2) {
+			t.Errorf("%q: missing or unexpected error: %v", input, err)
+		}
+	}
+}
+
+func TestBlockError(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "300KB1", "300KB2")
+	var blocks []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+		if block := sc.Block(); len(block.Data) > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	// Corrupt the CRC stored for block 4.
+	bit := blocks[4].Offset
+	compressed[bit/8] ^= 0x80 >> (bit % 8)
+	for _, concurrency := range []int{0, 2} {
+		opts := []pbzip2.ReaderOption{}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		_, readErr := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...))
+		verifyErr := pbzip2.Verify(ctx, bytes.NewReader(compressed), opts...)
+		for _, err := range []error{readErr, verifyErr} {
+			var blockErr *pbzip2.BlockError
+			if !errors.As(err, &blockErr) {
+				t.Errorf("concurrency %v: missing or unexpected error: %v", concurrency, err)
+				continue
+			}
+			if got, want := blockErr.Block, 4; got != want {
+				t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+			}
+			if got, want := blockErr.Offset, blocks[4].Offset; got != want {
+				t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+			}
+			if !errors.Is(err, pbzip2.ErrBlockChecksum) {
+				t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrBlockChecksum)
+			}
+		}
+	}
+}
+
+func TestCRCError(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "300KB1", "hello")
+	var blocks []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+		if block := sc.Block(); len(block.Data) > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	last := len(blocks) - 1
+
+	// Corrupt the CRC stored for block 1.
+	corruptedBlock := append([]byte{}, compressed...)
+	bit := blocks[1].Offset
+	corruptedBlock[bit/8] ^= 0x80 >> (bit % 8)
+
+	// Corrupt the CRC stored in the trailer of the second stream.
+	corruptedStream := append([]byte{}, compressed...)
+	corruptedStream[len(corruptedStream)-2] ^= 0xff
+
+	// Corrupt the CRC stored in the trailer of an empty stream.
+	empty, _ := readFile(t, "empty")
+	corruptedEmpty := append([]byte{}, empty...)
+	corruptedEmpty[len(corruptedEmpty)-1] ^= 0xff
+
+	for i, tc := range []struct {
+		input    []byte
+		sentinel error
+		want     pbzip2.CRCError
+	}{
+		{corruptedBlock, pbzip2.ErrBlockChecksum, pbzip2.CRCError{
+			Kind:     pbzip2.BlockCRCMismatch,
+			Block:    1,
+			Offset:   blocks[1].Offset,
+			Expected: blocks[1].CRC ^ 0x80000000,
+			Computed: blocks[1].CRC,
+		}},
+		{corruptedStream, pbzip2.ErrMismatchedCRC, pbzip2.CRCError{
+			Kind:     pbzip2.StreamCRCMismatch,
+			Block:    last,
+			Offset:   blocks[last].Offset,
+			Computed: 0x4eece836,
+		}},
+		{corruptedEmpty, pbzip2.ErrMismatchedCRC, pbzip2.CRCError{
+			Kind:     pbzip2.StreamCRCMismatch,
+			Block:    -1,
+			Offset:   -1,
+			Expected: 0xff,
+			Computed: 0,
+		}},
+	} {
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(tc.input), opts...))
+			if !errors.Is(err, tc.sentinel) {
+				t.Errorf("%v: concurrency %v: got %v, want %v", i, concurrency, err, tc.sentinel)
+			}
+			var crcErr *pbzip2.CRCError
+			if !errors.As(err, &crcErr) {
+				t.Errorf("%v: concurrency %v: missing or unexpected error: %v", i, concurrency, err)
+				continue
+			}
+			want := tc.want
+			if want.Kind == pbzip2.StreamCRCMismatch && want.Expected == 0 {
+				// The stored CRC depends on the alignment of the trailer.
+				want.Expected = crcErr.Expected
+				if crcErr.Expected == crcErr.Computed {
+					t.Errorf("%v: concurrency %v: stored and computed CRCs are the same", i, concurrency)
+				}
+			}
+			if got := *crcErr; got != want {
+				t.Errorf("%v: concurrency %v: got %+v, want %+v", i, concurrency, got, want)
+			}
+		}
+	}
+}
+
 type errorReader struct{}
 
 func (er *errorReader) Read(buf []byte) (int, error) {
 	return 1, fmt.Errorf("oops")
 }
+
+func TestClose(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+
+	buf, _ := readFile(t, "1033KB4_Random")
+	// Feed the reader enough data to start decompressing but not enough
+	// to complete the first block so that Read will block.
+	src, wr := io.Pipe()
+	go wr.Write(buf[:1024])
+
+	drd := pbzip2.NewReader(ctx, src, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(drd)
+		errCh <- err
+	}()
+
+	time.Sleep(100 * time.Millisecond)
+	if err := drd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err := <-errCh:
+		if !errors.Is(err, pbzip2.ErrClosed) {
+			t.Errorf("missing or unexpected error: %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("Read failed to return after Close")
+	}
+
+	if _, err := drd.Read(make([]byte, 10)); !errors.Is(err, pbzip2.ErrClosed) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+	if err := drd.Close(); err != nil {
+		t.Errorf("second Close: %v", err)
+	}
+
+	// Release the scanner which is blocked reading from the pipe.
+	wr.Close()
+	for i := 0; i < 100; i++ {
+		if pbzip2.GetNumDecompressionGoRoutines() == ngs {
+			break
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+}
+
+func TestCloseWaitsForWorkers(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	buf, _ := readFile(t, "900KB2_Random")
+	opts := pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2))
+
+	drd := pbzip2.NewReader(ctx, bytes.NewReader(buf), opts)
+	if err := drd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+
+	// Close whilst blocks are being decompressed.
+	drd = pbzip2.NewReader(ctx, bytes.NewReader(buf), opts)
+	if _, err := drd.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	if err := drd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+
+	// Close whilst the scanner is blocked reading from its source.
+	src, wr := io.Pipe()
+	defer wr.Close()
+	go wr.Write(buf[:1024])
+	drd = pbzip2.NewReader(ctx, src, opts)
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(drd)
+		errCh <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	if err := drd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+	if err := <-errCh; !errors.Is(err, pbzip2.ErrClosed) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestCloseConcurrently(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	buf, _ := readFile(t, "900KB1")
+	var rd io.ReadCloser
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd = pbzip2.NewReader(ctx, bytes.NewReader(buf), opts...)
+		if _, err := rd.Read(make([]byte, 1024)); err != nil {
+			t.Fatal(err)
+		}
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(io.Discard, rd)
+			errCh <- err
+		}()
+		var wg sync.WaitGroup
+		for i := 0; i < 4; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if err := rd.Close(); err != nil {
+					t.Errorf("concurrency %v: %v", concurrency, err)
+				}
+			}()
+		}
+		wg.Wait()
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+			t.Errorf("concurrency %v: goroutine leak: got %v, want %v", concurrency, got, want)
+		}
+		// The concurrent Read may have completed before Close was called.
+		if err := <-errCh; err != nil && !errors.Is(err, pbzip2.ErrClosed) {
+			t.Errorf("concurrency %v: missing or unexpected error: %v", concurrency, err)
+		}
+		if _, err := rd.Read(make([]byte, 10)); !errors.Is(err, pbzip2.ErrClosed) {
+			t.Errorf("concurrency %v: missing or unexpected error: %v", concurrency, err)
+		}
+	}
+}
+
+func TestCloseFromCallback(t *testing.T) {
+	ctx := context.Background()
+	buf, _ := readFile(t, "900KB1")
+	for _, concurrency := range []int{0, 2} {
+		var rd *pbzip2.Reader
+		closed := make(chan error, 1)
+		progress := func(inBytes, outBytes, blocks int64) {
+			if blocks == 1 {
+				closed <- rd.Close()
+			}
+		}
+		dcOpts := []pbzip2.DecompressorOption{pbzip2.BZProgress(progress)}
+		if concurrency > 0 {
+			dcOpts = append(dcOpts, pbzip2.BZConcurrency(concurrency))
+		}
+		rd = pbzip2.NewReader(ctx, bytes.NewReader(buf), pbzip2.DecompressionOptions(dcOpts...))
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := io.Copy(io.Discard, rd)
+			errCh <- err
+		}()
+		select {
+		case err := <-closed:
+			if err != nil {
+				t.Errorf("concurrency %v: %v", concurrency, err)
+			}
+		case <-time.After(time.Minute):
+			t.Fatalf("concurrency %v: Close called from a callback did not return", concurrency)
+		}
+		if err := <-errCh; err != nil && !errors.Is(err, pbzip2.ErrClosed) {
+			t.Errorf("concurrency %v: missing or unexpected error: %v", concurrency, err)
+		}
+	}
+}
+
+// closingReader records whether it has been closed.
+type closingReader struct {
+	*bytes.Reader
+	closed int
+	err    error
+}
+
+func (cr *closingReader) Close() error {
+	cr.closed++
+	return cr.err
+}
+
+func TestOwnsSource(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	boundaries := scanBoundaries(t, compressed)
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		owned := append(opts[:len(opts):len(opts)], pbzip2.OwnsSource(true))
+
+		readAndClose := func(drd *pbzip2.Reader) error {
+			data, err := io.ReadAll(drd)
+			if err != nil {
+				t.Fatalf("concurrency %v: %v", concurrency, err)
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("concurrency %v: got %v..., want %v...", concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			return drd.Close()
+		}
+
+		src := &closingReader{Reader: bytes.NewReader(compressed)}
+		if err := readAndClose(pbzip2.NewReader(ctx, src, opts...)); err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := src.closed, 0; got != want {
+			t.Errorf("concurrency %v: not owned: got %v, want %v", concurrency, got, want)
+		}
+
+		src = &closingReader{Reader: bytes.NewReader(compressed)}
+		drd := pbzip2.NewReader(ctx, src, owned...)
+		if err := readAndClose(drd); err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		if err := drd.Close(); err != nil {
+			t.Errorf("concurrency %v: second Close: %v", concurrency, err)
+		}
+		if got, want := src.closed, 1; got != want {
+			t.Errorf("concurrency %v: owned: got %v, want %v", concurrency, got, want)
+		}
+
+		split := len(compressed) / 2
+		srcs := []*closingReader{
+			{Reader: bytes.NewReader(compressed[:split])},
+			{Reader: bytes.NewReader(compressed[split:])},
+		}
+		if err := readAndClose(pbzip2.NewReaderMulti(ctx, []io.Reader{srcs[0], srcs[1]}, owned...)); err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		for i, src := range srcs {
+			if got, want := src.closed, 1; got != want {
+				t.Errorf("concurrency %v: multi %v: got %v, want %v", concurrency, i, got, want)
+			}
+		}
+
+		src = &closingReader{Reader: bytes.NewReader(compressed)}
+		if err := readAndClose(pbzip2.NewReaderWithBoundaries(ctx, src, boundaries, owned...)); err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := src.closed, 1; got != want {
+			t.Errorf("concurrency %v: boundaries: got %v, want %v", concurrency, got, want)
+		}
+
+		src = &closingReader{Reader: bytes.NewReader(compressed), err: fmt.Errorf("oops")}
+		if err := readAndClose(pbzip2.NewReader(ctx, src, owned...)); err == nil || err.Error() != "oops" {
+			t.Errorf("concurrency %v: missing or unexpected error: %v", concurrency, err)
+		}
+	}
+}
+
+func TestAbort(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	name := "900KB1"
+	buf, _ := readFile(t, name)
+	want := bzip2Data[name]
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+
+		// Abort before reading anything.
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(buf), opts...)
+		rd.Abort()
+		data, err := io.ReadAll(rd)
+		if err != nil || len(data) != 0 {
+			t.Errorf("concurrency %v: got %v bytes, %v, want 0 bytes, nil", concurrency, len(data), err)
+		}
+		rd.Close()
+
+		// Abort mid-stream.
+		rd = pbzip2.NewReader(ctx, bytes.NewReader(buf), opts...)
+		head := make([]byte, 1000)
+		if _, err := io.ReadFull(rd, head); err != nil {
+			t.Fatal(err)
+		}
+		rd.Abort()
+		tail, err := io.ReadAll(rd)
+		if err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		data = append(head, tail...)
+		if got := data; len(got) >= len(want) || !bytes.Equal(got, want[:len(got)]) {
+			t.Errorf("concurrency %v: got %v bytes which are not a prefix of %v bytes", concurrency, len(got), len(want))
+		}
+		// The remainder of the block being read is returned.
+		if len(tail) == 0 {
+			t.Errorf("concurrency %v: the remainder of the first block was not returned", concurrency)
+		}
+		if n, err := rd.Read(head); n != 0 || err != io.EOF {
+			t.Errorf("concurrency %v: got %v, %v, want 0, io.EOF", concurrency, n, err)
+		}
+		rd.Close()
+	}
+
+	// Abort whilst a Read is blocked.
+	src, wr := io.Pipe()
+	defer wr.Close()
+	go wr.Write(buf[:1024])
+	rd := pbzip2.NewReader(ctx, src, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := io.ReadAll(rd)
+		errCh <- err
+	}()
+	time.Sleep(100 * time.Millisecond)
+	rd.Abort()
+	if err := <-errCh; err != nil {
+		t.Errorf("unexpected error: %v", err)
+	}
+	rd.Close()
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+}
+
+func TestConcurrentRead(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB1")
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		// The first Read blocks since no input is available until it is
+		// written to pwr below, hence the second Read is concurrent with it.
+		prd, pwr := io.Pipe()
+		rd := pbzip2.NewReader(ctx, prd, opts...)
+		type result struct {
+			n   int
+			err error
+		}
+		resultCh := make(chan result, 2)
+		for i := 0; i < 2; i++ {
+			go func() {
+				n, err := rd.Read(make([]byte, 1024))
+				resultCh <- result{n, err}
+			}()
+		}
+		if r := <-resultCh; !errors.Is(r.err, pbzip2.ErrConcurrentRead) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, r.err, pbzip2.ErrConcurrentRead)
+		}
+		go func() {
+			pwr.Write(compressed)
+			pwr.Close()
+		}()
+		first := <-resultCh
+		if first.err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, first.err)
+		}
+		// Read is usable once the concurrent call has returned.
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := first.n+len(data), len(bzip2Data["300KB1"]); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestTotalTimeout(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	buf, _ := concatFiles(t, "900KB1", "900KB1", "900KB1", "900KB1", "900KB1", "900KB1")
+	for _, concurrency := range []int{0, 2} {
+		opts := []pbzip2.ReaderOption{pbzip2.TotalTimeout(20 * time.Millisecond)}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		start := time.Now()
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(buf), opts...)
+		_, err := io.Copy(io.Discard, rd)
+		if got, want := err, pbzip2.ErrDeadlineExceeded; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if took := time.Since(start); took > 5*time.Second {
+			t.Errorf("concurrency %v: took too long to time out: %v", concurrency, took)
+		}
+		if _, err := rd.Read(make([]byte, 10)); err != pbzip2.ErrDeadlineExceeded {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrDeadlineExceeded)
+		}
+		rd.Close()
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+			t.Errorf("concurrency %v: goroutine leak: got %v, want %v", concurrency, got, want)
+		}
+
+		// A stream that is decompressed within the timeout is unaffected,
+		// even once the timeout has elapsed.
+		opts[0] = pbzip2.TotalTimeout(100 * time.Millisecond)
+		compressed, _ := readFile(t, "hello")
+		rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := data, bzip2Data["hello"]; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %s, want %s", concurrency, got, want)
+		}
+		time.Sleep(200 * time.Millisecond)
+		if _, err := rd.Read(make([]byte, 10)); err != io.EOF {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, io.EOF)
+		}
+		rd.Close()
+	}
+}
+
+func TestReaderCompat(t *testing.T) {
+	for _, name := range []string{"empty", "hello", "300KB1", "900KB9", "300KB3_Random", "1033KB4_Random"} {
+		filename := bzip2Files[name]
+		rd := openBzipFile(t, filename)
+		data, err := io.ReadAll(pbzip2.NewReaderCompat(rd))
+		rd.Close()
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		if got, want := data, readBzipFile(t, filename); !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v..., want %v...", name, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+	}
+}
+
+func TestSerialReader(t *testing.T) {
+	ctx := context.Background()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for _, name := range []string{"empty", "hello", "300KB3_Random", "1033KB4_Random"} {
+		filename := bzip2Files[name]
+		for i, opts := range [][]pbzip2.ReaderOption{
+			nil,
+			{pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2))},
+		} {
+			rd := openBzipFile(t, filename)
+			data, max, err := readAllSample(pbzip2.NewReader(ctx, rd, opts...))
+			rd.Close()
+			if err != nil {
+				t.Errorf("%v: %v", name, err)
+				continue
+			}
+			if got, want := data, readBzipFile(t, filename); !bytes.Equal(got, want) {
+				t.Errorf("%v: got %v..., want %v...", name, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if serial := i == 0; serial && max != ngs {
+				t.Errorf("%v: unexpected decompression goroutines for serial decompression: %v", name, max)
+			}
+			if serial := i == 0; !serial && len(data) > 1024*1024 && max == ngs {
+				t.Errorf("%v: no decompression goroutines were used", name)
+			}
+		}
+	}
+}
+
+func TestSingleBlockFastPath(t *testing.T) {
+	ctx := context.Background()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for _, tc := range []struct {
+		name   string
+		serial bool
+	}{
+		{"empty", true},
+		{"hello", true},
+		{"tinyrun", true},
+		{"300KB5", true},
+		{"900KB1", false},
+	} {
+		compressed, _ := readFile(t, tc.name)
+		for i, opt := range []struct {
+			opt      pbzip2.ReaderOption
+			parallel bool
+		}{
+			{pbzip2.DecompressionOptions(), false},
+			{pbzip2.DecompressionOptions(pbzip2.BZForceParallel(true)), true},
+			{pbzip2.DecompressionOptions(pbzip2.BZConcurrency(4)), true},
+			{pbzip2.DecompressionOptions(pbzip2.BZMaxBuffered(1 << 20)), true},
+			{pbzip2.WithReorderBuffer(&recordingBuffer{data: map[int][]byte{}}), true},
+		} {
+			for _, readerAt := range []bool{false, true} {
+				pbzip2.ResetMaxDecompressionGoRoutines()
+				var rd *pbzip2.Reader
+				if readerAt {
+					rd = pbzip2.NewReaderAt(ctx, bytes.NewReader(compressed), int64(len(compressed)), opt.opt)
+				} else {
+					rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed), opt.opt)
+				}
+				data, err := io.ReadAll(rd)
+				if err != nil {
+					t.Errorf("%v: option %v: reader at %v: %v", tc.name, i, readerAt, err)
+					continue
+				}
+				if got, want := data, bzip2Data[tc.name]; !bytes.Equal(got, want) {
+					t.Errorf("%v: option %v: reader at %v: got %v..., want %v...", tc.name, i, readerAt, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+				serial := pbzip2.GetMaxDecompressionGoRoutines() == ngs
+				if got, want := serial, tc.serial && !opt.parallel; got != want {
+					t.Errorf("%v: option %v: reader at %v: serial: got %v, want %v", tc.name, i, readerAt, got, want)
+				}
+			}
+		}
+	}
+
+	// CRCs are verified by the fast path.
+	hello, _ := readFile(t, "hello")
+	corrupted := append([]byte{}, hello...)
+	corrupted[len(corrupted)-2] ^= 0xff
+	pbzip2.ResetMaxDecompressionGoRoutines()
+	_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(corrupted)))
+	if !errors.Is(err, pbzip2.ErrMismatchedCRC) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrMismatchedCRC)
+	}
+	if got, want := pbzip2.GetMaxDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestSerialReadInto(t *testing.T) {
+	ctx := context.Background()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	for _, name := range []string{"hello", "tinyrun", "300KB1", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		want := bzip2Data[name]
+		for _, size := range []int{1, 4096, 100 * 1000, len(want), len(want) + 1000} {
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+			// Any capacity beyond the length of the buffer must not
+			// be written to.
+			buf := make([]byte, size, size+100)
+			var data []byte
+			for {
+				for i := range buf[:cap(buf)] {
+					buf[:cap(buf)][i] = 0xff
+				}
+				n, err := rd.Read(buf)
+				data = append(data, buf[:n]...)
+				if !bytes.Equal(buf[size:cap(buf)], bytes.Repeat([]byte{0xff}, 100)) {
+					t.Fatalf("%v: %v: read beyond the length of the buffer", name, size)
+				}
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%v: %v: %v", name, size, err)
+				}
+			}
+			if got := data; !bytes.Equal(got, want) {
+				t.Errorf("%v: %v: got %v..., want %v...", name, size, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+}
+
+func BenchmarkSerialRead(b *testing.B) {
+	ctx := context.Background()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(1))
+	compressed, err := os.ReadFile(bzip2Files["hello"] + ".bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	input := bytes.Repeat(compressed, 1000)
+	output := bytes.Repeat(bzip2Data["hello"], 1000)
+	for _, size := range []int{8, 4096} {
+		b.Run(fmt.Sprintf("buffer-%v", size), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(int64(len(output)))
+			buf := make([]byte, size)
+			for i := 0; i < b.N; i++ {
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(input))
+				for {
+					_, err := rd.Read(buf)
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						b.Fatal(err)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestRemainder(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		names    []string
+		trailing string
+	}{
+		{[]string{"hello"}, "trailing data"},
+		{[]string{"hello"}, "BZh9 but not a stream"},
+		{[]string{"hello"}, ""},
+		{[]string{"empty"}, "x"},
+		{[]string{"hello", "300KB2"}, "trailing data"},
+		{[]string{"900KB2_Random"}, strings.Repeat("trailing data", 100*1000)},
+	} {
+		compressed, want := concatFiles(t, tc.names...)
+		compressed = append(compressed, tc.trailing...)
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{
+				pbzip2.ScannerOptions(pbzip2.AllowTrailingData(true)),
+			}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			data, err := io.ReadAll(rd)
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", tc.names, concurrency, err)
+				continue
+			}
+			if got := data; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", tc.names, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			remainder, err := io.ReadAll(rd.Remainder())
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", tc.names, concurrency, err)
+			}
+			if got, want := string(remainder), tc.trailing; got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", tc.names, concurrency, internal.FirstN(20, []byte(got)), internal.FirstN(20, []byte(want)))
+			}
+			rd.Close()
+		}
+	}
+
+	// Trailing data is an error by default.
+	compressed, _ := readFile(t, "hello")
+	compressed = append(compressed, "trailing data"...)
+	_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed)))
+	if err == nil || err.Error() != "failed to find trailer" {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+}
+
+func TestExpectDecompressedLength(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "hello")
+	want := bzip2Data["hello"]
+	for _, concurrency := range []int{0, 2} {
+		for _, length := range []int64{int64(len(want)), 0, int64(len(want)) - 1, int64(len(want)) + 1} {
+			opts := []pbzip2.ReaderOption{pbzip2.ExpectDecompressedLength(length)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...))
+			if got, want := data, want; !bytes.Equal(got, want) {
+				t.Errorf("concurrency %v: %v: got %v, want %v", concurrency, length, got, want)
+			}
+			if length == int64(len(want)) {
+				if err != nil {
+					t.Errorf("concurrency %v: %v: %v", concurrency, length, err)
+				}
+				continue
+			}
+			if !errors.Is(err, pbzip2.ErrLengthMismatch) {
+				t.Errorf("concurrency %v: %v: got %v, want %v", concurrency, length, err, pbzip2.ErrLengthMismatch)
+				continue
+			}
+			if got, want := err.Error(), fmt.Sprintf("decompressed length mismatch: expected %v bytes, got %v", length, len(want)); got != want {
+				t.Errorf("concurrency %v: %v: got %v, want %v", concurrency, length, got, want)
+			}
+		}
+	}
+}
+
+func be32(v uint32) []byte {
+	var buf [4]byte
+	binary.BigEndian.PutUint32(buf[:], v)
+	return buf[:]
+}
+
+func be64(v uint64) []byte {
+	var buf [8]byte
+	binary.BigEndian.PutUint64(buf[:], v)
+	return buf[:]
+}
+
+func TestExpectAppendedChecksum(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		crc32Sum := crc32.ChecksumIEEE(compressed)
+		crc64Sum := crc64.Checksum(compressed, crc64.MakeTable(crc64.ECMA))
+		for _, concurrency := range []int{0, 2} {
+			for _, tc := range []struct {
+				kind pbzip2.ChecksumKind
+				size int
+				sum  []byte
+				ok   bool
+			}{
+				{pbzip2.ChecksumCRC32, 4, be32(crc32Sum), true},
+				{pbzip2.ChecksumCRC32, 4, be32(crc32Sum + 1), false},
+				{pbzip2.ChecksumCRC64, 8, be64(crc64Sum), true},
+				{pbzip2.ChecksumCRC64, 4, be32(uint32(crc64Sum)), true},
+				{pbzip2.ChecksumCRC64, 8, be64(crc64Sum ^ 1<<63), false},
+			} {
+				opts := []pbzip2.ReaderOption{pbzip2.ExpectAppendedChecksum(tc.kind, tc.size)}
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency)))
+				}
+				input := append(compressed[:len(compressed):len(compressed)], tc.sum...)
+				data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(input), opts...))
+				if tc.ok {
+					if err != nil {
+						t.Errorf("%v: concurrency %v: %v/%v: %v", name, concurrency, tc.kind, tc.size, err)
+					}
+					if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+						t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+					}
+					continue
+				}
+				if !errors.Is(err, pbzip2.ErrAppendedChecksum) {
+					t.Errorf("%v: concurrency %v: %v/%v: missing or unexpected error: %v", name, concurrency, tc.kind, tc.size, err)
+				}
+			}
+		}
+	}
+
+	// A zero length read returns immediately.
+	crd := pbzip2.NewChecksumReader(strings.NewReader("input"), pbzip2.ChecksumCRC32, 4)
+	if n, err := crd.Read(nil); n != 0 || err != nil {
+		t.Errorf("got %v, %v, want 0, nil", n, err)
+	}
+}
+
+func TestExpectBlockCRCs(t *testing.T) {
+	ctx := context.Background()
+	compressed, data := concatFiles(t, "300KB1", "hello", "300KB2")
+	var crcs []uint32
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for sc.Scan(ctx) {
+		if block := sc.Block(); len(block.Data) > 0 {
+			crcs = append(crcs, block.CRC)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	permuted := append([]uint32{}, crcs...)
+	permuted[1], permuted[2] = permuted[2], permuted[1]
+	for _, concurrency := range []int{0, 2} {
+		for i, tc := range []struct {
+			crcs []uint32
+			ok   bool
+		}{
+			{crcs, true},
+			{permuted, false},
+			{crcs[:len(crcs)-1], false},
+			{append(append([]uint32{}, crcs...), crcs[0]), false},
+			{[]uint32{}, false},
+		} {
+			opts := []pbzip2.ReaderOption{pbzip2.ExpectBlockCRCs(tc.crcs)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			out, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...))
+			if tc.ok {
+				if err != nil {
+					t.Errorf("%v: concurrency %v: %v", i, concurrency, err)
+				}
+				if got, want := out, data; !bytes.Equal(got, want) {
+					t.Errorf("%v: concurrency %v: got %v..., want %v...", i, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+				continue
+			}
+			if !errors.Is(err, pbzip2.ErrBlockCRCMismatch) {
+				t.Errorf("%v: concurrency %v: missing or unexpected error: %v", i, concurrency, err)
+			}
+		}
+	}
+}
+
+func TestPreviewBytes(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name string
+		n    int
+	}{
+		{"empty", 100},
+		{"hello", 5},
+		{"hello", 100},
+		{"300KB3_Random", 100},
+		{"300KB3_Random", 500 * 1000},
+		{"300KB3_Random", 1 << 30},
+	} {
+		rd := openBzipFile(t, bzip2Files[tc.name])
+		preview, err := pbzip2.PreviewBytes(ctx, rd, tc.n)
+		rd.Close()
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+		if got, want := preview, internal.FirstN(tc.n, bzip2Data[tc.name]); !bytes.Equal(got, want) {
+			t.Errorf("%v: %v: got %v..., want %v...", tc.name, tc.n, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+	}
+	if _, err := pbzip2.PreviewBytes(ctx, bytes.NewReader(nil), -1); err == nil {
+		t.Errorf("expected an error for a negative size")
+	}
+}
+
+func TestFirstBlock(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		first, err := pbzip2.FirstBlock(ctx, bytes.NewReader(compressed))
+		if err != nil {
+			t.Errorf("%v: %v", name, err)
+			continue
+		}
+		data := bzip2Data[name]
+		if name == "900KB2_Random" {
+			if got, want := len(first), 200*1000; got == 0 || got > want {
+				t.Errorf("%v: got %v, want 1..%v", name, got, want)
+			}
+		} else if got, want := len(first), len(data); got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+		if got, want := first, internal.FirstN(len(first), data); !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v..., want %v...", name, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+	}
+
+	compressed, _ := readFile(t, "hello")
+	if _, err := pbzip2.FirstBlock(ctx, bytes.NewReader(compressed), pbzip2.FrameSize(10)); !errors.Is(err, pbzip2.ErrUnsupportedOption) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrUnsupportedOption)
+	}
+}
+
+func TestProbeHeader(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name      string
+		blockSize int
+	}{
+		{"empty", 900 * 1000},
+		{"hello", 900 * 1000},
+		{"300KB1", 100 * 1000},
+		{"900KB9", 900 * 1000},
+	} {
+		compressed, _ := readFile(t, tc.name)
+		for _, peek := range []bool{false, true} {
+			var rd io.Reader = bytes.NewReader(compressed)
+			if peek {
+				rd = bufio.NewReader(rd)
+			}
+			blockSize, prd, err := pbzip2.ProbeHeader(rd)
+			if err != nil {
+				t.Errorf("%v: peek %v: %v", tc.name, peek, err)
+				continue
+			}
+			if got, want := blockSize, tc.blockSize; got != want {
+				t.Errorf("%v: peek %v: got %v, want %v", tc.name, peek, got, want)
+			}
+			if peek && prd != rd {
+				t.Errorf("%v: the bufio.Reader was not returned", tc.name)
+			}
+			data, err := io.ReadAll(pbzip2.NewReader(ctx, prd))
+			if err != nil {
+				t.Errorf("%v: peek %v: %v", tc.name, peek, err)
+				continue
+			}
+			if got, want := data, bzip2Data[tc.name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: peek %v: got %v..., want %v...", tc.name, peek, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+
+	for _, tc := range []struct {
+		input string
+		err   string
+	}{
+		{"", "failed to read stream header: EOF"},
+		{"BZ", "stream header is too small: 2"},
+		{"BZx9", "wrong version: x"},
+		{"XXh9", "wrong file magic: 5858"},
+	} {
+		for _, peek := range []bool{false, true} {
+			var rd io.Reader = strings.NewReader(tc.input)
+			if peek {
+				rd = bufio.NewReader(rd)
+			}
+			_, _, err := pbzip2.ProbeHeader(rd)
+			if err == nil || err.Error() != tc.err {
+				t.Errorf("%q: peek %v: missing or unexpected error: %v", tc.input, peek, err)
+			}
+		}
+	}
+}
+
+func TestCountBlocks(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name   string
+		blocks int
+	}{
+		{"empty", 0},
+		{"hello", 1},
+		{"100KB1", 2},
+		{"300KB1", 4},
+		{"300KB2", 2},
+		{"300KB5", 1},
+		{"400KB1", 5},
+		{"800KB1", 9},
+		{"900KB1", 10},
+		{"900KB9", 2},
+		{"300KB3_Random", 2},
+		{"900KB2_Random", 5},
+		{"1033KB4_Random", 3},
+	} {
+		rd := openBzipFile(t, bzip2Files[tc.name])
+		n, err := pbzip2.CountBlocks(ctx, rd)
+		rd.Close()
+		if err != nil {
+			t.Errorf("%v: %v", tc.name, err)
+			continue
+		}
+		if got, want := n, tc.blocks; got != want {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+	}
+
+	multi, _ := concatFiles(t, "hello", "empty", "300KB2")
+	n, err := pbzip2.CountBlocks(ctx, bytes.NewReader(multi))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := n, 3; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestDumpStructure(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "hello")
+	out := &strings.Builder{}
+	if err := pbzip2.DumpStructure(ctx, bytes.NewReader(compressed), out); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := out.String(), `stream 1: offset 0: BZh9: block size 900000
+  block 1: offset 80, size 253, crc 0x4eece836
+  trailer: stream crc 0x4eece836
+`; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	multi, _ := concatFiles(t, "hello", "300KB2")
+	out.Reset()
+	if err := pbzip2.DumpStructure(ctx, bytes.NewReader(multi), out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if got, want := len(lines), 7; got != want {
+		t.Fatalf("got %v, want %v: %s", got, want, out)
+	}
+	if got, want := lines[3], fmt.Sprintf("stream 2: offset %v: BZh2: block size 200000", len(compressed)); got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+
+	// The structure preceding a corrupt trailer is still written.
+	out.Reset()
+	err := pbzip2.DumpStructure(ctx, bytes.NewReader(multi[:len(multi)-8]), out)
+	if err == nil {
+		t.Fatal("missing error")
+	}
+	if got, want := out.String(), strings.Join(lines[:3], "\n")+"\n"; !strings.HasPrefix(got, want) {
+		t.Errorf("got %q, want prefix %q", got, want)
+	}
+}
+
+func TestPlanConcurrency(t *testing.T) {
+	ctx := context.Background()
+	defer runtime.GOMAXPROCS(runtime.GOMAXPROCS(4))
+	forced := pbzip2.DecompressionOptions(pbzip2.BZForceParallel(true))
+	concurrency := func(n int) pbzip2.ReaderOption {
+		return pbzip2.DecompressionOptions(pbzip2.BZConcurrency(n))
+	}
+	for _, tc := range []struct {
+		name     string
+		file     bool
+		opts     []pbzip2.ReaderOption
+		expected int
+	}{
+		// In-memory inputs with a single block are decompressed serially.
+		{"empty", false, nil, 1},
+		{"hello", false, nil, 1},
+		{"300KB2", false, nil, 4},
+		{"900KB1", false, nil, 4},
+		// Other inputs are not probed for a single block.
+		{"hello", true, nil, 4},
+		{"900KB1", true, nil, 4},
+		{"hello", false, []pbzip2.ReaderOption{forced}, 4},
+		{"900KB1", false, []pbzip2.ReaderOption{forced}, 4},
+		{"hello", false, []pbzip2.ReaderOption{concurrency(2)}, 2},
+		{"300KB2", true, []pbzip2.ReaderOption{concurrency(1)}, 1},
+	} {
+		open := func() io.Reader {
+			if tc.file {
+				rd := openBzipFile(t, bzip2Files[tc.name])
+				t.Cleanup(func() { rd.Close() })
+				return rd
+			}
+			buf, _ := readFile(t, tc.name)
+			return bytes.NewReader(buf)
+		}
+		got, err := pbzip2.PlanConcurrency(ctx, open(), tc.opts...)
+		if err != nil {
+			t.Errorf("%v: file %v: %v", tc.name, tc.file, err)
+			continue
+		}
+		if want := tc.expected; got != want {
+			t.Errorf("%v: file %v: got %v, want %v", tc.name, tc.file, got, want)
+		}
+		// The plan must match the number of goroutines used by a Reader.
+		rd := pbzip2.NewReader(ctx, open(), tc.opts...)
+		if _, err := io.Copy(io.Discard, rd); err != nil {
+			t.Errorf("%v: file %v: %v", tc.name, tc.file, err)
+		}
+		if want := pbzip2.ReaderWorkers(rd); got != want {
+			t.Errorf("%v: file %v: got %v, but the Reader used %v", tc.name, tc.file, got, want)
+		}
+	}
+
+	if _, err := pbzip2.PlanConcurrency(ctx, strings.NewReader("not bzip2")); err == nil {
+		t.Errorf("expected an error for an invalid stream")
+	}
+}
+
+func TestHasMultipleBlocksWithin(t *testing.T) {
+	ctx := context.Background()
+	multi, _ := concatFiles(t, "hello", "empty", "300KB2")
+	for _, tc := range []struct {
+		name  string
+		limit int64
+		want  bool
+	}{
+		{"empty", 1 << 20, false},
+		{"hello", 1 << 20, false},
+		{"hello", 10, false},
+		{"300KB5", 1 << 20, false},
+		{"300KB1", 1 << 20, true},
+		{"900KB1", 1 << 20, true},
+		{"900KB2_Random", 1 << 20, true},
+		{"1033KB4_Random", 1 << 20, true},
+		{"900KB2_Random", 1000, false},
+		{"multi", 1 << 20, true},
+		{"multi", 40, false},
+	} {
+		compressed := multi
+		if tc.name != "multi" {
+			compressed, _ = readFile(t, tc.name)
+		}
+		got, err := pbzip2.HasMultipleBlocksWithin(ctx, bytes.NewReader(compressed), tc.limit)
+		if err != nil {
+			t.Errorf("%v: %v: %v", tc.name, tc.limit, err)
+			continue
+		}
+		if want := tc.want; got != want {
+			t.Errorf("%v: %v: got %v, want %v", tc.name, tc.limit, got, want)
+		}
+	}
+
+	if _, err := pbzip2.HasMultipleBlocksWithin(ctx, bytes.NewReader([]byte("not bzip2")), 1000); err == nil {
+		t.Errorf("expected an error")
+	}
+}
+
+func BenchmarkCountBlocks(b *testing.B) {
+	ctx := context.Background()
+	compressed, err := os.ReadFile(bzip2Files["900KB2_Random"] + ".bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Run("CountBlocks", func(b *testing.B) {
+		b.SetBytes(int64(len(compressed)))
+		for i := 0; i < b.N; i++ {
+			if _, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("Decompress", func(b *testing.B) {
+		b.SetBytes(int64(len(compressed)))
+		for i := 0; i < b.N; i++ {
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+			if _, err := io.Copy(io.Discard, rd); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+type countingReader struct {
+	rd io.Reader
+	n  int64
+}
+
+func (cr *countingReader) Read(buf []byte) (int, error) {
+	n, err := cr.rd.Read(buf)
+	atomic.AddInt64(&cr.n, int64(n))
+	return n, err
+}
+
+func (cr *countingReader) bytesRead() int64 {
+	return atomic.LoadInt64(&cr.n)
+}
+
+func TestZeroLengthRead(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := openBzipFile(t, bzip2Files["300KB3_Random"])
+		src := &countingReader{rd: rd}
+		drd := pbzip2.NewReader(ctx, src, opts...)
+		for _, buf := range [][]byte{nil, {}} {
+			if n, err := drd.Read(buf); n != 0 || err != nil {
+				t.Errorf("got %v, %v, want 0, nil", n, err)
+			}
+		}
+		if got, want := src.bytesRead(), int64(0); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+
+		var data []byte
+		buf := make([]byte, 1000)
+		for {
+			n, err := drd.Read(buf)
+			data = append(data, buf[:n]...)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n, err := drd.Read(buf[:0]); n != 0 || err != nil {
+				t.Errorf("got %v, %v, want 0, nil", n, err)
+			}
+		}
+		rd.Close()
+		if got, want := data, bzip2Data["300KB3_Random"]; !bytes.Equal(got, want) {
+			t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+	}
+}
+
+func TestConcurrencyDeterminism(t *testing.T) {
+	ctx := context.Background()
+	for name, filename := range bzip2Files {
+		var first []byte
+		for _, concurrency := range []int{1, 2, 4, 8} {
+			rd := openBzipFile(t, filename)
+			drd := pbzip2.NewReader(ctx, rd,
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			data, err := io.ReadAll(drd)
+			rd.Close()
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", name, concurrency, err)
+				continue
+			}
+			if first == nil {
+				first = data
+				if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+					t.Errorf("%v: got %v..., want %v...", name, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+				continue
+			}
+			if !bytes.Equal(data, first) {
+				t.Errorf("%v: concurrency %v: output differs from concurrency 1", name, concurrency)
+			}
+		}
+	}
+}
+
+func TestReaderMulti(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	for _, splits := range [][2]int{
+		{2, 3},
+		{123457, 400001},
+		{len(compressed) / 3, len(compressed) - 1},
+	} {
+		for _, concurrency := range []int{1, 2} {
+			rds := []io.Reader{
+				bytes.NewReader(compressed[:splits[0]]),
+				bytes.NewReader(compressed[splits[0]:splits[1]]),
+				bytes.NewReader(compressed[splits[1]:]),
+			}
+			drd := pbzip2.NewReaderMulti(ctx, rds,
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			data, err := io.ReadAll(drd)
+			if err != nil {
+				t.Errorf("splits %v: concurrency %v: %v", splits, concurrency, err)
+				continue
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("splits %v: got %v..., want %v...", splits, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+}
+
+func BenchmarkDecompressBlock(b *testing.B) {
+	input, err := os.ReadFile(bzip2Files["1033KB4_Random"] + ".bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	var blocks []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(input))
+	for sc.Scan(context.Background()) {
+		blocks = append(blocks, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		b.Fatal(err)
+	}
+	// The largest number of bytes allocated to decompress a single block.
+	// Since the tt arrays are reused this is not a measure of the memory
+	// in use whilst a block is being decompressed.
+	var before, after runtime.MemStats
+	var allocated uint64
+	b.ReportAllocs()
+	b.ResetTimer()
+	b.SetBytes(int64(len(input)))
+	for i := 0; i < b.N; i++ {
+		for _, block := range blocks {
+			b.StopTimer()
+			runtime.ReadMemStats(&before)
+			b.StartTimer()
+			if _, err := pbzip2.DecompressBlock(block); err != nil {
+				b.Fatal(err)
+			}
+			b.StopTimer()
+			runtime.ReadMemStats(&after)
+			if n := after.TotalAlloc - before.TotalAlloc; n > allocated {
+				allocated = n
+			}
+			b.StartTimer()
+		}
+	}
+	b.ReportMetric(float64(allocated), "max-alloc-B/block")
+}
+
+// sleepLimiter implements pbzip2.RateLimiter by sleeping for the time
+// taken to process n bytes at a fixed rate.
+type sleepLimiter struct {
+	bytesPerSecond int
+	burst          int
+}
+
+func (l *sleepLimiter) Burst() int {
+	return l.burst
+}
+
+func (l *sleepLimiter) WaitN(ctx context.Context, n int) error {
+	if n > l.burst {
+		return fmt.Errorf("%v exceeds burst %v", n, l.burst)
+	}
+	select {
+	case <-time.After(time.Duration(n) * time.Second / time.Duration(l.bytesPerSecond)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestRateLimiter(t *testing.T) {
+	name := "300KB3_Random"
+	for _, concurrency := range []int{0, 1, 2} {
+		opts := []pbzip2.ReaderOption{}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		}
+		limiter := &sleepLimiter{bytesPerSecond: 1000 * 1000, burst: 64 * 1024}
+		ctx := context.Background()
+		rd := openBzipFile(t, bzip2Files[name])
+		drd := pbzip2.NewReader(ctx, rd, append(opts, pbzip2.WithRateLimiter(limiter))...)
+		start := time.Now()
+		data, err := io.ReadAll(drd)
+		taken := time.Since(start)
+		rd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		if min := time.Duration(len(data)) * time.Microsecond; taken < min {
+			t.Errorf("concurrency %v: took %v, want at least %v", concurrency, taken, min)
+		}
+
+		// Cancelation must be respected whilst waiting on the limiter.
+		limiter = &sleepLimiter{bytesPerSecond: 1, burst: 64 * 1024}
+		ctx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		rd = openBzipFile(t, bzip2Files[name])
+		drd = pbzip2.NewReader(ctx, rd, append(opts, pbzip2.WithRateLimiter(limiter))...)
+		if _, err := io.ReadAll(drd); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, context.DeadlineExceeded)
+		}
+		cancel()
+		rd.Close()
+	}
+}
+
+func TestUnreadByte(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	want := bzip2Data[name]
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := openBzipFile(t, bzip2Files[name])
+		drd := pbzip2.NewReader(ctx, rd, opts...)
+		if err := drd.UnreadByte(); err != bufio.ErrInvalidUnreadByte {
+			t.Errorf("got %v, want %v", err, bufio.ErrInvalidUnreadByte)
+		}
+		b, err := drd.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := drd.UnreadByte(); err != nil {
+			t.Fatal(err)
+		}
+		if err := drd.UnreadByte(); err != bufio.ErrInvalidUnreadByte {
+			t.Errorf("got %v, want %v", err, bufio.ErrInvalidUnreadByte)
+		}
+		again, err := drd.ReadByte()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := again, b; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		if got, want := b, want[0]; got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+		// Read up to the end of the first block, which is 199981 bytes
+		// in size, and unread its last byte.
+		buf := make([]byte, 199980)
+		if _, err := io.ReadFull(drd, buf); err != nil {
+			t.Fatal(err)
+		}
+		if err := drd.UnreadByte(); err != nil {
+			t.Fatal(err)
+		}
+		rest, err := io.ReadAll(drd)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := rest, want[199980:]; !bytes.Equal(got, want) {
+			t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		rd.Close()
+	}
+}
+
+type panicReader struct{}
+
+func (pr *panicReader) Read([]byte) (int, error) {
+	panic("oops")
+}
+
+func TestWorkerPanic(t *testing.T) {
+	ctx := context.Background()
+	pbzip2.SetBlockDecoder(func(int, []byte, int) io.Reader {
+		return &panicReader{}
+	})
+	defer pbzip2.ResetBlockDecoder()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for _, concurrency := range []int{0, 1, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := openBzipFile(t, bzip2Files["900KB2_Random"])
+		_, err := io.ReadAll(pbzip2.NewReader(ctx, rd, opts...))
+		rd.Close()
+		if !errors.Is(err, pbzip2.ErrInternal) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrInternal)
+			continue
+		}
+		if got, want := err.Error(), "block 1: panic: oops"; !strings.Contains(got, want) {
+			t.Errorf("concurrency %v: %q does not contain %q", concurrency, got, want)
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestWarnIdleWorkers(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		name        string
+		concurrency int
+		warnings    []string
+	}{
+		{"hello", 8, []string{"pbzip2: concurrency of 8 exceeds the number of blocks, 1, 7 workers were idle"}},
+		{"900KB2_Random", 2, nil},
+	} {
+		var warnings []string
+		logf := func(format string, args ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+		rd := openBzipFile(t, bzip2Files[tc.name])
+		drd := pbzip2.NewReader(ctx, rd,
+			pbzip2.WithLogger(logf),
+			pbzip2.WarnIdleWorkers(true),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(tc.concurrency)))
+		if _, err := io.ReadAll(drd); err != nil {
+			t.Fatal(err)
+		}
+		rd.Close()
+		if got, want := warnings, tc.warnings; !reflect.DeepEqual(got, want) {
+			t.Errorf("%v: got %v, want %v", tc.name, got, want)
+		}
+	}
+}
+
+func TestPrewarmWorkers(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	for _, concurrency := range []int{2, 4} {
+		for _, prewarm := range []bool{false, true} {
+			// Use a pipe so that the workers remain parked until the
+			// compressed data is written to it.
+			prd, pwr := io.Pipe()
+			before := pbzip2.GetNumDecompressionGoRoutines()
+			drd := pbzip2.NewReader(ctx, prd,
+				pbzip2.PrewarmWorkers(prewarm),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			// Allow for the goroutine that assembles the output.
+			want := int64(0)
+			if prewarm {
+				want = int64(concurrency) + 1
+			}
+			if got := pbzip2.GetNumDecompressionGoRoutines() - before; got != want {
+				t.Errorf("concurrency %v: prewarm %v: got %v, want %v", concurrency, prewarm, got, want)
+			}
+			go func() {
+				pwr.Write(compressed)
+				pwr.Close()
+			}()
+			data, err := io.ReadAll(drd)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("concurrency %v: prewarm %v: got %v..., want %v...", concurrency, prewarm, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			drd.Close()
+			if got, want := pbzip2.GetNumDecompressionGoRoutines(), before; got != want {
+				t.Errorf("concurrency %v: prewarm %v: goroutine leak: got %v, want %v", concurrency, prewarm, got, want)
+			}
+		}
+	}
+}
+
+func TestZipEntry(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	archive := &bytes.Buffer{}
+	zw := zip.NewWriter(archive)
+	for _, method := range []uint16{zip.Store, zip.Deflate} {
+		w, err := zw.CreateHeader(&zip.FileHeader{
+			Name:   fmt.Sprintf("%v-%v.bz2", name, method),
+			Method: method,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := w.Write(compressed); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := zw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	zr, err := zip.NewReader(bytes.NewReader(archive.Bytes()), int64(archive.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, file := range zr.File {
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			}
+			entry, err := file.Open()
+			if err != nil {
+				t.Fatal(err)
+			}
+			data, err := io.ReadAll(pbzip2.NewReader(ctx, entry, opts...))
+			entry.Close()
+			if err != nil {
+				t.Fatalf("%v: %v", file.Name, err)
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: got %v..., want %v...", file.Name, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+}
+
+func TestDeterministicDispatch(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	concurrency := 2
+	var dispatched []string
+	logf := func(format string, args ...interface{}) {
+		dispatched = append(dispatched, fmt.Sprintf(format, args...))
+	}
+	rd := openBzipFile(t, bzip2Files[name])
+	defer rd.Close()
+	drd := pbzip2.NewReader(ctx, rd,
+		pbzip2.WithLogger(logf),
+		pbzip2.DecompressionOptions(
+			pbzip2.BZConcurrency(concurrency),
+			pbzip2.DeterministicDispatch(true)))
+	data, err := io.ReadAll(drd)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+	if got, want := len(dispatched), 5; got != want {
+		t.Fatalf("got %v, want %v: %v", got, want, dispatched)
+	}
+	prev := 0
+	for _, line := range dispatched {
+		var block, worker int
+		if _, err := fmt.Sscanf(line, "pbzip2: dispatching block %d to worker %d", &block, &worker); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		if block <= prev {
+			t.Errorf("block %v dispatched after block %v", block, prev)
+		}
+		if got, want := worker, (block-1)%concurrency; got != want {
+			t.Errorf("block %v: got worker %v, want %v", block, got, want)
+		}
+		prev = block
+	}
+}
+
+func TestCompressedOffset(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			}
+			drd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			if got, want := drd.CompressedOffset(), int64(0); got != want {
+				t.Errorf("%v: got %v, want %v", name, got, want)
+			}
+			prev := int64(0)
+			buf := make([]byte, 64*1024)
+			for {
+				_, err := drd.Read(buf)
+				offset := drd.CompressedOffset()
+				if offset < prev {
+					t.Errorf("%v: offset went backwards: %v < %v", name, offset, prev)
+				}
+				prev = offset
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if got, want := drd.CompressedOffset(), int64(len(compressed)); got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+		}
+	}
+}
+
+func TestBlockAllocations(t *testing.T) {
+	if raceEnabled {
+		// The race detector randomly discards values put into
+		// a sync.Pool.
+		t.Skip("allocations are not representative with the race detector")
+	}
+	ctx := context.Background()
+	for _, name := range []string{"hello", "100KB1", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+		if !sc.Scan(ctx) {
+			t.Fatalf("%v: %v", name, sc.Err())
+		}
+		block := sc.Block()
+		out, err := pbzip2.DecompressBlock(block)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		runs := 10
+		allocs := testing.AllocsPerRun(runs, func() {
+			pbzip2.DecompressBlock(block)
+		})
+		runtime.ReadMemStats(&after)
+		// AllocsPerRun performs an additional, warm-up, run.
+		allocated := (after.TotalAlloc - before.TotalAlloc) / uint64(runs+1)
+		// The number of allocations should not depend on the size of the
+		// block and the number of bytes allocated should be proportional
+		// to the size of the output rather than the declared block size.
+		if allocs > 100 {
+			t.Errorf("%v: too many allocations per block: %v", name, allocs)
+		}
+		if min, max := uint64(len(out)), uint64(len(out))*3/2+32*1024; allocated < min || allocated > max {
+			t.Errorf("%v: allocated %v bytes for %v bytes of output (block size %v), want %v..%v", name, allocated, len(out), block.StreamBlockSize, min, max)
+		}
+	}
+}
+
+func TestStopAtBytes(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	data := bzip2Data[name]
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	// The first block is 199981 bytes long, so the second marker spans the
+	// first two blocks.
+	for _, offset := range []int{1000, 199975} {
+		marker := data[offset : offset+16]
+		want := data[:bytes.Index(data, marker)+len(marker)]
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{pbzip2.StopAtBytes(marker)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := openBzipFile(t, bzip2Files[name])
+			drd := pbzip2.NewReader(ctx, rd, opts...)
+			var got []byte
+			buf := make([]byte, 1001)
+			for {
+				n, err := drd.Read(buf)
+				got = append(got, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("offset %v: concurrency %v: got %v bytes, want %v", offset, concurrency, len(got), len(want))
+			}
+			if n, err := drd.Read(buf); n != 0 || err != io.EOF {
+				t.Errorf("got %v, %v, want 0, %v", n, err, io.EOF)
+			}
+			if got, limit := drd.Stats().UncompressedBytes, int64(2*199981); got > limit {
+				t.Errorf("offset %v: concurrency %v: too many blocks decompressed: %v bytes", offset, concurrency, got)
+			}
+			drd.Close()
+			rd.Close()
+		}
+	}
+	time.Sleep(100 * time.Millisecond)
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStdinReader(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		}
+		prd, pwr, err := os.Pipe()
+		if err != nil {
+			t.Fatal(err)
+		}
+		go func() {
+			// Write in small chunks to exercise short reads from the pipe.
+			for buf := compressed; len(buf) > 0; {
+				n := 4099
+				if n > len(buf) {
+					n = len(buf)
+				}
+				if _, err := pwr.Write(buf[:n]); err != nil {
+					break
+				}
+				buf = buf[n:]
+			}
+			pwr.Close()
+		}()
+		stdin := os.Stdin
+		os.Stdin = prd
+		drd := pbzip2.NewStdinReader(ctx, opts...)
+		os.Stdin = stdin
+		data, err := io.ReadAll(drd)
+		prd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+	}
+}
+
+// intervalLimiter implements pbzip2.RateLimiter by allowing one event
+// per interval across all callers.
+type intervalLimiter struct {
+	sync.Mutex
+	interval time.Duration
+	next     time.Time
+}
+
+func (l *intervalLimiter) Burst() int {
+	return 1
+}
+
+func (l *intervalLimiter) WaitN(ctx context.Context, n int) error {
+	l.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(n) * l.interval)
+	l.Unlock()
+	select {
+	case <-time.After(time.Until(at)):
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+func TestStartLimiter(t *testing.T) {
+	ctx := context.Background()
+	nreaders, concurrency := 20, 4
+	compressed, _ := readFile(t, "hello")
+	peakGoroutines := func(opts ...pbzip2.DecompressorOption) int64 {
+		ngs := pbzip2.GetNumDecompressionGoRoutines()
+		pbzip2.ResetMaxDecompressionGoRoutines()
+		var wg sync.WaitGroup
+		wg.Add(nreaders)
+		for i := 0; i < nreaders; i++ {
+			go func() {
+				defer wg.Done()
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+					pbzip2.DecompressionOptions(append(opts, pbzip2.BZConcurrency(concurrency))...))
+				if _, err := io.ReadAll(rd); err != nil {
+					t.Error(err)
+				}
+			}()
+		}
+		wg.Wait()
+		return pbzip2.GetMaxDecompressionGoRoutines() - ngs
+	}
+	// Without a limiter all of the goroutines for all of the readers are
+	// likely to exist at the same time.
+	limiter := &intervalLimiter{interval: 2 * time.Millisecond}
+	if got, max := peakGoroutines(pbzip2.BZStartLimiter(limiter)), int64(nreaders*(concurrency+1)/2); got > max {
+		t.Errorf("got %v, want at most %v", got, max)
+	}
+}
+
+func TestStickyErrors(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	buf := make([]byte, 1024)
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		}
+		compressed, _ := readFile(t, "300KB3_Random")
+		src := &countingReader{rd: bytes.NewReader(compressed)}
+		drd := pbzip2.NewReader(ctx, src, opts...)
+		if _, err := io.ReadAll(drd); err != nil {
+			t.Fatal(err)
+		}
+		consumed := src.bytesRead()
+		for i := 0; i < 5; i++ {
+			if n, err := drd.Read(buf); n != 0 || err != io.EOF {
+				t.Errorf("concurrency %v: got %v, %v, want 0, %v", concurrency, n, err, io.EOF)
+			}
+		}
+		if got, want := src.bytesRead(), consumed; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+
+		// A stream CRC error is only detected once all of its blocks
+		// have been decompressed.
+		corrupted := append([]byte{}, compressed...)
+		corrupted[len(corrupted)-3] ^= 0xff
+		drd = pbzip2.NewReader(ctx, bytes.NewReader(corrupted), opts...)
+		_, err := io.ReadAll(drd)
+		if err == nil {
+			t.Fatalf("concurrency %v: expected an error", concurrency)
+		}
+		for i := 0; i < 5; i++ {
+			if n, rerr := drd.Read(buf); n != 0 || rerr != err {
+				t.Errorf("concurrency %v: got %v, %v, want 0, %v", concurrency, n, rerr, err)
+			}
+		}
+	}
+}
+
+func TestBlockFilter(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+
+	var want []byte
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	for i := 0; sc.Scan(ctx); {
+		block := sc.Block()
+		if len(block.Data) == 0 {
+			continue
+		}
+		if i%2 == 0 {
+			out, err := pbzip2.DecompressBlock(block)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, out...)
+		}
+		i++
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, concurrency := range []int{0, 2} {
+		var indices []int
+		opts := []pbzip2.ReaderOption{
+			pbzip2.BlockFilter(func(index int, storedCRC uint32) bool {
+				indices = append(indices, index)
+				return index%2 == 0
+			}),
+		}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		got, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %v bytes, want %v bytes", concurrency, len(got), len(want))
+		}
+		if got, want := indices, []int{0, 1, 2, 3, 4}; !reflect.DeepEqual(got, want) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestBlockChecksumFailFast(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	if !sc.Scan(ctx) {
+		t.Fatal(sc.Err())
+	}
+	// Corrupt the CRC stored for the first block, which immediately
+	// follows the block magic.
+	corrupted := append([]byte(nil), compressed...)
+	offset := sc.Block().Offset
+	corrupted[offset/8] ^= 0x80 >> (offset % 8)
+
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(corrupted), opts...)
+		buf := make([]byte, 4096)
+		total := 0
+		var err error
+		for err == nil {
+			var n int
+			n, err = rd.Read(buf)
+			total += n
+		}
+		if !errors.Is(err, pbzip2.ErrBlockChecksum) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrBlockChecksum)
+		}
+		// None of the first block's output should be returned.
+		if got, want := total, 0; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		rd.Close()
+	}
+}
+
+func TestSingleBlockChecksum(t *testing.T) {
+	ctx := context.Background()
+	// The stream CRC of a single block stream is derived solely from its
+	// block CRC, hence corruption of the block is reported as a block
+	// checksum mismatch as soon as the block is decompressed, even if the
+	// stream CRC in the trailer is also corrupt.
+	compressed, l := readFile(t, "hello")
+	corruptData := append([]byte(nil), compressed...)
+	corruptData[33] ^= 0x10
+	corruptBoth := append([]byte(nil), corruptData...)
+	corruptBoth[l] ^= 0x10
+	for _, corrupted := range [][]byte{corruptData, corruptBoth} {
+		for _, concurrency := range []int{0, 2} {
+			events := make(chan pbzip2.BlockEvent, 10)
+			opts := []pbzip2.ReaderOption{pbzip2.WithEventChannel(events)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(corrupted), opts...)
+			n, err := io.Copy(io.Discard, rd)
+			if !errors.Is(err, pbzip2.ErrBlockChecksum) {
+				t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrBlockChecksum)
+			}
+			if got, want := n, int64(0); got != want {
+				t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+			}
+			rd.Close()
+			close(events)
+			var types []pbzip2.BlockEventType
+			for ev := range events {
+				types = append(types, ev.Type)
+			}
+			if got, want := types, []pbzip2.BlockEventType{pbzip2.CRCMismatch}; !reflect.DeepEqual(got, want) {
+				t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+			}
+		}
+	}
+}
+
+func TestDispatchStrategy(t *testing.T) {
+	ctx := context.Background()
+	hello, _ := readFile(t, "hello")
+	manyBlocks := bytes.Repeat(hello, 500)
+	inputs := map[string][]byte{
+		"manyBlocks": manyBlocks,
+	}
+	want := map[string][]byte{
+		"manyBlocks": bytes.Repeat(bzip2Data["hello"], 500),
+	}
+	for _, name := range []string{"empty", "300KB2", "900KB2_Random"} {
+		inputs[name], _ = readFile(t, name)
+		want[name] = bzip2Data[name]
+	}
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for name, compressed := range inputs {
+		for _, concurrency := range []int{1, 2, 4} {
+			var outputs [][]byte
+			for _, strategy := range []pbzip2.DispatchStrategy{pbzip2.FixedPool, pbzip2.GoroutinePerBlock} {
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+					pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency),
+						pbzip2.BZDispatchStrategy(strategy)))
+				out, err := io.ReadAll(rd)
+				if err != nil {
+					t.Fatalf("%v: concurrency %v: strategy %v: %v", name, concurrency, strategy, err)
+				}
+				outputs = append(outputs, out)
+			}
+			if !bytes.Equal(outputs[0], outputs[1]) {
+				t.Errorf("%v: concurrency %v: outputs differ", name, concurrency)
+			}
+			if got, want := outputs[1], want[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+}
+
+func TestDispatchBatch(t *testing.T) {
+	ctx := context.Background()
+	hello, _ := readFile(t, "hello")
+	inputs := map[string][]byte{
+		"manyBlocks": bytes.Repeat(hello, 500),
+	}
+	want := map[string][]byte{
+		"manyBlocks": bytes.Repeat(bzip2Data["hello"], 500),
+	}
+	for _, name := range []string{"empty", "300KB2", "900KB2_Random"} {
+		inputs[name], _ = readFile(t, name)
+		want[name] = bzip2Data[name]
+	}
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for name, compressed := range inputs {
+		for _, concurrency := range []int{1, 2, 4} {
+			for _, batch := range []int{1, 3, 16} {
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+					pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency),
+						pbzip2.BZPrioritizeFirstBlock(true),
+						pbzip2.DispatchBatch(batch)))
+				out, err := io.ReadAll(rd)
+				if err != nil {
+					t.Fatalf("%v: concurrency %v: batch %v: %v", name, concurrency, batch, err)
+				}
+				if got, want := out, want[name]; !bytes.Equal(got, want) {
+					t.Errorf("%v: concurrency %v: batch %v: got %v..., want %v...", name, concurrency, batch, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+			}
+		}
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+}
+
+func TestPrioritizeFirstBlock(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB1"
+	compressed, _ := readFile(t, name)
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed))
+	if !sc.Scan(ctx) {
+		t.Fatal(sc.Err())
+	}
+	first := sc.Block().Data
+
+	// Record the number of blocks being decompressed whilst the first
+	// block is yet to be decompressed.
+	var (
+		mu                      sync.Mutex
+		firstDone               bool
+		running, maxBeforeFirst int
+	)
+	pbzip2.SetBlockDecoder(func(blockSize int, src []byte, start int) io.Reader {
+		mu.Lock()
+		running++
+		if !firstDone && running > maxBeforeFirst {
+			maxBeforeFirst = running
+		}
+		mu.Unlock()
+		data, err := io.ReadAll(ibzip2.NewBlockReader(blockSize, src, start))
+		if err != nil {
+			t.Error(err)
+		}
+		mu.Lock()
+		running--
+		if bytes.Equal(src, first) {
+			firstDone = true
+		}
+		mu.Unlock()
+		return bytes.NewReader(data)
+	})
+	defer pbzip2.ResetBlockDecoder()
+
+	for _, strategy := range []pbzip2.DispatchStrategy{pbzip2.FixedPool, pbzip2.GoroutinePerBlock} {
+		for _, concurrency := range []int{1, 2, 8} {
+			firstDone, maxBeforeFirst = false, 0
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency),
+					pbzip2.BZDispatchStrategy(strategy),
+					pbzip2.BZPrioritizeFirstBlock(true)))
+			data, err := io.ReadAll(rd)
+			if err != nil {
+				t.Fatalf("strategy %v: concurrency %v: %v", strategy, concurrency, err)
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("strategy %v: concurrency %v: got %v..., want %v...", strategy, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if got, want := maxBeforeFirst, runtime.GOMAXPROCS(-1); got > want {
+				t.Errorf("strategy %v: concurrency %v: got %v, want <= %v", strategy, concurrency, got, want)
+			}
+		}
+	}
+}
+
+func BenchmarkTimeToFirstByte(b *testing.B) {
+	ctx := context.Background()
+	compressed, err := os.ReadFile(bzip2Files["1033KB4_Random"] + ".bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	for _, priority := range []bool{false, true} {
+		b.Run(fmt.Sprintf("priority=%v", priority), func(b *testing.B) {
+			// Closing the reader waits for all of the workers to finish
+			// and hence the time to first byte is reported separately.
+			var total time.Duration
+			for i := 0; i < b.N; i++ {
+				total += timeToFirstByte(b, func() *pbzip2.Reader {
+					return pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+						pbzip2.DecompressionOptions(
+							pbzip2.BZConcurrency(8),
+							pbzip2.BZPrioritizeFirstBlock(priority)))
+				})
+			}
+			b.ReportMetric(float64(total.Nanoseconds())/float64(b.N), "ns/first-byte")
+		})
+	}
+}
+
+func TestSmallMemory(t *testing.T) {
+	ctx := context.Background()
+	for name := range bzip2Files {
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{pbzip2.SmallMemory(true)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...))
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", name, concurrency, err)
+				continue
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+
+	// Measure the memory allocated to decompress a stream with 900KB
+	// blocks, the two garbage collections ensure that nothing is reused
+	// from the pools of tables used for the inverse BWT.
+	compressed, _ := readFile(t, "900KB9")
+	allocated := func(small bool) uint64 {
+		runtime.GC()
+		runtime.GC()
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.SmallMemory(small),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(1)))
+		if _, err := io.Copy(io.Discard, rd); err != nil {
+			t.Fatal(err)
+		}
+		runtime.ReadMemStats(&after)
+		return after.TotalAlloc - before.TotalAlloc
+	}
+	normal, small := allocated(false), allocated(true)
+	t.Logf("allocated: normal %v, small %v", normal, small)
+	if small >= normal || normal-small < 1<<20 {
+		t.Errorf("small memory mode did not reduce allocations: normal %v, small %v", normal, small)
+	}
+}
+
+func TestRandomizedBlocks(t *testing.T) {
+	ctx := context.Background()
+	// The stream contains randomised, non-randomised and randomised
+	// blocks, in that order.
+	dir := filepath.Join("internal", "bzip2", "testdata")
+	compressed, err := os.ReadFile(filepath.Join(dir, "mixed-randomized.bz2"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := os.ReadFile(filepath.Join(dir, "mixed-randomized.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, small := range []bool{false, true} {
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{pbzip2.SmallMemory(small)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...))
+			if err != nil {
+				t.Errorf("small %v: concurrency %v: %v", small, concurrency, err)
+				continue
+			}
+			if got := data; !bytes.Equal(got, want) {
+				t.Errorf("small %v: concurrency %v: got %v..., want %v...", small, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+}
+
+func TestBlockSizeLevels(t *testing.T) {
+	ctx := context.Background()
+	tmpdir := t.TempDir()
+	// Random data is not changed by the initial run-length encoding and
+	// hence each block, other than the last, is as large as the level
+	// allows, so that level 1 results in 11 small blocks and level 9 in 2.
+	data := internal.GenReproducibleRandomData(1000 * 1024)
+	for level := 1; level <= 9; level++ {
+		filename := filepath.Join(tmpdir, fmt.Sprintf("level%v", level))
+		if err := internal.CreateBzipFile(filename, fmt.Sprintf("-%v", level), data); err != nil {
+			t.Fatal(err)
+		}
+		compressed, err := os.ReadFile(filename + ".bz2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got, want := compressed[3], byte('0'+level); got != want {
+			t.Errorf("level %v: got %c, want %c", level, got, want)
+		}
+		if stdlib, err := stdlibBzip2(filename + ".bz2"); err != nil || !bytes.Equal(stdlib, data) {
+			t.Fatalf("level %v: compress/bzip2 failed to decompress the input: %v", level, err)
+		}
+		// The maximum size of a block at each level, as per bzip2.
+		blockSize := level*100000 - 19
+		blocks := (len(data) + blockSize - 1) / blockSize
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			got, err := io.ReadAll(rd)
+			if err != nil {
+				t.Errorf("level %v: concurrency %v: %v", level, concurrency, err)
+				continue
+			}
+			if want := data; !bytes.Equal(got, want) {
+				t.Errorf("level %v: concurrency %v: got %v..., want %v...", level, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			// Read has verified the CRC of every block and of the stream.
+			if got, want := rd.Stats().BlocksDecoded, blocks; got != want {
+				t.Errorf("level %v: concurrency %v: got %v, want %v", level, concurrency, got, want)
+			}
+		}
+	}
+}
+
+func TestYieldEvery(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "900KB1", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		for _, yield := range []int{1, 3} {
+			for _, concurrency := range []int{0, 2} {
+				opts := []pbzip2.ReaderOption{pbzip2.YieldEvery(yield)}
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency)))
+				}
+				data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...))
+				if err != nil {
+					t.Errorf("%v: yield %v: concurrency %v: %v", name, yield, concurrency, err)
+					continue
+				}
+				if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+					t.Errorf("%v: yield %v: concurrency %v: got %v..., want %v...", name, yield, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+			}
+		}
+	}
+}
+
+// countingCRC counts the hashes it creates.
+type countingCRC struct {
+	sync.Mutex
+	n int
+}
+
+func (cc *countingCRC) new() hash.Hash32 {
+	cc.Lock()
+	defer cc.Unlock()
+	cc.n++
+	return pbzip2.NewCRC()
+}
+
+func TestWithCRC(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "900KB2_Random", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		blocks, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, concurrency := range []int{0, 2} {
+			for _, small := range []bool{false, true} {
+				opts := []pbzip2.ReaderOption{pbzip2.SmallMemory(small)}
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency)))
+				}
+				builtin := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+				want, err := io.ReadAll(builtin)
+				if err != nil {
+					t.Fatalf("%v: %v", name, err)
+				}
+				cc := &countingCRC{}
+				opts = append(opts, pbzip2.WithCRC(cc.new))
+				hooked := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+				got, err := io.ReadAll(hooked)
+				if err != nil {
+					t.Errorf("%v: concurrency %v: small %v: %v", name, concurrency, small, err)
+					continue
+				}
+				if !bytes.Equal(got, want) {
+					t.Errorf("%v: concurrency %v: small %v: got %v..., want %v...", name, concurrency, small, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+				if got, want := hooked.Stats().RunningCRC, builtin.Stats().RunningCRC; got != want {
+					t.Errorf("%v: concurrency %v: small %v: got %08x, want %08x", name, concurrency, small, got, want)
+				}
+				if got, want := cc.n, blocks; got < want {
+					t.Errorf("%v: concurrency %v: small %v: got %v, want >= %v", name, concurrency, small, got, want)
+				}
+			}
+		}
+		if err := pbzip2.Verify(ctx, bytes.NewReader(compressed), pbzip2.WithCRC(pbzip2.NewCRC)); err != nil {
+			t.Errorf("%v: %v", name, err)
+		}
+	}
+
+	// A different CRC fails to match that stored for each block.
+	compressed, _ := readFile(t, "hello")
+	_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), pbzip2.WithCRC(crc32.NewIEEE)))
+	if !errors.Is(err, pbzip2.ErrBlockChecksum) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrBlockChecksum)
+	}
+}
+
+func TestMTFShiftThreshold(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "300KB3_Random", "900KB2_Random", "1033KB4_Random"} {
+		compressed, _ := readFile(t, name)
+		for _, threshold := range []int{0, 8, 256} {
+			for _, concurrency := range []int{0, 2} {
+				opts := []pbzip2.ReaderOption{pbzip2.MTFShiftThreshold(threshold)}
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency)))
+				}
+				data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...))
+				if err != nil {
+					t.Errorf("%v: threshold %v: concurrency %v: %v", name, threshold, concurrency, err)
+					continue
+				}
+				if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+					t.Errorf("%v: threshold %v: concurrency %v: got %v..., want %v...", name, threshold, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+				if err := pbzip2.Verify(ctx, bytes.NewReader(compressed), opts...); err != nil {
+					t.Errorf("%v: threshold %v: concurrency %v: %v", name, threshold, concurrency, err)
+				}
+			}
+		}
+	}
+
+	compressed, _ := readFile(t, "hello")
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), pbzip2.MTFShiftThreshold(-1))
+	if _, err := io.ReadAll(rd); !errors.Is(err, pbzip2.ErrInvalidOption) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrInvalidOption)
+	}
+}
+
+func TestAllowOversizeBlocks(t *testing.T) {
+	ctx := context.Background()
+	// redeclare returns a copy of the named stream with its declared
+	// block size replaced by level.
+	redeclare := func(name string, level byte) []byte {
+		buf, _ := readFile(t, name)
+		buf = append([]byte{}, buf...)
+		buf[3] = level
+		return buf
+	}
+	read := func(compressed []byte, opts ...pbzip2.ReaderOption) ([]byte, []string, error) {
+		var warnings []string
+		logf := func(format string, args ...interface{}) {
+			warnings = append(warnings, fmt.Sprintf(format, args...))
+		}
+		opts = append(opts, pbzip2.WithLogger(logf))
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		defer rd.Close()
+		data, err := io.ReadAll(rd)
+		return data, warnings, err
+	}
+	// A single block of 105KB that is declared as being at most 100KB.
+	oversize := redeclare("105KB2_Random", '1')
+	// A single block of 300KB that is declared as being at most 200KB,
+	// which exceeds the limit for oversize blocks.
+	tooLarge := redeclare("300KB3_Random", '2')
+	for _, small := range []bool{false, true} {
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{pbzip2.SmallMemory(small)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			_, _, err := read(oversize, opts...)
+			if !errors.Is(err, pbzip2.ErrBadBlockSize) {
+				t.Errorf("small %v: concurrency %v: got %v, want %v", small, concurrency, err, pbzip2.ErrBadBlockSize)
+			}
+
+			lenient := append(opts, pbzip2.AllowOversizeBlocks(true))
+			data, warnings, err := read(oversize, lenient...)
+			if err != nil {
+				t.Errorf("small %v: concurrency %v: %v", small, concurrency, err)
+				continue
+			}
+			if got, want := data, bzip2Data["105KB2_Random"]; !bytes.Equal(got, want) {
+				t.Errorf("small %v: concurrency %v: got %v..., want %v...", small, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if got, want := len(warnings), 1; got != want {
+				t.Errorf("small %v: concurrency %v: got %v, want %v", small, concurrency, got, want)
+			} else if got, want := warnings[0], "exceeding the declared block size of 100000"; !strings.Contains(got, want) {
+				t.Errorf("small %v: concurrency %v: %q does not contain %q", small, concurrency, got, want)
+			}
+
+			_, _, err = read(tooLarge, lenient...)
+			if !errors.Is(err, pbzip2.ErrBadBlockSize) {
+				t.Errorf("small %v: concurrency %v: got %v, want %v", small, concurrency, err, pbzip2.ErrBadBlockSize)
+			}
+		}
+	}
+}
+
+func BenchmarkDispatchStrategy(b *testing.B) {
+	ctx := context.Background()
+	read := func(name string) []byte {
+		buf, err := os.ReadFile(bzip2Files[name] + ".bz2")
+		if err != nil {
+			b.Fatal(err)
+		}
+		return buf
+	}
+	hello, random, text := read("hello"), read("900KB2_Random"), read("800KB1")
+	// Interleave blocks that are cheap to decode with blocks that are
+	// expensive to decode so that workers that are statically assigned
+	// blocks in turn spend time idle.
+	var mixed []byte
+	for i := 0; i < 4; i++ {
+		mixed = append(mixed, text...)
+		mixed = append(mixed, random...)
+	}
+	for _, input := range []struct {
+		name       string
+		compressed []byte
+	}{
+		{"SmallBlocks", bytes.Repeat(hello, 10000)},
+		{"900KB2_Random", random},
+		{"Mixed", mixed},
+	} {
+		for _, strategy := range []struct {
+			name string
+			opts []pbzip2.DecompressorOption
+		}{
+			{"FixedPool", []pbzip2.DecompressorOption{pbzip2.BZDispatchStrategy(pbzip2.FixedPool)}},
+			{"GoroutinePerBlock", []pbzip2.DecompressorOption{pbzip2.BZDispatchStrategy(pbzip2.GoroutinePerBlock)}},
+			// DeterministicDispatch assigns blocks to workers round-robin.
+			{"RoundRobin", []pbzip2.DecompressorOption{pbzip2.DeterministicDispatch(true)}},
+		} {
+			b.Run(input.name+"/"+strategy.name, func(b *testing.B) {
+				b.SetBytes(int64(len(input.compressed)))
+				for i := 0; i < b.N; i++ {
+					rd := pbzip2.NewReader(ctx, bytes.NewReader(input.compressed),
+						pbzip2.DecompressionOptions(
+							append([]pbzip2.DecompressorOption{pbzip2.BZConcurrency(4)}, strategy.opts...)...))
+					if _, err := io.Copy(io.Discard, rd); err != nil {
+						b.Fatal(err)
+					}
+				}
+			})
+		}
+	}
+}
+
+func BenchmarkDispatchBatch(b *testing.B) {
+	ctx := context.Background()
+	hello, err := os.ReadFile(bzip2Files["hello"] + ".bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	compressed := bytes.Repeat(hello, 10000)
+	for _, batch := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("batch-%v", batch), func(b *testing.B) {
+			b.SetBytes(int64(len(compressed)))
+			for i := 0; i < b.N; i++ {
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+					pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(4),
+						pbzip2.DispatchBatch(batch)))
+				if _, err := io.Copy(io.Discard, rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestVerifiedProgress(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{0, 2} {
+			var verified []int64
+			opts := []pbzip2.ReaderOption{
+				pbzip2.VerifiedProgress(func(n int64) {
+					verified = append(verified, n)
+				}),
+			}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			n, err := io.Copy(io.Discard, rd)
+			if err != nil {
+				t.Fatalf("%v: concurrency %v: %v", name, concurrency, err)
+			}
+			if len(verified) == 0 {
+				t.Fatalf("%v: concurrency %v: no progress was reported", name, concurrency)
+			}
+			for i := 1; i < len(verified); i++ {
+				if verified[i] <= verified[i-1] {
+					t.Errorf("%v: concurrency %v: not increasing: %v", name, concurrency, verified)
+				}
+			}
+			if got, want := verified[len(verified)-1], n; got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+			if got, want := n, int64(len(bzip2Data[name])); got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+		}
+	}
+}
+
+// slowReader delays the first Read from the underlying block decoder.
+type slowReader struct {
+	rd    io.Reader
+	delay time.Duration
+	once  sync.Once
+}
+
+func (sr *slowReader) Read(buf []byte) (int, error) {
+	sr.once.Do(func() { time.Sleep(sr.delay) })
+	return sr.rd.Read(buf)
+}
+
+func TestTryRead(t *testing.T) {
+	ctx := context.Background()
+	pbzip2.SetBlockDecoder(func(blockSize int, src []byte, start int) io.Reader {
+		return &slowReader{rd: ibzip2.NewBlockReader(blockSize, src, start), delay: 200 * time.Millisecond}
+	})
+	defer pbzip2.ResetBlockDecoder()
+	compressed, _ := readFile(t, "300KB2")
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		buf := make([]byte, 1000)
+		n, err := rd.TryRead(buf)
+		if got, want := n, 0; got != want || err != nil {
+			t.Errorf("concurrency %v: got %v, %v, want %v, nil", concurrency, got, err, want)
+		}
+		var out bytes.Buffer
+		start := time.Now()
+		for time.Since(start) < 10*time.Second {
+			n, err = rd.TryRead(buf)
+			out.Write(buf[:n])
+			if n > 0 || err != nil {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		if n == 0 || err != nil {
+			t.Fatalf("concurrency %v: got %v, %v, want data", concurrency, n, err)
+		}
+		if _, err := io.Copy(&out, rd); err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := out.Bytes(), bzip2Data["300KB2"]; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %v..., want %v...", concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		if n, err := rd.TryRead(buf); n != 0 || err != io.EOF {
+			t.Errorf("concurrency %v: got %v, %v, want 0, %v", concurrency, n, err, io.EOF)
+		}
+		rd.Close()
+	}
+}
+
+func TestTryReadCanceled(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "300KB2")
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		before := runtime.NumGoroutine()
+		cctx, cancel := context.WithCancel(ctx)
+		rd := pbzip2.NewReader(cctx, bytes.NewReader(compressed), opts...)
+		if _, err := rd.TryRead(make([]byte, 10)); err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		// Neither Read nor Close are called again, canceling the
+		// context must be sufficient for all goroutines to exit.
+		cancel()
+		for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got, want := runtime.NumGoroutine(), before; got > want {
+			t.Errorf("concurrency %v: goroutine leak: got %v, want at most %v", concurrency, got, want)
+		}
+	}
+}
+
+type writeCounter struct {
+	bytes.Buffer
+	writes int
+	sizes  []int
+}
+
+func (wc *writeCounter) Write(p []byte) (int, error) {
+	wc.writes++
+	wc.sizes = append(wc.sizes, len(p))
+	return wc.Buffer.Write(p)
+}
+
+func TestWriteTo(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "hello")
+	for _, concurrency := range []int{0, 1, 16} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		wc := &writeCounter{}
+		start := time.Now()
+		n, err := rd.WriteTo(wc)
+		if err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		if took := time.Since(start); took > time.Second {
+			t.Errorf("concurrency %v: took too long: %v", concurrency, took)
+		}
+		if got, want := n, int64(len(bzip2Data["hello"])); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := wc.Bytes(), bzip2Data["hello"]; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %s, want %s", concurrency, got, want)
+		}
+		if got, want := wc.writes, 1; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+	}
+
+	for _, name := range []string{"empty", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(4)))
+		var out bytes.Buffer
+		if _, err := io.Copy(&out, rd); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		if got, want := out.Bytes(), bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v..., want %v...", name, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+	}
+}
+
+func TestWriteToCorpus(t *testing.T) {
+	ctx := context.Background()
+	for name := range bzip2Files {
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			var out bytes.Buffer
+			n, err := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...).WriteTo(&out)
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", name, concurrency, err)
+				continue
+			}
+			if got, want := n, int64(len(bzip2Data[name])); got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+			if got, want := out.Bytes(), bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+
+	compressed, _ := readFile(t, "900KB2_Random")
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		ctx, cancel := context.WithCancel(ctx)
+		cancel()
+		n, err := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...).WriteTo(io.Discard)
+		if err == nil || err.Error() != "context canceled" {
+			t.Errorf("concurrency %v: missing or unexpected error: %v", concurrency, err)
+		}
+		if got, want := n, int64(0); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestFrameSize(t *testing.T) {
+	ctx := context.Background()
+	frame := 64 * 1024
+	for _, name := range []string{"empty", "hello", "300KB1", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		want := bzip2Data[name]
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{pbzip2.FrameSize(frame)}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			wc := &writeCounter{}
+			if _, err := rd.WriteTo(wc); err != nil {
+				t.Fatalf("%v: concurrency %v: %v", name, concurrency, err)
+			}
+			if got := wc.Bytes(); !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if got, want := wc.writes, (len(want)+frame-1)/frame; got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+			for i, size := range wc.sizes {
+				if i < len(wc.sizes)-1 && size != frame {
+					t.Errorf("%v: concurrency %v: write %v: got %v, want %v", name, concurrency, i, size, frame)
+				}
+			}
+			if n := len(wc.sizes); n > 0 {
+				if got, want := wc.sizes[n-1], len(want)-(n-1)*frame; got != want {
+					t.Errorf("%v: concurrency %v: final write: got %v, want %v", name, concurrency, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestShortFinalBlock(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"tiny", "tinyrun"} {
+		compressed, _ := readFile(t, name)
+		stdlibData := readBzipFile(t, bzip2Files[name])
+		if got, want := stdlibData, bzip2Data[name]; !bytes.Equal(got, want) {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+		for _, concurrency := range []int{0, 2} {
+			for _, small := range []bool{false, true} {
+				opts := []pbzip2.ReaderOption{pbzip2.SmallMemory(small)}
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency)))
+				}
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+				data, err := io.ReadAll(iotest.OneByteReader(rd))
+				if err != nil {
+					t.Errorf("%v: concurrency %v: small %v: %v", name, concurrency, small, err)
+					continue
+				}
+				if got, want := data, stdlibData; !bytes.Equal(got, want) {
+					t.Errorf("%v: concurrency %v: small %v: got %v, want %v", name, concurrency, small, got, want)
+				}
+				if got, want := rd.Stats().UncompressedBytes, int64(len(stdlibData)); got != want {
+					t.Errorf("%v: concurrency %v: small %v: got %v, want %v", name, concurrency, small, got, want)
+				}
+			}
+		}
+	}
+}
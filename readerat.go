@@ -0,0 +1,237 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// scanRegionSize is the size of each of the regions of the input that are
+// searched concurrently for block magic numbers by NewReaderAt.
+var scanRegionSize int64 = 1 << 20
+
+// NewReaderAt returns a Reader for the size bytes of bzip2 data read from
+// r that searches for the blocks' magic numbers concurrently. When the
+// input is highly compressible, locating the blocks can take longer than
+// decompressing them, leaving the goroutines that decompress them idle
+// whilst the blocks are found. NewReaderAt divides the input into regions
+// which are searched concurrently, ahead of those being scanned, with the
+// locations found being used in place of searching the input as it is
+// scanned. The input is otherwise scanned, and the blocks decompressed,
+// exactly as for NewReader, including the handling of multiple streams
+// and of magic numbers that occur by chance within a block, and hence the
+// output is identical. The number of regions searched concurrently is
+// that requested via BZScanConcurrency, which defaults to the concurrency
+// requested via BZConcurrency. A scan concurrency of 1 searches the input
+// in turn, without any additional goroutines, as NewReader does. As for
+// an in-memory reader passed to NewReader, an input of no more than 1MB
+// that is found to contain a single block is decompressed without any
+// additional goroutines.
+func NewReaderAt(ctx context.Context, r io.ReaderAt, size int64, opts ...ReaderOption) *Reader {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	rdOpts.probe = rdOpts.probeInput(size)
+	sc := NewScanner(io.NewSectionReader(r, 0, size), rdOpts.scannerOptions()...)
+	if !rdOpts.probe && newDecompressorOpts(rdOpts.decOpts).scanConcurrency != 1 {
+		sc.regions = &regionFinder{
+			ra:         r,
+			size:       size,
+			regionSize: scanRegionSize,
+			workers:    scanConcurrency(rdOpts),
+		}
+	}
+	zrd := newReader(ctx, sc, rdOpts)
+	zrd.own(rdOpts, r)
+	return zrd
+}
+
+// scanConcurrency returns the number of goroutines to use to search for
+// block magic numbers, see BZScanConcurrency.
+func scanConcurrency(rdOpts *readerOpts) int {
+	if n := newDecompressorOpts(rdOpts.decOpts).scanConcurrency; n > 0 {
+		return n
+	}
+	return blockConcurrency(rdOpts)
+}
+
+// magicMatch is the location of a block magic number.
+type magicMatch struct {
+	byteOffset int64
+	bitOffset  int
+}
+
+// scanRegion is a region of the input to be searched for block magic
+// numbers, matches is valid once done is closed and err is nil.
+type scanRegion struct {
+	start, end int64
+	done       chan struct{}
+	matches    []magicMatch
+	err        error
+}
+
+// search finds all of the block magic numbers that start within the
+// region.
+func (sr *scanRegion) search(ra io.ReaderAt, size int64) {
+	defer close(sr.done)
+	// Allow for a magic number that starts in the last byte of the region.
+	end := sr.end + int64(len(blockMagic)+1)
+	if end > size {
+		end = size
+	}
+	buf := make([]byte, end-sr.start)
+	if _, err := ra.ReadAt(buf, sr.start); err != nil && err != io.EOF {
+		sr.err = fmt.Errorf("failed to read region at offset %v: %v", sr.start, err)
+		return
+	}
+	limit := int(sr.end - sr.start)
+	for pos := 0; pos < limit; {
+		byteOffset, bitOffset := blockMagicFinder.Find(buf[pos:])
+		if byteOffset < 0 || pos+byteOffset >= limit {
+			return
+		}
+		sr.matches = append(sr.matches, magicMatch{
+			byteOffset: sr.start + int64(pos+byteOffset),
+			bitOffset:  bitOffset,
+		})
+		pos += byteOffset + 1
+	}
+}
+
+// regionFinder implements the concurrent search used by NewReaderAt. The
+// regions are searched by a pool of goroutines that are started on the
+// first call to find and the results are consumed, in order, by find.
+type regionFinder struct {
+	ra         io.ReaderAt
+	size       int64
+	regionSize int64
+	workers    int
+	order      chan *scanRegion
+	current    *scanRegion
+	wg         sync.WaitGroup
+
+	mu      sync.Mutex
+	cancel  context.CancelFunc // guarded by mu.
+	stopped bool               // guarded by mu.
+}
+
+// start starts the goroutines, it returns false if stop has already been
+// called.
+func (rf *regionFinder) start(ctx context.Context) bool {
+	rf.mu.Lock()
+	defer rf.mu.Unlock()
+	if rf.stopped {
+		return false
+	}
+	ctx, rf.cancel = context.WithCancel(ctx)
+	// The capacity of order limits how far ahead of the scanner the
+	// regions are searched.
+	rf.order = make(chan *scanRegion, 2*rf.workers)
+	work := make(chan *scanRegion, rf.workers)
+	rf.wg.Add(rf.workers + 1)
+	goroutineStarted()
+	go func() {
+		defer rf.wg.Done()
+		defer goroutineDone()
+		defer close(rf.order)
+		defer close(work)
+		for start := int64(0); start < rf.size; start += rf.regionSize {
+			end := start + rf.regionSize
+			if end > rf.size {
+				end = rf.size
+			}
+			sr := &scanRegion{start: start, end: end, done: make(chan struct{})}
+			select {
+			case rf.order <- sr:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case work <- sr:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	for i := 0; i < rf.workers; i++ {
+		goroutineStarted()
+		go func() {
+			defer rf.wg.Done()
+			defer goroutineDone()
+			for sr := range work {
+				sr.search(rf.ra, rf.size)
+			}
+		}()
+	}
+	return true
+}
+
+// find is used in place of blockMagicFinder.Find by Scanner.scan, buf
+// being the input starting at offset. It returns the offset within buf
+// of the first block magic number that occurs in its entirety in buf.
+func (rf *regionFinder) find(ctx context.Context, offset int64, buf []byte) (int, int, error) {
+	if rf.order == nil && !rf.start(ctx) {
+		// stop is only called before the scan has finished when ctx
+		// has been canceled.
+		return -1, -1, ctx.Err()
+	}
+	for {
+		if rf.current == nil {
+			var sr *scanRegion
+			var ok bool
+			select {
+			case sr, ok = <-rf.order:
+			case <-ctx.Done():
+				return -1, -1, ctx.Err()
+			}
+			if !ok {
+				return -1, -1, nil
+			}
+			select {
+			case <-sr.done:
+			case <-ctx.Done():
+				return -1, -1, ctx.Err()
+			}
+			if sr.err != nil {
+				return -1, -1, sr.err
+			}
+			rf.current = sr
+		}
+		sr := rf.current
+		for len(sr.matches) > 0 && sr.matches[0].byteOffset < offset {
+			sr.matches = sr.matches[1:]
+		}
+		if len(sr.matches) > 0 {
+			m := sr.matches[0]
+			pos := int(m.byteOffset - offset)
+			if m.bitOffset+len(blockMagic)*8 <= 8*(len(buf)-pos) {
+				return pos, m.bitOffset, nil
+			}
+			return -1, -1, nil
+		}
+		if sr.end >= offset+int64(len(buf)) {
+			return -1, -1, nil
+		}
+		rf.current = nil
+	}
+}
+
+// stop stops the goroutines started by find, and prevents them from being
+// started, and waits for them to exit. It may be called concurrently with
+// find and more than once.
+func (rf *regionFinder) stop() {
+	rf.mu.Lock()
+	rf.stopped = true
+	cancel := rf.cancel
+	rf.mu.Unlock()
+	if cancel != nil {
+		cancel()
+	}
+	rf.wg.Wait()
+}
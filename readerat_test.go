@@ -0,0 +1,149 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"runtime"
+	"sort"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+func TestReaderAt(t *testing.T) {
+	ctx := context.Background()
+	var names []string
+	for name := range bzip2Files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	multi, multiData := concatFiles(t, "hello", "empty", "300KB2", "900KB1", "hello")
+	inputs := map[string][]byte{"multiple streams": multi}
+	outputs := map[string][]byte{"multiple streams": multiData}
+	for _, name := range names {
+		inputs[name], _ = readFile(t, name)
+		outputs[name] = bzip2Data[name]
+	}
+	names = append(names, "multiple streams")
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	// Use regions that are smaller than most blocks and that are not
+	// byte aligned with respect to the blocks, as well as the default.
+	const small = 4099
+	defaultSize := pbzip2.SetScanRegionSize(small)
+	defer pbzip2.SetScanRegionSize(defaultSize)
+	for _, regionSize := range []int64{small, defaultSize} {
+		pbzip2.SetScanRegionSize(regionSize)
+		for _, concurrency := range []int{0, 2, 8} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			for _, name := range names {
+				compressed := inputs[name]
+				rd := pbzip2.NewReaderAt(ctx, bytes.NewReader(compressed), int64(len(compressed)), opts...)
+				data, err := io.ReadAll(rd)
+				if err != nil {
+					t.Errorf("%v: region %v: concurrency %v: %v", name, regionSize, concurrency, err)
+					continue
+				}
+				if got, want := data, outputs[name]; !bytes.Equal(got, want) {
+					t.Errorf("%v: region %v: concurrency %v: got %v..., want %v...", name, regionSize, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+			}
+		}
+	}
+
+	// Errors are reported as for NewReader.
+	corrupted := append([]byte{}, inputs["hello"]...)
+	corrupted[len(corrupted)-2] ^= 0xff
+	_, err := io.ReadAll(pbzip2.NewReaderAt(ctx, bytes.NewReader(corrupted), int64(len(corrupted))))
+	if !errors.Is(err, pbzip2.ErrMismatchedCRC) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrMismatchedCRC)
+	}
+
+	// Canceling the context stops all of the goroutines.
+	before := runtime.NumGoroutine()
+	pbzip2.SetScanRegionSize(small)
+	compressed := inputs["1033KB4_Random"]
+	cctx, cancel := context.WithCancel(ctx)
+	rd := pbzip2.NewReaderAt(cctx, bytes.NewReader(compressed), int64(len(compressed)),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(4)))
+	if _, err := rd.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := io.Copy(io.Discard, rd); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	rd.Close()
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+	for i := 0; i < 100 && runtime.NumGoroutine() > before; i++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, want := runtime.NumGoroutine(), before; got > want {
+		t.Errorf("goroutine leak: got %v, want at most %v", got, want)
+	}
+}
+
+func TestScanConcurrency(t *testing.T) {
+	ctx := context.Background()
+	defer pbzip2.SetScanRegionSize(pbzip2.SetScanRegionSize(4099))
+	compressed, data := concatFiles(t, "hello", "900KB1", "300KB2")
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for _, tc := range []struct {
+		decode, scan int
+		goroutines   int64
+	}{
+		{1, 1, 0},
+		{1, 4, 1 + 1 + 5},
+		{4, 1, 4 + 1},
+		{2, 0, 2 + 1 + 3},
+		{4, 2, 4 + 1 + 3},
+	} {
+		pbzip2.ResetMaxDecompressionGoRoutines()
+		opts := []pbzip2.DecompressorOption{pbzip2.BZConcurrency(tc.decode)}
+		if tc.scan > 0 {
+			opts = append(opts, pbzip2.BZScanConcurrency(tc.scan))
+		}
+		rd := pbzip2.NewReaderAt(ctx, bytes.NewReader(compressed), int64(len(compressed)),
+			pbzip2.DecompressionOptions(opts...))
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Errorf("decode %v, scan %v: %v", tc.decode, tc.scan, err)
+			continue
+		}
+		if got, want := out, data; !bytes.Equal(got, want) {
+			t.Errorf("decode %v, scan %v: got %v..., want %v...", tc.decode, tc.scan, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		if got, want := pbzip2.GetMaxDecompressionGoRoutines()-ngs, tc.goroutines; got != want {
+			t.Errorf("decode %v, scan %v: got %v, want %v", tc.decode, tc.scan, got, want)
+		}
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+			t.Errorf("decode %v, scan %v: goroutine leak: got %v, want %v", tc.decode, tc.scan, got, want)
+		}
+	}
+
+	// Close stops the goroutines searching for blocks.
+	rd := pbzip2.NewReaderAt(ctx, bytes.NewReader(compressed), int64(len(compressed)),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2), pbzip2.BZScanConcurrency(4)))
+	if _, err := rd.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	if err := rd.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+}
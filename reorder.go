@@ -0,0 +1,197 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"fmt"
+	"sync"
+)
+
+// ReorderBuffer holds the decompressed output of blocks that have been
+// decompressed ahead of the blocks that precede them until their output
+// can be written in order. The default implementation keeps the output in
+// memory, other implementations may, for example, spill it to disk when
+// the consumer of the output is much slower than the decompressor. The
+// output of a block that is decompressed in order is written immediately
+// and is never Put. Each index is Put at most once and retrieved once via
+// Get, which should also remove it from the buffer. The methods are only
+// ever called from a single goroutine.
+type ReorderBuffer interface {
+	Put(index int, data []byte)
+	Get(index int) ([]byte, bool)
+}
+
+// WithReorderBuffer sets the ReorderBuffer to use; it has no effect when
+// blocks are decompressed serially since there is no need to reorder them.
+func WithReorderBuffer(rb ReorderBuffer) ReaderOption {
+	return func(o *readerOpts) {
+		o.reorder = rb
+	}
+}
+
+// OnBufferHighWater requests that fn be called each time that the
+// decompressed output held by the Reader, that is, the output of blocks
+// in the reorder buffer and of the block being returned by Read, grows
+// from at most threshold bytes to more than threshold bytes. fn is passed
+// the number of bytes currently held. It can be used, for example, to
+// slow down other producers when the consumer of the output falls
+// behind. fn is called from the goroutine that reassembles the output and
+// must not block. Like WithReorderBuffer it has no effect when blocks are
+// decompressed serially.
+func OnBufferHighWater(threshold int, fn func(current int)) ReaderOption {
+	return func(o *readerOpts) {
+		o.highWater = threshold
+		o.onHighWater = fn
+	}
+}
+
+type memoryReorderBuffer map[int][]byte
+
+func (mb memoryReorderBuffer) Put(index int, data []byte) {
+	mb[index] = data
+}
+
+func (mb memoryReorderBuffer) Get(index int) ([]byte, bool) {
+	data, ok := mb[index]
+	delete(mb, index)
+	return data, ok
+}
+
+// store saves the output of block in the reorder buffer.
+func (dc *Decompressor) store(block *blockDesc) {
+	if block.err == nil {
+		dc.reorder.Put(int(block.order), block.uncompressed)
+		block.stashed = true
+	}
+	if _, ok := dc.reorder.(memoryReorderBuffer); !ok {
+		// See WithBufferAllocator.
+		dc.allocator.release(block)
+	}
+	block.uncompressed = nil
+}
+
+// buffer records that the amount of output held by the Decompressor has
+// changed by n bytes, see OnBufferHighWater.
+func (dc *Decompressor) buffer(n int) {
+	prev := dc.buffered
+	dc.buffered += n
+	if dc.onHighWater != nil && prev <= dc.highWater && dc.buffered > dc.highWater {
+		dc.callback(func() { dc.onHighWater(dc.buffered) })
+	}
+}
+
+// retrieve restores the output of block from the reorder buffer, if it
+// was stored there.
+func (dc *Decompressor) retrieve(block *blockDesc) error {
+	if !block.stashed {
+		return nil
+	}
+	block.stashed = false
+	data, ok := dc.reorder.Get(int(block.order))
+	if !ok {
+		return fmt.Errorf("%w: block %v is missing from the reorder buffer", ErrInternal, block.order)
+	}
+	block.uncompressed = data
+	return nil
+}
+
+// bufferLimit implements BZMaxBuffered by limiting the output of the
+// blocks that are being decompressed, or have been decompressed but not
+// yet read. A nil bufferLimit imposes no limit.
+type bufferLimit struct {
+	mu      sync.Mutex
+	limit   int
+	used    int
+	next    uint64        // the order of the next block to be read.
+	closed  bool          // set once assembly is complete.
+	changed chan struct{} // closed, and replaced, whenever used or next changes.
+}
+
+func newBufferLimit(limit int) *bufferLimit {
+	return &bufferLimit{limit: limit, next: 1, changed: make(chan struct{})}
+}
+
+// acquire waits for the output of block to fit within the limit, counting
+// the block size declared by its stream's header towards it. The next
+// block to be read never waits. It returns false if ctx is canceled
+// whilst waiting.
+func (bl *bufferLimit) acquire(ctx context.Context, block *blockDesc) bool {
+	if bl == nil {
+		return true
+	}
+	n := 0
+	if len(block.Data) > 0 {
+		n = block.StreamBlockSize
+	}
+	for {
+		bl.mu.Lock()
+		if bl.closed || block.order <= bl.next || bl.used+n <= bl.limit {
+			bl.used += n
+			block.buffered = n
+			bl.mu.Unlock()
+			return true
+		}
+		changed := bl.changed
+		bl.mu.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return false
+		}
+	}
+}
+
+// decompressed replaces the estimate counted for block by acquire with
+// the size of its output.
+func (bl *bufferLimit) decompressed(block *blockDesc) {
+	if bl == nil {
+		return
+	}
+	bl.update(func() {
+		bl.used += len(block.uncompressed) - block.buffered
+		block.buffered = len(block.uncompressed)
+	})
+}
+
+// release is called once the output of block has been read, or discarded.
+func (bl *bufferLimit) release(block *blockDesc) {
+	if bl == nil {
+		return
+	}
+	bl.update(func() {
+		bl.used -= block.buffered
+		block.buffered = 0
+	})
+}
+
+// advance records that next is the next block to be read.
+func (bl *bufferLimit) advance(next uint64) {
+	if bl == nil {
+		return
+	}
+	bl.update(func() {
+		bl.next = next
+	})
+}
+
+// close releases all waiting workers, and disables the limit, once
+// assembly is complete so that they can exit.
+func (bl *bufferLimit) close() {
+	if bl == nil {
+		return
+	}
+	bl.update(func() {
+		bl.closed = true
+	})
+}
+
+func (bl *bufferLimit) update(fn func()) {
+	bl.mu.Lock()
+	defer bl.mu.Unlock()
+	fn()
+	close(bl.changed)
+	bl.changed = make(chan struct{})
+}
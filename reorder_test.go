@@ -0,0 +1,226 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+)
+
+// recordingBuffer is a ReorderBuffer that records every Put and Get.
+type recordingBuffer struct {
+	data       map[int][]byte
+	puts, gets []int
+	max        int
+}
+
+func (rb *recordingBuffer) Put(index int, data []byte) {
+	rb.puts = append(rb.puts, index)
+	rb.data[index] = data
+	if len(rb.data) > rb.max {
+		rb.max = len(rb.data)
+	}
+}
+
+func (rb *recordingBuffer) Get(index int) ([]byte, bool) {
+	rb.gets = append(rb.gets, index)
+	data, ok := rb.data[index]
+	delete(rb.data, index)
+	return data, ok
+}
+
+func TestReorderBuffer(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "900KB1", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{1, 4} {
+			rb := &recordingBuffer{data: map[int][]byte{}}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.WithReorderBuffer(rb),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			data, err := io.ReadAll(rd)
+			if err != nil {
+				t.Fatalf("%v: concurrency %v: %v", name, concurrency, err)
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if !sort.IntsAreSorted(rb.gets) {
+				t.Errorf("%v: concurrency %v: out of order: %v", name, concurrency, rb.gets)
+			}
+			sort.Ints(rb.puts)
+			if got, want := rb.puts, rb.gets; !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+			// A single worker decompresses every block in order and
+			// hence none need be reordered.
+			if got := len(rb.puts); concurrency == 1 && got != 0 {
+				t.Errorf("%v: concurrency %v: %v blocks put in the buffer", name, concurrency, got)
+			}
+			if got := len(rb.data); got != 0 {
+				t.Errorf("%v: concurrency %v: %v blocks left in the buffer", name, concurrency, got)
+			}
+			t.Logf("%v: concurrency %v: max buffered blocks: %v", name, concurrency, rb.max)
+		}
+	}
+}
+
+func TestBufferHighWater(t *testing.T) {
+	ctx := context.Background()
+	compressed, _ := readFile(t, "900KB1")
+	const threshold = 1024
+	var (
+		mu          sync.Mutex
+		calls       []int
+		onHighWater = func(current int) {
+			mu.Lock()
+			defer mu.Unlock()
+			calls = append(calls, current)
+		}
+	)
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.OnBufferHighWater(threshold, onHighWater),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	// A slow consumer.
+	var data []byte
+	buf := make([]byte, 64*1024)
+	for {
+		n, err := rd.Read(buf)
+		data = append(data, buf[:n]...)
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if got, want := data, bzip2Data["900KB1"]; !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(calls) == 0 {
+		t.Fatalf("callback was not called")
+	}
+	for _, current := range calls {
+		if current <= threshold {
+			t.Errorf("callback called with %v bytes buffered, which does not exceed %v", current, threshold)
+		}
+	}
+
+	// The callback is not called if the threshold is never exceeded.
+	called := false
+	rd = pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.OnBufferHighWater(len(data), func(int) { called = true }),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		t.Fatal(err)
+	}
+	if called {
+		t.Errorf("callback was called unexpectedly")
+	}
+}
+
+// peakAllocator records the peak number of bytes allocated but not freed.
+type peakAllocator struct {
+	sync.Mutex
+	inUse, peak int
+}
+
+func (pa *peakAllocator) alloc(size int) []byte {
+	pa.Lock()
+	defer pa.Unlock()
+	pa.inUse += size
+	if pa.inUse > pa.peak {
+		pa.peak = pa.inUse
+	}
+	return make([]byte, size)
+}
+
+func (pa *peakAllocator) free(buf []byte) {
+	pa.Lock()
+	defer pa.Unlock()
+	pa.inUse -= cap(buf)
+}
+
+func TestMaxBuffered(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB1"
+	compressed, _ := readFile(t, name)
+	const (
+		limit     = 250 * 1000
+		blockSize = 100 * 1000
+	)
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	for _, concurrency := range []int{2, 8} {
+		peaks := []int{}
+		for _, max := range []int{0, limit} {
+			pa := &peakAllocator{}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+				pbzip2.WithBufferAllocator(pa.alloc, pa.free),
+				pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency),
+					pbzip2.BZMaxBuffered(max)))
+			// A slow consumer.
+			var data []byte
+			buf := make([]byte, 64*1024)
+			for {
+				n, err := rd.Read(buf)
+				data = append(data, buf[:n]...)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				time.Sleep(time.Millisecond)
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("concurrency %v: max %v: got %v..., want %v...", concurrency, max, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			peaks = append(peaks, pa.peak)
+		}
+		t.Logf("concurrency %v: peak without limit %v, with limit %v", concurrency, peaks[0], peaks[1])
+		// The limit may be exceeded by the next block in order and by
+		// the allowance made for the growth of each block's buffer.
+		if got, want := peaks[1], limit+blockSize*3/2; got > want {
+			t.Errorf("concurrency %v: got %v, want at most %v", concurrency, got, want)
+		}
+		if concurrency == 8 && peaks[1] >= peaks[0] {
+			t.Errorf("concurrency %v: limit had no effect: %v >= %v", concurrency, peaks[1], peaks[0])
+		}
+	}
+
+	// Canceling the context releases workers that are waiting for
+	// output to be read.
+	ctx, cancel := context.WithCancel(ctx)
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(
+			pbzip2.BZConcurrency(8),
+			pbzip2.BZMaxBuffered(1)))
+	if _, err := rd.Read(make([]byte, 10)); err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(10 * time.Millisecond)
+	cancel()
+	if _, err := io.Copy(io.Discard, rd); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	rd.Close()
+	if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+		t.Errorf("goroutine leak: got %v, want %v", got, want)
+	}
+}
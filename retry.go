@@ -0,0 +1,95 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"errors"
+	"io"
+	"time"
+)
+
+// WithSourceRetry requests that a Read on the underlying io.Reader that
+// fails with a temporary error be retried up to attempts times, waiting
+// for backoff between each attempt, before the error is returned. An error
+// is temporary if it, or any error it wraps, implements Temporary() bool
+// and returns true, or if it matches the predicate supplied via
+// WithSourceRetryPredicate. All other errors are returned immediately.
+func WithSourceRetry(attempts int, backoff time.Duration) ReaderOption {
+	return func(o *readerOpts) {
+		o.retryAttempts = attempts
+		o.retryBackoff = backoff
+	}
+}
+
+// WithSourceRetryPredicate sets a function that is used, in addition to
+// Temporary() bool, to determine if an error returned by the underlying
+// io.Reader should be retried as per WithSourceRetry.
+func WithSourceRetryPredicate(fn func(error) bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.retryable = fn
+	}
+}
+
+// WithBlockRetry requests that decompressing a block that fails with an
+// error for which isRetryable returns true, or that is temporary as
+// defined by WithSourceRetry, be retried up to attempts times before
+// that error is returned. It is intended for block decoders that may
+// fail transiently, the standard decoder never does so.
+func WithBlockRetry(attempts int, isRetryable func(error) bool) ReaderOption {
+	return func(o *readerOpts) {
+		o.blockRetry = blockRetry{attempts: attempts, retryable: isRetryable}
+	}
+}
+
+// blockRetry implements WithBlockRetry.
+type blockRetry struct {
+	attempts  int
+	retryable func(error) bool
+}
+
+func (br blockRetry) retry(attempt int, err error) bool {
+	return err != nil && attempt < br.attempts && temporary(err, br.retryable)
+}
+
+// temporary returns true if err, or any error it wraps, implements
+// Temporary() bool and returns true, or if it matches retryable.
+func temporary(err error, retryable func(error) bool) bool {
+	var te interface{ Temporary() bool }
+	if errors.As(err, &te) && te.Temporary() {
+		return true
+	}
+	return retryable != nil && retryable(err)
+}
+
+// retryReader implements WithSourceRetry.
+type retryReader struct {
+	ctx       context.Context
+	rd        io.Reader
+	attempts  int
+	backoff   time.Duration
+	retryable func(error) bool
+}
+
+func (rr *retryReader) Read(buf []byte) (int, error) {
+	for attempt := 0; ; attempt++ {
+		n, err := rr.rd.Read(buf)
+		if err == nil || err == io.EOF || !temporary(err, rr.retryable) {
+			return n, err
+		}
+		if n > 0 {
+			// Return the data read so far, the next Read will be retried.
+			return n, nil
+		}
+		if attempt >= rr.attempts {
+			return n, err
+		}
+		select {
+		case <-time.After(rr.backoff):
+		case <-rr.ctx.Done():
+			return 0, rr.ctx.Err()
+		}
+	}
+}
@@ -0,0 +1,154 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal"
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
+)
+
+type temporaryError struct{}
+
+func (temporaryError) Error() string   { return "temporary error" }
+func (temporaryError) Temporary() bool { return true }
+
+var errFlaky = errors.New("flaky")
+
+// flakyReader returns err for the first failures calls to Read made after
+// offset bytes have been read.
+type flakyReader struct {
+	rd       io.Reader
+	offset   int
+	failures int
+	err      error
+	read     int
+	calls    int
+}
+
+func (fr *flakyReader) Read(buf []byte) (int, error) {
+	if fr.read >= fr.offset && fr.failures > 0 {
+		fr.failures--
+		fr.calls++
+		return 0, fr.err
+	}
+	n, err := fr.rd.Read(buf)
+	fr.read += n
+	fr.calls++
+	return n, err
+}
+
+func TestSourceRetry(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	for _, offset := range []int{0, 2, 1000} {
+		for _, concurrency := range []int{0, 2} {
+			for i, tc := range []struct {
+				err  error
+				opts []pbzip2.ReaderOption
+			}{
+				{temporaryError{}, nil},
+				{fmt.Errorf("wrapped: %w", temporaryError{}), nil},
+				{errFlaky, []pbzip2.ReaderOption{
+					pbzip2.WithSourceRetryPredicate(func(err error) bool {
+						return errors.Is(err, errFlaky)
+					})}},
+			} {
+				opts := append([]pbzip2.ReaderOption{pbzip2.WithSourceRetry(3, time.Millisecond)}, tc.opts...)
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency)))
+				}
+				src := &flakyReader{rd: bytes.NewReader(compressed), offset: offset, failures: 2, err: tc.err}
+				data, err := io.ReadAll(pbzip2.NewReader(ctx, src, opts...))
+				if err != nil {
+					t.Errorf("%v: offset %v: concurrency %v: %v", i, offset, concurrency, err)
+					continue
+				}
+				if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+					t.Errorf("%v: offset %v: concurrency %v: got %v..., want %v...", i, offset, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+			}
+		}
+	}
+
+	// Too many failures.
+	src := &flakyReader{rd: bytes.NewReader(compressed), failures: 4, err: temporaryError{}}
+	_, err := io.ReadAll(pbzip2.NewReader(ctx, src, pbzip2.WithSourceRetry(3, time.Millisecond)))
+	if err == nil || !strings.Contains(err.Error(), "temporary error") {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	// Permanent errors are not retried.
+	src = &flakyReader{rd: bytes.NewReader(compressed), failures: 1, err: errFlaky}
+	_, err = io.ReadAll(pbzip2.NewReader(ctx, src, pbzip2.WithSourceRetry(3, time.Millisecond)))
+	if err == nil || src.calls != 1 {
+		t.Errorf("missing or unexpected error: %v, after %v calls", err, src.calls)
+	}
+}
+
+func TestBlockRetry(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	var calls int64
+	// The first attempt at decompressing each block fails.
+	pbzip2.SetBlockDecoder(func(blockSize int, src []byte, start int) io.Reader {
+		rd := bzip2.NewBlockReader(blockSize, src, start)
+		if atomic.AddInt64(&calls, 1)%2 == 1 {
+			return &flakyReader{rd: rd, failures: 1, err: errFlaky}
+		}
+		return rd
+	})
+	defer pbzip2.ResetBlockDecoder()
+	isFlaky := func(err error) bool { return errors.Is(err, errFlaky) }
+	for _, concurrency := range []int{0, 1} {
+		for i, tc := range []struct {
+			opt pbzip2.ReaderOption
+			ok  bool
+		}{
+			{pbzip2.WithBlockRetry(1, isFlaky), true},
+			{pbzip2.WithBlockRetry(3, isFlaky), true},
+			{pbzip2.WithBlockRetry(0, isFlaky), false},
+			{pbzip2.WithBlockRetry(3, func(error) bool { return false }), false},
+		} {
+			opts := []pbzip2.ReaderOption{tc.opt}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			atomic.StoreInt64(&calls, 0)
+			drd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			data, err := io.ReadAll(drd)
+			if !tc.ok {
+				if !errors.Is(err, errFlaky) {
+					t.Errorf("%v: concurrency %v: got %v, want %v", i, concurrency, err, errFlaky)
+				}
+				continue
+			}
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", i, concurrency, err)
+				continue
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", i, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if got, want := atomic.LoadInt64(&calls), int64(2*drd.Stats().BlocksDecoded); got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", i, concurrency, got, want)
+			}
+		}
+	}
+}
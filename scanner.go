@@ -4,20 +4,33 @@
 package pbzip2
 
 import (
-	"bufio"
 	"bytes"
 	"context"
 	"encoding/binary"
 	"fmt"
 	"io"
+	"math"
 	"strings"
+	"sync/atomic"
+	"time"
 
 	"github.com/cosnicolaou/pbzip2/internal/bitstream"
 	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
 type scannerOpts struct {
-	maxPreamble int
+	maxPreamble      int
+	uniformBlockSize bool
+	missingTrailer   bool
+	truncated        bool
+	trailingData     bool
+	prefixSize       int
+	prefixOrder      binary.ByteOrder
+	timings          bool
+	onBlock          func(index int, raw []byte)
+	filter           func(index int, storedCRC uint32) bool
+	onSkip           func(ctx context.Context, block CompressedBlock)
+	sourceReader     bool
 }
 
 // ScannerOption represenst an option to NewBZ2BlockScanner.
@@ -33,17 +46,112 @@ func ScanBlockOverhead(b int) ScannerOption {
 	}
 }
 
+// RequireUniformBlockSize requests that the scanner fail with
+// ErrInconsistentBlockSize if any of a set of concatenated streams declares
+// a different block size to the first stream.
+func RequireUniformBlockSize(v bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.uniformBlockSize = v
+	}
+}
+
+// AllowMissingTrailer requests that the scanner treat end of input
+// immediately following a complete block as the end of the stream, rather
+// than failing because the stream trailer could not be found. This allows
+// for the output of producers that never write a trailer to be decompressed.
+// Since the trailer contains the stream CRC, it is not possible to verify
+// the stream CRC for such a stream, though the CRC of each block is still
+// verified and an incomplete final block will result in an error.
+func AllowMissingTrailer(v bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.missingTrailer = v
+	}
+}
+
+// AllowTrailingData requests that the scanner stop, rather than fail, at
+// the end of a stream that is followed by data that is not itself
+// a bzip2 stream, such as data that follows a bzip2 stream within
+// a container format. The trailing data is not consumed and may be read
+// via Reader.Remainder. The end of the stream is located by searching for
+// the stream trailer's magic number, which, as for the block magic number,
+// may match falsely within the compressed data, in which case the last
+// block will fail to decompress.
+func AllowTrailingData(v bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.trailingData = v
+	}
+}
+
+// ExpectLengthPrefix requests that the scanner read a length prefix of
+// size bytes, encoded using order, that precedes the stream header and
+// declares the length, in bytes, of the compressed data that follows it.
+// Only that many bytes are then read, with any following input left
+// unconsumed for Reader.Remainder, and it is an error for the input to be
+// shorter than the declared length. Note that this is not part of the
+// bzip2 format but is used by some derivative formats. size must be one
+// of 1, 2, 4 or 8.
+func ExpectLengthPrefix(size int, order binary.ByteOrder) ScannerOption {
+	return func(o *scannerOpts) {
+		o.prefixSize = size
+		o.prefixOrder = order
+	}
+}
+
+// OnCompressedBlock requests that fn be called with the raw compressed data
+// for each block as it is discovered by the scanner and before it is
+// decompressed. index starts at zero and raw is the same as the Data field
+// of the Block returned by the scanner and must not be modified. Note that
+// fn is called in the order that blocks are discovered, which is typically
+// well ahead of the output returned by a Reader, and that a false positive
+// match of the block magic number will result in a block being reported
+// as two separate blocks, even though they are subsequently decompressed
+// as one.
+func OnCompressedBlock(fn func(index int, raw []byte)) ScannerOption {
+	return func(o *scannerOpts) {
+		o.onBlock = fn
+	}
+}
+
+// scanBlockFilter is used by the BlockFilter ReaderOption.
+func scanBlockFilter(fn func(index int, storedCRC uint32) bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.filter = fn
+	}
+}
+
+// scanTruncated is used by the BZAllowTruncated DecompressorOption.
+func scanTruncated(v bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.truncated = v
+	}
+}
+
+// scanTimings is used by the CollectBlockTimings ReaderOption.
+func scanTimings(v bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.timings = v
+	}
+}
+
+// scanOnSkip is used to report the blocks rejected by a BlockFilter.
+func scanOnSkip(fn func(ctx context.Context, block CompressedBlock)) ScannerOption {
+	return func(o *scannerOpts) {
+		o.onSkip = fn
+	}
+}
+
 // See https://en.wikipedia.org/wiki/Bzip2 for an explanation of the file
 // format.
 var (
-	pretestBlockMagicLookup                       [256]bool
-	firstBlockMagicLookup, secondBlockMagicLookup map[uint32]uint8
-	blockMagic                                    [6]byte
-	eosMagic                                      [6]byte
+	blockMagicFinder bitstream.MagicFinder
+	eosMagicFinder   bitstream.MagicFinder
+	blockMagic       [6]byte
+	eosMagic         [6]byte
 )
 
 func init() {
-	pretestBlockMagicLookup, firstBlockMagicLookup, secondBlockMagicLookup = bitstream.Init(bzip2.BlockMagic)
+	blockMagicFinder = bitstream.NewAccumulatorFinder(bzip2.BlockMagic)
+	eosMagicFinder = bitstream.NewAccumulatorFinder(bzip2.EOSMagic)
 	copy(blockMagic[:], bzip2.BlockMagic[:])
 	copy(eosMagic[:], bzip2.EOSMagic[:])
 }
@@ -59,14 +167,37 @@ func init() {
 // and this is also consumed and validated internally.
 type Scanner struct {
 	rd                     io.Reader
-	brd                    *bufio.Reader
+	brd                    peekReader
+	sourceReader           bool
 	eos                    bool
 	err                    error
 	block                  CompressedBlock
 	prevBitOffset          int
 	first, done            bool
 	maxPreamble            int
+	uniformBlockSize       bool
+	missingTrailer         bool
+	truncated              bool
+	trailingData           bool
+	prefixSize             int
+	prefixOrder            binary.ByteOrder
+	bounded                *boundedReader // set by ExpectLengthPrefix.
+	timings                bool
+	onBlock                func(index int, raw []byte)
+	filter                 func(index int, storedCRC uint32) bool
+	onSkip                 func(ctx context.Context, block CompressedBlock)
+	nblocks                int // number of non-empty blocks discovered.
 	currentStreamBlockSize int
+	consumed               int64 // bytes consumed from rd so far, written atomically.
+	prevOffset             int64 // offset, in bits, of the previous block.
+	streamOffset           int64 // offset, in bytes, of the current stream's header.
+	maxStreamBlockSize     int64 // accessed atomically.
+	scanNanos              int64 // time spent in Scan, accessed atomically.
+	discovered             int64 // nblocks, accessed atomically.
+	finished               int32 // set once Scan has returned false, accessed atomically.
+	ra                     io.ReaderAt
+	boundaries             []int64       // set by NewReaderWithBoundaries.
+	regions                *regionFinder // set by NewReaderAt.
 }
 
 // NewScanner returns a new instance of Scanner.
@@ -80,9 +211,20 @@ func NewScanner(rd io.Reader, opts ...ScannerOption) *Scanner {
 		fn(&o)
 	}
 	bzs := &Scanner{
-		rd:          rd,
-		first:       true,
-		maxPreamble: o.maxPreamble,
+		rd:               rd,
+		first:            true,
+		maxPreamble:      o.maxPreamble,
+		uniformBlockSize: o.uniformBlockSize,
+		missingTrailer:   o.missingTrailer,
+		truncated:        o.truncated,
+		trailingData:     o.trailingData,
+		prefixSize:       o.prefixSize,
+		prefixOrder:      o.prefixOrder,
+		timings:          o.timings,
+		onBlock:          o.onBlock,
+		filter:           o.filter,
+		onSkip:           o.onSkip,
+		sourceReader:     o.sourceReader,
 	}
 	return bzs
 }
@@ -95,13 +237,13 @@ func parseHeader(buf []byte) (int, error) {
 	//	.hundred_k_blocksize:8 = '1'..'9' block-size 100 kB-900 kB
 	//                           (uncompressed)
 	if !bytes.Equal(buf[0:2], bzip2.FileMagic) {
-		return -1, fmt.Errorf("wrong file magic: %x", buf[0:2])
+		return -1, notBzip2(buf, fmt.Errorf("%w: %x", ErrBadMagic, buf[0:2]))
 	}
 	if buf[2] != 'h' {
-		return -1, fmt.Errorf("wrong version: %c", buf[2])
+		return -1, fmt.Errorf("%w: %c", ErrWrongVersion, buf[2])
 	}
 	if s := buf[3]; s < '0' || s > '9' {
-		return -1, fmt.Errorf("bad block size: %c", s)
+		return -1, &headerError{fmt.Sprintf("bad block size: %c", s), ErrBadBlockSize}
 
 	}
 	return 100 * 1000 * int(buf[3]-'0'), nil
@@ -114,25 +256,98 @@ func (sc *Scanner) scanHeader() bool {
 	//                           '0' for //Bzip1 (deprecated)
 	//	.hundred_k_blocksize:8 = '1'..'9' block-size 100 kB-900 kB
 	//                           (uncompressed)
+	if sc.prefixSize > 0 && !sc.readLengthPrefix() {
+		return false
+	}
 	var header [4]byte
-	n, err := sc.rd.Read(header[:])
-	if err != nil {
-		sc.err = fmt.Errorf("failed to read stream header: %v", err)
+	// Use io.ReadFull since the underlying reader may return fewer bytes
+	// than requested, eg. at the boundary between the readers used by
+	// NewReaderMulti.
+	n, err := io.ReadFull(sc.rd, header[:])
+	if err == io.ErrUnexpectedEOF {
+		sc.err = notBzip2(header[:n], shortHeaderError(n))
 		return false
 	}
-	if n != 4 {
-		sc.err = fmt.Errorf("stream header is too small: %v", n)
+	if err == io.EOF {
+		sc.err = emptyStreamError()
 		return false
 	}
+	if err != nil {
+		sc.err = fmt.Errorf("failed to read stream header: %v", err)
+		return false
+	}
+	atomic.AddInt64(&sc.consumed, int64(n))
 	sc.currentStreamBlockSize, sc.err = parseHeader(header[:])
 	if sc.err != nil {
 		return false
 	}
+	sc.setStreamBlockSize(sc.currentStreamBlockSize)
 	// Allow for maximum possible block size.
-	sc.brd = bufio.NewReaderSize(sc.rd, 9*100*1000+sc.maxPreamble)
+	sc.brd = newPeekReader(sc.rd, 9*100*1000+sc.maxPreamble, sc.sourceReader)
 	return true
 }
 
+// readLengthPrefix reads the length prefix requested by ExpectLengthPrefix
+// and bounds the remaining input accordingly.
+func (sc *Scanner) readLengthPrefix() bool {
+	switch sc.prefixSize {
+	case 1, 2, 4, 8:
+	default:
+		sc.err = fmt.Errorf("unsupported length prefix size: %v", sc.prefixSize)
+		return false
+	}
+	var prefix [8]byte
+	buf := prefix[:sc.prefixSize]
+	n, err := io.ReadFull(sc.rd, buf)
+	if err != nil {
+		sc.err = fmt.Errorf("failed to read length prefix: %v", err)
+		return false
+	}
+	atomic.AddInt64(&sc.consumed, int64(n))
+	var length uint64
+	switch sc.prefixSize {
+	case 1:
+		length = uint64(buf[0])
+	case 2:
+		length = uint64(sc.prefixOrder.Uint16(buf))
+	case 4:
+		length = uint64(sc.prefixOrder.Uint32(buf))
+	case 8:
+		length = sc.prefixOrder.Uint64(buf)
+	}
+	// The smallest possible stream is an empty one, consisting of
+	// a 4 byte header and a 10 byte trailer.
+	if length < 14 || length > math.MaxInt64 {
+		sc.err = fmt.Errorf("invalid length prefix: %v", length)
+		return false
+	}
+	sc.bounded = &boundedReader{rd: sc.rd, size: int64(length), remaining: int64(length)}
+	sc.rd = sc.bounded
+	return true
+}
+
+// boundedReader limits the input to the length declared by a length
+// prefix, see ExpectLengthPrefix.
+type boundedReader struct {
+	rd              io.Reader
+	size, remaining int64
+}
+
+func (br *boundedReader) Read(buf []byte) (int, error) {
+	if br.remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(buf)) > br.remaining {
+		buf = buf[:br.remaining]
+	}
+	n, err := br.rd.Read(buf)
+	br.remaining -= int64(n)
+	if err == io.EOF && br.remaining > 0 {
+		err = fmt.Errorf("input is %v bytes shorter than its length prefix of %v: %w", br.remaining, br.size, io.ErrUnexpectedEOF)
+	}
+	return n, err
+}
+
 func readCRC(block []byte, shift int) uint32 {
 	if len(block) < 4 {
 		return 0
@@ -147,6 +362,40 @@ func readCRC(block []byte, shift int) uint32 {
 
 // Scan returns true if there is a block to be returned.
 func (sc *Scanner) Scan(ctx context.Context) bool {
+	if sc.timings {
+		start := time.Now()
+		defer func() {
+			atomic.AddInt64(&sc.scanNanos, int64(time.Since(start)))
+		}()
+	}
+	for {
+		if !sc.scan(ctx) {
+			if sc.regions != nil {
+				sc.regions.stop()
+			}
+			atomic.StoreInt32(&sc.finished, 1)
+			return false
+		}
+		if len(sc.block.Data) == 0 {
+			return true
+		}
+		index := sc.nblocks
+		sc.nblocks++
+		atomic.StoreInt64(&sc.discovered, int64(sc.nblocks))
+		sc.block.index = index
+		if sc.onBlock != nil {
+			sc.onBlock(index, sc.block.Data)
+		}
+		if sc.filter == nil || sc.filter(index, sc.block.CRC) {
+			return true
+		}
+		if sc.onSkip != nil {
+			sc.onSkip(ctx, sc.block)
+		}
+	}
+}
+
+func (sc *Scanner) scan(ctx context.Context) bool {
 	if sc.err != nil || sc.done {
 		return false
 	}
@@ -156,6 +405,9 @@ func (sc *Scanner) Scan(ctx context.Context) bool {
 		return false
 	default:
 	}
+	if sc.ra != nil {
+		return sc.scanBoundary()
+	}
 	if sc.first {
 		if !sc.scanHeader() {
 			return false
@@ -168,6 +420,8 @@ func (sc *Scanner) Scan(ctx context.Context) bool {
 	sc.eos = false
 	eof := false
 	lookahead := 9*100*1000 + sc.maxPreamble
+	// Note that any data returned along with io.EOF by the underlying
+	// reader is buffered by brd and hence included in buf.
 	buf, err := sc.brd.Peek(lookahead)
 	if err != nil {
 		if err != io.EOF {
@@ -183,7 +437,7 @@ func (sc *Scanner) Scan(ctx context.Context) bool {
 		// If this is the first block, and it starts with a block magic
 		// number, discard that block magic and search for the next one.
 		if bytes.HasPrefix(buf, blockMagic[:]) {
-			sc.brd.Discard(len(blockMagic))
+			sc.discard(len(blockMagic))
 			buf = buf[len(blockMagic):]
 			sc.block.BitOffset = 0
 			sc.prevBitOffset = 0
@@ -191,8 +445,16 @@ func (sc *Scanner) Scan(ctx context.Context) bool {
 	}
 
 	// Look for the next block magic or eof.
-	byteOffset, bitOffset := bitstream.Scan(pretestBlockMagicLookup, firstBlockMagicLookup, secondBlockMagicLookup, buf)
+	byteOffset, bitOffset := sc.findBlockMagic(ctx, buf)
+	if sc.err != nil {
+		return false
+	}
 	if byteOffset == -1 {
+		if sc.trailingData {
+			if ok, handled := sc.handleTrailingData(buf, eof); handled {
+				return ok
+			}
+		}
 		if !eof {
 			sc.err = fmt.Errorf("failed to find next block within expected max buffer size of %v", lookahead)
 			return false
@@ -208,7 +470,7 @@ func (sc *Scanner) Scan(ctx context.Context) bool {
 		// If an EOS magic number was skipped, the bitoffset must be zero
 		// since the stream has ended.
 		if ok := sc.skippedEOS(buf, byteOffset, bitOffset); ok {
-			return true
+			return sc.err == nil
 		}
 	}
 	sz := byteOffset
@@ -216,9 +478,41 @@ func (sc *Scanner) Scan(ctx context.Context) bool {
 		sz++
 	}
 	sc.initBlockValues(false, buf, sz, (byteOffset*8)+bitOffset-sc.prevBitOffset, 0)
+	if !sc.checkBlockOffsets() {
+		return false
+	}
 	sc.prevBitOffset = bitOffset
 	// skip the magic # before starting the search for the next magic #.
-	sc.brd.Discard(byteOffset + len(blockMagic))
+	sc.discard(byteOffset + len(blockMagic))
+	return true
+}
+
+// findBlockMagic returns the location of the first block magic number in
+// buf, which must start at the current offset in the input.
+func (sc *Scanner) findBlockMagic(ctx context.Context, buf []byte) (int, int) {
+	if sc.regions == nil {
+		return blockMagicFinder.Find(buf)
+	}
+	byteOffset, bitOffset, err := sc.regions.find(ctx, atomic.LoadInt64(&sc.consumed), buf)
+	sc.err = err
+	return byteOffset, bitOffset
+}
+
+func (sc *Scanner) discard(n int) {
+	sc.brd.Discard(n)
+	atomic.AddInt64(&sc.consumed, int64(n))
+}
+
+// checkBlockOffsets verifies that the current block is not empty and that
+// it starts after the previous one. Either condition indicates that the
+// stream is corrupt, for example, by containing a duplicated block magic
+// number, and that the scanner is no longer in sync with its contents.
+func (sc *Scanner) checkBlockOffsets() bool {
+	if sc.block.SizeInBits <= 0 || (!sc.first && sc.block.Offset <= sc.prevOffset) {
+		sc.err = fmt.Errorf("%w: block at bit offset %v, size %v bits, previous block at bit offset %v", ErrBlockDesync, sc.block.Offset, sc.block.SizeInBits, sc.prevOffset)
+		return false
+	}
+	sc.prevOffset = sc.block.Offset
 	return true
 }
 
@@ -228,6 +522,10 @@ func (sc *Scanner) skippedEOS(buf []byte, byteOffset, bitOffset int) bool {
 	if !ok {
 		return false
 	}
+	if sc.uniformBlockSize && newStreamBlockSize != sc.currentStreamBlockSize {
+		sc.err = fmt.Errorf("%w: stream block size %v differs from %v", ErrInconsistentBlockSize, newStreamBlockSize, sc.currentStreamBlockSize)
+		return true
+	}
 	szBits := ((byteOffset - consumed) * 8) + trailerOffset - sc.prevBitOffset
 	szBytes := szBits / 8
 	if szBits%8 != 0 {
@@ -240,11 +538,13 @@ func (sc *Scanner) skippedEOS(buf []byte, byteOffset, bitOffset int) bool {
 	// compressed block up to the EOS trailer and hence needs to take
 	// the trailer offset into account.
 	sc.initBlockValues(true, buf, szBytes, szBits, prevStreamCRC)
-	sc.currentStreamBlockSize = newStreamBlockSize
+	sc.setStreamBlockSize(newStreamBlockSize)
+	// The header for the new stream immediately precedes the block magic.
+	sc.streamOffset = sc.consumed + int64(byteOffset) - 4
 	sc.prevBitOffset = bitOffset
 
 	// skip the magic # before starting the search for the next magic #.
-	sc.brd.Discard(byteOffset + len(blockMagic))
+	sc.discard(byteOffset + len(blockMagic))
 	return true
 }
 
@@ -260,6 +560,8 @@ func (sc *Scanner) initBlockValues(eos bool, buf []byte, sz, szInBits int, strea
 	sc.block.SizeInBits = szInBits
 	sc.block.StreamBlockSize = sc.currentStreamBlockSize
 	sc.block.StreamCRC = streamCRC
+	sc.block.Offset = sc.consumed*8 + int64(sc.prevBitOffset)
+	sc.block.StreamOffset = sc.streamOffset
 }
 
 // trimTrailingEmptyFiles removes a trailing run of 1 or more empty files; an empty
@@ -349,7 +651,19 @@ func handleSkippedEOS(buf []byte, byteOffset int) (newBlockSize int, prevCRC uin
 func (sc *Scanner) handleEOF(buf []byte) bool {
 	trailer, trailerSize, trailerOffset := bitstream.FindTrailingMagicAndCRC(buf, eosMagic[:])
 	if trailerSize != 10 {
-		sc.err = fmt.Errorf("failed to find trailer")
+		if n := truncatedHeader(buf); n > 0 {
+			// Report a truncated header for a concatenated stream in the
+			// same way as for the first stream.
+			sc.err = shortHeaderError(n)
+			return false
+		}
+		if sc.missingTrailer {
+			return sc.handleMissingTrailer(buf)
+		}
+		if sc.truncated {
+			return sc.handleTruncated(buf)
+		}
+		sc.err = ErrNoTrailer
 		return false
 	}
 	szBytes := len(buf) - trailerSize
@@ -361,10 +675,98 @@ func (sc *Scanner) handleEOF(buf []byte) bool {
 		szBits -= sc.prevBitOffset
 	}
 	sc.initBlockValues(true, buf, szBytes, szBits, binary.BigEndian.Uint32(trailer))
+	// Consume the trailer and any trailing empty files.
+	sc.discard(sc.brd.Buffered())
 	sc.done = true
 	return true
 }
 
+// truncatedHeader returns the number of bytes of a truncated stream header
+// that follow a stream trailer at the end of buf, or 0 if there are none.
+func truncatedHeader(buf []byte) int {
+	header := append(bzip2.FileMagic[:2:2], 'h')
+	for n := 1; n <= len(header) && n < len(buf); n++ {
+		if !bytes.HasPrefix(header, buf[len(buf)-n:]) {
+			continue
+		}
+		if _, size, _ := bitstream.FindTrailingMagicAndCRC(buf[:len(buf)-n], eosMagic[:]); size == 10 {
+			return n
+		}
+	}
+	return 0
+}
+
+// handleTrailingData ends the scan at the first stream trailer in buf,
+// which contains no further block magic numbers, if that trailer is
+// followed by trailing data, leaving that data unconsumed. It returns
+// false for handled if there is no such trailer.
+func (sc *Scanner) handleTrailingData(buf []byte, eof bool) (ok, handled bool) {
+	byteOffset, bitOffset := eosMagicFinder.Find(buf)
+	if byteOffset == -1 {
+		return false, false
+	}
+	// The trailer is 48 bits of magic and a 32 bit CRC, padded to a byte.
+	end := (byteOffset*8 + bitOffset + 80 + 7) / 8
+	if end > len(buf) || (eof && end == len(buf)) {
+		// Either the trailer is incomplete or there is no trailing data.
+		return false, false
+	}
+	crc := readCRC(buf[byteOffset+len(eosMagic):], bitOffset)
+	sz := byteOffset
+	if bitOffset > 0 {
+		sz++
+	}
+	sc.initBlockValues(true, buf, sz, (byteOffset*8)+bitOffset-sc.prevBitOffset, crc)
+	sc.discard(end)
+	sc.done = true
+	return true, true
+}
+
+// remainder returns the input that follows the data consumed so far.
+func (sc *Scanner) remainder() io.Reader {
+	if sc.ra != nil {
+		return nil
+	}
+	if sc.bounded != nil {
+		// The input following the bounded stream is read directly.
+		if sc.brd == nil {
+			return io.MultiReader(sc.bounded, sc.bounded.rd)
+		}
+		return io.MultiReader(sc.brd, sc.bounded.rd)
+	}
+	if sc.brd == nil {
+		return sc.rd
+	}
+	return sc.brd
+}
+
+// handleMissingTrailer treats all of the remaining input as the final block
+// of a stream that has no trailer. The block is not marked as EOS since
+// there is no stream CRC to verify it against.
+func (sc *Scanner) handleMissingTrailer(buf []byte) bool {
+	sc.done = true
+	if len(buf) == 0 {
+		return false
+	}
+	sc.initBlockValues(false, buf, len(buf), len(buf)*8-sc.prevBitOffset, 0)
+	sc.discard(sc.brd.Buffered())
+	return true
+}
+
+// handleTruncated treats all of the remaining input as the, possibly
+// incomplete, final block of a truncated stream. The block is returned
+// even if there is no remaining input so that the truncation is reported.
+func (sc *Scanner) handleTruncated(buf []byte) bool {
+	sc.done = true
+	sc.initBlockValues(false, buf, len(buf), len(buf)*8-sc.prevBitOffset, 0)
+	if len(buf) == 0 {
+		sc.block.SizeInBits = 0
+	}
+	sc.block.truncated = true
+	sc.discard(sc.brd.Buffered())
+	return true
+}
+
 // CompressedBlock represents a single bzip2 compressed block.
 type CompressedBlock struct {
 	// Buffer containing compressed data as a bitstream that starts at
@@ -374,9 +776,14 @@ type CompressedBlock struct {
 	SizeInBits      int    // SizeInBits is the size of the compressed data in Data.
 	CRC             uint32 // CRC for this block.
 	StreamBlockSize int    // StreamBlockSize is the 1..9 *100*1000 compression block size specified when the stream was created.
+	Offset          int64  // Offset, in bits, of the start of the compressed data from the start of the input.
+	StreamOffset    int64  // StreamOffset is the offset, in bytes, of the header of the stream containing this block.
 
 	EOS       bool   // EOS has been detected.
 	StreamCRC uint32 // CRC
+
+	index     int  // index of the block, see BlockEvent.Block.
+	truncated bool // set for the final block of a truncated stream, see BZAllowTruncated.
 }
 
 func (b CompressedBlock) String() string {
@@ -389,7 +796,40 @@ func (b CompressedBlock) String() string {
 	return out.String()
 }
 
-// Block returns the current block bzip2 compression block.
+func (sc *Scanner) setStreamBlockSize(blockSize int) {
+	sc.currentStreamBlockSize = blockSize
+	if int64(blockSize) > atomic.LoadInt64(&sc.maxStreamBlockSize) {
+		atomic.StoreInt64(&sc.maxStreamBlockSize, int64(blockSize))
+	}
+}
+
+// MaxStreamBlockSize returns the largest block size, as specified in
+// the header of each stream, seen so far. It returns zero if no stream
+// header has been read. It may be called concurrently with Scan.
+func (sc *Scanner) MaxStreamBlockSize() int {
+	return int(atomic.LoadInt64(&sc.maxStreamBlockSize))
+}
+
+// scanTime returns the time spent in Scan if timings were requested.
+func (sc *Scanner) scanTime() time.Duration {
+	return time.Duration(atomic.LoadInt64(&sc.scanNanos))
+}
+
+// blocksScanned returns the number of non-empty blocks found so far and
+// whether the scan is complete. It may be called concurrently with Scan.
+func (sc *Scanner) blocksScanned() (int, bool) {
+	return int(atomic.LoadInt64(&sc.discovered)), atomic.LoadInt32(&sc.finished) != 0
+}
+
+// CompressedOffset returns the number of bytes of compressed input that
+// have been consumed so far. It may be called concurrently with Scan.
+func (sc *Scanner) CompressedOffset() int64 {
+	return atomic.LoadInt64(&sc.consumed)
+}
+
+// Block returns the current block bzip2 compression block. The block's
+// Data is copied from the input and hence remains valid regardless of
+// any subsequent reads from the underlying io.Reader.
 func (sc *Scanner) Block() CompressedBlock {
 	return sc.block
 }
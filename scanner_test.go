@@ -7,16 +7,21 @@ import (
 	"bytes"
 	gobzip2 "compress/bzip2"
 	"context"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
 	"reflect"
+	"strings"
 	"sync"
 	"testing"
+	"testing/iotest"
 
 	"github.com/cosnicolaou/pbzip2"
 	"github.com/cosnicolaou/pbzip2/internal"
+	"github.com/cosnicolaou/pbzip2/internal/bitstream"
 	"github.com/cosnicolaou/pbzip2/internal/bzip2"
 )
 
@@ -37,6 +42,9 @@ func generateCompressedFiles(tmpdir string) (map[string]string, map[string][]byt
 	}{
 		{"empty", nil, "-1", true},
 		{"hello", []byte("hello world\n"), "-1", true},
+		{"tiny", []byte("a"), "-1", true},
+		{"tinyrun", []byte("aaaa"), "-1", true},
+		{"zerocrc", []byte("this block's crc is zero: \x03{4M"), "-1", true},
 		{"100KB1", internal.GenPredictableRandomData(100 * 1024), "-1", true},
 		{"300KB1", internal.GenPredictableRandomData(300 * 1024), "-1", true},
 		{"300KB2", internal.GenPredictableRandomData(300 * 1024), "-1", true},
@@ -46,6 +54,7 @@ func generateCompressedFiles(tmpdir string) (map[string]string, map[string][]byt
 		{"900KB1", internal.GenPredictableRandomData(900 * 1024), "-1", true},
 		{"900KB9", internal.GenPredictableRandomData(900 * 1024), "-1", true},
 
+		{"105KB2_Random", internal.GenReproducibleRandomData(105 * 1024), "-2", false},
 		{"300KB3_Random", internal.GenReproducibleRandomData(300 * 1024), "-3", false},
 		{"900KB2_Random", internal.GenReproducibleRandomData(900 * 1024), "-2", false},
 		{"1033KB4_Random", internal.GenReproducibleRandomData(1033 * 1024), "-4", false},
@@ -249,6 +258,8 @@ func TestScan(t *testing.T) {
 	}{
 		{"empty", 0, bc(), bci()},
 		{"hello", 1324148790, bc(1324148790), bci(253)},
+		{"tiny", 429103979, bc(429103979), bci(131)},
+		{"tinyrun", 2282894246, bc(2282894246), bci(152)},
 		{"100KB1", 2846214228, bc(984137596, 3707025068), bci(806206, 22712)},
 		{"300KB1", 2560071082,
 			bc(984137596, 1527206082, 1102975844, 2729642890),
@@ -315,3 +326,586 @@ func BenchmarkScanner(b *testing.B) {
 		}
 	}
 }
+
+func TestBlockDesync(t *testing.T) {
+	ctx := context.Background()
+	buf, _ := readFile(t, "hello")
+	// The first block magic immediately follows the 4 byte header,
+	// duplicate it.
+	corrupted := append([]byte{}, buf[:10]...)
+	corrupted = append(corrupted, bzip2.BlockMagic[:]...)
+	corrupted = append(corrupted, buf[10:]...)
+
+	sc := pbzip2.NewScanner(bytes.NewBuffer(corrupted))
+	for sc.Scan(ctx) {
+	}
+	if err := sc.Err(); !errors.Is(err, pbzip2.ErrBlockDesync) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	_, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewBuffer(corrupted)))
+	if !errors.Is(err, pbzip2.ErrBlockDesync) {
+		t.Errorf("missing or unexpected error: %v", err)
+	}
+
+	// Block offsets must be strictly increasing for a valid stream.
+	rd := openBzipFile(t, bzip2Files["900KB1"])
+	defer rd.Close()
+	sc = pbzip2.NewScanner(rd)
+	prev := int64(-1)
+	for sc.Scan(ctx) {
+		block := sc.Block()
+		if block.Offset <= prev {
+			t.Errorf("offsets not increasing: %v <= %v", block.Offset, prev)
+		}
+		prev = block.Offset
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOnCompressedBlock(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	var raws [][]byte
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed),
+		pbzip2.OnCompressedBlock(func(index int, raw []byte) {
+			if got, want := index, len(raws); got != want {
+				t.Errorf("got %v, want %v", got, want)
+			}
+			raws = append(raws, raw)
+		}))
+	var blocks []pbzip2.CompressedBlock
+	for sc.Scan(ctx) {
+		blocks = append(blocks, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(raws), 5; got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	if got, want := len(raws), len(blocks); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+
+	// Reframe the raw blocks as a bzip2 stream.
+	bw := &bitstream.BitWriter{}
+	bw.Init(compressed[:4], 32, len(compressed))
+	for i, raw := range raws {
+		bw.Append(bzip2.BlockMagic[:], 0, 48)
+		bw.Append(raw, blocks[i].BitOffset, blocks[i].SizeInBits)
+	}
+	var crc [4]byte
+	binary.BigEndian.PutUint32(crc[:], blocks[len(blocks)-1].StreamCRC)
+	bw.Append(bzip2.EOSMagic[:], 0, 48)
+	bw.Append(crc[:], 0, 32)
+	reframed, _ := bw.Data()
+	data, err := io.ReadAll(gobzip2.NewReader(bytes.NewReader(reframed)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+		t.Errorf("got %v..., want %v...", internal.FirstN(10, got), internal.FirstN(10, want))
+	}
+}
+
+func TestUnalignedTrailer(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	var raws [][]byte
+	sc := pbzip2.NewScanner(bytes.NewReader(compressed),
+		pbzip2.OnCompressedBlock(func(index int, raw []byte) {
+			raws = append(raws, raw)
+		}))
+	var blocks []pbzip2.CompressedBlock
+	for sc.Scan(ctx) {
+		if block := sc.Block(); len(block.Data) > 0 {
+			blocks = append(blocks, block)
+		}
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Reframe the first n blocks as a bzip2 stream so that the trailer
+	// is located at a variety of bit offsets.
+	alignments := map[int]bool{}
+	for n := 1; n <= len(blocks); n++ {
+		bw := &bitstream.BitWriter{}
+		bw.Init(compressed[:4], 32, len(compressed))
+		var want []byte
+		var streamCRC uint32
+		for i, raw := range raws[:n] {
+			bw.Append(bzip2.BlockMagic[:], 0, 48)
+			bw.Append(raw, blocks[i].BitOffset, blocks[i].SizeInBits)
+			streamCRC = (streamCRC<<1 | streamCRC>>31) ^ blocks[i].CRC
+			out, err := pbzip2.DecompressBlock(blocks[i])
+			if err != nil {
+				t.Fatal(err)
+			}
+			want = append(want, out...)
+		}
+		_, trailerOffset := bw.Data()
+		alignments[trailerOffset%8] = true
+		var crc [4]byte
+		binary.BigEndian.PutUint32(crc[:], streamCRC)
+		bw.Append(bzip2.EOSMagic[:], 0, 48)
+		bw.Append(crc[:], 0, 32)
+		reframed, _ := bw.Data()
+
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(reframed), opts...)
+			got, err := io.ReadAll(rd)
+			if err != nil {
+				t.Fatalf("%v blocks, trailer offset %v: concurrency %v: %v", n, trailerOffset%8, concurrency, err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("%v blocks, trailer offset %v: concurrency %v: got %v..., want %v...", n, trailerOffset%8, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+	t.Logf("trailer bit offsets: %v", alignments)
+	if len(alignments) < 2 {
+		t.Errorf("trailer was not bit-shifted in any of the test streams: %v", alignments)
+	}
+}
+
+// ringReader returns data via a small, fixed size, ring buffer that is
+// overwritten on every call to Read, as would be the case for a
+// zero-allocation streaming source.
+type ringReader struct {
+	data []byte
+	ring []byte
+	pos  int
+}
+
+func (r *ringReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		return 0, io.EOF
+	}
+	// Scribble over the ring before refilling it.
+	for i := range r.ring {
+		r.ring[i] = 0xaa
+	}
+	data := r.data
+	if len(data) > len(p) {
+		data = data[:len(p)]
+	}
+	n := copy(r.ring[r.pos:], data)
+	r.data = r.data[n:]
+	chunk := r.ring[r.pos : r.pos+n]
+	r.pos = (r.pos + n) % len(r.ring)
+	return copy(p, chunk), nil
+}
+
+func TestRingBufferSource(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "300KB2", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			src := &ringReader{data: compressed, ring: make([]byte, 4093)}
+			data, err := io.ReadAll(pbzip2.NewReader(ctx, src, opts...))
+			if err != nil {
+				t.Fatalf("%v: concurrency %v: %v", name, concurrency, err)
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+		}
+	}
+}
+
+// eofReader returns its data in chunks with the last chunk being returned
+// together with io.EOF.
+type eofReader struct {
+	data  []byte
+	chunk int
+}
+
+func (r *eofReader) Read(p []byte) (int, error) {
+	if len(p) > r.chunk {
+		p = p[:r.chunk]
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	if len(r.data) == 0 {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func TestDataWithEOF(t *testing.T) {
+	ctx := context.Background()
+	multi, multiData := concatFiles(t, "hello", "empty", "300KB2")
+	for _, name := range []string{"empty", "hello", "300KB2", "900KB2_Random", "multi"} {
+		compressed, want := multi, multiData
+		if name != "multi" {
+			compressed, _ = readFile(t, name)
+			want = bzip2Data[name]
+		}
+		for i, src := range []func() io.Reader{
+			func() io.Reader { return iotest.DataErrReader(bytes.NewReader(compressed)) },
+			func() io.Reader { return &eofReader{data: compressed, chunk: len(compressed)} },
+			func() io.Reader { return &eofReader{data: compressed, chunk: 1000} },
+			func() io.Reader { return &eofReader{data: compressed, chunk: 3} },
+		} {
+			for _, concurrency := range []int{0, 2} {
+				var opts []pbzip2.ReaderOption
+				if concurrency > 0 {
+					opts = append(opts, pbzip2.DecompressionOptions(
+						pbzip2.BZConcurrency(concurrency)))
+				}
+				data, err := io.ReadAll(pbzip2.NewReader(ctx, src(), opts...))
+				if err != nil {
+					t.Errorf("%v: %v: concurrency %v: %v", name, i, concurrency, err)
+					continue
+				}
+				if got, want := data, want; !bytes.Equal(got, want) {
+					t.Errorf("%v: %v: concurrency %v: got %v..., want %v...", name, i, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+				}
+			}
+		}
+	}
+}
+
+func TestOneByteReads(t *testing.T) {
+	ctx := context.Background()
+	ngs := pbzip2.GetNumDecompressionGoRoutines()
+	multi, multiData := concatFiles(t, "hello", "empty", "300KB2", "900KB2_Random")
+	var want []pbzip2.CompressedBlock
+	sc := pbzip2.NewScanner(bytes.NewReader(multi))
+	for sc.Scan(ctx) {
+		want = append(want, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The scanner must find the same blocks, at the same bit offsets, when
+	// its input is returned one byte at a time.
+	var got []pbzip2.CompressedBlock
+	sc = pbzip2.NewScanner(iotest.OneByteReader(bytes.NewReader(multi)))
+	for sc.Scan(ctx) {
+		got = append(got, sc.Block())
+	}
+	if err := sc.Err(); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(got), len(want); got != want {
+		t.Fatalf("got %v, want %v", got, want)
+	}
+	for i := range want {
+		if got, want := got[i].BitOffset, want[i].BitOffset; got != want {
+			t.Errorf("block %v: bit offset: got %v, want %v", i, got, want)
+		}
+		if got, want := got[i].CRC, want[i].CRC; got != want {
+			t.Errorf("block %v: crc: got %v, want %v", i, got, want)
+		}
+		if got, want := got[i].Data, want[i].Data; !bytes.Equal(got, want) {
+			t.Errorf("block %v: got %v..., want %v...", i, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+	}
+
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		drd := pbzip2.NewReader(ctx, iotest.OneByteReader(bytes.NewReader(multi)), opts...)
+		data, err := io.ReadAll(drd)
+		if err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+			continue
+		}
+		if got, want := data, multiData; !bytes.Equal(got, want) {
+			t.Errorf("concurrency %v: got %v..., want %v...", concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+		}
+		if err := drd.Close(); err != nil {
+			t.Errorf("concurrency %v: %v", concurrency, err)
+		}
+		if got, want := pbzip2.GetNumDecompressionGoRoutines(), ngs; got != want {
+			t.Errorf("concurrency %v: goroutine leak: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestAllowMissingTrailer(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"hello", "900KB2_Random"} {
+		compressed, _ := readFile(t, name)
+		_, trailerSize, _ := bitstream.FindTrailingMagicAndCRC(compressed, bzip2.EOSMagic[:])
+		if trailerSize != 10 {
+			t.Fatalf("%v: failed to find trailer", name)
+		}
+		stripped := compressed[:len(compressed)-trailerSize]
+		truncated := stripped[:len(stripped)-len(stripped)/4]
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{
+				pbzip2.ScannerOptions(pbzip2.AllowMissingTrailer(true)),
+			}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(stripped), opts...))
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", name, concurrency, err)
+				continue
+			}
+			if got, want := data, bzip2Data[name]; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", name, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+
+			// An incomplete final block must still be reported as an error.
+			_, err = io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(truncated), opts...))
+			if err == nil {
+				t.Errorf("%v: concurrency %v: expected an error for a truncated block", name, concurrency)
+			}
+
+			// The trailer is required by default.
+			_, err = io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(stripped), opts[1:]...))
+			if err == nil || err.Error() != "failed to find trailer" {
+				t.Errorf("%v: concurrency %v: unexpected or missing error: %v", name, concurrency, err)
+			}
+		}
+	}
+}
+
+func TestAllowTruncated(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB2_Random"
+	compressed, _ := readFile(t, name)
+	var blocks [][]byte
+	err := pbzip2.ReadBlocks(ctx, bytes.NewReader(compressed), func(_ int, data []byte) error {
+		blocks = append(blocks, append([]byte{}, data...))
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(blocks) < 2 {
+		t.Fatalf("too few blocks: %v", len(blocks))
+	}
+	all := bytes.Join(blocks, nil)
+	complete := bytes.Join(blocks[:len(blocks)-1], nil)
+	_, trailerSize, _ := bitstream.FindTrailingMagicAndCRC(compressed, bzip2.EOSMagic[:])
+	stripped := compressed[:len(compressed)-trailerSize]
+	for _, tc := range []struct {
+		input []byte
+		want  []byte
+	}{
+		{stripped, all},
+		{compressed[:len(compressed)-3], all},
+		{stripped[:len(stripped)-1000], complete},
+	} {
+		for _, concurrency := range []int{0, 2} {
+			decOpts := []pbzip2.DecompressorOption{pbzip2.BZAllowTruncated(true)}
+			if concurrency > 0 {
+				decOpts = append(decOpts, pbzip2.BZConcurrency(concurrency))
+			}
+			data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(tc.input),
+				pbzip2.DecompressionOptions(decOpts...)))
+			if !errors.Is(err, pbzip2.ErrTruncated) || !errors.Is(err, io.ErrUnexpectedEOF) {
+				t.Errorf("%v: concurrency %v: got %v, want %v", len(tc.input), concurrency, err, pbzip2.ErrTruncated)
+			}
+			if got, want := data, tc.want; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v bytes, want %v bytes", len(tc.input), concurrency, len(got), len(want))
+			}
+		}
+	}
+
+	// A complete stream is unaffected.
+	data, err := io.ReadAll(pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZAllowTruncated(true))))
+	if err != nil || !bytes.Equal(data, all) {
+		t.Errorf("got %v bytes, %v, want %v bytes", len(data), err, len(all))
+	}
+}
+
+func lengthPrefixed(size int, order binary.ByteOrder, length int, data []byte) []byte {
+	prefix := make([]byte, 16)
+	switch size {
+	case 1:
+		prefix[0] = byte(length)
+	case 2:
+		order.PutUint16(prefix, uint16(length))
+	case 4:
+		order.PutUint32(prefix, uint32(length))
+	case 8:
+		order.PutUint64(prefix, uint64(length))
+	}
+	return append(prefix[:size], data...)
+}
+
+func TestLengthPrefix(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		names    []string
+		size     int
+		order    binary.ByteOrder
+		trailing string
+	}{
+		{[]string{"hello"}, 1, binary.BigEndian, ""},
+		{[]string{"hello"}, 2, binary.LittleEndian, "trailing data"},
+		{[]string{"empty"}, 4, binary.BigEndian, "BZh9"},
+		{[]string{"hello", "300KB2"}, 4, binary.LittleEndian, "trailing data"},
+		{[]string{"900KB2_Random"}, 8, binary.BigEndian, "trailing data"},
+	} {
+		compressed, want := concatFiles(t, tc.names...)
+		input := lengthPrefixed(tc.size, tc.order, len(compressed), compressed)
+		input = append(input, tc.trailing...)
+		for _, concurrency := range []int{0, 2} {
+			opts := []pbzip2.ReaderOption{
+				pbzip2.ScannerOptions(pbzip2.ExpectLengthPrefix(tc.size, tc.order)),
+			}
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(input), opts...)
+			data, err := io.ReadAll(rd)
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", tc.names, concurrency, err)
+				continue
+			}
+			if got := data; !bytes.Equal(got, want) {
+				t.Errorf("%v: concurrency %v: got %v..., want %v...", tc.names, concurrency, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			remainder, err := io.ReadAll(rd.Remainder())
+			if err != nil {
+				t.Errorf("%v: concurrency %v: %v", tc.names, concurrency, err)
+			}
+			if got, want := string(remainder), tc.trailing; got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", tc.names, concurrency, got, want)
+			}
+			rd.Close()
+		}
+	}
+
+	compressed, _ := readFile(t, "hello")
+	for _, tc := range []struct {
+		size   int
+		length int
+		err    string
+	}{
+		{4, len(compressed) + 1, "input is 1 bytes shorter than its length prefix"},
+		{4, len(compressed) - 1, "failed to find trailer"},
+		{4, 10, "invalid length prefix: 10"},
+		{3, len(compressed), "unsupported length prefix size: 3"},
+		{16, len(compressed), "unsupported length prefix size: 16"},
+	} {
+		input := lengthPrefixed(tc.size, binary.BigEndian, tc.length, compressed)
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(input),
+			pbzip2.ScannerOptions(pbzip2.ExpectLengthPrefix(tc.size, binary.BigEndian)))
+		_, err := io.ReadAll(rd)
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%v: missing or unexpected error: %v", tc.length, err)
+		}
+	}
+}
+
+// peekableSource implements pbzip2.SourceReader and records how its input
+// is consumed.
+type peekableSource struct {
+	data []byte
+	off  int
+	read int // the number of bytes returned by Read and ReadByte.
+}
+
+func (ps *peekableSource) Read(buf []byte) (int, error) {
+	if ps.off == len(ps.data) {
+		return 0, io.EOF
+	}
+	n := copy(buf, ps.data[ps.off:])
+	ps.off += n
+	ps.read += n
+	return n, nil
+}
+
+func (ps *peekableSource) ReadByte() (byte, error) {
+	if ps.off == len(ps.data) {
+		return 0, io.EOF
+	}
+	ps.off++
+	ps.read++
+	return ps.data[ps.off-1], nil
+}
+
+func (ps *peekableSource) Peek(n int) ([]byte, error) {
+	if ps.off+n > len(ps.data) {
+		return ps.data[ps.off:], io.EOF
+	}
+	return ps.data[ps.off : ps.off+n], nil
+}
+
+func (ps *peekableSource) Discard(n int) (int, error) {
+	if n > len(ps.data)-ps.off {
+		n = len(ps.data) - ps.off
+	}
+	ps.off += n
+	return n, nil
+}
+
+func TestUseSourceReader(t *testing.T) {
+	ctx := context.Background()
+	trailing := "trailing data"
+	for _, names := range [][]string{
+		{"hello"},
+		{"hello", "empty", "300KB2"},
+		{"900KB2_Random"},
+	} {
+		compressed, want := concatFiles(t, names...)
+		input := append(compressed[:len(compressed):len(compressed)], trailing...)
+		for _, direct := range []bool{false, true} {
+			src := &peekableSource{data: input}
+			rd := pbzip2.NewReader(ctx, src, pbzip2.ScannerOptions(
+				pbzip2.AllowTrailingData(true),
+				pbzip2.UseSourceReader(direct)))
+			data, err := io.ReadAll(rd)
+			if err != nil {
+				t.Errorf("%v: direct %v: %v", names, direct, err)
+				continue
+			}
+			if got := data; !bytes.Equal(got, want) {
+				t.Errorf("%v: direct %v: got %v..., want %v...", names, direct, internal.FirstN(10, got), internal.FirstN(10, want))
+			}
+			if direct {
+				// Only the stream header is read, the rest of the stream is
+				// scanned using Peek and then discarded, and none of the
+				// trailing data is consumed.
+				if got, want := src.read, 4; got != want {
+					t.Errorf("%v: direct %v: got %v, want %v", names, direct, got, want)
+				}
+				if got, want := src.off, len(compressed); got != want {
+					t.Errorf("%v: direct %v: got %v, want %v", names, direct, got, want)
+				}
+			} else if got, want := src.off, len(input); got != want {
+				// The trailing data is buffered by the Scanner.
+				t.Errorf("%v: direct %v: got %v, want %v", names, direct, got, want)
+			}
+			remainder, err := io.ReadAll(rd.Remainder())
+			if err != nil {
+				t.Errorf("%v: direct %v: %v", names, direct, err)
+			}
+			if got, want := string(remainder), trailing; got != want {
+				t.Errorf("%v: direct %v: got %v, want %v", names, direct, got, want)
+			}
+			rd.Close()
+		}
+	}
+}
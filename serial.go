@@ -0,0 +1,250 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"io"
+)
+
+// maxSingleBlockInput is the size of the largest input that is probed
+// for containing a single block, see probeInput.
+var maxSingleBlockInput int64 = 1 << 20
+
+// lenReader is implemented by in-memory readers, such as *bytes.Reader
+// and *strings.Reader, that report the size of their remaining input.
+type lenReader interface {
+	io.Reader
+	Len() int
+}
+
+// probeInput returns true if an input of size bytes is to be probed, by
+// the first Read, for containing a single block, in which case there is
+// nothing to be gained from decompressing it concurrently. Inputs larger
+// than maxSingleBlockInput are not probed, nor are any inputs when
+// concurrency is explicitly requested, BZForceParallel is set or any of
+// the options that only apply to decompressing blocks concurrently, such
+// as WithReorderBuffer or BZMaxBuffered, are specified.
+func (o *readerOpts) probeInput(size int64) bool {
+	if size > maxSingleBlockInput {
+		return false
+	}
+	if o.reorder != nil || o.highWater > 0 || o.onHighWater != nil || o.prewarm {
+		return false
+	}
+	do := newDecompressorOpts(o.decOpts)
+	return !do.serial() && !do.parallelOnly()
+}
+
+// probeSource sets probe if rd is an in-memory reader whose input is to be
+// probed, see probeInput.
+func (o *readerOpts) probeSource(rd io.Reader) {
+	if l, ok := rd.(lenReader); ok {
+		o.probe = o.probeInput(int64(l.Len()))
+	}
+}
+
+// decompression returns true if the blocks are to be decompressed in turn,
+// by the goroutine calling Read, rather than by a Decompressor, along with
+// the number of goroutines used to decompress them. single is true if the
+// input has been probed and found to contain a single block, see
+// Reader.probe. It is used by both NewReader and PlanConcurrency.
+func (o *readerOpts) decompression(single bool) (bool, int) {
+	do := newDecompressorOpts(o.decOpts)
+	if do.serial() || (o.probe && single) {
+		return true, 1
+	}
+	return false, do.concurrency
+}
+
+// probeBlocks scans the blocks up to, and including, the first non-empty
+// one and returns them. It also returns true if the scanner has then
+// reached the end of the input, and hence the input contains a single
+// block, or no blocks at all.
+func probeBlocks(ctx context.Context, sc *Scanner) ([]CompressedBlock, bool) {
+	var blocks []CompressedBlock
+	for sc.Scan(ctx) {
+		block := sc.Block()
+		blocks = append(blocks, block)
+		if len(block.Data) > 0 {
+			return blocks, sc.done
+		}
+	}
+	return blocks, true
+}
+
+// parallelOnly returns true if concurrency is explicitly requested, or any
+// option that only applies to a Decompressor is specified.
+func (o decompressorOpts) parallelOnly() bool {
+	return o.forceParallel ||
+		o.explicitConcurrency ||
+		o.scanConcurrency != 0 ||
+		o.startLimiter != nil ||
+		o.deterministic ||
+		o.dispatch != FixedPool ||
+		o.batch != 0 ||
+		o.prioritizeFirst ||
+		o.maxBuffered != 0
+}
+
+// serialReader decompresses each block in turn in the goroutine that calls
+// Read rather than using a Decompressor. It is used when there is nothing
+// to be gained from concurrency, for example, when GOMAXPROCS is 1 or the
+// input contains a single block.
+type serialReader struct {
+	ctx     context.Context
+	sc      *Scanner
+	pool    chan struct{}
+	order   uint64
+	pending []byte
+	err     error
+	block   *blockDesc        // the block whose output is pending.
+	next    *blockDesc        // a block scanned, but not merged, by decompressNext.
+	probed  []CompressedBlock // blocks scanned by Reader.probe.
+	// growTables is set if the input contains a single block, see
+	// Reader.probe.
+	growTables bool
+	gate       *pauseGate // see Reader.Pause.
+	*assembler
+}
+
+// newSerialReader returns a serialReader that uses asm, or a new assembler
+// if asm is nil.
+func newSerialReader(ctx context.Context, sc *Scanner, o decompressorOpts, asm *assembler) *serialReader {
+	if asm == nil {
+		asm = &assembler{progressCh: o.progressCh, progressFn: o.progressFn}
+	}
+	return &serialReader{
+		ctx:       ctx,
+		sc:        sc,
+		pool:      o.pool,
+		assembler: asm,
+	}
+}
+
+// scan returns true if there is another block, either one already scanned
+// by Reader.probe or the next one found by the scanner, to be returned by
+// nextBlock.
+func (sr *serialReader) scan() bool {
+	if len(sr.probed) > 0 {
+		return true
+	}
+	return sr.sc.Scan(sr.ctx)
+}
+
+// Read implements io.Reader. If there is no pending output then the next
+// block is decompressed directly into buf, avoiding both allocating a
+// buffer for its output and copying that output to buf, provided that the
+// entire block fits in buf. Since buf is not retained by Read this is
+// only done for blocks whose output is returned in full by this Read.
+func (sr *serialReader) Read(buf []byte) (int, error) {
+	for len(sr.pending) == 0 {
+		sr.release()
+		if sr.err != nil {
+			return 0, sr.err
+		}
+		// Limit the capacity of buf so that any capacity beyond its
+		// length is not written to.
+		sr.err = sr.decompressNext(buf[:len(buf):len(buf)])
+		if n := len(sr.pending); n > 0 && len(buf) > 0 && &sr.pending[0] == &buf[0] {
+			sr.pending = nil
+			return n, nil
+		}
+	}
+	n := copy(buf, sr.pending)
+	sr.pending = sr.pending[n:]
+	if len(sr.pending) == 0 {
+		sr.release()
+	}
+	return n, nil
+}
+
+// release releases the buffer of the block whose output has been returned,
+// see WithBufferAllocator.
+func (sr *serialReader) release() {
+	if sr.block != nil {
+		sr.allocator.release(sr.block)
+		sr.block = nil
+	}
+}
+
+func (sr *serialReader) nextBlock() *blockDesc {
+	sr.order++
+	cb := sr.sc.Block()
+	if len(sr.probed) > 0 {
+		cb, sr.probed = sr.probed[0], sr.probed[1:]
+	}
+	block := sr.newBlock(sr.order, cb)
+	block.growTables = sr.growTables
+	return block
+}
+
+// decompressNext scans and decompresses the next block, into dst if it
+// fits, making its output available as sr.pending. It returns io.EOF, or
+// the error for a stream that was skipped, once there are no more blocks.
+func (sr *serialReader) decompressNext(dst []byte) error {
+	if err := sr.ctx.Err(); err != nil {
+		return err
+	}
+	if err := sr.gate.wait(sr.ctx); err != nil {
+		return err
+	}
+	block := sr.next
+	sr.next = nil
+	if block == nil {
+		if !sr.scan() {
+			if err := sr.sc.Err(); err != nil {
+				return err
+			}
+			return sr.eof()
+		}
+		block = sr.nextBlock()
+	}
+	if sr.skip(block) {
+		return nil
+	}
+	if sr.pool != nil {
+		select {
+		case <-sr.pool:
+		case <-sr.ctx.Done():
+			return sr.ctx.Err()
+		}
+		defer func() {
+			sr.pool <- struct{}{}
+		}()
+	}
+	if err := sr.allocator.reserve(sr.ctx, block); err != nil {
+		return err
+	}
+	block.dst = dst
+	sr.decompress(block)
+	sr.block = block
+	if err := block.err; err != nil {
+		// See Decompressor.tryMergeBlocks.
+		if mergeable(err) && sr.scan() {
+			sr.next = sr.nextBlock()
+			if mergeBlocks(block, sr.next) {
+				sr.next = nil
+			}
+		}
+		if block.err != nil {
+			sr.failed(sr.ctx, block)
+			block.err = err
+			if sr.dropTruncated(block) {
+				sr.release()
+				return nil
+			}
+			return sr.streamFailed(block, blockError(block))
+		}
+	}
+	if err := sr.check(sr.ctx, block); err != nil {
+		return err
+	}
+	if err := sr.wait(sr.ctx, block); err != nil {
+		return err
+	}
+	sr.pending = block.uncompressed
+	return sr.assembled(block)
+}
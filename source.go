@@ -0,0 +1,92 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"bufio"
+	"io"
+)
+
+// SourceReader represents a source of compressed data that provides its
+// own buffering, such as a suitably sized bufio.Reader, see UseSourceReader.
+// Peek must return the next n bytes without consuming them or, if fewer
+// than n bytes are available, the remaining bytes along with io.EOF, or
+// any other error encountered. If the SourceReader also implements
+// Discard(n int) (int, error), as bufio.Reader does, it is used to consume
+// the bytes that have been scanned, otherwise they are consumed using Read.
+type SourceReader interface {
+	io.Reader
+	io.ByteReader
+	Peek(n int) ([]byte, error)
+}
+
+// UseSourceReader requests that if the input implements SourceReader it be
+// used directly, rather than being wrapped in the buffer that is otherwise
+// used to locate each block, so that the caller has full control over the
+// buffering of the input and no input beyond that belonging to the stream
+// is read from it. Since a block may be as large as 900KB the SourceReader
+// must be able to Peek at 900KB plus the overhead specified via
+// ScanBlockOverhead, 30KB by default. It has no effect when used with
+// ExpectLengthPrefix or when the input is wrapped by a Reader, for
+// example, as requested by SourceReadTimeout, WithSourceRetry or
+// ExpectAppendedChecksum.
+func UseSourceReader(v bool) ScannerOption {
+	return func(o *scannerOpts) {
+		o.sourceReader = v
+	}
+}
+
+// peekReader is the subset of the methods of bufio.Reader used by the
+// Scanner.
+type peekReader interface {
+	io.Reader
+	Peek(n int) ([]byte, error)
+	Discard(n int) (int, error)
+	Buffered() int
+}
+
+// newPeekReader returns the peekReader to be used for rd, buffering it with
+// a buffer of size bytes unless it is a SourceReader that is to be used
+// directly.
+func newPeekReader(rd io.Reader, size int, direct bool) peekReader {
+	if src, ok := rd.(SourceReader); ok && direct {
+		return &sourceReader{SourceReader: src}
+	}
+	return bufio.NewReaderSize(rd, size)
+}
+
+// sourceReader adapts a SourceReader to the peekReader interface.
+type sourceReader struct {
+	SourceReader
+	buffered int // the number of bytes returned by Peek not yet consumed.
+}
+
+func (sr *sourceReader) Peek(n int) ([]byte, error) {
+	buf, err := sr.SourceReader.Peek(n)
+	sr.buffered = len(buf)
+	return buf, err
+}
+
+func (sr *sourceReader) Discard(n int) (int, error) {
+	var discarded int
+	var err error
+	if d, ok := sr.SourceReader.(interface {
+		Discard(n int) (int, error)
+	}); ok {
+		discarded, err = d.Discard(n)
+	} else {
+		var n64 int64
+		n64, err = io.CopyN(io.Discard, sr.SourceReader, int64(n))
+		discarded = int(n64)
+	}
+	if sr.buffered -= discarded; sr.buffered < 0 {
+		sr.buffered = 0
+	}
+	return discarded, err
+}
+
+func (sr *sourceReader) Buffered() int {
+	return sr.buffered
+}
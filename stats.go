@@ -0,0 +1,177 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import "time"
+
+// Stats represents statistics gathered during decompression. The values
+// are updated as each block is reassembled into the output stream and
+// hence reflect the progress made so far.
+type Stats struct {
+	CompressedBytes   int64 // Size of the compressed blocks decompressed so far.
+	UncompressedBytes int64 // Size of the decompressed output produced so far.
+
+	// WorkerCPUTime is the aggregate time spent decompressing blocks
+	// across all workers. Note that it is measured as elapsed time for
+	// each block and hence includes any time that a worker was not
+	// scheduled to run.
+	WorkerCPUTime time.Duration
+
+	// ScannerTime and DecodeTime are the aggregate times spent scanning
+	// the input for blocks and decoding those blocks respectively, if
+	// requested via CollectBlockTimings. They are approximate since the
+	// scanner runs concurrently with decoding, and ScannerTime includes
+	// any time spent waiting to read from the underlying io.Reader.
+	ScannerTime time.Duration
+	DecodeTime  time.Duration
+
+	// RunningCRC is the combined CRC of the blocks of the current stream
+	// that have been decompressed so far; once the last block of a stream
+	// has been decompressed it is equal to that stream's CRC and it is
+	// restarted by the first block of the next stream. It may be saved,
+	// along with the offset of the next block (see BlockBitOffsets), to
+	// allow verification of the stream CRC to be continued when resuming
+	// decompression from that block, by combining it with the CRC of each
+	// subsequent block as follows:
+	//
+	//	crc = (crc<<1 | crc>>31) ^ blockCRC
+	//
+	// The result after the last block should equal the stream CRC stored
+	// in the stream's trailer.
+	RunningCRC uint32
+
+	// BlocksDecoded is the number of non-empty blocks decompressed so far.
+	BlocksDecoded int
+
+	// BlocksScanned is the number of non-empty blocks found by the
+	// scanner so far, including any that are yet to be decompressed.
+	BlocksScanned int
+
+	// BlockSize is the largest block size, 100k..900k, specified by the
+	// stream headers read so far, see Scanner.MaxStreamBlockSize.
+	BlockSize int
+
+	// MaxConcurrency is the largest number of blocks that were being
+	// decompressed at the same time, and hence the number of workers
+	// that were actually used, which may be fewer than requested via
+	// BZConcurrency if blocks are decompressed faster than they are found
+	// or than their output is read. It is 1 when blocks are decompressed
+	// serially.
+	MaxConcurrency int
+
+	// IndexHits is the number of calls to ReadAt that were served from
+	// the cache requested via ReadAtCache. Since ReadAt never decompresses
+	// any blocks itself, each call is either served from the cache or
+	// fails with ErrNotCached.
+	IndexHits int64
+
+	// BlockStats contains the statistics for each block, in output order,
+	// if requested via CollectBlockStats.
+	BlockStats []BlockStats
+
+	// BlockBitOffsets contains the offset, in bits from the start of the
+	// input, of the magic number that starts each block, in output order.
+	// It is intended for callers that maintain their own index of the
+	// blocks in a file.
+	BlockBitOffsets []int64
+
+	scanned  bool    // set once the entire input has been scanned.
+	eof      bool    // set once Read has returned io.EOF.
+	progress float64 // the largest estimate made by Reader.Stats so far, see Progress.
+}
+
+// BlockStats contains information on the structure of a single block that
+// is gathered whilst decoding it.
+type BlockStats struct {
+	HuffmanTrees int   // Number of Huffman tables used by the block, 2..6.
+	Selectors    int   // Number of Huffman table selectors, one per 50 symbols.
+	Symbols      int   // Number of distinct byte values in the block.
+	SymbolCounts []int // Number of times each Huffman coded symbol, ie. RUNA, RUNB, the MTF indices and EOB, was decoded.
+	Size         int   // Number of bytes in the block prior to the inverse BWT.
+}
+
+// CompressionRatio returns the ratio of compressed to decompressed bytes
+// seen so far. It returns zero if no output has been produced, as is the
+// case for an empty stream.
+func (s Stats) CompressionRatio() float64 {
+	if s.UncompressedBytes == 0 {
+		return 0
+	}
+	return float64(s.CompressedBytes) / float64(s.UncompressedBytes)
+}
+
+// Progress returns an estimate, in the range 0 to 1, of the fraction of
+// the input that has been decompressed, based on the number of blocks
+// decompressed relative to the number found by the scanner. Until the
+// scanner has reached the end of the input the total number of blocks is
+// not known and the number found so far is used as a lower bound for it,
+// hence the estimate will be too high for a stream whose blocks have not
+// all been found yet; it is always less than 1 until then. Progress
+// returns 1 once Read has returned io.EOF. The estimates for successive
+// calls to Reader.Stats never decrease.
+func (s Stats) Progress() float64 {
+	if s.eof {
+		return 1
+	}
+	if p := s.estimate(); p > s.progress {
+		return p
+	}
+	return s.progress
+}
+
+// estimate implements Progress, without ensuring that it never decreases.
+func (s Stats) estimate() float64 {
+	total := s.BlocksScanned
+	if !s.scanned {
+		total++
+	}
+	if total == 0 {
+		return 0
+	}
+	decoded := s.BlocksDecoded
+	if decoded >= total {
+		// All of the blocks have been decoded but not yet read,
+		// return a value that is just below 1.
+		total = decoded + 1
+	}
+	return float64(decoded) / float64(total)
+}
+
+// streamStats starts the goroutine that implements WithStatsChannel.
+func (rd *Reader) streamStats(ch chan<- Stats, every time.Duration) {
+	if ch == nil || every <= 0 {
+		return
+	}
+	rd.done = make(chan struct{})
+	go func() {
+		defer close(ch)
+		ticker := time.NewTicker(every)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				select {
+				case ch <- rd.Stats():
+				default:
+				}
+			case <-rd.done:
+				select {
+				case ch <- rd.Stats():
+				case <-rd.ctx.Done():
+				}
+				return
+			case <-rd.ctx.Done():
+				return
+			}
+		}
+	}()
+}
+
+// finish is called once Read has returned an error, including io.EOF.
+func (rd *Reader) finish() {
+	if rd.done != nil {
+		rd.doneOnce.Do(func() { close(rd.done) })
+	}
+}
@@ -0,0 +1,531 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/cosnicolaou/pbzip2"
+	"github.com/cosnicolaou/pbzip2/internal/bitstream"
+	"github.com/cosnicolaou/pbzip2/internal/bzip2"
+)
+
+func readAllStats(t *testing.T, name string, opts ...pbzip2.ReaderOption) pbzip2.Stats {
+	rd := openBzipFile(t, bzip2Files[name])
+	defer rd.Close()
+	drd := pbzip2.NewReader(context.Background(), rd, opts...)
+	if _, err := io.Copy(io.Discard, drd); err != nil {
+		t.Fatalf("%v: %v", name, err)
+	}
+	return drd.Stats()
+}
+
+func TestCompressionRatio(t *testing.T) {
+	stats := readAllStats(t, "empty")
+	if got, want := stats.CompressionRatio(), 0.0; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	stats = readAllStats(t, "hello")
+	if got, want := stats.UncompressedBytes, int64(len(bzip2Data["hello"])); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got := stats.CompressionRatio(); got < 2 {
+		t.Errorf("hello: compression ratio is too low: %v", got)
+	}
+
+	for _, name := range []string{"300KB3_Random", "900KB2_Random", "1033KB4_Random"} {
+		stats := readAllStats(t, name)
+		if got, want := stats.UncompressedBytes, int64(len(bzip2Data[name])); got != want {
+			t.Errorf("%v: got %v, want %v", name, got, want)
+		}
+		if got := stats.CompressionRatio(); got < 0.95 || got > 1.05 {
+			t.Errorf("%v: compression ratio is not close to 1: %v", name, got)
+		}
+	}
+}
+
+func TestEstimatedMemory(t *testing.T) {
+	estimate := func(name string, concurrency int) int64 {
+		rd := openBzipFile(t, bzip2Files[name])
+		defer rd.Close()
+		drd := pbzip2.NewReader(context.Background(), rd,
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+		if _, err := io.Copy(io.Discard, drd); err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		return drd.EstimatedMemory()
+	}
+
+	// 300KB3_Random uses 300KB blocks, 900KB2_Random 200KB blocks.
+	for _, concurrency := range []int{1, 2, 4} {
+		if got, want := estimate("300KB3_Random", concurrency), int64(concurrency*300*1000*6); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := estimate("900KB2_Random", concurrency), int64(concurrency*200*1000*6); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+	}
+
+	// The estimate is not available until the header has been read.
+	rd := openBzipFile(t, bzip2Files["hello"])
+	defer rd.Close()
+	drd := pbzip2.NewReader(context.Background(), rd)
+	if runtime.GOMAXPROCS(-1) == 1 {
+		if got, want := drd.EstimatedMemory(), int64(0); got != want {
+			t.Errorf("got %v, want %v", got, want)
+		}
+	}
+	if _, err := io.Copy(io.Discard, drd); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := drd.EstimatedMemory(), int64(900*1000*6); got < want {
+		t.Errorf("got %v, want >= %v", got, want)
+	}
+}
+
+func TestBlockStats(t *testing.T) {
+	if stats := readAllStats(t, "300KB2"); stats.BlockStats != nil {
+		t.Errorf("got %v, want nil", stats.BlockStats)
+	}
+	for _, tc := range []struct {
+		name    string
+		nblocks int
+	}{
+		{"hello", 1},
+		{"300KB2", 2},
+		{"1033KB4_Random", 3},
+	} {
+		for _, concurrency := range []int{1, 2} {
+			stats := readAllStats(t, tc.name, pbzip2.CollectBlockStats(true),
+				pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)))
+			if got, want := len(stats.BlockStats), tc.nblocks; got != want {
+				t.Errorf("%v: got %v, want %v", tc.name, got, want)
+			}
+			for i, bs := range stats.BlockStats {
+				if bs.HuffmanTrees < 2 || bs.HuffmanTrees > 6 {
+					t.Errorf("%v: block %v: number of huffman trees %v is out of range", tc.name, i, bs.HuffmanTrees)
+				}
+				if got, want := len(bs.SymbolCounts), bs.Symbols+2; got != want {
+					t.Errorf("%v: block %v: got %v, want %v", tc.name, i, got, want)
+				}
+				// There is exactly one EOB symbol per block.
+				if got, want := bs.SymbolCounts[len(bs.SymbolCounts)-1], 1; got != want {
+					t.Errorf("%v: block %v: got %v, want %v", tc.name, i, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestWorkerCPUTime(t *testing.T) {
+	small := readAllStats(t, "300KB3_Random").WorkerCPUTime
+	large := readAllStats(t, "900KB2_Random").WorkerCPUTime
+	if small <= 0 || large <= 0 {
+		t.Fatalf("got %v, %v, want both to be positive", small, large)
+	}
+	// The larger file is 3 times the size of the smaller one.
+	if ratio := float64(large) / float64(small); ratio < 1.5 || ratio > 10 {
+		t.Errorf("got %v (%v/%v), want a ratio close to 3", ratio, large, small)
+	}
+
+	rd := openBzipFile(t, bzip2Files["900KB2_Random"])
+	defer rd.Close()
+	drd := pbzip2.NewReader(context.Background(), rd, pbzip2.MaxWorkerCPUTime(time.Nanosecond))
+	if _, err := io.ReadAll(drd); !errors.Is(err, pbzip2.ErrCPUBudgetExceeded) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrCPUBudgetExceeded)
+	}
+}
+
+func TestBlockBitOffsets(t *testing.T) {
+	stats := readAllStats(t, "hello")
+	// The first block follows the 4 byte stream header.
+	if got, want := stats.BlockBitOffsets, []int64{32}; !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+
+	for _, concurrency := range []int{0, 2} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		offsets := readAllStats(t, "900KB2_Random", opts...).BlockBitOffsets
+		if got, want := len(offsets), 5; got != want {
+			t.Fatalf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		compressed, _ := readFile(t, "900KB2_Random")
+		for i, offset := range offsets {
+			if i > 0 && offset <= offsets[i-1] {
+				t.Errorf("concurrency %v: offsets not increasing: %v <= %v", concurrency, offset, offsets[i-1])
+			}
+			// Shift the magic number so that it is byte aligned.
+			buf := make([]byte, 8)
+			copy(buf, compressed[offset/8:])
+			if shift := offset % 8; shift > 0 {
+				for s := shift; s < 8; s++ {
+					buf = bitstream.ShiftRight(buf)
+				}
+				buf = buf[1:]
+			}
+			if got, want := buf[:6], bzip2.BlockMagic[:]; !bytes.Equal(got, want) {
+				t.Errorf("concurrency %v: block %v: got %02x, want %02x", concurrency, i, got, want)
+			}
+		}
+	}
+}
+
+func TestBlockTimings(t *testing.T) {
+	for _, concurrency := range []int{0, 2} {
+		opts := []pbzip2.ReaderOption{pbzip2.CollectBlockTimings(true)}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		stats := readAllStats(t, "900KB1", opts...)
+		if stats.ScannerTime <= 0 || stats.DecodeTime <= 0 {
+			t.Errorf("concurrency %v: scanner time %v, decode time %v: both should be positive", concurrency, stats.ScannerTime, stats.DecodeTime)
+		}
+		if got, want := stats.DecodeTime, stats.WorkerCPUTime; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		t.Logf("concurrency %v: scanner time %v, decode time %v", concurrency, stats.ScannerTime, stats.DecodeTime)
+	}
+
+	stats := readAllStats(t, "900KB1")
+	if stats.ScannerTime != 0 || stats.DecodeTime != 0 {
+		t.Errorf("timings should not be collected by default: %v, %v", stats.ScannerTime, stats.DecodeTime)
+	}
+}
+
+func TestRunningCRC(t *testing.T) {
+	// The stream CRCs are taken from TestScan.
+	for _, tc := range []struct {
+		name      string
+		streamCRC uint32
+	}{
+		{"hello", 1324148790},
+		{"300KB1", 2560071082},
+		{"400KB1", 182711008},
+		{"900KB9", 37440935},
+	} {
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			stats := readAllStats(t, tc.name, opts...)
+			if got, want := stats.RunningCRC, tc.streamCRC; got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", tc.name, concurrency, got, want)
+			}
+		}
+	}
+
+	// The running CRC is restarted by each stream.
+	ctx := context.Background()
+	compressed, _ := concatFiles(t, "300KB1", "300KB2")
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed))
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rd.Stats().RunningCRC, uint32(2500044168); got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestStreamCRC(t *testing.T) {
+	ctx := context.Background()
+	for _, tc := range []struct {
+		names []string
+		crcs  []uint32
+	}{
+		{[]string{"hello"}, []uint32{1324148790}},
+		{[]string{"300KB1"}, []uint32{2560071082}},
+		{[]string{"empty"}, nil},
+		{[]string{"300KB1", "empty", "hello", "300KB2"}, []uint32{2560071082, 1324148790, 2500044168}},
+	} {
+		compressed, _ := concatFiles(t, tc.names...)
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			if _, ok := rd.StreamCRC(); ok {
+				t.Errorf("%v: concurrency %v: stream CRC available before EOF", tc.names, concurrency)
+			}
+			if _, err := io.Copy(io.Discard, rd); err != nil {
+				t.Fatalf("%v: concurrency %v: %v", tc.names, concurrency, err)
+			}
+			if got, want := rd.StreamCRCs(), tc.crcs; !reflect.DeepEqual(got, want) {
+				t.Errorf("%v: concurrency %v: got %v, want %v", tc.names, concurrency, got, want)
+			}
+			crc, ok := rd.StreamCRC()
+			if got, want := ok, len(tc.crcs) > 0; got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", tc.names, concurrency, got, want)
+			}
+			if ok {
+				if got, want := crc, tc.crcs[len(tc.crcs)-1]; got != want {
+					t.Errorf("%v: concurrency %v: got %v, want %v", tc.names, concurrency, got, want)
+				}
+			}
+		}
+	}
+
+	// The stream CRC is not available after an error.
+	corrupted, _ := concatFiles(t, "300KB1", "hello")
+	corrupted[len(corrupted)-2] ^= 0xff
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(corrupted))
+	if _, err := io.Copy(io.Discard, rd); !errors.Is(err, pbzip2.ErrMismatchedCRC) {
+		t.Errorf("got %v, want %v", err, pbzip2.ErrMismatchedCRC)
+	}
+	if crcs := rd.StreamCRCs(); crcs != nil {
+		t.Errorf("unexpected stream CRCs: %v", crcs)
+	}
+
+	// Nor for a stream that has no trailer.
+	compressed, _ := readFile(t, "hello")
+	stripped := compressed[:len(compressed)-10]
+	rd = pbzip2.NewReader(ctx, bytes.NewReader(stripped),
+		pbzip2.ScannerOptions(pbzip2.AllowMissingTrailer(true)))
+	if _, err := io.Copy(io.Discard, rd); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rd.StreamCRC(); ok {
+		t.Errorf("stream CRC available for a stream without a trailer")
+	}
+}
+
+func TestProgress(t *testing.T) {
+	ctx := context.Background()
+	for _, name := range []string{"empty", "hello", "900KB9"} {
+		compressed, _ := readFile(t, name)
+		for _, concurrency := range []int{0, 2} {
+			var opts []pbzip2.ReaderOption
+			if concurrency > 0 {
+				opts = append(opts, pbzip2.DecompressionOptions(
+					pbzip2.BZConcurrency(concurrency)))
+			}
+			rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+			if got, want := rd.Stats().Progress(), 0.0; got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+			buf := make([]byte, 64*1024)
+			prev := 0.0
+			for {
+				_, err := rd.Read(buf)
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("%v: concurrency %v: %v", name, concurrency, err)
+				}
+				progress := rd.Stats().Progress()
+				if progress < 0 || progress >= 1 {
+					t.Errorf("%v: concurrency %v: progress out of range before EOF: %v", name, concurrency, progress)
+				}
+				if progress < prev {
+					t.Errorf("%v: concurrency %v: progress decreased: got %v, previously %v", name, concurrency, progress, prev)
+				}
+				prev = progress
+			}
+			if name == "900KB9" && prev == 0 {
+				t.Errorf("%v: concurrency %v: no progress reported before EOF", name, concurrency)
+			}
+			if got, want := rd.Stats().Progress(), 1.0; got != want {
+				t.Errorf("%v: concurrency %v: got %v, want %v", name, concurrency, got, want)
+			}
+		}
+	}
+}
+
+func TestConcurrencyStats(t *testing.T) {
+	ctx := context.Background()
+	name := "1033KB4_Random"
+	compressed, _ := readFile(t, name)
+	blocks, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, concurrency := range []int{0, 4} {
+		var opts []pbzip2.ReaderOption
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		data, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		stats := rd.Stats()
+		if got, want := stats.BlocksDecoded, blocks; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := stats.UncompressedBytes, int64(len(data)); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := stats.BlockSize, 400*1000; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		max := concurrency
+		if max == 0 {
+			max = 1
+		}
+		if got := stats.MaxConcurrency; got < 1 || got > max {
+			t.Errorf("concurrency %v: got %v, want 1..%v", concurrency, got, max)
+		}
+		t.Logf("concurrency %v: max concurrency %v", concurrency, stats.MaxConcurrency)
+	}
+
+	// The statistics reflect the progress made before a cancelation.
+	ctx, cancel := context.WithCancel(ctx)
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed),
+		pbzip2.DecompressionOptions(pbzip2.BZConcurrency(2)))
+	if _, err := io.ReadFull(rd, make([]byte, 500*1000)); err != nil {
+		t.Fatal(err)
+	}
+	cancel()
+	if _, err := io.Copy(io.Discard, rd); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+	stats := rd.Stats()
+	if got := stats.BlocksDecoded; got < 1 || got >= blocks {
+		t.Errorf("got %v, want 1..%v", got, blocks-1)
+	}
+	if got := stats.MaxConcurrency; got < 1 || got > 2 {
+		t.Errorf("got %v, want 1..2", got)
+	}
+}
+
+func TestBZProgress(t *testing.T) {
+	ctx := context.Background()
+	compressed, data := concatFiles(t, "hello", "empty", "900KB2_Random")
+	blocks, err := pbzip2.CountBlocks(ctx, bytes.NewReader(compressed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	type update struct{ in, out, blocks int64 }
+	for _, concurrency := range []int{0, 2, 8} {
+		var updates []update
+		decOpts := []pbzip2.DecompressorOption{
+			pbzip2.BZProgress(func(in, out, blocks int64) {
+				updates = append(updates, update{in, out, blocks})
+			}),
+		}
+		if concurrency > 0 {
+			decOpts = append(decOpts, pbzip2.BZConcurrency(concurrency))
+		}
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), pbzip2.DecompressionOptions(decOpts...))
+		out, err := io.ReadAll(rd)
+		if err != nil {
+			t.Fatalf("concurrency %v: %v", concurrency, err)
+		}
+		if !bytes.Equal(out, data) {
+			t.Errorf("concurrency %v: wrong output", concurrency)
+		}
+		if got, want := len(updates), blocks; got != want {
+			t.Fatalf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		var prev update
+		for i, u := range updates {
+			if u.blocks != int64(i+1) || u.in <= prev.in || u.out <= prev.out {
+				t.Errorf("concurrency %v: update %v: %+v does not follow %+v", concurrency, i, u, prev)
+			}
+			prev = u
+		}
+		stats := rd.Stats()
+		if got, want := prev, (update{stats.CompressedBytes, int64(len(data)), int64(blocks)}); got != want {
+			t.Errorf("concurrency %v: got %+v, want %+v", concurrency, got, want)
+		}
+		rd.Close()
+		if got, want := len(updates), blocks; got != want {
+			t.Errorf("concurrency %v: called after EOF: got %v, want %v", concurrency, got, want)
+		}
+	}
+}
+
+func TestStatsChannel(t *testing.T) {
+	ctx := context.Background()
+	name := "900KB1"
+	compressed, _ := readFile(t, name)
+	for _, concurrency := range []int{0, 2} {
+		opts := []pbzip2.ReaderOption{}
+		if concurrency > 0 {
+			opts = append(opts, pbzip2.DecompressionOptions(
+				pbzip2.BZConcurrency(concurrency)))
+		}
+		ch := make(chan pbzip2.Stats, 1)
+		opts = append(opts, pbzip2.WithStatsChannel(ch, time.Millisecond))
+		rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opts...)
+		snapshots := make(chan []pbzip2.Stats, 1)
+		go func() {
+			var all []pbzip2.Stats
+			for s := range ch {
+				all = append(all, s)
+			}
+			snapshots <- all
+		}()
+		// Read slowly to allow for several snapshots to be sent.
+		buf := make([]byte, 16*1024)
+		for {
+			_, err := rd.Read(buf)
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				t.Fatalf("concurrency %v: %v", concurrency, err)
+			}
+			time.Sleep(time.Millisecond)
+		}
+		all := <-snapshots
+		if got, want := len(all), 2; got < want {
+			t.Fatalf("concurrency %v: too few snapshots: got %v, want >= %v", concurrency, got, want)
+		}
+		for i := 1; i < len(all); i++ {
+			prev, cur := all[i-1], all[i]
+			if cur.CompressedBytes < prev.CompressedBytes || cur.UncompressedBytes < prev.UncompressedBytes || cur.BlocksDecoded < prev.BlocksDecoded {
+				t.Errorf("concurrency %v: snapshot %v: not monotonic: got %+v after %+v", concurrency, i, cur, prev)
+			}
+		}
+		last := all[len(all)-1]
+		if got, want := last.UncompressedBytes, int64(len(bzip2Data[name])); got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		if got, want := last.Progress(), 1.0; got != want {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, got, want)
+		}
+		rd.Close()
+	}
+
+	// The channel is closed, and the goroutine that sends on it exits,
+	// when the Reader is closed before reaching EOF.
+	ch := make(chan pbzip2.Stats)
+	rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), pbzip2.WithStatsChannel(ch, time.Millisecond))
+	if _, err := rd.Read(make([]byte, 1024)); err != nil {
+		t.Fatal(err)
+	}
+	rd.Close()
+	deadline := time.After(5 * time.Second)
+	for {
+		select {
+		case <-deadline:
+			t.Fatalf("stats channel was not closed")
+		case _, ok := <-ch:
+			if !ok {
+				return
+			}
+		}
+	}
+}
@@ -5,6 +5,7 @@
 package pbzip2
 
 import (
+	"io"
 	"sync/atomic"
 
 	"github.com/cosnicolaou/pbzip2/internal/bitstream"
@@ -15,13 +16,65 @@ func GetNumDecompressionGoRoutines() int64 {
 	return atomic.LoadInt64(&numDecompressionGoRoutines)
 }
 
+// ResetMaxDecompressionGoRoutines resets the high water mark of
+// the number of decompression goroutines to the current number.
+func ResetMaxDecompressionGoRoutines() {
+	atomic.StoreInt64(&maxDecompressionGoRoutines, atomic.LoadInt64(&numDecompressionGoRoutines))
+}
+
+func GetMaxDecompressionGoRoutines() int64 {
+	return atomic.LoadInt64(&maxDecompressionGoRoutines)
+}
+
 func SetCustomBlockMagic(magic [6]byte) {
-	pretestBlockMagicLookup, firstBlockMagicLookup, secondBlockMagicLookup = bitstream.Init(magic)
+	blockMagicFinder = bitstream.NewAccumulatorFinder(magic)
 	copy(blockMagic[:], magic[:])
 }
 
 func ResetBlockMagic() {
-	pretestBlockMagicLookup, firstBlockMagicLookup, secondBlockMagicLookup = bitstream.Init(bzip2.BlockMagic)
+	blockMagicFinder = bitstream.NewAccumulatorFinder(bzip2.BlockMagic)
 	copy(blockMagic[:], bzip2.BlockMagic[:])
 	copy(eosMagic[:], bzip2.EOSMagic[:])
 }
+
+func DecompressBlock(block CompressedBlock) ([]byte, error) {
+	b := &blockDesc{CompressedBlock: block}
+	b.decompress()
+	return b.uncompressed, b.err
+}
+
+func SetBlockDecoder(fn func(blockSize int, src []byte, start int) io.Reader) {
+	newBlockReader = fn
+}
+
+func ResetBlockDecoder() {
+	newBlockReader = bzip2.NewBlockReader
+}
+
+// NewChecksumReader returns the reader used to implement
+// ExpectAppendedChecksum.
+func NewChecksumReader(rd io.Reader, kind ChecksumKind, size int) io.Reader {
+	return newChecksumReader(rd, kind, size)
+}
+
+// SetScanRegionSize sets the size of the regions searched concurrently by
+// NewReaderAt and returns the previous size.
+func SetScanRegionSize(n int64) int64 {
+	prev := scanRegionSize
+	scanRegionSize = n
+	return prev
+}
+
+// SetRemoveFile sets the function used by DecompressFile to remove the
+// source file and returns the previous one.
+func SetRemoveFile(fn func(string) error) func(string) error {
+	prev := removeFile
+	removeFile = fn
+	return prev
+}
+
+// ReaderWorkers returns the number of goroutines used by rd to decompress
+// blocks, as reported by PlanConcurrency.
+func ReaderWorkers(rd *Reader) int {
+	return int(atomic.LoadInt64(&rd.workers))
+}
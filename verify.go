@@ -0,0 +1,44 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2
+
+import (
+	"context"
+	"io"
+)
+
+// verifyBufferSize is the size of the buffer used by each of the
+// goroutines started by Verify to read, and discard, the output of the
+// blocks they decompress.
+const verifyBufferSize = 64 * 1024
+
+// Verify verifies the block and stream CRCs of the stream, or concatenated
+// streams, read from rd without retaining any of the decompressed output.
+// Since the bzip2 CRCs are computed over the decompressed data each block
+// must still be decompressed in its entirety, including the inverse BWT,
+// but the output is discarded as it is decoded rather than being retained
+// and reassembled into a single stream. Verify is therefore faster, and
+// requires much less memory, than reading all of the output from a Reader.
+// Blocks are decompressed concurrently, with each goroutine computing the
+// CRC of the blocks it decompresses, and the block CRCs are combined into
+// the stream CRCs in order as they are verified. Options that do not
+// apply to the decompression of individual blocks are rejected, see
+// ErrUnsupportedOption.
+func Verify(ctx context.Context, rd io.Reader, opts ...ReaderOption) error {
+	rdOpts := &readerOpts{}
+	for _, fn := range opts {
+		fn(rdOpts)
+	}
+	if err := rdOpts.unsupportedOption(false); err != nil {
+		return err
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done, scanErr := decompressBlocks(ctx, rd, rdOpts, verifyBufferSize, nil)
+	if err := inOrder(done, make([]byte, verifyBufferSize), nil); err != nil {
+		return err
+	}
+	return <-scanErr
+}
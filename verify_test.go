@@ -0,0 +1,117 @@
+// Copyright 2021 Cosmos Nicolaou. All rights reserved.
+// Use of this source code is governed by the Apache-2.0
+// license that can be found in the LICENSE file.
+
+package pbzip2_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/cosnicolaou/pbzip2"
+)
+
+func TestVerify(t *testing.T) {
+	ctx := context.Background()
+	multi, _ := concatFiles(t, "hello", "empty", "300KB2", "hello")
+	for _, concurrency := range []int{0, 2} {
+		opts := []pbzip2.ReaderOption{
+			pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency)),
+		}
+		for _, name := range []string{"empty", "hello", "tiny", "300KB3_Random", "900KB2_Random", "1033KB4_Random"} {
+			buf, _ := readFile(t, name)
+			if err := pbzip2.Verify(ctx, bytes.NewReader(buf), opts...); err != nil {
+				t.Errorf("concurrency %v: %v: %v", concurrency, name, err)
+			}
+		}
+		if err := pbzip2.Verify(ctx, bytes.NewReader(multi), opts...); err != nil {
+			t.Errorf("concurrency %v: multiple streams: %v", concurrency, err)
+		}
+
+		corruptedBlock, _ := concatFiles(t, "hello", "hello", "empty")
+		corruptedBlock[len(corruptedBlock)-26] = 0xff
+		if err := pbzip2.Verify(ctx, bytes.NewReader(corruptedBlock), opts...); !errors.Is(err, pbzip2.ErrBlockChecksum) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrBlockChecksum)
+		}
+
+		corruptedEmpty, _ := concatFiles(t, "hello", "empty", "empty")
+		corruptedEmpty[len(corruptedEmpty)-2] = 0xff
+		err := pbzip2.Verify(ctx, bytes.NewReader(corruptedEmpty), opts...)
+		if err == nil || !strings.Contains(err.Error(), "mismatched stream CRCs") {
+			t.Errorf("concurrency %v: missing or unexpected error: %v", concurrency, err)
+		}
+		if !errors.Is(err, pbzip2.ErrMismatchedCRC) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrMismatchedCRC)
+		}
+
+		buf, l := readFile(t, "hello")
+		buf[l-4] = 0x1
+		err = pbzip2.Verify(ctx, bytes.NewReader(buf), opts...)
+		if err == nil || !strings.Contains(err.Error(), "failed to find trailer") {
+			t.Errorf("concurrency %v: missing or unexpected error: %v", concurrency, err)
+		}
+		if !errors.Is(err, pbzip2.ErrNoTrailer) {
+			t.Errorf("concurrency %v: got %v, want %v", concurrency, err, pbzip2.ErrNoTrailer)
+		}
+	}
+
+	cctx, cancel := context.WithCancel(ctx)
+	cancel()
+	buf, _ := readFile(t, "900KB2_Random")
+	if err := pbzip2.Verify(cctx, bytes.NewReader(buf)); !errors.Is(err, context.Canceled) {
+		t.Errorf("got %v, want %v", err, context.Canceled)
+	}
+
+	hello, _ := readFile(t, "hello")
+	for i, opt := range []pbzip2.ReaderOption{
+		pbzip2.ExpectBlockCRCs([]uint32{1}),
+		pbzip2.BlockFilter(func(int, uint32) bool { return true }),
+		pbzip2.WithEventChannel(make(chan pbzip2.BlockEvent, 10)),
+		pbzip2.UnorderedOutput(true),
+		pbzip2.DecompressionOptions(pbzip2.BZMaxBuffered(1 << 20)),
+	} {
+		if err := pbzip2.Verify(ctx, bytes.NewReader(hello), opt); !errors.Is(err, pbzip2.ErrUnsupportedOption) {
+			t.Errorf("option %v: got %v, want %v", i, err, pbzip2.ErrUnsupportedOption)
+		}
+	}
+	if err := pbzip2.Verify(ctx, bytes.NewReader(hello), pbzip2.SmallMemory(true), pbzip2.WithCRC(pbzip2.NewCRC)); err != nil {
+		t.Errorf("supported options: %v", err)
+	}
+}
+
+func BenchmarkVerify(b *testing.B) {
+	ctx := context.Background()
+	compressed, err := os.ReadFile(bzip2Files["900KB2_Random"] + ".bz2")
+	if err != nil {
+		b.Fatal(err)
+	}
+	size := int64(len(bzip2Data["900KB2_Random"]))
+	for _, concurrency := range []int{1, 4} {
+		opt := pbzip2.DecompressionOptions(pbzip2.BZConcurrency(concurrency))
+		b.Run(fmt.Sprintf("Verify-%v", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				if err := pbzip2.Verify(ctx, bytes.NewReader(compressed), opt); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("ReadAll-%v", concurrency), func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(size)
+			for i := 0; i < b.N; i++ {
+				rd := pbzip2.NewReader(ctx, bytes.NewReader(compressed), opt)
+				if _, err := io.ReadAll(rd); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}